@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mostlydev/cllama/internal/cost"
+	"github.com/mostlydev/cllama/internal/provider"
+)
+
+// newAdminHandler serves operator-only endpoints on ADMIN_ADDR, so they can
+// be kept off the network the agents reach.
+func newAdminHandler(reg *provider.Registry, acc *cost.Accumulator, inflight *inflightCounter) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", healthHandler(reg))
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", cost.PrometheusContentType)
+		writeMetrics(w, acc, inflight)
+	})
+	mux.HandleFunc("POST /costs/reset", func(w http.ResponseWriter, r *http.Request) {
+		acc.Reset()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	})
+	return mux
+}
+
+// writeMetrics renders accumulated spend and the in-flight gauge in the
+// Prometheus text format.
+func writeMetrics(w http.ResponseWriter, acc *cost.Accumulator, inflight *inflightCounter) {
+	cost.WritePrometheus(w, acc.All())
+	fmt.Fprintf(w, "# HELP cllama_inflight_requests API requests currently being served.\n# TYPE cllama_inflight_requests gauge\n")
+	fmt.Fprintf(w, "cllama_inflight_requests %d\n", inflight.current())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// defaultSecurityHeaders are set on every API, UI and admin response unless
+// SECURITY_HEADERS replaces them.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "DENY",
+	"Referrer-Policy":        "no-referrer",
+	"Cache-Control":          "no-store",
+}
+
+// parseSecurityHeaders reads SECURITY_HEADERS, a JSON object of header name
+// to value. Empty means the defaults; "{}" turns them all off.
+func parseSecurityHeaders(raw string) (http.Header, error) {
+	values := defaultSecurityHeaders
+	if strings.TrimSpace(raw) != "" {
+		values = nil
+		if err := json.Unmarshal([]byte(raw), &values); err != nil {
+			return nil, fmt.Errorf("want a JSON object of header names to values: %w", err)
+		}
+	}
+	h := make(http.Header, len(values))
+	for name, v := range values {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") || strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("invalid header %q", name)
+		}
+		h.Set(textproto.CanonicalMIMEHeaderKey(name), v)
+	}
+	return h, nil
+}
+
+// withHeaders sets headers on every response before next runs, so a
+// handler that sets one of them itself, or relays it from upstream, wins.
+func withHeaders(headers http.Header, next http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dst := w.Header()
+		for k, v := range headers {
+			dst[k] = append([]string(nil), v...)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -141,10 +141,10 @@ func TestLiveDashboard(t *testing.T) {
 
 	pricing := cost.DefaultPricing()
 	acc := cost.NewAccumulator()
-	logger := logging.New(os.Stdout)
+	logger := logging.New(os.Stdout, logging.FormatJSON)
 
 	apiHandler := newAPIHandler(contextRoot, reg, logger, acc, pricing)
-	uiHandler := newUIHandler(reg, acc, contextRoot)
+	uiHandler := newUIHandler(reg, logger, acc, contextRoot)
 
 	// ── Listen on fixed ports ────────────────────────────────────────────
 	apiLn, err := net.Listen("tcp", "127.0.0.1:9080")
@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -26,13 +30,85 @@ import (
 type config struct {
 	APIAddr     string
 	UIAddr      string
+	AdminAddr   string
 	ContextRoot string
 	AuthDir     string
 	PodName     string
+	LogFormat   string
+	LogSample   int
+
+	MaxInflight  int
+	InflightWait time.Duration
+
+	ResponseHeaderAllow []string
+	ResponseHeaderDeny  []string
+
+	MinChargeUSD        float64
+	RoundToCents        bool
+	UsageReconciliation string
+	PriceByResponse     bool
+	CostTokenUnit       string
+	UIAdminToken        string
+
+	FreeProviders    []string
+	ModelMonthlyCaps []string
+	GlobalBudgetUSD  string
+
+	AgentMonthlyBudgetUSD string
+	BudgetThresholds      []string
+	BudgetWebhook         string
+
+	AuthMaxFailures   int
+	AuthFailureWindow time.Duration
+	TokenGrace        time.Duration
+
+	UpstreamTimeout    time.Duration
+	MaxUpstreamTimeout time.Duration
+	BodyReadTimeout    time.Duration
+
+	ProviderFailureThreshold int
+	ProviderCooldown         time.Duration
+
+	UpstreamRetries    int
+	UpstreamRetryDelay time.Duration
+	RetryBudgetPerSec  float64
+	RetryBudgetBurst   int
+
+	StreamReframe       bool
+	StreamBufferSize    int
+	StreamFlushInterval time.Duration
+
+	IdempotencyTTL      time.Duration
+	IdempotencyMaxKeys  int
+	IdempotencyMaxBytes int
+
+	MaxPromptMessages int
+	MaxPromptTokens   int
+
+	ValidateRequests bool
+
+	EchoProvider bool
+
+	ShadowModels []string
+
+	RoutingRulesFile string
+
+	EndpointProbeInterval time.Duration
+
+	TrustedProxies []string
+
+	SecurityHeaders string
+
+	EnforceProviderPerms bool
 }
 
 func main() {
 	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			log.Printf("cllama: %v", err)
+			os.Exit(exit.code)
+		}
 		log.Fatalf("cllama: %v", err)
 	}
 }
@@ -47,39 +123,134 @@ func run(args []string, stdout, stderr io.Writer) error {
 
 	cfg := configFromEnv()
 	if *healthcheck {
-		return runHealthcheck(cfg.APIAddr)
+		return runHealthcheck(cfg)
 	}
 
-	reg := provider.NewRegistry(cfg.AuthDir)
-	if err := reg.LoadFromFile(); err != nil {
-		return fmt.Errorf("load providers from file: %w", err)
+	reg, err := loadRegistry(cfg.AuthDir, stderr, provider.WithEnforcePerms(cfg.EnforceProviderPerms))
+	if err != nil {
+		return err
 	}
-	reg.LoadFromEnv()
 
-	logger := logging.New(stdout)
+	logFormat, err := logging.ParseFormat(cfg.LogFormat)
+	if err != nil {
+		return fmt.Errorf("LOG_FORMAT: %w", err)
+	}
+	logger := logging.New(stdout, logFormat)
+	logger.SetSampling(cfg.LogSample)
 	pricing := cost.DefaultPricing()
+	pricing.MinChargeUSD = cfg.MinChargeUSD
+	pricing.RoundToCents = cfg.RoundToCents
+	applyProviderPricing(pricing, reg, cfg.FreeProviders)
+	if err := applyModelCaps(pricing, cfg.ModelMonthlyCaps); err != nil {
+		return err
+	}
+	globalBudget, err := parseBudgetUSD(cfg.GlobalBudgetUSD)
+	if err != nil {
+		return fmt.Errorf("GLOBAL_BUDGET_USD: %w", err)
+	}
+	agentBudget, err := parseBudgetUSD(cfg.AgentMonthlyBudgetUSD)
+	if err != nil {
+		return fmt.Errorf("AGENT_MONTHLY_BUDGET_USD: %w", err)
+	}
+	reconcile, err := proxy.ParseUsageReconciliation(cfg.UsageReconciliation)
+	if err != nil {
+		return fmt.Errorf("USAGE_RECONCILIATION: %w", err)
+	}
+	budgetThresholds, err := proxy.ParseBudgetThresholds(cfg.BudgetThresholds)
+	if err != nil {
+		return fmt.Errorf("BUDGET_THRESHOLDS: %w", err)
+	}
+	tokenUnit, err := parseTokenUnit(cfg.CostTokenUnit)
+	if err != nil {
+		return fmt.Errorf("COST_TOKEN_UNIT: %w", err)
+	}
+	shadows, err := proxy.ParseShadowRules(cfg.ShadowModels)
+	if err != nil {
+		return fmt.Errorf("SHADOW_MODELS: %w", err)
+	}
+	routes, err := proxy.LoadRouteRules(cfg.RoutingRulesFile)
+	if err != nil {
+		return fmt.Errorf("ROUTING_RULES_FILE: %w", err)
+	}
+	securityHeaders, err := parseSecurityHeaders(cfg.SecurityHeaders)
+	if err != nil {
+		return fmt.Errorf("SECURITY_HEADERS: %w", err)
+	}
 	acc := cost.NewAccumulator()
 
+	// Multi-endpoint providers go to their fastest endpoint once probed,
+	// and round-robin until then or with probing off.
+	endpoints := provider.NewEndpointSelector(reg)
+	if cfg.EndpointProbeInterval > 0 {
+		probeCtx, stopProbes := context.WithCancel(context.Background())
+		defer stopProbes()
+		go endpoints.Run(probeCtx, cfg.EndpointProbeInterval)
+	}
+
+	proxyOpts := []proxy.HandlerOption{
+		proxy.WithUsageReconciliation(reconcile),
+		proxy.WithResponseModelPricing(cfg.PriceByResponse),
+		proxy.WithMaxInflight(cfg.MaxInflight, cfg.InflightWait),
+		proxy.WithResponseHeaderFilter(cfg.ResponseHeaderAllow, cfg.ResponseHeaderDeny),
+		proxy.WithAuthThrottle(cfg.AuthMaxFailures, cfg.AuthFailureWindow),
+		proxy.WithTokenGrace(cfg.TokenGrace),
+		proxy.WithUpstreamTimeout(cfg.UpstreamTimeout, cfg.MaxUpstreamTimeout),
+		proxy.WithProviderCooldown(cfg.ProviderFailureThreshold, cfg.ProviderCooldown),
+		proxy.WithUpstreamRetries(cfg.UpstreamRetries, cfg.UpstreamRetryDelay, cfg.RetryBudgetPerSec, cfg.RetryBudgetBurst),
+		proxy.WithSSEReframe(cfg.StreamReframe),
+		proxy.WithStreamFlush(cfg.StreamBufferSize, cfg.StreamFlushInterval),
+		proxy.WithIdempotency(cfg.IdempotencyTTL, cfg.IdempotencyMaxKeys, cfg.IdempotencyMaxBytes),
+		proxy.WithPromptLimits(cfg.MaxPromptMessages, cfg.MaxPromptTokens),
+		proxy.WithRequestValidation(cfg.ValidateRequests),
+		proxy.WithEchoProvider(cfg.EchoProvider),
+		proxy.WithShadow(shadows),
+		proxy.WithRouteRules(routes),
+		proxy.WithEndpointSelector(endpoints),
+		proxy.WithTrustedProxies(cfg.TrustedProxies),
+		proxy.WithGlobalBudget(globalBudget),
+		proxy.WithAgentBudget(agentBudget),
+		proxy.WithBudgetWebhook(cfg.BudgetWebhook, agentBudget, budgetThresholds),
+	}
+
+	var inflight inflightCounter
+	api := newAPIHandler(cfg.ContextRoot, reg, logger, acc, pricing, proxyOpts...)
+	if cfg.AdminAddr != "" {
+		api = shallowHealth(api)
+	}
 	apiServer := &http.Server{
 		Addr:              cfg.APIAddr,
-		Handler:           newAPIHandler(cfg.ContextRoot, reg, logger, acc, pricing),
+		Handler:           withHeaders(securityHeaders, bodyTimeout(cfg.BodyReadTimeout, inflight.wrap(api))),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 	uiServer := &http.Server{
 		Addr:              cfg.UIAddr,
-		Handler:           newUIHandler(reg, acc, cfg.ContextRoot),
+		Handler:           withHeaders(securityHeaders, bodyTimeout(cfg.BodyReadTimeout, newUIHandler(reg, logger, acc, cfg.ContextRoot, ui.WithTokenUnit(tokenUnit), ui.WithAdminToken(cfg.UIAdminToken), ui.WithPricing(pricing)))),
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
-	errCh := make(chan error, 2)
+	var adminServer *http.Server
+	if cfg.AdminAddr != "" {
+		adminServer = &http.Server{
+			Addr:              cfg.AdminAddr,
+			Handler:           withHeaders(securityHeaders, bodyTimeout(cfg.BodyReadTimeout, newAdminHandler(reg, acc, &inflight))),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+	}
+
+	errCh := make(chan error, 3)
 	go serveServer("api", apiServer, stderr, errCh)
 	go serveServer("ui", uiServer, stderr, errCh)
+	if adminServer != nil {
+		go serveServer("admin", adminServer, stderr, errCh)
+	}
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	notifySignals(sigCh)
+	defer signal.Stop(sigCh)
 
+	var sig os.Signal
 	select {
-	case sig := <-sigCh:
+	case sig = <-sigCh:
 		fmt.Fprintf(stderr, "received signal %s, shutting down\n", sig)
 	case err := <-errCh:
 		return err
@@ -88,34 +259,266 @@ func run(args []string, stdout, stderr io.Writer) error {
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if err := apiServer.Shutdown(shutdownCtx); err != nil {
-		return fmt.Errorf("shutdown api server: %w", err)
+	pending := inflight.current()
+	drainStart := time.Now()
+	err = apiServer.Shutdown(shutdownCtx)
+	if err != nil {
+		err = fmt.Errorf("shutdown api server: %w", err)
+	} else if uiErr := uiServer.Shutdown(shutdownCtx); uiErr != nil {
+		err = fmt.Errorf("shutdown ui server: %w", uiErr)
+	} else if adminServer != nil {
+		if adminErr := adminServer.Shutdown(shutdownCtx); adminErr != nil {
+			err = fmt.Errorf("shutdown admin server: %w", adminErr)
+		}
+	}
+	logger.LogShutdown(sig.String(), pending, time.Since(drainStart).Milliseconds(), err)
+	logSummary(logger, acc)
+	return err
+}
+
+// logSummary writes the end-of-run totals, for ephemeral deployments whose
+// accumulator dies with the process.
+func logSummary(logger *logging.Logger, acc *cost.Accumulator) {
+	t := acc.Totals()
+	logger.LogSummary(t.RequestCount, t.TotalInputTokens, t.TotalOutputTokens, t.TotalCostUSD)
+}
+
+// notifySignals subscribes ch to the shutdown signals; tests replace it to
+// deliver a fake signal.
+var notifySignals = func(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+}
+
+// inflightCounter tracks requests currently being served by the API server
+// so shutdown can report how many it had to drain.
+type inflightCounter struct {
+	n atomic.Int64
+}
+
+func (c *inflightCounter) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.n.Add(1)
+		defer c.n.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *inflightCounter) current() int {
+	return int(c.n.Load())
+}
+
+// bodyTimeout bounds how long a client may take to upload its request body,
+// so a slow sender cannot hold a handler indefinitely. Unlike the server's
+// ReadTimeout, the deadline is lifted once the body has been read: left in
+// place it would cancel long-running streamed responses. Zero disables it.
+func bodyTimeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(d)); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineBody clears the connection's read deadline at the end of the body.
+type deadlineBody struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	done bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		_ = b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// loadRegistry builds the provider registry from providers.json and env
+// overrides. An unreadable or corrupt file is only a warning as long as the
+// environment supplies at least one provider.
+func loadRegistry(authDir string, stderr io.Writer, opts ...provider.RegistryOption) (*provider.Registry, error) {
+	warnf := func(format string, args ...any) {
+		fmt.Fprintf(stderr, "warning: "+format+"\n", args...)
+	}
+	opts = append([]provider.RegistryOption{provider.WithWarnf(warnf)}, opts...)
+	reg := provider.NewRegistry(authDir, opts...)
+	fileErr := reg.LoadFromFile()
+	reg.LoadFromEnv()
+	if fileErr != nil {
+		if len(reg.Names()) == 0 {
+			return nil, fmt.Errorf("load providers from file: %w", fileErr)
+		}
+		fmt.Fprintf(stderr, "warning: load providers from file: %v; continuing with environment providers\n", fileErr)
+	}
+	return reg, nil
+}
+
+// applyProviderPricing merges inline "pricing" maps from providers.json into
+// the effective pricing table; inline rates win over built-in defaults.
+func applyProviderPricing(pricing *cost.Pricing, reg *provider.Registry, free []string) {
+	for _, name := range free {
+		pricing.SetFree(strings.ToLower(strings.TrimSpace(name)))
 	}
-	if err := uiServer.Shutdown(shutdownCtx); err != nil {
-		return fmt.Errorf("shutdown ui server: %w", err)
+	for name, p := range reg.All() {
+		if p.Free {
+			pricing.SetFree(name)
+		}
+		for model, price := range p.Pricing {
+			pricing.SetRate(name, model, cost.Rate{InputPerMTok: price.InputPerMTok, OutputPerMTok: price.OutputPerMTok})
+		}
 	}
+}
 
+// applyModelCaps parses MODEL_MONTHLY_CAPS entries of the form
+// "provider/model=usd". Unlike other settings a malformed cap is fatal, since
+// silently dropping it would lift a spending limit.
+func applyModelCaps(pricing *cost.Pricing, entries []string) error {
+	for _, e := range entries {
+		target, amount, ok := strings.Cut(e, "=")
+		providerName, model, hasSlash := strings.Cut(strings.TrimSpace(target), "/")
+		usd, err := strconv.ParseFloat(strings.TrimSpace(amount), 64)
+		if !ok || !hasSlash || providerName == "" || model == "" || err != nil || usd < 0 {
+			return fmt.Errorf("invalid MODEL_MONTHLY_CAPS entry %q (want provider/model=usd)", e)
+		}
+		pricing.SetMonthlyCap(providerName, model, usd)
+	}
 	return nil
 }
 
-func newAPIHandler(contextRoot string, reg *provider.Registry, logger *logging.Logger, acc *cost.Accumulator, pricing *cost.Pricing) http.Handler {
+// parseBudgetUSD reads a dollar budget; empty means none. Like a malformed
+// model cap, a value that doesn't parse is fatal rather than falling back to
+// zero, which would lift the limit.
+func parseBudgetUSD(raw string) (float64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	usd, err := strconv.ParseFloat(raw, 64)
+	if err != nil || usd < 0 || math.IsInf(usd, 0) || math.IsNaN(usd) {
+		return 0, fmt.Errorf("invalid amount %q (want a non-negative number of dollars)", raw)
+	}
+	return usd, nil
+}
+
+func newAPIHandler(contextRoot string, reg *provider.Registry, logger *logging.Logger, acc *cost.Accumulator, pricing *cost.Pricing, opts ...proxy.HandlerOption) http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("POST /v1/chat/completions", proxy.NewHandler(reg, func(agentID string) (*agentctx.AgentContext, error) {
+	opts = append([]proxy.HandlerOption{proxy.WithCostTracking(acc, pricing)}, opts...)
+	proxyHandler := proxy.NewHandler(reg, func(agentID string) (*agentctx.AgentContext, error) {
 		return agentctx.Load(contextRoot, agentID)
-	}, logger, proxy.WithCostTracking(acc, pricing)))
-	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+	}, logger, opts...)
+	// /v1/completions is the legacy text-completions API; it shares the
+	// OpenAI routing, auth swap, and usage accounting with chat.
+	for _, path := range []string{"/v1/chat/completions", "/v1/completions"} {
+		mux.Handle("POST "+path, proxyHandler)
+		mux.HandleFunc("OPTIONS "+path, handlePreflight)
+		mux.HandleFunc(path, handleMethodNotAllowed)
+	}
+	// Every other /v1 path (embeddings, moderations, models, /v1/messages...)
+	// goes to the proxy, which picks the flow and enforces methods itself.
+	mux.Handle("/v1/{path...}", proxyHandler)
+	mux.HandleFunc("GET /health", healthHandler(reg))
+	mux.HandleFunc("GET /health/providers", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+		_ = json.NewEncoder(w).Encode(map[string]any{"providers": proxyHandler.ProviderHealth()})
 	})
 	return mux
 }
 
-func newUIHandler(reg *provider.Registry, acc *cost.Accumulator, contextRoot string) http.Handler {
+// healthHandler answers liveness probes; ?deep=1 adds a cached
+// reachability probe of every provider.
+func healthHandler(reg *provider.Registry) http.HandlerFunc {
+	health := provider.NewHealthChecker(reg, 10*time.Second)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if deep, _ := strconv.ParseBool(r.URL.Query().Get("deep")); deep && r.Method != http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"ok":        true,
+				"providers": health.Check(r.Context()),
+			})
+			return
+		}
+		livenessHandler(w, r)
+	}
+}
+
+// livenessHandler answers {"ok": true}, or just the status for HEAD.
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		// Load balancer probes only need the status.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// shallowHealth serves /health on next's behalf as a plain liveness check,
+// ignoring ?deep, for the public API once the admin server owns the
+// provider probes.
+func shallowHealth(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", livenessHandler)
+	mux.Handle("/", next)
+	return mux
+}
+
+// handleMethodNotAllowed replaces the mux's plain-text 405 with an
+// OpenAI-style JSON error so clients surface a readable message.
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "POST, OPTIONS")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": fmt.Sprintf("method %s not allowed; use POST", r.Method),
+		},
+	})
+}
+
+// handlePreflight answers CORS preflight and OPTIONS probes on the proxy API.
+// Auth is still enforced on the actual POST.
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "POST, OPTIONS")
+	if r.Header.Get("Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Cllama-Session, X-Cllama-Timeout-Seconds, Idempotency-Key")
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newUIHandler(reg *provider.Registry, logger *logging.Logger, acc *cost.Accumulator, contextRoot string, opts ...ui.UIOption) http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/", ui.NewHandler(reg, ui.WithAccumulator(acc), ui.WithContextRoot(contextRoot)))
+	opts = append([]ui.UIOption{ui.WithAccumulator(acc), ui.WithContextRoot(contextRoot), ui.WithLogger(logger)}, opts...)
+	mux.Handle("/", ui.NewHandler(reg, opts...))
 	return mux
 }
 
+// parseTokenUnit reads COST_TOKEN_UNIT: "1k" or "1m" tokens.
+func parseTokenUnit(s string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "1m":
+		return cost.PerMillion, nil
+	case "1k":
+		return cost.PerThousand, nil
+	}
+	return 0, fmt.Errorf("unknown token unit %q (want 1k or 1m)", s)
+}
+
 func serveServer(name string, server *http.Server, stderr io.Writer, errCh chan<- error) {
 	fmt.Fprintf(stderr, "cllama %s listening on %s\n", name, server.Addr)
 	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -123,15 +526,45 @@ func serveServer(name string, server *http.Server, stderr io.Writer, errCh chan<
 	}
 }
 
-func runHealthcheck(apiAddr string) error {
+// Exit codes for -healthcheck, so a failed deploy says which check failed.
+const (
+	exitHealthAPI         = 1
+	exitHealthContextRoot = 2
+	exitHealthAuthDir     = 3
+)
+
+// exitError is an error from run that should end the process with code.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// runHealthcheck checks that the context root can be listed and the auth
+// dir exists, catching a bad mount, and then that the API server answers
+// /health. Each failure has its own exit code.
+func runHealthcheck(cfg config) error {
+	if _, err := os.ReadDir(cfg.ContextRoot); err != nil {
+		return &exitError{code: exitHealthContextRoot, err: fmt.Errorf("context root not readable: %w", err)}
+	}
+	info, err := os.Stat(cfg.AuthDir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", cfg.AuthDir)
+	}
+	if err != nil {
+		return &exitError{code: exitHealthAuthDir, err: fmt.Errorf("auth dir: %w", err)}
+	}
+
 	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(healthcheckURL(apiAddr))
+	resp, err := client.Get(healthcheckURL(cfg.APIAddr))
 	if err != nil {
-		return err
+		return &exitError{code: exitHealthAPI, err: err}
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("health endpoint returned %s", resp.Status)
+		return &exitError{code: exitHealthAPI, err: fmt.Errorf("health endpoint returned %s", resp.Status)}
 	}
 	return nil
 }
@@ -160,9 +593,76 @@ func configFromEnv() config {
 	return config{
 		APIAddr:     envOr("LISTEN_ADDR", ":8080"),
 		UIAddr:      envOr("UI_ADDR", ":8081"),
+		AdminAddr:   os.Getenv("ADMIN_ADDR"),
 		ContextRoot: envOr("CLAW_CONTEXT_ROOT", "/claw/context"),
 		AuthDir:     envOr("CLAW_AUTH_DIR", "/claw/auth"),
 		PodName:     os.Getenv("CLAW_POD"),
+		LogFormat:   envOr("LOG_FORMAT", string(logging.FormatJSON)),
+		LogSample:   envInt("LOG_SAMPLE_EVERY", 1),
+
+		MaxInflight:  envInt("MAX_INFLIGHT", 0),
+		InflightWait: envDuration("MAX_INFLIGHT_WAIT", 5*time.Second),
+
+		ResponseHeaderAllow: envList("RESPONSE_HEADER_ALLOW"),
+		ResponseHeaderDeny:  envList("RESPONSE_HEADER_DENY"),
+
+		MinChargeUSD:        envFloat("COST_MIN_CHARGE_USD", 0),
+		RoundToCents:        envBool("COST_ROUND_TO_CENTS", false),
+		UsageReconciliation: envOr("USAGE_RECONCILIATION", string(proxy.ReconcileReportedOnly)),
+		PriceByResponse:     envBool("PRICE_BY_RESPONSE_MODEL", false),
+		CostTokenUnit:       envOr("COST_TOKEN_UNIT", "1m"),
+		UIAdminToken:        os.Getenv("UI_ADMIN_TOKEN"),
+
+		FreeProviders:    envList("FREE_PROVIDERS"),
+		ModelMonthlyCaps: envList("MODEL_MONTHLY_CAPS"),
+		GlobalBudgetUSD:  os.Getenv("GLOBAL_BUDGET_USD"),
+
+		AgentMonthlyBudgetUSD: os.Getenv("AGENT_MONTHLY_BUDGET_USD"),
+		BudgetThresholds:      envList("BUDGET_THRESHOLDS"),
+		BudgetWebhook:         os.Getenv("BUDGET_WEBHOOK"),
+
+		AuthMaxFailures:   envInt("AUTH_MAX_FAILURES", 10),
+		AuthFailureWindow: envDuration("AUTH_FAILURE_WINDOW", time.Minute),
+		TokenGrace:        envDuration("TOKEN_GRACE", time.Minute),
+
+		UpstreamTimeout:    envDuration("UPSTREAM_TIMEOUT", 0),
+		MaxUpstreamTimeout: envDuration("UPSTREAM_TIMEOUT_MAX", 30*time.Minute),
+		BodyReadTimeout:    envDuration("READ_TIMEOUT", time.Minute),
+
+		ProviderFailureThreshold: envInt("PROVIDER_FAILURE_THRESHOLD", 5),
+		ProviderCooldown:         envDuration("PROVIDER_COOLDOWN", 30*time.Second),
+
+		UpstreamRetries:    envInt("UPSTREAM_RETRIES", 0),
+		UpstreamRetryDelay: envDuration("UPSTREAM_RETRY_DELAY", 250*time.Millisecond),
+		RetryBudgetPerSec:  envFloat("RETRY_BUDGET_PER_SECOND", 1),
+		RetryBudgetBurst:   envInt("RETRY_BUDGET_BURST", 10),
+
+		StreamReframe:       envBool("STREAM_REFRAME", false),
+		StreamBufferSize:    envInt("STREAM_BUFFER_SIZE", 32*1024),
+		StreamFlushInterval: envDuration("STREAM_FLUSH_INTERVAL", 0),
+
+		IdempotencyTTL:      envDuration("IDEMPOTENCY_TTL", 0),
+		IdempotencyMaxKeys:  envInt("IDEMPOTENCY_MAX_KEYS", 1000),
+		IdempotencyMaxBytes: envInt("IDEMPOTENCY_MAX_BODY_BYTES", 1<<20),
+
+		MaxPromptMessages: envInt("MAX_PROMPT_MESSAGES", 0),
+		MaxPromptTokens:   envInt("MAX_PROMPT_TOKENS", 0),
+
+		ValidateRequests: envBool("VALIDATE_REQUESTS", false),
+
+		EchoProvider: envBool("ECHO_PROVIDER", false),
+
+		ShadowModels: envList("SHADOW_MODELS"),
+
+		RoutingRulesFile: os.Getenv("ROUTING_RULES_FILE"),
+
+		EndpointProbeInterval: envDuration("ENDPOINT_PROBE_INTERVAL", 30*time.Second),
+
+		TrustedProxies: envList("TRUSTED_PROXIES"),
+
+		SecurityHeaders: os.Getenv("SECURITY_HEADERS"),
+
+		EnforceProviderPerms: envBool("PROVIDERS_ENFORCE_0600", false),
 	}
 }
 
@@ -172,3 +672,61 @@ func envOr(key, fallback string) string {
 	}
 	return fallback
 }
+
+func envList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func envInt(key string, fallback int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
+
+func envFloat(key string, fallback float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+func envBool(key string, fallback bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback
+	}
+	return b
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
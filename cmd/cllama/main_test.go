@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -75,8 +77,8 @@ func TestDualServerIntegrationSmoke(t *testing.T) {
 	}
 	pricing := cost.DefaultPricing()
 	acc := cost.NewAccumulator()
-	apiHandler := newAPIHandler(contextRoot, reg, logging.New(io.Discard), acc, pricing)
-	uiHandler := newUIHandler(reg, acc, contextRoot)
+	apiHandler := newAPIHandler(contextRoot, reg, logging.New(io.Discard, logging.FormatJSON), acc, pricing)
+	uiHandler := newUIHandler(reg, logging.New(io.Discard, logging.FormatJSON), acc, contextRoot)
 
 	apiServer := &http.Server{Handler: apiHandler}
 	uiServer := &http.Server{Handler: uiHandler}
@@ -146,6 +148,158 @@ func TestDualServerIntegrationSmoke(t *testing.T) {
 	}
 }
 
+func TestLegacyCompletionsRoutedAndAccounted(t *testing.T) {
+	var gotPath, gotAuth, gotModel string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		gotModel, _ = payload["model"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"id":"cmpl-1","object":"text_completion","choices":[{"text":"ok"}],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`)
+	}))
+	defer backend.Close()
+
+	contextRoot := t.TempDir()
+	agentDir := filepath.Join(contextRoot, "tiverton")
+	if err := os.MkdirAll(agentDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"AGENTS.md":     "# contract",
+		"CLAWDAPUS.md":  "# infra",
+		"metadata.json": `{"token":"tiverton:dummy123"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(agentDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := newAPIHandler(contextRoot, reg, logging.New(io.Discard, logging.FormatJSON), acc, cost.DefaultPricing())
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"model":"openai/gpt-4o","prompt":"say ok"}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotPath != "/v1/completions" {
+		t.Errorf("expected upstream path /v1/completions, got %q", gotPath)
+	}
+	if gotAuth != "Bearer sk-real" || gotModel != "gpt-4o" {
+		t.Errorf("expected auth swap and stripped model, got auth=%q model=%q", gotAuth, gotModel)
+	}
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 || entries[0].TotalInputTokens != 12 || entries[0].TotalOutputTokens != 3 {
+		t.Errorf("expected completion usage recorded, got %+v", entries)
+	}
+}
+
+func TestAPIHealthHead(t *testing.T) {
+	h := newAPIHandler(t.TempDir(), provider.NewRegistry(""), logging.New(io.Discard, logging.FormatJSON), cost.NewAccumulator(), cost.DefaultPricing())
+
+	req := httptest.NewRequest(http.MethodHead, "/health", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected empty body for HEAD, got %q", w.Body.String())
+	}
+}
+
+func TestAPIHealthDeepReportsProviders(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer up.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downURL := "http://" + ln.Addr().String()
+	ln.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{BaseURL: up.URL})
+	reg.Set("ollama", &provider.Provider{BaseURL: downURL})
+	h := newAPIHandler(t.TempDir(), reg, logging.New(io.Discard, logging.FormatJSON), cost.NewAccumulator(), cost.DefaultPricing())
+
+	req := httptest.NewRequest(http.MethodGet, "/health?deep=1", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		OK        bool                       `json:"ok"`
+		Providers map[string]provider.Health `json:"providers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if !body.Providers["openai"].Reachable {
+		t.Errorf("expected openai reachable, got %+v", body.Providers["openai"])
+	}
+	if body.Providers["ollama"].Reachable || body.Providers["ollama"].Error == "" {
+		t.Errorf("expected ollama unreachable, got %+v", body.Providers["ollama"])
+	}
+}
+
+func TestAPIChatOptions(t *testing.T) {
+	h := newAPIHandler(t.TempDir(), provider.NewRegistry(""), logging.New(io.Discard, logging.FormatJSON), cost.NewAccumulator(), cost.DefaultPricing())
+
+	req := httptest.NewRequest(http.MethodOptions, "/v1/chat/completions", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if got := w.Header().Get("Allow"); got != "POST, OPTIONS" {
+		t.Errorf("unexpected Allow header: %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(got, "POST") {
+		t.Errorf("expected CORS methods to include POST, got %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Authorization") {
+		t.Errorf("expected CORS headers to include Authorization, got %q", got)
+	}
+}
+
+func TestAPIChatGetReturns405(t *testing.T) {
+	h := newAPIHandler(t.TempDir(), provider.NewRegistry(""), logging.New(io.Discard, logging.FormatJSON), cost.NewAccumulator(), cost.DefaultPricing())
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/chat/completions", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", w.Code)
+	}
+	if got := w.Header().Get("Allow"); !strings.Contains(got, "POST") {
+		t.Errorf("expected Allow to include POST, got %q", got)
+	}
+	var body map[string]map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected JSON error body: %v (%s)", err, w.Body.String())
+	}
+	if msg, _ := body["error"]["message"].(string); !strings.Contains(msg, "GET") {
+		t.Errorf("expected error message to name the method, got %q", msg)
+	}
+}
+
 func TestHealthcheckURL(t *testing.T) {
 	cases := []struct {
 		addr string
@@ -161,3 +315,462 @@ func TestHealthcheckURL(t *testing.T) {
 		}
 	}
 }
+
+func TestRunHealthcheckChecksDirectories(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer api.Close()
+	apiAddr := strings.TrimPrefix(api.URL, "http://")
+
+	contextRoot, authDir := t.TempDir(), t.TempDir()
+	missing := filepath.Join(t.TempDir(), "missing")
+	notDir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(notDir, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		cfg      config
+		wantCode int
+	}{
+		{"healthy", config{ContextRoot: contextRoot, AuthDir: authDir, APIAddr: apiAddr}, 0},
+		{"missing context root", config{ContextRoot: missing, AuthDir: authDir, APIAddr: apiAddr}, exitHealthContextRoot},
+		{"missing auth dir", config{ContextRoot: contextRoot, AuthDir: missing, APIAddr: apiAddr}, exitHealthAuthDir},
+		{"auth dir is a file", config{ContextRoot: contextRoot, AuthDir: notDir, APIAddr: apiAddr}, exitHealthAuthDir},
+		{"api down", config{ContextRoot: contextRoot, AuthDir: authDir, APIAddr: "127.0.0.1:1"}, exitHealthAPI},
+	}
+	for _, tc := range cases {
+		err := runHealthcheck(tc.cfg)
+		if tc.wantCode == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		var exit *exitError
+		if !errors.As(err, &exit) || exit.code != tc.wantCode {
+			t.Errorf("%s: expected exit code %d, got %v", tc.name, tc.wantCode, err)
+		}
+	}
+}
+
+func TestConfigFromEnvInflight(t *testing.T) {
+	t.Setenv("MAX_INFLIGHT", "32")
+	t.Setenv("MAX_INFLIGHT_WAIT", "250ms")
+	cfg := configFromEnv()
+	if cfg.MaxInflight != 32 {
+		t.Fatalf("expected MaxInflight=32, got %d", cfg.MaxInflight)
+	}
+	if cfg.InflightWait != 250*time.Millisecond {
+		t.Fatalf("expected InflightWait=250ms, got %s", cfg.InflightWait)
+	}
+
+	t.Setenv("MAX_INFLIGHT", "lots")
+	if got := configFromEnv().MaxInflight; got != 0 {
+		t.Fatalf("expected invalid MAX_INFLIGHT to fall back to 0, got %d", got)
+	}
+}
+
+func TestLoadRegistryToleratesCorruptFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "providers.json"), []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"OPENAI_API_KEY", "ANTHROPIC_API_KEY", "OPENROUTER_API_KEY", "OPENAI_BASE_URL", "ANTHROPIC_BASE_URL", "OPENROUTER_BASE_URL", "OLLAMA_BASE_URL"} {
+		t.Setenv(k, "")
+	}
+
+	var stderr bytes.Buffer
+	if _, err := loadRegistry(dir, &stderr); err == nil {
+		t.Fatal("expected error when no providers can be loaded")
+	}
+
+	t.Setenv("OPENAI_API_KEY", "sk-from-env")
+	reg, err := loadRegistry(dir, &stderr)
+	if err != nil {
+		t.Fatalf("expected startup to continue with env providers: %v", err)
+	}
+	if p, err := reg.Get("openai"); err != nil || p.APIKey != "sk-from-env" {
+		t.Errorf("expected env provider loaded, got %+v (%v)", p, err)
+	}
+	if !strings.Contains(stderr.String(), "warning: load providers from file") {
+		t.Errorf("expected warning on stderr, got %q", stderr.String())
+	}
+}
+
+func TestApplyModelCaps(t *testing.T) {
+	pricing := cost.DefaultPricing()
+	if err := applyModelCaps(pricing, []string{"anthropic/claude-opus-4=500", "openrouter/anthropic/claude-sonnet-4=25.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, usd, ok := pricing.MonthlyCap("anthropic", "claude-opus-4-6"); !ok || usd != 500 {
+		t.Errorf("expected opus cap 500, got %v %v", usd, ok)
+	}
+	if _, usd, ok := pricing.MonthlyCap("openrouter", "anthropic/claude-sonnet-4"); !ok || usd != 25.5 {
+		t.Errorf("expected openrouter cap 25.5, got %v %v", usd, ok)
+	}
+
+	for _, bad := range []string{"claude-opus-4=5", "anthropic/claude-opus-4", "anthropic/claude-opus-4=lots", "anthropic/=5"} {
+		if err := applyModelCaps(cost.DefaultPricing(), []string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParseBudgetUSD(t *testing.T) {
+	if usd, err := parseBudgetUSD(""); err != nil || usd != 0 {
+		t.Errorf("expected empty to mean no budget, got %v, %v", usd, err)
+	}
+	if usd, err := parseBudgetUSD(" 500.5 "); err != nil || usd != 500.5 {
+		t.Errorf("expected 500.5, got %v, %v", usd, err)
+	}
+	for _, bad := range []string{"$500", "500usd", "-1", "NaN", "Inf"} {
+		if _, err := parseBudgetUSD(bad); err == nil {
+			t.Errorf("expected %q rejected", bad)
+		}
+	}
+}
+
+func TestRunRejectsMalformedBudgets(t *testing.T) {
+	for _, key := range []string{"GLOBAL_BUDGET_USD", "AGENT_MONTHLY_BUDGET_USD"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv("CLAW_AUTH_DIR", t.TempDir())
+			t.Setenv("CLAW_CONTEXT_ROOT", t.TempDir())
+			t.Setenv(key, "$500")
+
+			var stdout, stderr bytes.Buffer
+			err := run(nil, &stdout, &stderr)
+			if err == nil || !strings.Contains(err.Error(), key) {
+				t.Fatalf("expected a %s error, got %v", key, err)
+			}
+		})
+	}
+}
+
+func TestRunLogsShutdown(t *testing.T) {
+	t.Setenv("LISTEN_ADDR", "127.0.0.1:0")
+	t.Setenv("UI_ADDR", "127.0.0.1:0")
+	t.Setenv("ADMIN_ADDR", "127.0.0.1:0")
+	t.Setenv("CLAW_AUTH_DIR", t.TempDir())
+	t.Setenv("CLAW_CONTEXT_ROOT", t.TempDir())
+
+	orig := notifySignals
+	notifySignals = func(ch chan<- os.Signal) { ch <- syscall.SIGTERM }
+	defer func() { notifySignals = orig }()
+
+	// The servers report their listen address from their own goroutines.
+	var stdout bytes.Buffer
+	var stderr lockedBuffer
+	if err := run(nil, &stdout, &stderr); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	var entry map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(stdout.String()), "\n") {
+		var e map[string]any
+		if json.Unmarshal([]byte(line), &e) == nil && e["type"] == "shutdown" {
+			entry = e
+		}
+	}
+	if entry == nil {
+		t.Fatalf("expected shutdown log entry, got %q", stdout.String())
+	}
+	if entry["signal"] != "terminated" {
+		t.Errorf("expected signal=terminated, got %v", entry["signal"])
+	}
+	if entry["inflight"] != float64(0) {
+		t.Errorf("expected inflight=0, got %v", entry["inflight"])
+	}
+	if _, ok := entry["drain_ms"]; !ok {
+		t.Error("expected drain_ms on shutdown entry")
+	}
+	if _, ok := entry["error"]; ok {
+		t.Errorf("expected clean drain, got error %v", entry["error"])
+	}
+	if !strings.Contains(stdout.String(), `"type":"summary"`) {
+		t.Errorf("expected a summary entry after shutdown, got %q", stdout.String())
+	}
+}
+
+func TestLogSummaryReflectsRecordedCosts(t *testing.T) {
+	acc := cost.NewAccumulator()
+	acc.RecordSession("tiverton", "s1", "openai", "gpt-4o", 1000, 200, 0.5)
+	acc.Record("westin", "anthropic", "claude-sonnet-4", 300, 100, 0.25)
+
+	var buf bytes.Buffer
+	logSummary(logging.New(&buf, logging.FormatJSON), acc)
+
+	var entry struct {
+		Type      string  `json:"type"`
+		Requests  int     `json:"requests"`
+		TokensIn  int     `json:"tokens_in"`
+		TokensOut int     `json:"tokens_out"`
+		CostUSD   float64 `json:"cost_usd"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid summary entry %q: %v", buf.String(), err)
+	}
+	if entry.Type != "summary" || entry.Requests != 2 || entry.TokensIn != 1300 || entry.TokensOut != 300 || entry.CostUSD != 0.75 {
+		t.Errorf("unexpected summary: %+v", entry)
+	}
+}
+
+func TestAPIHealthProviders(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	reg.Set("ollama", &provider.Provider{Name: "ollama", BaseURL: "http://ollama:11434/v1", Auth: "none"})
+	h := newAPIHandler(t.TempDir(), reg, nil, cost.NewAccumulator(), cost.DefaultPricing())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/providers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body struct {
+		Providers map[string]struct {
+			Healthy bool `json:"healthy"`
+		} `json:"providers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if p, ok := body.Providers["ollama"]; !ok || !p.Healthy {
+		t.Errorf("expected ollama reported healthy, got %s", w.Body.String())
+	}
+}
+
+func TestAdminServerMetricsAndReset(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	var inflight inflightCounter
+	admin := httptest.NewServer(newAdminHandler(reg, acc, &inflight))
+	defer admin.Close()
+
+	resp, err := http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	for _, want := range []string{
+		`cllama_requests_total{agent_id="tiverton",provider="anthropic",model="claude-sonnet-4"} 1`,
+		`cllama_cost_usd_total{agent_id="tiverton",provider="anthropic",model="claude-sonnet-4"} 0.0105`,
+		"cllama_inflight_requests 0",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %q in metrics, got:\n%s", want, body)
+		}
+	}
+
+	resp, err = http.Post(admin.URL+"/costs/reset", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected reset to succeed, got %d", resp.StatusCode)
+	}
+	if got := acc.TotalCost(); got != 0 {
+		t.Errorf("expected spend cleared, got %f", got)
+	}
+
+	resp, err = http.Get(admin.URL + "/health?deep=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected deep health on admin server, got %d", resp.StatusCode)
+	}
+
+	api := newAPIHandler(t.TempDir(), reg, nil, acc, cost.DefaultPricing())
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected /metrics absent from the API server, got %d", w.Code)
+	}
+
+	// With the admin server up, the public API only answers liveness.
+	public := shallowHealth(api)
+	w = httptest.NewRecorder()
+	public.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health?deep=1", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "providers") {
+		t.Errorf("expected a shallow health check on the API server, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	public.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health/providers", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected other API routes unaffected, got %d", w.Code)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestInflightCounter(t *testing.T) {
+	var c inflightCounter
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	h := c.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(done)
+	}()
+	<-entered
+	if got := c.current(); got != 1 {
+		t.Fatalf("expected 1 in flight, got %d", got)
+	}
+	close(release)
+	<-done
+	if got := c.current(); got != 0 {
+		t.Fatalf("expected 0 in flight after completion, got %d", got)
+	}
+}
+
+func TestBodyTimeoutBoundsSlowUploads(t *testing.T) {
+	srv := httptest.NewServer(bodyTimeout(100*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, "slow body", http.StatusRequestTimeout)
+			return
+		}
+		// Once the body is in, the deadline must not cut the response short.
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+			http.Error(w, "canceled", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("expected a prompt upload to outlive the deadline, got %d %s", resp.StatusCode, body)
+	}
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Promise ten bytes, send one, then stall.
+	if _, err := io.WriteString(conn, "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\n{"); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	status, err := io.ReadAll(io.LimitReader(conn, 64))
+	if err != nil && len(status) == 0 {
+		t.Fatalf("expected the server to give up on the body, got %v", err)
+	}
+	if !strings.Contains(string(status), "408") {
+		t.Errorf("expected the handler to see a read error, got %q", status)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the slow upload cut off near the deadline, took %s", elapsed)
+	}
+}
+
+func TestProviderInlinePricing(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "providers.json"), []byte(`{"providers": {
+		"ollama": {"base_url": "http://gpu:11434/v1", "pricing": {"llama3-70b": {"input_per_mtok": 0.2, "output_per_mtok": 0.4}}},
+		"openai": {"api_key": "sk-x", "pricing": {"gpt-4o": {"input_per_mtok": 2.0, "output_per_mtok": 8.0}}},
+		"vllm": {"base_url": "http://gpu:8000/v1", "auth": "none", "free": true}
+	}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := loadRegistry(dir, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pricing := cost.DefaultPricing()
+	applyProviderPricing(pricing, reg, []string{"LMStudio"})
+
+	rate, ok := pricing.Lookup("ollama", "llama3-70b-q4")
+	if !ok || rate.InputPerMTok != 0.2 || rate.OutputPerMTok != 0.4 {
+		t.Errorf("expected inline ollama rate, got %+v (%v)", rate, ok)
+	}
+	if rate, _ := pricing.Lookup("openai", "gpt-4o"); rate.InputPerMTok != 2.0 {
+		t.Errorf("expected inline rate to override default, got %+v", rate)
+	}
+	if _, ok := pricing.Lookup("openai", "gpt-4o-mini"); !ok {
+		t.Error("expected other built-in rates to remain")
+	}
+	for _, name := range []string{"vllm", "lmstudio", "ollama"} {
+		if rate, ok := pricing.Lookup(name, "some-local-model"); !ok || rate != (cost.Rate{}) {
+			t.Errorf("expected %s priced free, got %+v (%v)", name, rate, ok)
+		}
+	}
+}
+
+func TestSecurityHeadersOnUIResponses(t *testing.T) {
+	headers, err := parseSecurityHeaders("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uiHandler := newUIHandler(provider.NewRegistry(t.TempDir()), logging.New(io.Discard, logging.FormatJSON), cost.NewAccumulator(), t.TempDir())
+	h := withHeaders(headers, uiHandler)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	for name, want := range defaultSecurityHeaders {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("expected %s: %s on the UI, got %q", name, want, got)
+		}
+	}
+
+	// Revalidated JSON keeps its ETag usable: no-cache, not no-store.
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/costs/api", nil))
+	if w.Header().Get("ETag") == "" || w.Header().Get("Cache-Control") != "no-cache" {
+		t.Errorf("expected /costs/api to be revalidated, got ETag %q, Cache-Control %q", w.Header().Get("ETag"), w.Header().Get("Cache-Control"))
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("expected the other security headers kept on /costs/api, got %q", got)
+	}
+
+	headers, err = parseSecurityHeaders(`{"content-security-policy":"default-src 'self'"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	withHeaders(headers, uiHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := w.Header().Get("Content-Security-Policy"); got != "default-src 'self'" {
+		t.Errorf("expected the configured header, got %q", got)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "" {
+		t.Errorf("expected configured headers to replace the defaults, got X-Frame-Options %q", got)
+	}
+
+	for _, bad := range []string{`not json`, `{"Bad Name":"x"}`, `{"X-Split":"a\r\nb"}`} {
+		if _, err := parseSecurityHeaders(bad); err == nil {
+			t.Errorf("parseSecurityHeaders(%q): expected an error", bad)
+		}
+	}
+}
@@ -2,9 +2,14 @@ package agentctx
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // AgentContext holds the per-agent mounted contract and metadata files.
@@ -15,9 +20,16 @@ type AgentContext struct {
 	Metadata    map[string]any
 }
 
+// ErrUnsafeAgentID is returned by Load for an agent ID that is not a single
+// path element inside the context root.
+var ErrUnsafeAgentID = errors.New("agent id is not a plain directory name")
+
 // Load reads an agent's context files from contextRoot/<agentID>/.
 func Load(contextRoot, agentID string) (*AgentContext, error) {
-	dir := filepath.Join(contextRoot, agentID)
+	dir, err := agentDir(contextRoot, agentID)
+	if err != nil {
+		return nil, fmt.Errorf("load agent context %q: %w", agentID, err)
+	}
 
 	agentsMD, err := os.ReadFile(filepath.Join(dir, "AGENTS.md"))
 	if err != nil {
@@ -29,14 +41,9 @@ func Load(contextRoot, agentID string) (*AgentContext, error) {
 		return nil, fmt.Errorf("load agent context %q: CLAWDAPUS.md: %w", agentID, err)
 	}
 
-	metaRaw, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
+	meta, err := readMetadata(dir)
 	if err != nil {
-		return nil, fmt.Errorf("load agent context %q: metadata.json: %w", agentID, err)
-	}
-
-	var meta map[string]any
-	if err := json.Unmarshal(metaRaw, &meta); err != nil {
-		return nil, fmt.Errorf("load agent context %q: parse metadata: %w", agentID, err)
+		return nil, fmt.Errorf("load agent context %q: %w", agentID, err)
 	}
 
 	return &AgentContext{
@@ -47,6 +54,115 @@ func Load(contextRoot, agentID string) (*AgentContext, error) {
 	}, nil
 }
 
+// ErrAgentExists is returned by Create when the agent's directory is
+// already present.
+var ErrAgentExists = errors.New("agent already exists")
+
+// Create writes a new agent's AGENTS.md, CLAWDAPUS.md and metadata.json
+// under contextRoot/<ctx.AgentID>/. The metadata usually holds the agent's
+// bearer token, so the directory is private to the proxy's user.
+func Create(contextRoot string, ctx *AgentContext) error {
+	dir, err := agentDir(contextRoot, ctx.AgentID)
+	if err != nil {
+		return fmt.Errorf("create agent %q: %w", ctx.AgentID, err)
+	}
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("create agent %q: %w", ctx.AgentID, ErrAgentExists)
+		}
+		return fmt.Errorf("create agent %q: %w", ctx.AgentID, err)
+	}
+	meta := ctx.Metadata
+	if meta == nil {
+		meta = map[string]any{}
+	}
+	metaJSON, err := json.MarshalIndent(meta, "", "  ")
+	if err == nil {
+		for name, data := range map[string][]byte{
+			"AGENTS.md":     ctx.AgentsMD,
+			"CLAWDAPUS.md":  ctx.ClawdapusMD,
+			"metadata.json": metaJSON,
+		} {
+			if err = os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		// Leave no half-written agent behind.
+		_ = os.RemoveAll(dir)
+		return fmt.Errorf("create agent %q: %w", ctx.AgentID, err)
+	}
+	return nil
+}
+
+// Remove deletes agentID's context directory. It returns an error wrapping
+// fs.ErrNotExist when there is no such agent.
+func Remove(contextRoot, agentID string) error {
+	dir, err := agentDir(contextRoot, agentID)
+	if err != nil {
+		return fmt.Errorf("remove agent %q: %w", agentID, err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("remove agent %q: %w", agentID, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("remove agent %q: %w", agentID, fs.ErrNotExist)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("remove agent %q: %w", agentID, err)
+	}
+	return nil
+}
+
+// agentDir resolves agentID's directory under contextRoot, refusing IDs with
+// separators, dot elements, or anything else that would land outside it.
+func agentDir(contextRoot, agentID string) (string, error) {
+	if agentID == "" || agentID == "." || agentID == ".." || strings.ContainsAny(agentID, `/\`) ||
+		strings.ContainsRune(agentID, filepath.Separator) || strings.ContainsRune(agentID, 0) {
+		return "", ErrUnsafeAgentID
+	}
+	root := filepath.Clean(contextRoot)
+	dir := filepath.Join(root, agentID)
+	if rel, err := filepath.Rel(root, dir); err != nil || rel != agentID {
+		return "", ErrUnsafeAgentID
+	}
+	return dir, nil
+}
+
+// metadataFiles lists the accepted metadata file names in precedence order.
+var metadataFiles = []string{"metadata.json", "metadata.yaml", "metadata.yml"}
+
+// readMetadata loads the first metadata file present in dir. JSON wins over
+// YAML when both exist. Parse errors name the offending file relative to
+// the context root (e.g. "bad JSON in west/metadata.json").
+func readMetadata(dir string) (map[string]any, error) {
+	for _, name := range metadataFiles {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		rel := filepath.Join(filepath.Base(dir), name)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", rel, err)
+		}
+
+		var meta map[string]any
+		if name == "metadata.json" {
+			if err := json.Unmarshal(raw, &meta); err != nil {
+				return nil, fmt.Errorf("bad JSON in %s: %w", rel, err)
+			}
+		} else {
+			if meta, err = parseYAML(raw); err != nil {
+				return nil, fmt.Errorf("bad YAML in %s: %w", rel, err)
+			}
+		}
+		return meta, nil
+	}
+	return nil, fmt.Errorf("metadata.json: %w", fs.ErrNotExist)
+}
+
 // MetadataToken returns metadata["token"] when present and a string.
 func (a *AgentContext) MetadataToken() string {
 	if a == nil {
@@ -65,6 +181,50 @@ func (a *AgentContext) MetadataString(key string) string {
 	return v
 }
 
+// MetadataStrings returns a list metadata field. It accepts a JSON array or
+// YAML sequence of strings, or a single comma-separated string; anything
+// else yields nil.
+func (a *AgentContext) MetadataStrings(key string) []string {
+	if a == nil {
+		return nil
+	}
+	var out []string
+	switch v := a.Metadata[key].(type) {
+	case string:
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok && strings.TrimSpace(s) != "" {
+				out = append(out, strings.TrimSpace(s))
+			}
+		}
+	}
+	return out
+}
+
+// MetadataInt returns a whole-number metadata field, given as a number or a
+// numeric string. ok is false when the field is absent or not a whole number.
+func (a *AgentContext) MetadataInt(key string) (n int, ok bool) {
+	if a == nil {
+		return 0, false
+	}
+	switch v := a.Metadata[key].(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return int(v), true
+		}
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
 // AgentSummary is a lightweight view of an agent for listing purposes.
 type AgentSummary struct {
 	AgentID string
@@ -73,26 +233,44 @@ type AgentSummary struct {
 	Service string
 }
 
+// AgentLoadError describes an agent directory that could not be listed.
+type AgentLoadError struct {
+	AgentID string
+	Err     error
+}
+
+func (e AgentLoadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.AgentID, e.Err)
+}
+
+func (e AgentLoadError) Unwrap() error {
+	return e.Err
+}
+
 // ListAgents scans the context root directory for agent subdirectories
 // and returns a summary for each. Agents that fail to load are skipped.
 func ListAgents(contextRoot string) ([]AgentSummary, error) {
+	agents, _, err := ListAgentsWithErrors(contextRoot)
+	return agents, err
+}
+
+// ListAgentsWithErrors is like ListAgents but also reports each agent
+// directory whose metadata could not be read or parsed.
+func ListAgentsWithErrors(contextRoot string) ([]AgentSummary, []AgentLoadError, error) {
 	entries, err := os.ReadDir(contextRoot)
 	if err != nil {
-		return nil, fmt.Errorf("list agents in %q: %w", contextRoot, err)
+		return nil, nil, fmt.Errorf("list agents in %q: %w", contextRoot, err)
 	}
 
 	var agents []AgentSummary
+	var loadErrs []AgentLoadError
 	for _, e := range entries {
 		if !e.IsDir() {
 			continue
 		}
-		metaPath := filepath.Join(contextRoot, e.Name(), "metadata.json")
-		raw, err := os.ReadFile(metaPath)
+		meta, err := readMetadata(filepath.Join(contextRoot, e.Name()))
 		if err != nil {
-			continue // skip agents without metadata
-		}
-		var meta map[string]any
-		if json.Unmarshal(raw, &meta) != nil {
+			loadErrs = append(loadErrs, AgentLoadError{AgentID: e.Name(), Err: err})
 			continue
 		}
 		s := AgentSummary{AgentID: e.Name()}
@@ -107,5 +285,5 @@ func ListAgents(contextRoot string) ([]AgentSummary, error) {
 		}
 		agents = append(agents, s)
 	}
-	return agents, nil
+	return agents, loadErrs, nil
 }
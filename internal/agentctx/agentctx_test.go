@@ -1,8 +1,11 @@
 package agentctx
 
 import (
+	"errors"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -46,3 +49,207 @@ func TestLoadMissingDirErrors(t *testing.T) {
 		t.Error("expected error for missing dir")
 	}
 }
+
+func TestLoadRefusesPathTraversal(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "context")
+	// A complete context one level up, so a traversal would otherwise load.
+	outside := filepath.Join(root, "..", "etc")
+	if err := os.MkdirAll(outside, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"AGENTS.md", "CLAWDAPUS.md"} {
+		if err := os.WriteFile(filepath.Join(outside, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"../../etc", "../etc", "..", ".", "", "a/b", `a\b`} {
+		_, err := Load(root, id)
+		if !errors.Is(err, ErrUnsafeAgentID) {
+			t.Errorf("Load(%q): expected ErrUnsafeAgentID, got %v", id, err)
+		}
+	}
+}
+
+func TestCreateAndRemoveAgent(t *testing.T) {
+	root := t.TempDir()
+	ctx := &AgentContext{
+		AgentID:     "tiverton",
+		AgentsMD:    []byte("# Tiverton"),
+		ClawdapusMD: []byte("# Contract"),
+		Metadata:    map[string]any{"token": "tiverton:secret", "pod": "ops"},
+	}
+	if err := Create(root, ctx); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(root, "tiverton")
+	if err != nil {
+		t.Fatalf("expected the created agent to load: %v", err)
+	}
+	if string(loaded.AgentsMD) != "# Tiverton" || loaded.MetadataToken() != "tiverton:secret" {
+		t.Errorf("unexpected loaded context %+v", loaded)
+	}
+	info, err := os.Stat(filepath.Join(root, "tiverton", "metadata.json"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected metadata.json written 0600, got %v %v", info, err)
+	}
+
+	if err := Create(root, ctx); !errors.Is(err, ErrAgentExists) {
+		t.Errorf("expected ErrAgentExists on a second create, got %v", err)
+	}
+	if err := Create(root, &AgentContext{AgentID: "../escape"}); !errors.Is(err, ErrUnsafeAgentID) {
+		t.Errorf("expected ErrUnsafeAgentID, got %v", err)
+	}
+
+	if err := Remove(root, "tiverton"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tiverton")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the agent directory gone, got %v", err)
+	}
+	if err := Remove(root, "tiverton"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist removing a missing agent, got %v", err)
+	}
+	if err := Remove(root, ".."); !errors.Is(err, ErrUnsafeAgentID) {
+		t.Errorf("expected ErrUnsafeAgentID, got %v", err)
+	}
+}
+
+func TestListAgentsWithErrorsReportsMalformedMetadata(t *testing.T) {
+	dir := t.TempDir()
+	write := func(agent, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, agent), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if content == "" {
+			return
+		}
+		if err := os.WriteFile(filepath.Join(dir, agent, "metadata.json"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("tiverton", `{"pod":"ops","service":"tiverton"}`)
+	write("westin", `{"pod":`)
+	write("allen", "")
+
+	agents, loadErrs, err := ListAgentsWithErrors(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(agents) != 1 || agents[0].AgentID != "tiverton" {
+		t.Fatalf("expected only tiverton listed, got %+v", agents)
+	}
+	if len(loadErrs) != 2 {
+		t.Fatalf("expected 2 load errors, got %v", loadErrs)
+	}
+	if loadErrs[0].AgentID != "allen" || !errors.Is(loadErrs[0], os.ErrNotExist) {
+		t.Errorf("expected missing metadata for allen, got %v", loadErrs[0])
+	}
+	if loadErrs[1].AgentID != "westin" || !strings.Contains(loadErrs[1].Error(), "bad JSON in westin/metadata.json") {
+		t.Errorf("expected bad JSON for westin, got %v", loadErrs[1])
+	}
+
+	legacy, err := ListAgents(dir)
+	if err != nil || len(legacy) != 1 {
+		t.Errorf("expected ListAgents to keep skipping bad agents, got %+v err=%v", legacy, err)
+	}
+}
+
+func TestLoadReadsYAMLMetadata(t *testing.T) {
+	dir := t.TempDir()
+	agentDir := filepath.Join(dir, "westin")
+	if err := os.MkdirAll(agentDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"AGENTS.md":     "# Contract",
+		"CLAWDAPUS.md":  "# Infra",
+		"metadata.yaml": "token: westin:secret\npod: ops\nservice: westin\ntype: openclaw\n",
+	} {
+		if err := os.WriteFile(filepath.Join(agentDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := Load(dir, "westin")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctx.MetadataToken() != "westin:secret" {
+		t.Errorf("wrong token: %q", ctx.MetadataToken())
+	}
+	if ctx.MetadataString("pod") != "ops" {
+		t.Errorf("wrong pod: %v", ctx.Metadata)
+	}
+
+	agents, err := ListAgents(dir)
+	if err != nil || len(agents) != 1 || agents[0].Type != "openclaw" {
+		t.Fatalf("expected YAML agent listed, got %+v err=%v", agents, err)
+	}
+}
+
+func TestLoadPrefersJSONOverYAML(t *testing.T) {
+	dir := t.TempDir()
+	agentDir := filepath.Join(dir, "tiverton")
+	if err := os.MkdirAll(agentDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"AGENTS.md":     "# Contract",
+		"CLAWDAPUS.md":  "# Infra",
+		"metadata.json": `{"token":"from-json"}`,
+		"metadata.yml":  "token: from-yaml\n",
+	} {
+		if err := os.WriteFile(filepath.Join(agentDir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, err := Load(dir, "tiverton")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ctx.MetadataToken() != "from-json" {
+		t.Errorf("expected metadata.json to win, got %q", ctx.MetadataToken())
+	}
+}
+
+func TestMetadataStrings(t *testing.T) {
+	yamlMeta, err := parseYAML([]byte("allowed_providers:\n  - ollama\n  - vllm\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, meta := range map[string]map[string]any{
+		"json array": {"allowed_providers": []any{"ollama", " vllm ", 3}},
+		"yaml list":  yamlMeta,
+		"csv string": {"allowed_providers": "ollama, vllm,"},
+	} {
+		got := (&AgentContext{Metadata: meta}).MetadataStrings("allowed_providers")
+		if strings.Join(got, ",") != "ollama,vllm" {
+			t.Errorf("%s: expected [ollama vllm], got %q", name, got)
+		}
+	}
+	if got := (&AgentContext{Metadata: map[string]any{}}).MetadataStrings("allowed_providers"); got != nil {
+		t.Errorf("expected nil for absent key, got %q", got)
+	}
+}
+
+func TestMetadataInt(t *testing.T) {
+	a := &AgentContext{Metadata: map[string]any{
+		"json":     float64(40),
+		"string":   " 12 ",
+		"fraction": 1.5,
+		"word":     "many",
+	}}
+	for key, want := range map[string]int{"json": 40, "string": 12} {
+		if n, ok := a.MetadataInt(key); !ok || n != want {
+			t.Errorf("%s: expected %d, got %d (ok=%v)", key, want, n, ok)
+		}
+	}
+	for _, key := range []string{"fraction", "word", "absent"} {
+		if _, ok := a.MetadataInt(key); ok {
+			t.Errorf("%s: expected not ok", key)
+		}
+	}
+}
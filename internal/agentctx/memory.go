@@ -0,0 +1,66 @@
+package agentctx
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// MemoryStore holds agent contexts in memory for programs that embed the
+// proxy without a context directory on disk. Its Load method satisfies the
+// proxy's context loader signature. It is safe for concurrent use.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	agents map[string]*AgentContext
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{agents: make(map[string]*AgentContext)}
+}
+
+// Add registers ctx under ctx.AgentID, replacing any existing entry.
+func (s *MemoryStore) Add(ctx *AgentContext) error {
+	if ctx == nil || ctx.AgentID == "" {
+		return fmt.Errorf("agent context requires an AgentID")
+	}
+	cp := *ctx
+	s.mu.Lock()
+	s.agents[cp.AgentID] = &cp
+	s.mu.Unlock()
+	return nil
+}
+
+// Remove drops an agent; it reports whether the agent was registered.
+func (s *MemoryStore) Remove(agentID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.agents[agentID]; !ok {
+		return false
+	}
+	delete(s.agents, agentID)
+	return true
+}
+
+// Load returns a copy of the registered context for agentID.
+func (s *MemoryStore) Load(agentID string) (*AgentContext, error) {
+	s.mu.RLock()
+	ctx, ok := s.agents[agentID]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("load agent context %q: not registered", agentID)
+	}
+	cp := *ctx
+	return &cp, nil
+}
+
+// IDs returns the registered agent IDs, sorted.
+func (s *MemoryStore) IDs() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]string, 0, len(s.agents))
+	for id := range s.agents {
+		out = append(out, id)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,34 @@
+package agentctx
+
+import "testing"
+
+func TestMemoryStoreAddLoadRemove(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.Add(&AgentContext{AgentID: "tiverton", Metadata: map[string]any{"token": "tiverton:secret"}}); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := s.Add(&AgentContext{}); err == nil {
+		t.Error("expected error adding context without AgentID")
+	}
+
+	ctx, err := s.Load("tiverton")
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if ctx.MetadataToken() != "tiverton:secret" {
+		t.Errorf("wrong token: %q", ctx.MetadataToken())
+	}
+	if _, err := s.Load("ghost"); err == nil {
+		t.Error("expected error for unregistered agent")
+	}
+	if ids := s.IDs(); len(ids) != 1 || ids[0] != "tiverton" {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+
+	if !s.Remove("tiverton") {
+		t.Error("expected Remove to report a registered agent")
+	}
+	if _, err := s.Load("tiverton"); err == nil {
+		t.Error("expected removed agent to be gone")
+	}
+}
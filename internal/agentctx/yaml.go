@@ -0,0 +1,256 @@
+package agentctx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML decodes the small YAML subset used for agent metadata: block
+// mappings, block sequences, comments, and plain or quoted scalars. Scalars
+// decode to the same types encoding/json produces (string, float64, bool,
+// nil) so callers can treat JSON and YAML metadata identically. Flow
+// collections, anchors, and multi-line strings are not supported.
+func parseYAML(data []byte) (map[string]any, error) {
+	lines, err := yamlLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	if lines[0].indent != 0 {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[0].num)
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("top-level value must be a mapping")
+	}
+	return m, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func yamlLines(src string) ([]yamlLine, error) {
+	var out []yamlLine
+	for i, raw := range strings.Split(src, "\n") {
+		raw = strings.TrimRight(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		text = strings.TrimSpace(stripYAMLComment(text))
+		if text == "" || text == "---" {
+			continue
+		}
+		out = append(out, yamlLine{num: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text})
+	}
+	return out, nil
+}
+
+// stripYAMLComment removes a trailing "# comment" that is not inside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) block(indent int) (any, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	out := make(map[string]any)
+	for p.pos < len(p.lines) {
+		ln := p.lines[p.pos]
+		if ln.indent < indent {
+			break
+		}
+		if ln.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", ln.num)
+		}
+		key, rest, ok := splitYAMLKey(ln.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", ln.num)
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", ln.num, key)
+		}
+		p.pos++
+		if rest != "" {
+			v, err := yamlScalar(rest)
+			if err != nil {
+				// Name the key but never echo the value: it may be the token.
+				return nil, fmt.Errorf("line %d: %s: %w", ln.num, key, err)
+			}
+			out[key] = v
+			continue
+		}
+		out[key] = nil
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			if next.indent > indent || (next.indent == indent && isSeqItem(next.text)) {
+				v, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				out[key] = v
+			}
+		}
+	}
+	return out, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	out := []any{}
+	for p.pos < len(p.lines) {
+		ln := p.lines[p.pos]
+		if ln.indent != indent || !isSeqItem(ln.text) {
+			if ln.indent > indent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", ln.num)
+			}
+			break
+		}
+		item := strings.TrimSpace(strings.TrimPrefix(ln.text, "-"))
+		if item == "" {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.block(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			} else {
+				out = append(out, nil)
+			}
+			continue
+		}
+		if _, _, isMap := splitYAMLKey(item); isMap {
+			// "- key: value" opens a mapping whose keys align with "key".
+			p.lines[p.pos] = yamlLine{num: ln.num, indent: indent + len(ln.text) - len(item), text: item}
+			v, err := p.mapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			continue
+		}
+		v, err := yamlScalar(item)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", ln.num, err)
+		}
+		out = append(out, v)
+		p.pos++
+	}
+	return out, nil
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" (or "key:") on the first unquoted colon
+// that is followed by a space or end of line.
+func splitYAMLKey(text string) (key, rest string, ok bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		after := text[end+2:]
+		if !strings.HasPrefix(after, ":") {
+			return "", "", false
+		}
+		k, err := yamlScalar(text[:end+2])
+		if err != nil {
+			return "", "", false
+		}
+		ks, _ := k.(string)
+		return ks, strings.TrimSpace(after[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			key = strings.TrimSpace(text[:i])
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+func yamlScalar(s string) (any, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double-quoted string")
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("invalid single-quoted string")
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "[]":
+		return []any{}, nil
+	case s == "{}":
+		return map[string]any{}, nil
+	case strings.HasPrefix(s, "[") || strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("flow collections are not supported")
+	}
+	switch strings.ToLower(s) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null", "~":
+		return nil, nil
+	}
+	if looksNumeric(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+	return s, nil
+}
+
+// looksNumeric rejects forms ParseFloat accepts but YAML treats as strings
+// (hex, "inf", "nan", underscores).
+func looksNumeric(s string) bool {
+	t := strings.TrimLeft(s, "+-")
+	if t == "" || !(t[0] >= '0' && t[0] <= '9' || t[0] == '.') {
+		return false
+	}
+	return !strings.ContainsAny(t, "xXpP_")
+}
@@ -0,0 +1,66 @@
+package agentctx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAMLSubset(t *testing.T) {
+	src := `---
+# generated by claw up
+token: "tiverton:abc123"   # quoted
+pod: trading-desk
+service: tiverton
+replicas: 2
+enabled: true
+note: 'it''s fine'
+empty:
+tags:
+  - alpha
+  - beta
+limits:
+  daily_usd: 5.5
+  models:
+    - name: gpt-4o
+      max: 10
+    - name: o3
+`
+	got, err := parseYAML([]byte(src))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	want := map[string]any{
+		"token":    "tiverton:abc123",
+		"pod":      "trading-desk",
+		"service":  "tiverton",
+		"replicas": 2.0,
+		"enabled":  true,
+		"note":     "it's fine",
+		"empty":    nil,
+		"tags":     []any{"alpha", "beta"},
+		"limits": map[string]any{
+			"daily_usd": 5.5,
+			"models": []any{
+				map[string]any{"name": "gpt-4o", "max": 10.0},
+				map[string]any{"name": "o3"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected result:\n got: %#v\nwant: %#v", got, want)
+	}
+}
+
+func TestParseYAMLRejectsMalformed(t *testing.T) {
+	for _, src := range []string{
+		"token: a\n  stray: b\n",
+		"- just\n- a list\n",
+		"no colon here\n",
+		"tags: [a, b]\n",
+		"a: 1\na: 2\n",
+	} {
+		if _, err := parseYAML([]byte(src)); err == nil {
+			t.Errorf("expected error for %q", src)
+		}
+	}
+}
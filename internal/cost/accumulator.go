@@ -1,50 +1,255 @@
 package cost
 
 import (
+	"fmt"
 	"sort"
 	"sync"
+	"time"
 )
 
-// CostEntry is one (agent, provider, model) cost bucket.
+// WindowWidth is the granularity of the time-bucketed accounting behind Since.
+const WindowWidth = time.Minute
+
+// WindowRetention is how far back Since can look; older windows are pruned.
+const WindowRetention = 24 * time.Hour
+
+// Tags are chosen by agents, so the distinct tag keys, and values per key,
+// that get their own buckets are capped. Anything past the caps is recorded
+// under TagOverflow: the value for a known key, both key and value for a
+// key past MaxTagKeys.
+const (
+	MaxTagKeys   = 32
+	MaxTagValues = 100
+	TagOverflow  = "_other"
+)
+
+// Sessions are chosen by agents too, so each agent gets its own buckets for
+// at most MaxSessions distinct sessions; later ones are recorded under
+// SessionOverflow.
+const (
+	MaxSessions     = 1000
+	SessionOverflow = "_other"
+)
+
+// CostEntry is one (agent, provider, model) cost bucket. Session is set only
+// on entries returned by the session views, and TagKey and TagValue only on
+// those returned by ByTag.
 type CostEntry struct {
 	AgentID           string
+	Session           string
+	TagKey            string
+	TagValue          string
 	Provider          string
 	Model             string
 	TotalInputTokens  int
 	TotalOutputTokens int
 	TotalCostUSD      float64
 	RequestCount      int
+	RequestBytes      int64 // request bodies sent upstream; lifetime and Since views only
+	ResponseBytes     int64 // response bodies relayed to agents; lifetime and Since views only
+	ToolCallCount     int   // tool calls in responses; lifetime and Since views only
+	ToolTokens        int   // estimated tokens of tool definitions and calls, already in the token totals
+	FirstSeen         time.Time
+	LastSeen          time.Time
 }
 
 type bucketKey struct {
 	AgentID  string
+	Session  string
+	TagKey   string
+	TagValue string
 	Provider string
 	Model    string
+	Window   int64 // unix start of the time window or month; zero for lifetime buckets
 }
 
 // Accumulator aggregates per-request cost data in memory. Thread-safe.
 type Accumulator struct {
-	mu      sync.RWMutex
-	buckets map[bucketKey]*CostEntry
+	mu        sync.RWMutex
+	buckets   map[bucketKey]*CostEntry
+	sessions  map[bucketKey]*CostEntry
+	windows   map[bucketKey]*CostEntry
+	months    map[bucketKey]*CostEntry // per provider/model, current UTC month only
+	agentMTD  map[bucketKey]*CostEntry // per agent, current UTC month only
+	tags      map[bucketKey]*CostEntry // per tag key=value, provider and model, across agents
+	lastPrune time.Time
+	version   uint64    // bumped on every change, for cheap polling
+	modified  time.Time // time of the last change
+	now       func() time.Time
+
+	tagVals  map[string]map[string]bool // distinct values seen per tag key, for the caps
+	sessVals map[string]map[string]bool // distinct sessions seen per agent, for the cap
 }
 
 func NewAccumulator() *Accumulator {
-	return &Accumulator{buckets: make(map[bucketKey]*CostEntry)}
+	return &Accumulator{
+		buckets:  make(map[bucketKey]*CostEntry),
+		sessions: make(map[bucketKey]*CostEntry),
+		windows:  make(map[bucketKey]*CostEntry),
+		months:   make(map[bucketKey]*CostEntry),
+		agentMTD: make(map[bucketKey]*CostEntry),
+		tags:     make(map[bucketKey]*CostEntry),
+		tagVals:  make(map[string]map[string]bool),
+		sessVals: make(map[string]map[string]bool),
+		now:      time.Now,
+	}
+}
+
+// Reset discards everything recorded so far, including session, window and
+// month-to-date history, so budgets and caps start again from zero.
+func (a *Accumulator) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buckets = make(map[bucketKey]*CostEntry)
+	a.sessions = make(map[bucketKey]*CostEntry)
+	a.windows = make(map[bucketKey]*CostEntry)
+	a.months = make(map[bucketKey]*CostEntry)
+	a.agentMTD = make(map[bucketKey]*CostEntry)
+	a.tags = make(map[bucketKey]*CostEntry)
+	a.tagVals = make(map[string]map[string]bool)
+	a.sessVals = make(map[string]map[string]bool)
+	a.version++
+	a.modified = a.now()
 }
 
 func (a *Accumulator) Record(agentID, provider, model string, inputTokens, outputTokens int, costUSD float64) {
-	key := bucketKey{AgentID: agentID, Provider: provider, Model: model}
+	a.RecordSession(agentID, "", provider, model, inputTokens, outputTokens, costUSD)
+}
+
+// RecordSession records a request like Record and, when session is non-empty,
+// also attributes it to that (agent, session) pair for per-conversation views.
+func (a *Accumulator) RecordSession(agentID, session, provider, model string, inputTokens, outputTokens int, costUSD float64) {
+	a.record(agentID, session, nil, provider, model, inputTokens, outputTokens, costUSD, 1)
+}
+
+// RecordTagged records a request like RecordSession and also attributes it
+// to each key=value pair in tags, for the ByTag views. No tags is the same
+// as RecordSession.
+func (a *Accumulator) RecordTagged(agentID, session string, tags map[string]string, provider, model string, inputTokens, outputTokens int, costUSD float64) {
+	a.record(agentID, session, tags, provider, model, inputTokens, outputTokens, costUSD, 1)
+}
+
+// RecordPartial adds tokens and cost from a request that is still running,
+// such as a long stream, without counting a request. The caller completes
+// it with RecordSession for the remainder, so the request is counted once
+// and the totals match a single RecordSession of the final figures.
+func (a *Accumulator) RecordPartial(agentID, session, provider, model string, inputTokens, outputTokens int, costUSD float64) {
+	a.record(agentID, session, nil, provider, model, inputTokens, outputTokens, costUSD, 0)
+}
+
+// RecordPartialTagged is RecordPartial for a request completed with
+// RecordTagged.
+func (a *Accumulator) RecordPartialTagged(agentID, session string, tags map[string]string, provider, model string, inputTokens, outputTokens int, costUSD float64) {
+	a.record(agentID, session, tags, provider, model, inputTokens, outputTokens, costUSD, 0)
+}
+
+func (a *Accumulator) record(agentID, session string, tags map[string]string, provider, model string, inputTokens, outputTokens int, costUSD float64, requests int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	a.version++
+	a.modified = now
+	addTo(a.buckets, bucketKey{AgentID: agentID, Provider: provider, Model: model},
+		inputTokens, outputTokens, costUSD, requests, now)
+	if session != "" {
+		addTo(a.sessions, bucketKey{AgentID: agentID, Session: a.sessionSlot(agentID, session), Provider: provider, Model: model},
+			inputTokens, outputTokens, costUSD, requests, now)
+	}
+	for k, v := range tags {
+		k, v = a.tagSlot(k, v)
+		addTo(a.tags, bucketKey{TagKey: k, TagValue: v, Provider: provider, Model: model},
+			inputTokens, outputTokens, costUSD, requests, now)
+	}
+
+	window := now.Truncate(WindowWidth).Unix()
+	addTo(a.windows, bucketKey{AgentID: agentID, Provider: provider, Model: model, Window: window},
+		inputTokens, outputTokens, costUSD, requests, now)
+	month := monthStart(now)
+	addTo(a.months, bucketKey{Provider: provider, Model: model, Window: month},
+		inputTokens, outputTokens, costUSD, requests, now)
+	addTo(a.agentMTD, bucketKey{AgentID: agentID, Window: month},
+		inputTokens, outputTokens, costUSD, requests, now)
+	if now.Sub(a.lastPrune) >= WindowWidth {
+		cutoff := now.Add(-WindowRetention).Truncate(WindowWidth).Unix()
+		for k := range a.windows {
+			if k.Window < cutoff {
+				delete(a.windows, k)
+			}
+		}
+		for k := range a.months {
+			if k.Window < month {
+				delete(a.months, k)
+			}
+		}
+		for k := range a.agentMTD {
+			if k.Window < month {
+				delete(a.agentMTD, k)
+			}
+		}
+		a.lastPrune = now
+	}
+}
+
+// RecordBytes adds the body sizes of one proxied request, as sent upstream
+// and as relayed back, to the agent's (provider, model) totals. It counts
+// no request: that is left to the Record calls, which need usage to price
+// it, while bytes are known for every response.
+func (a *Accumulator) RecordBytes(agentID, provider, model string, requestBytes, responseBytes int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	a.version++
+	a.modified = now
+	for _, e := range a.entriesFor(agentID, provider, model, now) {
+		e.RequestBytes += requestBytes
+		e.ResponseBytes += responseBytes
+	}
+}
+
+// RecordTools adds the tool calls of one request, and the estimated tokens
+// spent on tool definitions and calls, to the agent's (provider, model)
+// totals. The tokens are a breakdown of those already recorded, not extra
+// spend. Like RecordBytes, it counts no request.
+func (a *Accumulator) RecordTools(agentID, provider, model string, calls, tokens int) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
-	e, ok := a.buckets[key]
+	now := a.now()
+	a.version++
+	a.modified = now
+	for _, e := range a.entriesFor(agentID, provider, model, now) {
+		e.ToolCallCount += calls
+		e.ToolTokens += tokens
+	}
+}
+
+// entriesFor returns the lifetime and current-window buckets for (agent,
+// provider, model), creating them if needed. Callers hold a.mu.
+func (a *Accumulator) entriesFor(agentID, provider, model string, at time.Time) []*CostEntry {
+	key := bucketKey{AgentID: agentID, Provider: provider, Model: model}
+	addTo(a.buckets, key, 0, 0, 0, 0, at)
+	lifetime := a.buckets[key]
+	key.Window = at.Truncate(WindowWidth).Unix()
+	addTo(a.windows, key, 0, 0, 0, 0, at)
+	return []*CostEntry{lifetime, a.windows[key]}
+}
+
+func monthStart(t time.Time) int64 {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC).Unix()
+}
+
+func addTo(buckets map[bucketKey]*CostEntry, key bucketKey, inputTokens, outputTokens int, costUSD float64, requests int, at time.Time) {
+	e, ok := buckets[key]
 	if !ok {
-		e = &CostEntry{AgentID: agentID, Provider: provider, Model: model}
-		a.buckets[key] = e
+		e = &CostEntry{AgentID: key.AgentID, Session: key.Session, TagKey: key.TagKey, TagValue: key.TagValue,
+			Provider: key.Provider, Model: key.Model, FirstSeen: at}
+		buckets[key] = e
 	}
 	e.TotalInputTokens += inputTokens
 	e.TotalOutputTokens += outputTokens
 	e.TotalCostUSD += costUSD
-	e.RequestCount++
+	e.RequestCount += requests
+	e.LastSeen = at
 }
 
 // ByAgent returns all cost entries for a given agent, sorted by model.
@@ -67,8 +272,12 @@ func (a *Accumulator) ByAgent(agentID string) []CostEntry {
 func (a *Accumulator) All() map[string][]CostEntry {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
+	return groupByAgent(a.buckets)
+}
+
+func groupByAgent(buckets map[bucketKey]*CostEntry) map[string][]CostEntry {
 	grouped := make(map[string][]CostEntry)
-	for _, e := range a.buckets {
+	for _, e := range buckets {
 		grouped[e.AgentID] = append(grouped[e.AgentID], *e)
 	}
 	for k := range grouped {
@@ -79,6 +288,295 @@ func (a *Accumulator) All() map[string][]CostEntry {
 	return grouped
 }
 
+// Sessions returns session-attributed cost entries grouped by agent, sorted
+// by session then model. Requests recorded without a session are omitted.
+func (a *Accumulator) Sessions() map[string][]CostEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	grouped := make(map[string][]CostEntry)
+	for _, e := range a.sessions {
+		grouped[e.AgentID] = append(grouped[e.AgentID], *e)
+	}
+	for k := range grouped {
+		sort.Slice(grouped[k], func(i, j int) bool {
+			x, y := grouped[k][i], grouped[k][j]
+			if x.Session != y.Session {
+				return x.Session < y.Session
+			}
+			return x.Provider+"/"+x.Model < y.Provider+"/"+y.Model
+		})
+	}
+	return grouped
+}
+
+// ByTag returns the cost of requests tagged with key, across all agents,
+// grouped by the tag's value and sorted by model. Untagged requests, and
+// those without key, are omitted.
+func (a *Accumulator) ByTag(key string) map[string][]CostEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	grouped := make(map[string][]CostEntry)
+	for k, e := range a.tags {
+		if k.TagKey == key {
+			grouped[k.TagValue] = append(grouped[k.TagValue], *e)
+		}
+	}
+	for v := range grouped {
+		sort.Slice(grouped[v], func(i, j int) bool {
+			return grouped[v][i].Provider+"/"+grouped[v][i].Model < grouped[v][j].Provider+"/"+grouped[v][j].Model
+		})
+	}
+	return grouped
+}
+
+// Since returns cost recorded from t up to until, grouped by agent like All.
+// Accounting is bucketed by WindowWidth, so only whole windows are counted:
+// a t inside a window is rounded up to that window's end, so nothing
+// recorded before t is included, and until is the start of the window still
+// open, which is left for later. Passing until back as the next t covers
+// every window exactly once. It errors when t predates the retained history.
+func (a *Accumulator) Since(t time.Time) (grouped map[string][]CostEntry, until time.Time, err error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	now := a.now()
+	if t.Before(now.Add(-WindowRetention)) {
+		return nil, time.Time{}, fmt.Errorf("since %s is older than the retained %s of history", t.Format(time.RFC3339), WindowRetention)
+	}
+	start := t.Truncate(WindowWidth)
+	if start.Before(t) {
+		start = start.Add(WindowWidth)
+	}
+	until = now.Truncate(WindowWidth)
+	from, to := start.Unix(), until.Unix()
+	merged := make(map[bucketKey]*CostEntry)
+	for k, e := range a.windows {
+		if k.Window < from || k.Window >= to {
+			continue
+		}
+		k.Window = 0
+		m, ok := merged[k]
+		if !ok {
+			m = &CostEntry{AgentID: e.AgentID, Provider: e.Provider, Model: e.Model, FirstSeen: e.FirstSeen}
+			merged[k] = m
+		}
+		m.TotalInputTokens += e.TotalInputTokens
+		m.TotalOutputTokens += e.TotalOutputTokens
+		m.TotalCostUSD += e.TotalCostUSD
+		m.RequestCount += e.RequestCount
+		m.RequestBytes += e.RequestBytes
+		m.ResponseBytes += e.ResponseBytes
+		m.ToolCallCount += e.ToolCallCount
+		m.ToolTokens += e.ToolTokens
+		if e.FirstSeen.Before(m.FirstSeen) {
+			m.FirstSeen = e.FirstSeen
+		}
+		if e.LastSeen.After(m.LastSeen) {
+			m.LastSeen = e.LastSeen
+		}
+	}
+	return groupByAgent(merged), until, nil
+}
+
+// MonthToDate returns the spend on a provider's model across all agents in
+// the current UTC calendar month. model matches exactly or as a version
+// prefix, as in Pricing.Lookup, so "claude-opus-4" includes dated releases.
+func (a *Accumulator) MonthToDate(provider, model string) float64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	month := monthStart(a.now())
+	var total float64
+	for k, e := range a.months {
+		if k.Window != month || k.Provider != provider {
+			continue
+		}
+		if k.Model == model || isVersionPrefix(model, k.Model) {
+			total += e.TotalCostUSD
+		}
+	}
+	return total
+}
+
+// AgentMonthToDate returns agentID's spend in the current UTC month.
+func (a *Accumulator) AgentMonthToDate(agentID string) float64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if e, ok := a.agentMTD[bucketKey{AgentID: agentID, Window: monthStart(a.now())}]; ok {
+		return e.TotalCostUSD
+	}
+	return 0
+}
+
+// AgentTotal aggregates everything recorded for agentID across providers
+// and models: spend in USD, request count, and input plus output tokens.
+func (a *Accumulator) AgentTotal(agentID string) (cost float64, requests int, tokens int) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, e := range a.buckets {
+		if e.AgentID != agentID {
+			continue
+		}
+		cost += e.TotalCostUSD
+		requests += e.RequestCount
+		tokens += e.TotalInputTokens + e.TotalOutputTokens
+	}
+	return cost, requests, tokens
+}
+
+// Totals aggregates everything recorded, across agents, providers and
+// models, into a single entry with no agent, provider or model set.
+func (a *Accumulator) Totals() CostEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var t CostEntry
+	for _, e := range a.buckets {
+		t.TotalInputTokens += e.TotalInputTokens
+		t.TotalOutputTokens += e.TotalOutputTokens
+		t.TotalCostUSD += e.TotalCostUSD
+		t.RequestCount += e.RequestCount
+		t.RequestBytes += e.RequestBytes
+		t.ResponseBytes += e.ResponseBytes
+		t.ToolCallCount += e.ToolCallCount
+		t.ToolTokens += e.ToolTokens
+		if t.FirstSeen.IsZero() || e.FirstSeen.Before(t.FirstSeen) {
+			t.FirstSeen = e.FirstSeen
+		}
+		if e.LastSeen.After(t.LastSeen) {
+			t.LastSeen = e.LastSeen
+		}
+	}
+	return t
+}
+
+// Version returns a counter that changes whenever anything is recorded or
+// the accumulator is reset, and the time of that change (zero if nothing
+// has changed yet). Pollers can compare versions instead of totals.
+func (a *Accumulator) Version() (uint64, time.Time) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.version, a.modified
+}
+
+// Snapshot returns a copy of the lifetime, session and tag buckets, for
+// persisting the accumulator to a store of the caller's choosing. Session
+// entries have Session set and tag entries TagKey; the rest are the
+// per-agent lifetime totals. Time-windowed history is not included.
+func (a *Accumulator) Snapshot() []CostEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	out := make([]CostEntry, 0, len(a.buckets)+len(a.sessions)+len(a.tags))
+	for _, m := range []map[bucketKey]*CostEntry{a.buckets, a.sessions, a.tags} {
+		for _, e := range m {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		x, y := out[i], out[j]
+		if x.AgentID != y.AgentID {
+			return x.AgentID < y.AgentID
+		}
+		if x.Session != y.Session {
+			return x.Session < y.Session
+		}
+		if x.TagKey+"="+x.TagValue != y.TagKey+"="+y.TagValue {
+			return x.TagKey+"="+x.TagValue < y.TagKey+"="+y.TagValue
+		}
+		return x.Provider+"/"+x.Model < y.Provider+"/"+y.Model
+	})
+	return out
+}
+
+// Restore merges entries from Snapshot into a, adding to anything already
+// recorded. Lifetime entries first seen in the current UTC month also count
+// toward month-to-date caps and budgets, since all of their spend falls in
+// it; older history only restores the lifetime totals.
+func (a *Accumulator) Restore(entries []CostEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	month := monthStart(a.now())
+	for _, e := range entries {
+		switch {
+		case e.Session != "":
+			merge(a.sessions, bucketKey{AgentID: e.AgentID, Session: a.sessionSlot(e.AgentID, e.Session), Provider: e.Provider, Model: e.Model}, e)
+		case e.TagKey != "":
+			k, v := a.tagSlot(e.TagKey, e.TagValue)
+			merge(a.tags, bucketKey{TagKey: k, TagValue: v, Provider: e.Provider, Model: e.Model}, e)
+		default:
+			merge(a.buckets, bucketKey{AgentID: e.AgentID, Provider: e.Provider, Model: e.Model}, e)
+			if !e.FirstSeen.IsZero() && monthStart(e.FirstSeen) == month {
+				merge(a.months, bucketKey{Provider: e.Provider, Model: e.Model, Window: month}, e)
+				merge(a.agentMTD, bucketKey{AgentID: e.AgentID, Window: month}, e)
+			}
+		}
+	}
+	a.version++
+	a.modified = a.now()
+}
+
+// tagSlot returns the key and value a tag is recorded under: itself within
+// MaxTagKeys and MaxTagValues, else TagOverflow. Callers must hold a.mu.
+func (a *Accumulator) tagSlot(k, v string) (string, string) {
+	if k == TagOverflow {
+		return k, v
+	}
+	vals, ok := a.tagVals[k]
+	if !ok {
+		if len(a.tagVals) >= MaxTagKeys {
+			return TagOverflow, TagOverflow
+		}
+		vals = make(map[string]bool)
+		a.tagVals[k] = vals
+	}
+	if !vals[v] {
+		if len(vals) >= MaxTagValues {
+			return k, TagOverflow
+		}
+		vals[v] = true
+	}
+	return k, v
+}
+
+// sessionSlot returns the session a request is recorded under: itself for
+// the first MaxSessions of agentID's sessions, else SessionOverflow. Callers
+// must hold a.mu.
+func (a *Accumulator) sessionSlot(agentID, session string) string {
+	seen, ok := a.sessVals[agentID]
+	if !ok {
+		seen = make(map[string]bool)
+		a.sessVals[agentID] = seen
+	}
+	if !seen[session] {
+		if session == SessionOverflow || len(seen) >= MaxSessions {
+			return SessionOverflow
+		}
+		seen[session] = true
+	}
+	return session
+}
+
+// merge folds e into the bucket at key, widening its first and last seen.
+func merge(buckets map[bucketKey]*CostEntry, key bucketKey, e CostEntry) {
+	b, ok := buckets[key]
+	if !ok {
+		b = &CostEntry{AgentID: key.AgentID, Session: key.Session, TagKey: key.TagKey, TagValue: key.TagValue,
+			Provider: key.Provider, Model: key.Model, FirstSeen: e.FirstSeen, LastSeen: e.LastSeen}
+		buckets[key] = b
+	}
+	b.TotalInputTokens += e.TotalInputTokens
+	b.TotalOutputTokens += e.TotalOutputTokens
+	b.TotalCostUSD += e.TotalCostUSD
+	b.RequestCount += e.RequestCount
+	b.RequestBytes += e.RequestBytes
+	b.ResponseBytes += e.ResponseBytes
+	b.ToolCallCount += e.ToolCallCount
+	b.ToolTokens += e.ToolTokens
+	if e.FirstSeen.Before(b.FirstSeen) {
+		b.FirstSeen = e.FirstSeen
+	}
+	if e.LastSeen.After(b.LastSeen) {
+		b.LastSeen = e.LastSeen
+	}
+}
+
 // TotalCost returns the sum of all recorded costs across all agents.
 func (a *Accumulator) TotalCost() float64 {
 	a.mu.RLock()
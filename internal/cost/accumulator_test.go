@@ -1,6 +1,11 @@
 package cost
 
-import "testing"
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
 
 func TestAccumulatorRecordAndQuery(t *testing.T) {
 	a := NewAccumulator()
@@ -46,3 +51,414 @@ func TestAccumulatorTotalCost(t *testing.T) {
 		t.Errorf("expected ~0.003, got %f", total)
 	}
 }
+
+func TestAccumulatorAgentTotal(t *testing.T) {
+	a := NewAccumulator()
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.25)
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 10, 5, 0.25)
+	a.Record("tiverton", "openai", "gpt-4o", 200, 100, 0.50)
+	a.RecordSession("tiverton", "conv-1", "openai", "gpt-4o", 1, 1, 0.25)
+	a.Record("westin", "openai", "gpt-4o", 999, 999, 9.00)
+
+	var wantCost float64
+	var wantRequests, wantTokens int
+	for _, e := range a.ByAgent("tiverton") {
+		wantCost += e.TotalCostUSD
+		wantRequests += e.RequestCount
+		wantTokens += e.TotalInputTokens + e.TotalOutputTokens
+	}
+	cost, requests, tokens := a.AgentTotal("tiverton")
+	if cost != wantCost || requests != wantRequests || tokens != wantTokens {
+		t.Errorf("expected %f/%d/%d from entries, got %f/%d/%d", wantCost, wantRequests, wantTokens, cost, requests, tokens)
+	}
+	if cost != 1.25 || requests != 4 || tokens != 467 {
+		t.Errorf("unexpected totals %f/%d/%d", cost, requests, tokens)
+	}
+	if cost, requests, tokens := a.AgentTotal("nobody"); cost != 0 || requests != 0 || tokens != 0 {
+		t.Errorf("expected zero totals for unknown agent, got %f/%d/%d", cost, requests, tokens)
+	}
+}
+
+func TestAccumulatorPartialThenFinalCountsOnce(t *testing.T) {
+	a := NewAccumulator()
+	a.RecordPartial("tiverton", "conv-1", "openai", "gpt-4o", 100, 10, 0.25)
+	if e := a.ByAgent("tiverton"); len(e) != 1 || e[0].RequestCount != 0 || e[0].TotalCostUSD != 0.25 {
+		t.Fatalf("expected in-progress spend without a request, got %+v", e)
+	}
+	a.RecordSession("tiverton", "conv-1", "openai", "gpt-4o", 0, 30, 0.50)
+
+	e := a.ByAgent("tiverton")
+	if len(e) != 1 || e[0].RequestCount != 1 || e[0].TotalInputTokens != 100 || e[0].TotalOutputTokens != 40 || e[0].TotalCostUSD != 0.75 {
+		t.Errorf("expected one request totalling 100/40/$0.75, got %+v", e)
+	}
+	if s := a.Sessions()["tiverton"]; len(s) != 1 || s[0].RequestCount != 1 || s[0].TotalCostUSD != 0.75 {
+		t.Errorf("expected session totals to match, got %+v", s)
+	}
+	if got := a.MonthToDate("openai", "gpt-4o"); got != 0.75 {
+		t.Errorf("expected month-to-date 0.75, got %f", got)
+	}
+}
+
+func TestAccumulatorSessionsSeparated(t *testing.T) {
+	a := NewAccumulator()
+	a.RecordSession("tiverton", "conv-a", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+	a.RecordSession("tiverton", "conv-a", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+	a.RecordSession("tiverton", "conv-b", "anthropic", "claude-sonnet-4", 300, 150, 0.003)
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 10, 5, 0.0001)
+
+	byAgent := a.ByAgent("tiverton")
+	if len(byAgent) != 1 || byAgent[0].RequestCount != 4 {
+		t.Fatalf("expected session requests folded into the agent bucket, got %+v", byAgent)
+	}
+
+	sessions := a.Sessions()["tiverton"]
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 session entries, got %d", len(sessions))
+	}
+	if sessions[0].Session != "conv-a" || sessions[0].RequestCount != 2 || sessions[0].TotalInputTokens != 200 {
+		t.Errorf("unexpected conv-a entry: %+v", sessions[0])
+	}
+	if sessions[1].Session != "conv-b" || sessions[1].RequestCount != 1 || sessions[1].TotalInputTokens != 300 {
+		t.Errorf("unexpected conv-b entry: %+v", sessions[1])
+	}
+}
+
+func TestAccumulatorByTag(t *testing.T) {
+	a := NewAccumulator()
+	a.RecordTagged("tiverton", "", map[string]string{"feature": "search", "experiment": "b"}, "openai", "gpt-4o", 100, 50, 0.01)
+	a.RecordTagged("westin", "", map[string]string{"feature": "search"}, "openai", "gpt-4o", 200, 100, 0.02)
+	a.RecordTagged("westin", "", map[string]string{"feature": "summarize"}, "anthropic", "claude-sonnet-4", 10, 5, 0.001)
+	a.Record("tiverton", "openai", "gpt-4o", 1000, 500, 0.1)
+
+	features := a.ByTag("feature")
+	if len(features) != 2 {
+		t.Fatalf("expected 2 feature values, got %+v", features)
+	}
+	search := features["search"]
+	if len(search) != 1 || search[0].RequestCount != 2 || search[0].TotalInputTokens != 300 || search[0].TagKey != "feature" || search[0].TagValue != "search" {
+		t.Errorf("expected search spend merged across agents, got %+v", search)
+	}
+	if got := a.ByTag("experiment")["b"]; len(got) != 1 || got[0].RequestCount != 1 {
+		t.Errorf("expected one request in experiment b, got %+v", got)
+	}
+	if len(a.ByTag("team")) != 0 {
+		t.Error("expected no groups for an unused tag key")
+	}
+	if cost, requests, _ := a.AgentTotal("tiverton"); requests != 2 || cost != 0.11 {
+		t.Errorf("expected tagged requests in agent totals too, got $%v over %d", cost, requests)
+	}
+}
+
+func TestAccumulatorCapsDistinctTagValues(t *testing.T) {
+	a := NewAccumulator()
+	for i := 0; i < MaxTagValues+50; i++ {
+		a.RecordTagged("tiverton", "", map[string]string{"request": fmt.Sprintf("r%d", i)}, "openai", "gpt-4o", 1, 1, 0.01)
+	}
+	for i := 0; i < MaxTagKeys+5; i++ {
+		a.RecordTagged("tiverton", "", map[string]string{fmt.Sprintf("k%d", i): "v"}, "openai", "gpt-4o", 1, 1, 0.01)
+	}
+
+	byValue := a.ByTag("request")
+	if len(byValue) != MaxTagValues+1 {
+		t.Errorf("expected %d values plus %q, got %d", MaxTagValues, TagOverflow, len(byValue))
+	}
+	if got := byValue[TagOverflow]; len(got) != 1 || got[0].RequestCount != 50 {
+		t.Errorf("expected the 50 extra values folded into %q, got %+v", TagOverflow, got)
+	}
+	// "request" already took one key slot.
+	if got := a.ByTag(TagOverflow)[TagOverflow]; len(got) != 1 || got[0].RequestCount != 6 {
+		t.Errorf("expected the keys past the cap folded into %q, got %+v", TagOverflow, got)
+	}
+}
+
+func TestAccumulatorCapsDistinctSessions(t *testing.T) {
+	a := NewAccumulator()
+	for i := 0; i < MaxSessions+20; i++ {
+		a.RecordSession("tiverton", fmt.Sprintf("s%d", i), "openai", "gpt-4o", 1, 1, 0.01)
+	}
+	a.RecordSession("tiverton", "s0", "openai", "gpt-4o", 1, 1, 0.01)
+	a.RecordSession("westin", "s1", "openai", "gpt-4o", 1, 1, 0.01)
+
+	sessions := a.Sessions()
+	tiv := sessions["tiverton"]
+	if len(tiv) != MaxSessions+1 {
+		t.Fatalf("expected %d sessions plus %q, got %d", MaxSessions, SessionOverflow, len(tiv))
+	}
+	for _, e := range tiv {
+		switch e.Session {
+		case SessionOverflow:
+			if e.RequestCount != 20 {
+				t.Errorf("expected the 20 extra sessions folded into %q, got %d requests", SessionOverflow, e.RequestCount)
+			}
+		case "s0":
+			if e.RequestCount != 2 {
+				t.Errorf("expected a known session to keep its bucket, got %d requests", e.RequestCount)
+			}
+		}
+	}
+	if got := sessions["westin"]; len(got) != 1 || got[0].Session != "s1" {
+		t.Errorf("expected the cap to be per agent, got %+v", got)
+	}
+}
+
+func TestAccumulatorSinceExcludesEarlierWindows(t *testing.T) {
+	a := NewAccumulator()
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return clock }
+
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+	clock = clock.Add(5 * time.Minute)
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 200, 100, 0.002)
+	a.Record("westin", "openai", "gpt-4o", 300, 150, 0.003)
+	clock = clock.Add(time.Minute)
+
+	got, until, err := a.Since(clock.Add(-2 * time.Minute))
+	if err != nil {
+		t.Fatalf("since: %v", err)
+	}
+	if !until.Equal(clock) {
+		t.Errorf("expected until at the open window's start %s, got %s", clock, until)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 agents in delta, got %d", len(got))
+	}
+	tiv := got["tiverton"]
+	if len(tiv) != 1 || tiv[0].RequestCount != 1 || tiv[0].TotalInputTokens != 200 {
+		t.Errorf("expected only the later tiverton request, got %+v", tiv)
+	}
+
+	all, _, err := a.Since(clock.Add(-10 * time.Minute))
+	if err != nil {
+		t.Fatalf("since: %v", err)
+	}
+	if all["tiverton"][0].RequestCount != 2 {
+		t.Errorf("expected both tiverton requests, got %+v", all["tiverton"])
+	}
+
+	if _, _, err := a.Since(clock.Add(-WindowRetention - time.Hour)); err == nil {
+		t.Error("expected error for since beyond retention")
+	}
+}
+
+func TestAccumulatorSinceCursorCountsEachWindowOnce(t *testing.T) {
+	a := NewAccumulator()
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return clock }
+
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001) // 12:00:00, before since
+	clock = clock.Add(30 * time.Second)
+	since := clock
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001) // 12:00:30, same window
+	clock = clock.Add(time.Minute)
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001) // 12:01:30, still open
+
+	var requests int
+	for i := 0; i < 4; i++ {
+		got, until, err := a.Since(since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range got["tiverton"] {
+			requests += e.RequestCount
+		}
+		since = until
+		clock = clock.Add(20 * time.Second) // polling faster than the window
+	}
+	// The 12:00 window held spend from before the first since, so it is
+	// skipped whole; the 12:01 window is counted once it closes, once.
+	if requests != 1 {
+		t.Errorf("expected the 12:01 request counted exactly once, got %d", requests)
+	}
+}
+
+func TestAccumulatorPrunesExpiredWindows(t *testing.T) {
+	a := NewAccumulator()
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return clock }
+
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+	clock = clock.Add(WindowRetention + time.Hour)
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+
+	if len(a.windows) != 1 {
+		t.Errorf("expected expired window pruned, have %d windows", len(a.windows))
+	}
+	if a.ByAgent("tiverton")[0].RequestCount != 2 {
+		t.Error("expected lifetime totals unaffected by pruning")
+	}
+}
+
+func TestAccumulatorTracksFirstAndLastSeen(t *testing.T) {
+	a := NewAccumulator()
+	first := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	clock := first
+	a.now = func() time.Time { return clock }
+
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+	clock = first.Add(90 * time.Second)
+	a.Record("tiverton", "anthropic", "claude-sonnet-4", 100, 50, 0.001)
+
+	e := a.ByAgent("tiverton")[0]
+	if !e.FirstSeen.Equal(first) {
+		t.Errorf("expected FirstSeen=%s, got %s", first, e.FirstSeen)
+	}
+	if !e.LastSeen.Equal(clock) {
+		t.Errorf("expected LastSeen=%s, got %s", clock, e.LastSeen)
+	}
+
+	last := clock
+	clock = clock.Add(time.Minute)
+	delta, _, err := a.Since(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := delta["tiverton"][0]; !d.FirstSeen.Equal(first) || !d.LastSeen.Equal(last) {
+		t.Errorf("expected Since to span both windows, got first=%s last=%s", d.FirstSeen, d.LastSeen)
+	}
+}
+
+func TestAccumulatorMonthToDate(t *testing.T) {
+	acc := NewAccumulator()
+	clock := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	acc.now = func() time.Time { return clock }
+
+	acc.Record("tiverton", "anthropic", "claude-opus-4-20250514", 0, 0, 4.00)
+	acc.Record("westin", "anthropic", "claude-opus-4", 0, 0, 1.50)
+	acc.Record("westin", "anthropic", "claude-opus-40", 0, 0, 9.00)
+	acc.Record("westin", "openai", "claude-opus-4", 0, 0, 9.00)
+
+	if got := acc.MonthToDate("anthropic", "claude-opus-4"); got != 5.50 {
+		t.Fatalf("expected 5.50 month-to-date, got %f", got)
+	}
+
+	clock = clock.Add(2 * time.Hour) // April
+	if got := acc.MonthToDate("anthropic", "claude-opus-4"); got != 0 {
+		t.Fatalf("expected reset at month boundary, got %f", got)
+	}
+	acc.Record("tiverton", "anthropic", "claude-opus-4", 0, 0, 0.25)
+	if got := acc.MonthToDate("anthropic", "claude-opus-4"); got != 0.25 {
+		t.Fatalf("expected only April spend, got %f", got)
+	}
+	if len(acc.months) != 1 {
+		t.Errorf("expected previous month pruned, have %d buckets", len(acc.months))
+	}
+}
+
+func TestAccumulatorAgentMonthToDate(t *testing.T) {
+	acc := NewAccumulator()
+	clock := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	acc.now = func() time.Time { return clock }
+
+	acc.Record("tiverton", "anthropic", "claude-opus-4", 0, 0, 4.00)
+	acc.Record("tiverton", "openai", "gpt-4o", 0, 0, 1.00)
+	acc.Record("westin", "openai", "gpt-4o", 0, 0, 9.00)
+
+	if got := acc.AgentMonthToDate("tiverton"); got != 5.00 {
+		t.Fatalf("expected 5.00 month-to-date for tiverton, got %f", got)
+	}
+
+	clock = clock.Add(2 * time.Hour) // April
+	acc.Record("tiverton", "openai", "gpt-4o", 0, 0, 0.25)
+	if got := acc.AgentMonthToDate("tiverton"); got != 0.25 {
+		t.Fatalf("expected only April spend, got %f", got)
+	}
+	if got := acc.AgentMonthToDate("nobody"); got != 0 {
+		t.Errorf("expected 0 for unknown agent, got %f", got)
+	}
+}
+
+func TestAccumulatorVersion(t *testing.T) {
+	acc := NewAccumulator()
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	acc.now = func() time.Time { return clock }
+
+	if v, modified := acc.Version(); v != 0 || !modified.IsZero() {
+		t.Fatalf("expected zero version for a new accumulator, got %d %s", v, modified)
+	}
+	acc.Record("tiverton", "openai", "gpt-4o", 10, 5, 0.01)
+	v1, modified := acc.Version()
+	if v1 == 0 || !modified.Equal(clock) {
+		t.Fatalf("expected version bump at %s, got %d %s", clock, v1, modified)
+	}
+	acc.All()
+	if v, _ := acc.Version(); v != v1 {
+		t.Errorf("expected reads to leave the version alone, got %d want %d", v, v1)
+	}
+	acc.Reset()
+	if v, _ := acc.Version(); v == v1 {
+		t.Error("expected Reset to change the version")
+	}
+}
+
+func TestAccumulatorSnapshotRestore(t *testing.T) {
+	clock := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	src := NewAccumulator()
+	src.now = func() time.Time { return clock }
+	src.RecordSession("tiverton", "s1", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	src.RecordTagged("tiverton", "", map[string]string{"feature": "search"}, "openai", "gpt-4o", 200, 100, 0.002)
+	src.Record("westin", "openai", "gpt-4o", 300, 150, 0.003)
+
+	snap := src.Snapshot()
+	dst := NewAccumulator()
+	dst.now = func() time.Time { return clock.Add(time.Hour) }
+	dst.Restore(snap)
+
+	if got, want := dst.TotalCost(), src.TotalCost(); math.Abs(got-want) > 1e-12 {
+		t.Errorf("expected total %f after restore, got %f", want, got)
+	}
+	for _, agent := range []string{"tiverton", "westin"} {
+		wc, wr, wt := src.AgentTotal(agent)
+		gc, gr, gt := dst.AgentTotal(agent)
+		if math.Abs(gc-wc) > 1e-12 || gr != wr || gt != wt {
+			t.Errorf("%s: expected %f/%d/%d, got %f/%d/%d", agent, wc, wr, wt, gc, gr, gt)
+		}
+	}
+	if got := dst.Sessions()["tiverton"]; len(got) != 1 || got[0].Session != "s1" || got[0].RequestCount != 1 {
+		t.Errorf("expected the session restored, got %+v", got)
+	}
+	if got := dst.ByTag("feature")["search"]; len(got) != 1 || got[0].TotalCostUSD != 0.002 {
+		t.Errorf("expected the tag restored, got %+v", got)
+	}
+	if got := dst.AgentMonthToDate("tiverton"); math.Abs(got-src.AgentMonthToDate("tiverton")) > 1e-12 {
+		t.Errorf("expected this month's spend to count toward the budget, got %f", got)
+	}
+	if got, want := dst.Snapshot(), snap; len(got) != len(want) {
+		t.Errorf("expected a restored snapshot to round-trip, got %d entries want %d", len(got), len(want))
+	}
+
+	// Spend from an earlier month restores lifetime totals only.
+	next := NewAccumulator()
+	next.now = func() time.Time { return clock.AddDate(0, 1, 0) }
+	next.Restore(snap)
+	if next.AgentMonthToDate("tiverton") != 0 || math.Abs(next.TotalCost()-src.TotalCost()) > 1e-12 {
+		t.Errorf("expected only lifetime totals from last month, got mtd %f total %f", next.AgentMonthToDate("tiverton"), next.TotalCost())
+	}
+}
+
+func TestAccumulatorRecordBytes(t *testing.T) {
+	acc := NewAccumulator()
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	acc.now = func() time.Time { return clock }
+	acc.Record("tiverton", "openai", "gpt-4o", 10, 5, 0.01)
+	acc.RecordBytes("tiverton", "openai", "gpt-4o", 120, 480)
+	acc.RecordBytes("tiverton", "openai", "gpt-4o", 80, 20)
+
+	e := acc.ByAgent("tiverton")[0]
+	if e.RequestBytes != 200 || e.ResponseBytes != 500 {
+		t.Errorf("expected 200/500 bytes, got %d/%d", e.RequestBytes, e.ResponseBytes)
+	}
+	if e.RequestCount != 1 {
+		t.Errorf("expected bytes not to count requests, got %d", e.RequestCount)
+	}
+	clock = clock.Add(time.Minute)
+	since, _, err := acc.Since(clock.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := since["tiverton"][0]; got.RequestBytes != 200 || got.ResponseBytes != 500 {
+		t.Errorf("expected bytes in the windowed view, got %d/%d", got.RequestBytes, got.ResponseBytes)
+	}
+	if tot := acc.Totals(); tot.RequestBytes != 200 || tot.ResponseBytes != 500 {
+		t.Errorf("expected bytes in the totals, got %d/%d", tot.RequestBytes, tot.ResponseBytes)
+	}
+}
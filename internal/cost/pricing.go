@@ -1,5 +1,11 @@
 package cost
 
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
 // Rate is the per-million-token price in USD.
 type Rate struct {
 	InputPerMTok  float64
@@ -12,15 +18,121 @@ func (r Rate) Compute(inputTokens, outputTokens int) float64 {
 		float64(outputTokens)/1_000_000*r.OutputPerMTok
 }
 
+// Token units prices are commonly quoted per.
+const (
+	PerThousand = 1_000
+	PerMillion  = 1_000_000
+)
+
+// Per returns the input and output prices in USD per unit tokens, so
+// r.Per(PerThousand) gives the per-1K figures.
+func (r Rate) Per(unit int) (input, output float64) {
+	scale := float64(unit) / PerMillion
+	return r.InputPerMTok * scale, r.OutputPerMTok * scale
+}
+
+// CostPer spreads costUSD over tokens and returns the effective price per
+// unit tokens, or zero when there are no tokens.
+func CostPer(costUSD float64, tokens, unit int) float64 {
+	if tokens <= 0 {
+		return 0
+	}
+	return costUSD / float64(tokens) * float64(unit)
+}
+
 // Pricing is a lookup table: provider -> model -> rate.
+//
+// MinChargeUSD and RoundToCents describe the billing convention applied by
+// Charge: a priced request costs at least MinChargeUSD, and with RoundToCents
+// each request is rounded up to the next whole cent.
 type Pricing struct {
 	rates map[string]map[string]Rate
+	caps  map[string]map[string]float64
+	free  map[string]bool
+
+	MinChargeUSD float64
+	RoundToCents bool
+}
+
+// SetRate adds or replaces the rate for a provider's model.
+func (p *Pricing) SetRate(provider, model string, rate Rate) {
+	if p.rates == nil {
+		p.rates = make(map[string]map[string]Rate)
+	}
+	if p.rates[provider] == nil {
+		p.rates[provider] = make(map[string]Rate)
+	}
+	p.rates[provider][model] = rate
+}
+
+// SetFree prices every model of provider at zero, for self-hosted providers
+// whose requests cost nothing but whose tokens should still be counted.
+// Rates set with SetRate still take precedence.
+func (p *Pricing) SetFree(provider string) {
+	if p.free == nil {
+		p.free = make(map[string]bool)
+	}
+	p.free[provider] = true
 }
 
+// SetMonthlyCap limits month-to-date spend on a provider's model to usd.
+// The model name may be a version prefix, as with rates.
+func (p *Pricing) SetMonthlyCap(provider, model string, usd float64) {
+	if p.caps == nil {
+		p.caps = make(map[string]map[string]float64)
+	}
+	if p.caps[provider] == nil {
+		p.caps[provider] = make(map[string]float64)
+	}
+	p.caps[provider][model] = usd
+}
+
+// MonthlyCap returns the cap covering provider/model and the model key it
+// was configured under, using the same matching rules as Lookup.
+func (p *Pricing) MonthlyCap(provider, model string) (key string, usd float64, ok bool) {
+	caps := p.caps[provider]
+	if usd, ok := caps[model]; ok {
+		return model, usd, true
+	}
+	for k, v := range caps {
+		if len(k) > len(key) && isVersionPrefix(k, model) {
+			key, usd = k, v
+		}
+	}
+	return key, usd, key != ""
+}
+
+// originPriced lists aggregators whose model IDs name the origin vendor
+// ("openai/gpt-4o") and which charge that vendor's prices.
+var originPriced = map[string]bool{"openrouter": true}
+
 // Lookup returns the rate for a provider/model pair.
 // It tries exact match first, then prefix match (e.g. "claude-sonnet-4"
 // matches "claude-sonnet-4-20250514") to handle date-suffixed model IDs.
+// Prefix matches must end on a version boundary ("-", ":" or "@") and may
+// not span a "/", so "claude-sonnet-4" never prices "claude-sonnet-40".
+//
+// For an aggregator such as OpenRouter, a model with no entry of its own
+// is priced from the origin vendor's table: "openai/gpt-4o" is looked up
+// as "gpt-4o" under "openai".
+//
+// Any model of a provider marked with SetFree is priced at zero.
 func (p *Pricing) Lookup(provider, model string) (Rate, bool) {
+	if rate, ok := p.lookup(provider, model); ok {
+		return rate, true
+	}
+	if p.free[provider] {
+		return Rate{}, true
+	}
+	if originPriced[provider] {
+		if origin, originModel, ok := strings.Cut(model, "/"); ok && origin != provider {
+			return p.lookup(origin, originModel)
+		}
+	}
+	return Rate{}, false
+}
+
+func (p *Pricing) lookup(provider, model string) (Rate, bool) {
 	models, ok := p.rates[provider]
 	if !ok {
 		return Rate{}, false
@@ -33,7 +145,7 @@ func (p *Pricing) Lookup(provider, model string) (Rate, bool) {
 	var best Rate
 	bestLen := 0
 	for key, rate := range models {
-		if len(key) > bestLen && len(key) <= len(model) && model[:len(key)] == key {
+		if len(key) > bestLen && isVersionPrefix(key, model) {
 			best = rate
 			bestLen = len(key)
 		}
@@ -44,10 +156,94 @@ func (p *Pricing) Lookup(provider, model string) (Rate, bool) {
 	return Rate{}, false
 }
 
+// ProvidersFor returns, sorted, the providers whose rate table prices model
+// under Lookup's matching rules.
+func (p *Pricing) ProvidersFor(model string) []string {
+	var out []string
+	for provider := range p.rates {
+		if _, ok := p.Lookup(provider, model); ok {
+			out = append(out, provider)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Rates returns a copy of the explicit rate table, provider -> model -> rate,
+// after every SetRate. Version-prefix and origin matching happen at Lookup
+// time and are not expanded here.
+func (p *Pricing) Rates() map[string]map[string]Rate {
+	out := make(map[string]map[string]Rate, len(p.rates))
+	for provider, models := range p.rates {
+		out[provider] = make(map[string]Rate, len(models))
+		for model, rate := range models {
+			out[provider][model] = rate
+		}
+	}
+	return out
+}
+
+// FreeProviders returns, sorted, the providers marked with SetFree.
+func (p *Pricing) FreeProviders() []string {
+	out := make([]string, 0, len(p.free))
+	for provider, free := range p.free {
+		if free {
+			out = append(out, provider)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// MonthlyCaps returns a copy of the caps set with SetMonthlyCap, provider
+// -> model -> USD.
+func (p *Pricing) MonthlyCaps() map[string]map[string]float64 {
+	out := make(map[string]map[string]float64, len(p.caps))
+	for provider, models := range p.caps {
+		out[provider] = make(map[string]float64, len(models))
+		for model, usd := range models {
+			out[provider][model] = usd
+		}
+	}
+	return out
+}
+
+// Charge applies the billing policy to a computed request cost. Zero-cost
+// requests (unpriced or free models) are left at zero.
+func (p *Pricing) Charge(costUSD float64) float64 {
+	if costUSD <= 0 {
+		return costUSD
+	}
+	if costUSD < p.MinChargeUSD {
+		costUSD = p.MinChargeUSD
+	}
+	if p.RoundToCents {
+		// The epsilon keeps float noise (e.g. 3.0000000000000004) from
+		// bumping an exact cent value up by one.
+		costUSD = math.Ceil(costUSD*100-1e-9) / 100
+	}
+	return costUSD
+}
+
+// isVersionPrefix reports whether model is key followed by a version suffix.
+func isVersionPrefix(key, model string) bool {
+	if len(key) >= len(model) || model[:len(key)] != key {
+		return false
+	}
+	rest := model[len(key):]
+	switch rest[0] {
+	case '-', ':', '@':
+	default:
+		return false
+	}
+	return !strings.Contains(rest, "/")
+}
+
 // DefaultPricing returns a pricing table with well-known models.
-// Prices in USD per million tokens. Updated manually.
+// Prices in USD per million tokens. Updated manually. Self-hosted ollama
+// models are free.
 func DefaultPricing() *Pricing {
-	return &Pricing{rates: map[string]map[string]Rate{
+	return &Pricing{free: map[string]bool{"ollama": true}, rates: map[string]map[string]Rate{
 		"anthropic": {
 			"claude-sonnet-4":   {InputPerMTok: 3.0, OutputPerMTok: 15.0},
 			"claude-sonnet-4-6": {InputPerMTok: 3.0, OutputPerMTok: 15.0},
@@ -67,10 +263,10 @@ func DefaultPricing() *Pricing {
 		},
 		"openrouter": {
 			// OpenRouter passes through to upstream providers; rates match origin pricing.
-			"anthropic/claude-sonnet-4":   {InputPerMTok: 3.0, OutputPerMTok: 15.0},
-			"anthropic/claude-haiku-3-5":  {InputPerMTok: 0.80, OutputPerMTok: 4.0},
-			"google/gemini-2.5-pro":       {InputPerMTok: 1.25, OutputPerMTok: 10.0},
-			"google/gemini-2.5-flash":     {InputPerMTok: 0.15, OutputPerMTok: 0.60},
+			"anthropic/claude-sonnet-4":  {InputPerMTok: 3.0, OutputPerMTok: 15.0},
+			"anthropic/claude-haiku-3-5": {InputPerMTok: 0.80, OutputPerMTok: 4.0},
+			"google/gemini-2.5-pro":      {InputPerMTok: 1.25, OutputPerMTok: 10.0},
+			"google/gemini-2.5-flash":    {InputPerMTok: 0.15, OutputPerMTok: 0.60},
 		},
 	}}
 }
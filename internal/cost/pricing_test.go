@@ -1,6 +1,9 @@
 package cost
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestLookupKnownModel(t *testing.T) {
 	p := DefaultPricing()
@@ -42,3 +45,145 @@ func TestComputeCost(t *testing.T) {
 		t.Errorf("expected ~%f, got %f", expected, cost)
 	}
 }
+
+func TestLookupPrefixRespectsSegmentBoundaries(t *testing.T) {
+	p := DefaultPricing()
+	cases := []struct {
+		provider, model string
+		wantOK          bool
+	}{
+		{"anthropic", "claude-sonnet-4-20250514", true},
+		{"anthropic", "claude-sonnet-40", false},
+		{"anthropic", "claude-sonnet-4x", false},
+		{"openrouter", "anthropic/claude-sonnet-4", true},
+		{"openrouter", "anthropic/claude-sonnet-4:beta", true},
+		{"openrouter", "anthropic/claude-sonnet-40", false},
+		{"openrouter", "anthropic/claude-sonnet-4-extended/v2", false},
+		{"openrouter", "anthropic", false},
+		{"openrouter", "claude-sonnet-4", false},
+	}
+	for _, tc := range cases {
+		_, ok := p.Lookup(tc.provider, tc.model)
+		if ok != tc.wantOK {
+			t.Errorf("Lookup(%q, %q) ok=%v, want %v", tc.provider, tc.model, ok, tc.wantOK)
+		}
+	}
+}
+
+func TestLookupNestedOpenRouterPicksLongestKey(t *testing.T) {
+	p := DefaultPricing()
+	rate, ok := p.Lookup("openrouter", "google/gemini-2.5-flash-001")
+	if !ok {
+		t.Fatal("expected nested OpenRouter model to resolve")
+	}
+	if rate.InputPerMTok != 0.15 {
+		t.Errorf("expected gemini-2.5-flash rate, got %+v", rate)
+	}
+}
+
+func TestLookupOpenRouterFallsBackToOriginPricing(t *testing.T) {
+	p := DefaultPricing()
+	want, _ := p.Lookup("openai", "gpt-4o")
+	rate, ok := p.Lookup("openrouter", "openai/gpt-4o")
+	if !ok || rate != want {
+		t.Fatalf("expected openrouter/openai/gpt-4o at OpenAI's rate %+v, got %+v ok=%v", want, rate, ok)
+	}
+	if _, ok := p.Lookup("openrouter", "openai/gpt-4o-2024-08-06"); !ok {
+		t.Error("expected origin prefix matching to apply")
+	}
+
+	// An explicit OpenRouter entry wins over the origin table.
+	p.SetRate("openrouter", "openai/gpt-4o", Rate{InputPerMTok: 9, OutputPerMTok: 9})
+	if rate, _ := p.Lookup("openrouter", "openai/gpt-4o"); rate.InputPerMTok != 9 {
+		t.Errorf("expected the explicit OpenRouter rate, got %+v", rate)
+	}
+
+	if _, ok := p.Lookup("openrouter", "mystery/gpt-4o"); ok {
+		t.Error("expected an unknown origin vendor to stay unpriced")
+	}
+	if _, ok := p.Lookup("anthropic", "openai/gpt-4o"); ok {
+		t.Error("expected only aggregators to delegate to the origin vendor")
+	}
+}
+
+func TestChargeAppliesMinimumAndRounding(t *testing.T) {
+	p := DefaultPricing()
+	if got := p.Charge(0.0105); got != 0.0105 {
+		t.Errorf("expected default policy to leave cost unchanged, got %f", got)
+	}
+
+	p.MinChargeUSD = 0.005
+	if got := p.Charge(0.001); got != 0.005 {
+		t.Errorf("expected minimum charge 0.005, got %f", got)
+	}
+	if got := p.Charge(0.0105); got != 0.0105 {
+		t.Errorf("expected cost above minimum unchanged, got %f", got)
+	}
+	if got := p.Charge(0); got != 0 {
+		t.Errorf("expected zero-cost request to stay free, got %f", got)
+	}
+
+	p.RoundToCents = true
+	if got := p.Charge(0.0105); got != 0.02 {
+		t.Errorf("expected 0.0105 rounded up to 0.02, got %f", got)
+	}
+	if got := p.Charge(0.001); got != 0.01 {
+		t.Errorf("expected minimum rounded up to 0.01, got %f", got)
+	}
+	if got := p.Charge(0.01 + 0.02); got != 0.03 {
+		t.Errorf("expected exact cents to stay put, got %f", got)
+	}
+}
+
+func TestProvidersForBareModel(t *testing.T) {
+	p := DefaultPricing()
+	if got := p.ProvidersFor("gpt-4o-2024-08-06"); len(got) != 1 || got[0] != "openai" {
+		t.Errorf("expected [openai], got %v", got)
+	}
+	if got := p.ProvidersFor("llama3"); len(got) != 0 {
+		t.Errorf("expected no providers for unknown model, got %v", got)
+	}
+}
+
+func TestRatePerAndCostPer(t *testing.T) {
+	r := Rate{InputPerMTok: 3.0, OutputPerMTok: 15.0}
+	in, out := r.Per(PerThousand)
+	if math.Abs(in-0.003) > 1e-12 || math.Abs(out-0.015) > 1e-12 {
+		t.Errorf("expected $0.003/$0.015 per 1K, got %g/%g", in, out)
+	}
+	if in, out := r.Per(PerMillion); in != 3.0 || out != 15.0 {
+		t.Errorf("expected per-1M figures unchanged, got %g/%g", in, out)
+	}
+
+	// 1000 in + 500 out on the rate above costs $0.0105, which is $0.007 per
+	// 1K tokens overall; the per-unit figure agrees with Compute.
+	spent := r.Compute(1000, 500)
+	if got := CostPer(spent, 1500, PerThousand); math.Abs(got-0.007) > 1e-12 {
+		t.Errorf("expected $0.007 per 1K, got %g", got)
+	}
+	if got := CostPer(spent, 1500, PerMillion); math.Abs(got-7.0) > 1e-9 {
+		t.Errorf("expected $7 per 1M, got %g", got)
+	}
+	if got := CostPer(1.0, 0, PerThousand); got != 0 {
+		t.Errorf("expected zero with no tokens, got %g", got)
+	}
+}
+
+func TestLookupFreeProvider(t *testing.T) {
+	p := DefaultPricing()
+	rate, ok := p.Lookup("ollama", "llama3.1:8b")
+	if !ok || rate != (Rate{}) {
+		t.Fatalf("expected ollama priced at zero, got %+v (%v)", rate, ok)
+	}
+	p.SetRate("ollama", "llama3-70b", Rate{InputPerMTok: 0.2, OutputPerMTok: 0.4})
+	if rate, _ := p.Lookup("ollama", "llama3-70b"); rate.InputPerMTok != 0.2 {
+		t.Errorf("expected an explicit rate to win over free, got %+v", rate)
+	}
+	if _, ok := p.Lookup("vllm", "anything"); ok {
+		t.Error("expected an unmarked provider to stay unpriced")
+	}
+	p.SetFree("vllm")
+	if _, ok := p.Lookup("vllm", "anything"); !ok {
+		t.Error("expected SetFree to price the provider")
+	}
+}
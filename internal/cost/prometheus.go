@@ -0,0 +1,45 @@
+package cost
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PrometheusContentType is the media type of WritePrometheus output.
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus renders the request, token and spend totals in grouped
+// (as returned by Accumulator.All) as Prometheus counters, one series per
+// agent, provider and model.
+func WritePrometheus(w io.Writer, grouped map[string][]CostEntry) {
+	var entries []CostEntry
+	for _, agentEntries := range grouped {
+		entries = append(entries, agentEntries...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		x, y := entries[i], entries[j]
+		return x.AgentID+"/"+x.Provider+"/"+x.Model < y.AgentID+"/"+y.Provider+"/"+y.Model
+	})
+
+	counters := []struct {
+		name, help string
+		value      func(CostEntry) string
+	}{
+		{"cllama_requests_total", "Completed proxied requests.", func(e CostEntry) string { return fmt.Sprint(e.RequestCount) }},
+		{"cllama_input_tokens_total", "Prompt tokens reported by providers.", func(e CostEntry) string { return fmt.Sprint(e.TotalInputTokens) }},
+		{"cllama_output_tokens_total", "Completion tokens reported by providers.", func(e CostEntry) string { return fmt.Sprint(e.TotalOutputTokens) }},
+		{"cllama_cost_usd_total", "Spend in USD.", func(e CostEntry) string { return fmt.Sprintf("%g", e.TotalCostUSD) }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s{agent_id=\"%s\",provider=\"%s\",model=\"%s\"} %s\n",
+				c.name, labelEscaper.Replace(e.AgentID), labelEscaper.Replace(e.Provider), labelEscaper.Replace(e.Model), c.value(e))
+		}
+	}
+}
+
+// labelEscaper escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,130 @@
+package cost
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// UsageSink is an io.Writer that finds the usage report in a response body
+// written through it, typically as one side of an io.MultiWriter with the
+// client response. Event streams are scanned line by line as they pass, so
+// only the current partial line is held; a plain JSON body has to be parsed
+// whole and is kept until Usage is called. It is not safe for concurrent use.
+type UsageSink struct {
+	// OnUsage, if set, is called with the cumulative usage each time an
+	// event stream reports it, so long streams can be costed as they run.
+	OnUsage func(Usage)
+
+	anthropic bool
+
+	sniffed bool
+	sse     bool
+	scanner SSEUsageScanner
+	body    bytes.Buffer
+
+	// Anthropic streams report input tokens in message_start and output
+	// tokens, cumulatively, in message_delta.
+	input, output int
+	model         string
+}
+
+// NewUsageSink returns a sink for responses in apiFormat, as in a provider's
+// api_format: "anthropic", or anything else for OpenAI-compatible. Whether
+// the body is an event stream or JSON is detected from what is written.
+func NewUsageSink(apiFormat string) *UsageSink {
+	s := &UsageSink{anthropic: apiFormat == "anthropic"}
+	if s.anthropic {
+		s.scanner.onLine = s.anthropicEvent
+	} else {
+		s.scanner.OnUsage = s.report
+	}
+	return s
+}
+
+func (s *UsageSink) report(u Usage) {
+	if s.OnUsage != nil {
+		s.OnUsage(u)
+	}
+}
+
+// Write consumes the next piece of the body; it never fails.
+func (s *UsageSink) Write(p []byte) (int, error) {
+	if !s.sniffed {
+		trimmed := bytes.TrimLeft(p, " \t\r\n")
+		if len(trimmed) == 0 {
+			return len(p), nil
+		}
+		s.sniffed = true
+		s.sse = trimmed[0] != '{'
+	}
+	if s.sse {
+		return s.scanner.Write(p)
+	}
+	return s.body.Write(p)
+}
+
+// Usage returns the usage the body reported once it has all been written,
+// or zero usage if it reported none. The error is from parsing a JSON body.
+func (s *UsageSink) Usage() (Usage, error) {
+	switch {
+	case !s.sniffed:
+		return Usage{}, nil
+	case !s.sse:
+		return ExtractUsage(s.body.Bytes())
+	case s.anthropic:
+		s.scanner.Finish()
+		return Usage{PromptTokens: s.input, CompletionTokens: s.output, TotalTokens: s.input + s.output}, nil
+	}
+	return s.scanner.Finish(), nil
+}
+
+// Model returns the model the response says served it, or "" if it named
+// none. Call it once the body has all been written.
+func (s *UsageSink) Model() string {
+	switch {
+	case !s.sniffed:
+		return ""
+	case !s.sse:
+		var resp struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(s.body.Bytes(), &resp)
+		return resp.Model
+	case s.anthropic:
+		return s.model
+	}
+	return s.scanner.Model()
+}
+
+// anthropicEvent picks usage out of an Anthropic stream event.
+func (s *UsageSink) anthropicEvent(payload []byte) {
+	var event struct {
+		Message struct {
+			Model string `json:"model"`
+			Usage *Usage `json:"usage"`
+		} `json:"message"`
+		Usage *Usage `json:"usage"`
+	}
+	if json.Unmarshal(payload, &event) != nil {
+		return
+	}
+	if s.model == "" {
+		s.model = event.Message.Model
+	}
+	seen := false
+	for _, u := range []*Usage{event.Message.Usage, event.Usage} {
+		if u == nil {
+			continue
+		}
+		seen = true
+		if u.PromptTokens > 0 {
+			s.input = u.PromptTokens
+		}
+		if u.CompletionTokens > 0 {
+			s.output = u.CompletionTokens
+		}
+	}
+	if seen {
+		s.report(Usage{PromptTokens: s.input, CompletionTokens: s.output, TotalTokens: s.input + s.output})
+	}
+}
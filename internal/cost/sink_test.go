@@ -0,0 +1,90 @@
+package cost
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestUsageSinkJSON(t *testing.T) {
+	sink := NewUsageSink("openai")
+	var client bytes.Buffer
+	body := `{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":30,"total_tokens":42}}`
+	if _, err := io.Copy(io.MultiWriter(&client, sink), strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if client.String() != body {
+		t.Errorf("client side of the MultiWriter got %q", client.String())
+	}
+	u, err := sink.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PromptTokens != 12 || u.CompletionTokens != 30 || u.TotalTokens != 42 {
+		t.Errorf("expected 12/30/42, got %+v", u)
+	}
+}
+
+func TestUsageSinkOpenAISSE(t *testing.T) {
+	stream := "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+		"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":8,\"completion_tokens\":3}}\n\n" +
+		"data: [DONE]\n\n"
+	sink := NewUsageSink("")
+	for i := 0; i < len(stream); i += 5 {
+		_, _ = sink.Write([]byte(stream[i:min(i+5, len(stream))]))
+	}
+	u, err := sink.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.PromptTokens != 8 || u.CompletionTokens != 3 || u.TotalTokens != 11 {
+		t.Errorf("expected 8/3/11, got %+v", u)
+	}
+}
+
+func TestUsageSinkAnthropicSSE(t *testing.T) {
+	stream := "event: message_start\n" +
+		"data: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"usage\":{\"input_tokens\":25,\"output_tokens\":1}}}\n\n" +
+		"event: content_block_delta\n" +
+		"data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n" +
+		"event: message_delta\n" +
+		"data: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":15}}\n\n" +
+		"event: message_stop\n" +
+		"data: {\"type\":\"message_stop\"}\n\n"
+	sink := NewUsageSink("anthropic")
+	_, _ = io.Copy(sink, strings.NewReader(stream))
+	u, _ := sink.Usage()
+	if u.PromptTokens != 25 || u.CompletionTokens != 15 || u.TotalTokens != 40 {
+		t.Errorf("expected 25/15/40, got %+v", u)
+	}
+}
+
+func TestUsageSinkEmptyAndMalformed(t *testing.T) {
+	if u, err := NewUsageSink("openai").Usage(); err != nil || u != (Usage{}) {
+		t.Errorf("expected zero usage for an empty body, got %+v, %v", u, err)
+	}
+	sink := NewUsageSink("openai")
+	_, _ = sink.Write([]byte(`{"usage":`))
+	if _, err := sink.Usage(); err == nil {
+		t.Error("expected an error for truncated JSON")
+	}
+}
+
+func TestUsageSinkModel(t *testing.T) {
+	cases := []struct {
+		format, body, want string
+	}{
+		{"openai", `{"model":"gpt-4o-mini-2024-07-18","usage":{}}`, "gpt-4o-mini-2024-07-18"},
+		{"openai", "data: {\"model\":\"gpt-4o-mini\",\"choices\":[]}\n\ndata: [DONE]\n\n", "gpt-4o-mini"},
+		{"anthropic", "data: {\"type\":\"message_start\",\"message\":{\"model\":\"claude-haiku-4-5\"}}\n\n", "claude-haiku-4-5"},
+		{"openai", `{"usage":{}}`, ""},
+	}
+	for _, c := range cases {
+		sink := NewUsageSink(c.format)
+		_, _ = sink.Write([]byte(c.body))
+		if got := sink.Model(); got != c.want {
+			t.Errorf("%s %q: got model %q, want %q", c.format, c.body, got, c.want)
+		}
+	}
+}
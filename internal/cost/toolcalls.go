@@ -0,0 +1,150 @@
+package cost
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ToolCallCounter is an io.Writer that counts the tool calls in a response
+// body written through it, in the OpenAI (tool_calls, function_call) or
+// Anthropic (tool_use) shape, streamed or not. Providers do not break tool
+// calls out of usage, so their tokens are estimated at four characters per
+// token of function name and arguments. It is not safe for concurrent use.
+type ToolCallCounter struct {
+	sniffed bool
+	sse     bool
+	pending []byte
+	body    bytes.Buffer
+
+	calls int
+	chars int
+}
+
+// Write consumes the next piece of the body; it never fails.
+func (c *ToolCallCounter) Write(p []byte) (int, error) {
+	if !c.sniffed {
+		trimmed := bytes.TrimLeft(p, " \t\r\n")
+		if len(trimmed) == 0 {
+			return len(p), nil
+		}
+		c.sniffed = true
+		c.sse = trimmed[0] != '{'
+	}
+	if !c.sse {
+		return c.body.Write(p)
+	}
+	c.pending = append(c.pending, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(c.pending[start:], '\n')
+		if i < 0 {
+			break
+		}
+		c.line(c.pending[start : start+i])
+		start += i + 1
+	}
+	c.pending = append(c.pending[:0], c.pending[start:]...)
+	return len(p), nil
+}
+
+// ToolCalls returns the number of tool calls in the body and their
+// estimated tokens. Call it once the body has all been written.
+func (c *ToolCallCounter) ToolCalls() (calls, tokens int) {
+	if c.sse && len(c.pending) > 0 {
+		c.line(c.pending)
+		c.pending = c.pending[:0]
+	}
+	if !c.sse && c.body.Len() > 0 {
+		c.payload(c.body.Bytes(), false)
+		c.body.Reset()
+	}
+	return c.calls, (c.chars + 3) / 4
+}
+
+func (c *ToolCallCounter) line(line []byte) {
+	payload, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+	if !ok {
+		return
+	}
+	if payload = bytes.TrimSpace(payload); len(payload) > 0 && payload[0] == '{' {
+		c.payload(payload, true)
+	}
+}
+
+type toolCallMessage struct {
+	ToolCalls []struct {
+		ID       string `json:"id"`
+		Function struct {
+			Name      string `json:"name"`
+			Arguments string `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls"`
+	FunctionCall *struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function_call"`
+}
+
+// payload counts the tool calls in one JSON body or stream event. In a
+// stream a call spans several chunks; only the first carries its ID (or,
+// for a legacy function_call, its name), so that is where it is counted.
+func (c *ToolCallCounter) payload(data []byte, streamed bool) {
+	var p struct {
+		Choices []struct {
+			Message *toolCallMessage `json:"message"`
+			Delta   *toolCallMessage `json:"delta"`
+		} `json:"choices"`
+
+		// Anthropic: tool_use content blocks, whole or streamed.
+		Content []struct {
+			Type  string          `json:"type"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string `json:"type"`
+			PartialJSON string `json:"partial_json"`
+		} `json:"delta"`
+	}
+	if json.Unmarshal(data, &p) != nil {
+		return
+	}
+	for _, ch := range p.Choices {
+		m := ch.Message
+		if streamed {
+			m = ch.Delta
+		}
+		if m == nil {
+			continue
+		}
+		for _, tc := range m.ToolCalls {
+			if !streamed || tc.ID != "" {
+				c.calls++
+			}
+			c.chars += len(tc.Function.Name) + len(tc.Function.Arguments)
+		}
+		if fc := m.FunctionCall; fc != nil {
+			if !streamed || fc.Name != "" {
+				c.calls++
+			}
+			c.chars += len(fc.Name) + len(fc.Arguments)
+		}
+	}
+	for _, block := range p.Content {
+		if block.Type == "tool_use" {
+			c.calls++
+			c.chars += len(block.Name) + len(block.Input)
+		}
+	}
+	if p.ContentBlock.Type == "tool_use" {
+		c.calls++
+		c.chars += len(p.ContentBlock.Name)
+	}
+	if p.Delta.Type == "input_json_delta" {
+		c.chars += len(p.Delta.PartialJSON)
+	}
+}
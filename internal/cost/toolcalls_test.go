@@ -0,0 +1,56 @@
+package cost
+
+import "testing"
+
+func TestToolCallCounter(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		calls, tok int
+	}{
+		{
+			name:  "openai json",
+			body:  `{"choices":[{"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},{"id":"call_2","type":"function","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+			calls: 2,
+			tok:   (len("get_weather") + len(`{"city":"Paris"}`) + len("get_time") + len("{}") + 3) / 4,
+		},
+		{
+			name: "openai stream",
+			body: "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"function\":{\"name\":\"get_weather\",\"arguments\":\"\"}}]}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"city\\\":\"}}]}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\"Paris\\\"}\"}}]}}]}\n\n" +
+				"data: [DONE]\n\n",
+			calls: 1,
+			tok:   (len("get_weather") + len(`{"city":"Paris"}`) + 3) / 4,
+		},
+		{
+			name:  "anthropic json",
+			body:  `{"type":"message","content":[{"type":"text","text":"Checking."},{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]}`,
+			calls: 1,
+			tok:   (len("get_weather") + len(`{"city":"Paris"}`) + 3) / 4,
+		},
+		{
+			name: "anthropic stream",
+			body: "event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":1,\"content_block\":{\"type\":\"tool_use\",\"id\":\"toolu_1\",\"name\":\"get_weather\",\"input\":{}}}\n\n" +
+				"event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":1,\"delta\":{\"type\":\"input_json_delta\",\"partial_json\":\"{\\\"city\\\":\\\"Paris\\\"}\"}}\n\n",
+			calls: 1,
+			tok:   (len("get_weather") + len(`{"city":"Paris"}`) + 3) / 4,
+		},
+		{
+			name: "no tools",
+			body: `{"choices":[{"message":{"role":"assistant","content":"hello"}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c ToolCallCounter
+			for i := 0; i < len(tt.body); i += 7 {
+				_, _ = c.Write([]byte(tt.body[i:min(i+7, len(tt.body))]))
+			}
+			calls, tok := c.ToolCalls()
+			if calls != tt.calls || tok != tt.tok {
+				t.Errorf("expected %d calls and %d tokens, got %d and %d", tt.calls, tt.tok, calls, tok)
+			}
+		})
+	}
+}
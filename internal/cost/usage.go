@@ -12,6 +12,42 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+// UnmarshalJSON reads the chat completions field names, falling back to the
+// input_tokens/output_tokens names used by the Responses API (and Anthropic)
+// for any that are absent. A missing total is the sum of the other two.
+func (u *Usage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		PromptTokens     *int `json:"prompt_tokens"`
+		CompletionTokens *int `json:"completion_tokens"`
+		TotalTokens      *int `json:"total_tokens"`
+		InputTokens      *int `json:"input_tokens"`
+		OutputTokens     *int `json:"output_tokens"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*u = Usage{
+		PromptTokens:     firstCount(raw.PromptTokens, raw.InputTokens),
+		CompletionTokens: firstCount(raw.CompletionTokens, raw.OutputTokens),
+	}
+	if raw.TotalTokens != nil {
+		u.TotalTokens = *raw.TotalTokens
+	} else {
+		u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	}
+	return nil
+}
+
+func firstCount(primary, alternate *int) int {
+	if primary != nil {
+		return *primary
+	}
+	if alternate != nil {
+		return *alternate
+	}
+	return 0
+}
+
 // ExtractUsage parses usage from a non-streamed JSON response body.
 func ExtractUsage(body []byte) (Usage, error) {
 	var resp struct {
@@ -29,22 +65,86 @@ func ExtractUsage(body []byte) (Usage, error) {
 // ExtractUsageFromSSE scans SSE data lines for the last one containing a "usage" field.
 // OpenAI streams include usage in the final data chunk before "data: [DONE]".
 func ExtractUsageFromSSE(stream []byte) (Usage, error) {
-	var lastUsage Usage
-	for _, line := range bytes.Split(stream, []byte("\n")) {
-		line = bytes.TrimSpace(line)
-		if !bytes.HasPrefix(line, []byte("data: ")) {
-			continue
-		}
-		payload := bytes.TrimPrefix(line, []byte("data: "))
-		if bytes.Equal(payload, []byte("[DONE]")) {
-			continue
-		}
-		var chunk struct {
-			Usage *Usage `json:"usage"`
+	var s SSEUsageScanner
+	_, _ = s.Write(stream)
+	return s.Finish(), nil
+}
+
+// SSEUsageScanner finds usage reports in an SSE stream as it is written,
+// so long streams can be costed before they end. Usage in a stream is
+// cumulative; the latest report wins. It is not safe for concurrent use.
+type SSEUsageScanner struct {
+	// OnUsage, if set, is called with each usage report as it is seen.
+	OnUsage func(Usage)
+
+	// onLine, if set, replaces the OpenAI usage lookup for each data
+	// payload; UsageSink uses it for Anthropic streams.
+	onLine func(payload []byte)
+
+	pending []byte
+	usage   Usage
+	model   string
+}
+
+// Write consumes the next piece of the stream; it never fails.
+func (s *SSEUsageScanner) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	start := 0
+	for {
+		i := bytes.IndexByte(s.pending[start:], '\n')
+		if i < 0 {
+			break
 		}
-		if json.Unmarshal(payload, &chunk) == nil && chunk.Usage != nil {
-			lastUsage = *chunk.Usage
+		s.line(s.pending[start : start+i])
+		start += i + 1
+	}
+	s.pending = append(s.pending[:0], s.pending[start:]...)
+	return len(p), nil
+}
+
+// Finish processes any unterminated final line and returns the last usage
+// seen, or zero usage if the stream reported none.
+func (s *SSEUsageScanner) Finish() Usage {
+	if len(s.pending) > 0 {
+		s.line(s.pending)
+		s.pending = s.pending[:0]
+	}
+	return s.usage
+}
+
+// Model returns the first model named by a chunk of the stream so far, or
+// "" if none has been.
+func (s *SSEUsageScanner) Model() string {
+	return s.model
+}
+
+func (s *SSEUsageScanner) line(line []byte) {
+	line = bytes.TrimSpace(line)
+	if !bytes.HasPrefix(line, []byte("data: ")) {
+		return
+	}
+	payload := bytes.TrimPrefix(line, []byte("data: "))
+	if bytes.Equal(payload, []byte("[DONE]")) {
+		return
+	}
+	if s.onLine != nil {
+		s.onLine(payload)
+		return
+	}
+	var chunk struct {
+		Model string `json:"model"`
+		Usage *Usage `json:"usage"`
+	}
+	if json.Unmarshal(payload, &chunk) != nil {
+		return
+	}
+	if s.model == "" {
+		s.model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		s.usage = *chunk.Usage
+		if s.OnUsage != nil {
+			s.OnUsage(s.usage)
 		}
 	}
-	return lastUsage, nil
 }
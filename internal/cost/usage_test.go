@@ -25,6 +25,37 @@ func TestExtractUsageFromJSON(t *testing.T) {
 	}
 }
 
+func TestExtractUsageResponsesAPIShape(t *testing.T) {
+	body := []byte(`{
+		"id": "resp_1",
+		"object": "response",
+		"usage": {
+			"input_tokens": 328,
+			"input_tokens_details": {"cached_tokens": 0},
+			"output_tokens": 52,
+			"output_tokens_details": {"reasoning_tokens": 0},
+			"total_tokens": 380
+		}
+	}`)
+	u, err := ExtractUsage(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != (Usage{PromptTokens: 328, CompletionTokens: 52, TotalTokens: 380}) {
+		t.Errorf("unexpected usage from Responses API body: %+v", u)
+	}
+
+	// The chat completions names win when both are present; a missing
+	// total is derived.
+	u, err = ExtractUsage([]byte(`{"usage": {"prompt_tokens": 10, "input_tokens": 99, "output_tokens": 5}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != (Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}) {
+		t.Errorf("unexpected usage from mixed names: %+v", u)
+	}
+}
+
 func TestExtractUsageMissing(t *testing.T) {
 	body := []byte(`{"id": "chatcmpl-1", "choices": []}`)
 	u, err := ExtractUsage(body)
@@ -63,3 +94,23 @@ func TestExtractUsageFromSSENoUsage(t *testing.T) {
 		t.Errorf("expected 0, got %d", u.PromptTokens)
 	}
 }
+
+func TestSSEUsageScannerAcrossSplitWrites(t *testing.T) {
+	stream := "data: {\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5}}\n\n" +
+		"data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+		"data: {\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":40}}\n\n" +
+		"data: [DONE]"
+
+	var seen []Usage
+	s := SSEUsageScanner{OnUsage: func(u Usage) { seen = append(seen, u) }}
+	for i := 0; i < len(stream); i += 7 {
+		end := min(i+7, len(stream))
+		_, _ = s.Write([]byte(stream[i:end]))
+	}
+	if len(seen) != 2 || seen[0].CompletionTokens != 5 || seen[1].CompletionTokens != 40 {
+		t.Fatalf("expected two cumulative reports, got %+v", seen)
+	}
+	if u := s.Finish(); u.PromptTokens != 10 || u.CompletionTokens != 40 {
+		t.Errorf("expected final usage 10/40, got %+v", u)
+	}
+}
@@ -1,10 +1,30 @@
 package identity
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// ErrInvalidAgentID is returned for agent IDs outside the safe charset. Agent
+// IDs name directories under the context root, so nothing that could act as
+// a path separator or traversal is accepted.
+var ErrInvalidAgentID = errors.New("invalid agent id")
+
+// ValidateAgentID checks that id is non-empty and made only of lowercase
+// ASCII letters, digits, '_' and '-'.
+func ValidateAgentID(id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidAgentID)
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' && c != '-' {
+			return fmt.Errorf("%w %q: want only a-z, 0-9, '_' and '-'", ErrInvalidAgentID, id)
+		}
+	}
+	return nil
+}
+
 // ParseBearer extracts agent ID and secret from "Bearer <agent-id>:<secret>".
 // It splits on the first colon only, allowing colons inside the secret.
 func ParseBearer(header string) (agentID, secret string, err error) {
@@ -26,5 +46,8 @@ func ParseBearer(header string) (agentID, secret string, err error) {
 	if !ok || agentID == "" || secret == "" {
 		return "", "", fmt.Errorf("invalid bearer token: expected <agent-id>:<secret>")
 	}
+	if err := ValidateAgentID(agentID); err != nil {
+		return "", "", err
+	}
 	return agentID, secret, nil
 }
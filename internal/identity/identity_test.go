@@ -1,6 +1,9 @@
 package identity
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestParseBearerValid(t *testing.T) {
 	id, secret, err := ParseBearer("Bearer tiverton:abc123def456")
@@ -48,3 +51,15 @@ func TestParseBearerNoPrefix(t *testing.T) {
 		t.Error("expected error for non-Bearer auth")
 	}
 }
+
+func TestParseBearerRejectsUnsafeAgentID(t *testing.T) {
+	for _, id := range []string{"../etc", "..", "a/b", `a\b`, "Tiverton", "bot.a", "bot a"} {
+		_, _, err := ParseBearer("Bearer " + id + ":secret")
+		if !errors.Is(err, ErrInvalidAgentID) {
+			t.Errorf("%q: expected ErrInvalidAgentID, got %v", id, err)
+		}
+	}
+	if _, _, err := ParseBearer("Bearer bot_a-2:secret"); err != nil {
+		t.Errorf("expected safe id to parse, got %v", err)
+	}
+}
@@ -1,30 +1,79 @@
 package logging
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Logger writes structured JSON logs suitable for claw audit ingestion.
+// Format selects how log entries are written.
+type Format string
+
+const (
+	// FormatJSON writes one JSON object per line, for claw audit ingestion.
+	FormatJSON Format = "json"
+	// FormatText writes "ts type key=value ..." lines for reading at a
+	// terminal during local development.
+	FormatText Format = "text"
+)
+
+// ParseFormat checks s against the known formats; empty means FormatJSON.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(strings.TrimSpace(s))); f {
+	case "":
+		return FormatJSON, nil
+	case FormatJSON, FormatText:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown log format %q (want %s or %s)", s, FormatJSON, FormatText)
+}
+
+// Logger writes structured logs, as JSON suitable for claw audit ingestion
+// or as plain text.
 type Logger struct {
-	mu  sync.Mutex
-	enc *json.Encoder
+	mu     sync.Mutex
+	w      io.Writer
+	enc    *json.Encoder
+	format Format
+
+	// sampleEvery keeps one in this many request and response entries;
+	// see SetSampling.
+	sampleEvery uint64
+	requests    atomic.Uint64
+	responses   atomic.Uint64
 }
 
 type entry struct {
-	TS           string   `json:"ts"`
-	ClawID       string   `json:"claw_id,omitempty"`
-	Type         string   `json:"type"`
-	Model        string   `json:"model,omitempty"`
-	LatencyMS    *int64   `json:"latency_ms,omitempty"`
-	StatusCode   *int     `json:"status_code,omitempty"`
-	TokensIn     *int     `json:"tokens_in,omitempty"`
-	TokensOut    *int     `json:"tokens_out,omitempty"`
-	CostUSD      *float64 `json:"cost_usd,omitempty"`
-	Intervention *string  `json:"intervention"`
-	Error        string   `json:"error,omitempty"`
+	TS            string   `json:"ts"`
+	ClawID        string   `json:"claw_id,omitempty"`
+	Type          string   `json:"type"`
+	Model         string   `json:"model,omitempty"`
+	UpstreamModel string   `json:"upstream_model,omitempty"`
+	LatencyMS     *int64   `json:"latency_ms,omitempty"`
+	StatusCode    *int     `json:"status_code,omitempty"`
+	TokensIn      *int     `json:"tokens_in,omitempty"`
+	TokensOut     *int     `json:"tokens_out,omitempty"`
+	CostUSD       *float64 `json:"cost_usd,omitempty"`
+	Intervention  *string  `json:"intervention"`
+	Error         string   `json:"error,omitempty"`
+	Action        string   `json:"action,omitempty"`
+	Provider      string   `json:"provider,omitempty"`
+	MaskedKey     string   `json:"masked_key,omitempty"`
+	ClientIP      string   `json:"client_ip,omitempty"`
+	Signal        string   `json:"signal,omitempty"`
+	InFlight      *int     `json:"inflight,omitempty"`
+	DrainMS       *int64   `json:"drain_ms,omitempty"`
+	Attempt       *int     `json:"attempt,omitempty"`
+	DelayMS       *int64   `json:"delay_ms,omitempty"`
+	Stack         string   `json:"stack,omitempty"`
+	Requests      *int     `json:"requests,omitempty"`
 }
 
 // CostInfo holds token counts and estimated cost for a single LLM request.
@@ -34,34 +83,53 @@ type CostInfo struct {
 	CostUSD      float64
 }
 
-func New(w io.Writer) *Logger {
+// New returns a Logger writing to w in format; an unknown format falls back
+// to FormatJSON.
+func New(w io.Writer, format Format) *Logger {
 	if w == nil {
 		w = io.Discard
 	}
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false)
-	return &Logger{enc: enc}
+	if format != FormatText {
+		format = FormatJSON
+	}
+	return &Logger{w: w, enc: enc, format: format}
 }
 
-func (l *Logger) LogRequest(clawID, model string) {
+// LogRequest records an outbound request. model is what the agent asked for;
+// upstreamModel is the name actually sent to the provider; clientIP is the
+// caller's address as resolved by the proxy.
+func (l *Logger) LogRequest(clawID, model, upstreamModel, clientIP string) {
+	if !l.sampled(&l.requests) {
+		return
+	}
 	l.log(entry{
-		TS:           time.Now().UTC().Format(time.RFC3339),
-		ClawID:       clawID,
-		Type:         "request",
-		Model:        model,
-		Intervention: nil,
+		TS:            time.Now().UTC().Format(time.RFC3339),
+		ClawID:        clawID,
+		Type:          "request",
+		Model:         model,
+		UpstreamModel: upstreamModel,
+		ClientIP:      clientIP,
+		Intervention:  nil,
 	})
 }
 
-func (l *Logger) LogResponse(clawID, model string, statusCode int, latencyMS int64) {
+// LogResponse records a relayed response. Sampling applies only to
+// successes; 4xx and 5xx responses are always written.
+func (l *Logger) LogResponse(clawID, model, upstreamModel string, statusCode int, latencyMS int64) {
+	if statusCode < 400 && !l.sampled(&l.responses) {
+		return
+	}
 	l.log(entry{
-		TS:           time.Now().UTC().Format(time.RFC3339),
-		ClawID:       clawID,
-		Type:         "response",
-		Model:        model,
-		LatencyMS:    ptrI64(latencyMS),
-		StatusCode:   ptrInt(statusCode),
-		Intervention: nil,
+		TS:            time.Now().UTC().Format(time.RFC3339),
+		ClawID:        clawID,
+		Type:          "response",
+		Model:         model,
+		UpstreamModel: upstreamModel,
+		LatencyMS:     ptrI64(latencyMS),
+		StatusCode:    ptrInt(statusCode),
+		Intervention:  nil,
 	})
 }
 
@@ -82,15 +150,19 @@ func (l *Logger) LogError(clawID, model string, statusCode int, latencyMS int64,
 	})
 }
 
-func (l *Logger) LogResponseWithCost(clawID, model string, statusCode int, latencyMS int64, ci *CostInfo) {
+func (l *Logger) LogResponseWithCost(clawID, model, upstreamModel string, statusCode int, latencyMS int64, ci *CostInfo) {
+	if statusCode < 400 && !l.sampled(&l.responses) {
+		return
+	}
 	e := entry{
-		TS:           time.Now().UTC().Format(time.RFC3339),
-		ClawID:       clawID,
-		Type:         "response",
-		Model:        model,
-		LatencyMS:    ptrI64(latencyMS),
-		StatusCode:   ptrInt(statusCode),
-		Intervention: nil,
+		TS:            time.Now().UTC().Format(time.RFC3339),
+		ClawID:        clawID,
+		Type:          "response",
+		Model:         model,
+		UpstreamModel: upstreamModel,
+		LatencyMS:     ptrI64(latencyMS),
+		StatusCode:    ptrInt(statusCode),
+		Intervention:  nil,
 	}
 	if ci != nil {
 		e.TokensIn = ptrInt(ci.InputTokens)
@@ -111,13 +183,197 @@ func (l *Logger) LogIntervention(clawID, model, reason string) {
 	})
 }
 
+// LogRetry records a failed upstream attempt that is about to be retried
+// against the same provider after delay. attempt counts from 1 and names the
+// attempt that failed; statusCode is 0 when no response arrived.
+func (l *Logger) LogRetry(clawID, model, providerName string, attempt, statusCode int, delay time.Duration, err error) {
+	e := entry{
+		TS:           time.Now().UTC().Format(time.RFC3339),
+		ClawID:       clawID,
+		Type:         "retry",
+		Model:        model,
+		Provider:     providerName,
+		Attempt:      ptrInt(attempt),
+		DelayMS:      ptrI64(delay.Milliseconds()),
+		Intervention: nil,
+	}
+	if statusCode != 0 {
+		e.StatusCode = ptrInt(statusCode)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.log(e)
+}
+
+// LogUsageMiss records a completed request that could not be fully
+// accounted: the provider reported no usage, or the model has no price.
+func (l *Logger) LogUsageMiss(clawID, model, upstreamModel, reason string) {
+	l.log(entry{
+		TS:            time.Now().UTC().Format(time.RFC3339),
+		ClawID:        clawID,
+		Type:          "usage_miss",
+		Model:         model,
+		UpstreamModel: upstreamModel,
+		Intervention:  nil,
+		Error:         reason,
+	})
+}
+
+// LogShadow records a shadow copy of a request, sent to providerName's
+// upstreamModel for comparison: its status (0 when no response arrived),
+// latency and, when known, cost. The agent never sees it.
+func (l *Logger) LogShadow(clawID, model, providerName, upstreamModel string, statusCode int, latencyMS int64, ci *CostInfo, err error) {
+	e := entry{
+		TS:            time.Now().UTC().Format(time.RFC3339),
+		ClawID:        clawID,
+		Type:          "shadow",
+		Model:         model,
+		UpstreamModel: upstreamModel,
+		Provider:      providerName,
+		LatencyMS:     ptrI64(latencyMS),
+		Intervention:  nil,
+	}
+	if statusCode != 0 {
+		e.StatusCode = ptrInt(statusCode)
+	}
+	if ci != nil {
+		e.TokensIn = ptrInt(ci.InputTokens)
+		e.TokensOut = ptrInt(ci.OutputTokens)
+		e.CostUSD = ptrF64(ci.CostUSD)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.log(e)
+}
+
+// LogPanic records a panic recovered while serving a request: the panic
+// value as the error, and the goroutine's stack.
+func (l *Logger) LogPanic(clawID string, value any, stack []byte) {
+	l.log(entry{
+		TS:           time.Now().UTC().Format(time.RFC3339),
+		ClawID:       clawID,
+		Type:         "panic",
+		Intervention: nil,
+		Error:        fmt.Sprint(value),
+		Stack:        string(stack),
+	})
+}
+
+// LogProviderChange records an operator edit to the provider registry, or
+// a reveal of a provider's key. The key must already be masked by the caller.
+func (l *Logger) LogProviderChange(action, providerName, maskedKey string) {
+	l.log(entry{
+		TS:           time.Now().UTC().Format(time.RFC3339),
+		Type:         "provider_change",
+		Action:       action,
+		Provider:     providerName,
+		MaskedKey:    maskedKey,
+		Intervention: nil,
+	})
+}
+
+// LogShutdown records a graceful shutdown: the signal received, requests
+// still in flight when it arrived, and how long draining took. A non-nil err
+// means the drain did not complete cleanly.
+func (l *Logger) LogShutdown(signal string, inFlight int, drainMS int64, err error) {
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	l.log(entry{
+		TS:           time.Now().UTC().Format(time.RFC3339),
+		Type:         "shutdown",
+		Signal:       signal,
+		InFlight:     ptrInt(inFlight),
+		DrainMS:      ptrI64(drainMS),
+		Intervention: nil,
+		Error:        errText,
+	})
+}
+
+// LogSummary records the totals served since start: requests, input and
+// output tokens, and cost. It is written once at shutdown as an
+// end-of-run record.
+func (l *Logger) LogSummary(requests, tokensIn, tokensOut int, costUSD float64) {
+	l.log(entry{
+		TS:           time.Now().UTC().Format(time.RFC3339),
+		Type:         "summary",
+		Requests:     ptrInt(requests),
+		TokensIn:     ptrInt(tokensIn),
+		TokensOut:    ptrInt(tokensOut),
+		CostUSD:      ptrF64(costUSD),
+		Intervention: nil,
+	})
+}
+
+// SetSampling keeps only one in every n request entries, and one in every n
+// response entries, to spare log ingestion at high request rates. Errors,
+// interventions and every other entry type are always written. n of one or
+// less logs everything. Call it before the logger is shared.
+func (l *Logger) SetSampling(n int) {
+	if n < 1 {
+		n = 1
+	}
+	l.sampleEvery = uint64(n)
+}
+
+// sampled counts an entry against counter and reports whether it is one of
+// the entries to write: the first, then every sampleEvery-th after it.
+func (l *Logger) sampled(counter *atomic.Uint64) bool {
+	if l == nil || l.sampleEvery <= 1 {
+		return true
+	}
+	return (counter.Add(1)-1)%l.sampleEvery == 0
+}
+
 func (l *Logger) log(e entry) {
 	if l == nil || l.enc == nil {
 		return
 	}
 	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.format == FormatText {
+		_, _ = l.w.Write(e.text())
+		return
+	}
 	_ = l.enc.Encode(e)
-	l.mu.Unlock()
+}
+
+// text renders e as "ts type key=value ...", with the same keys as the JSON
+// form in the same order and empty fields left out. Values containing spaces
+// or quotes are quoted.
+func (e entry) text() []byte {
+	var b bytes.Buffer
+	b.WriteString(e.TS)
+	b.WriteByte(' ')
+	b.WriteString(e.Type)
+	v := reflect.ValueOf(e)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if key == "ts" || key == "type" {
+			continue
+		}
+		f := v.Field(i)
+		if f.Kind() == reflect.Pointer {
+			if f.IsNil() {
+				continue
+			}
+			f = f.Elem()
+		}
+		if f.IsZero() && f.Kind() == reflect.String {
+			continue
+		}
+		val := fmt.Sprint(f.Interface())
+		if strings.ContainsAny(val, " \t\n\"=") {
+			val = strconv.Quote(val)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, val)
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
 }
 
 func ptrInt(v int) *int {
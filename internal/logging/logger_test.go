@@ -3,13 +3,16 @@ package logging
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLogRequestEmitsJSON(t *testing.T) {
 	var buf bytes.Buffer
-	l := New(&buf)
-	l.LogRequest("tiverton", "openai/gpt-4o")
+	l := New(&buf, FormatJSON)
+	l.LogRequest("tiverton", "openai/gpt-4o", "gpt-4o", "10.0.0.7")
 
 	var entry map[string]any
 	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
@@ -24,6 +27,12 @@ func TestLogRequestEmitsJSON(t *testing.T) {
 	if entry["model"] != "openai/gpt-4o" {
 		t.Errorf("expected model, got %v", entry["model"])
 	}
+	if entry["upstream_model"] != "gpt-4o" {
+		t.Errorf("expected upstream_model=gpt-4o, got %v", entry["upstream_model"])
+	}
+	if entry["client_ip"] != "10.0.0.7" {
+		t.Errorf("expected client_ip=10.0.0.7, got %v", entry["client_ip"])
+	}
 	if _, ok := entry["intervention"]; !ok {
 		t.Errorf("expected intervention field to be present")
 	}
@@ -31,8 +40,8 @@ func TestLogRequestEmitsJSON(t *testing.T) {
 
 func TestLogResponseIncludesLatency(t *testing.T) {
 	var buf bytes.Buffer
-	l := New(&buf)
-	l.LogResponse("tiverton", "openai/gpt-4o", 200, 1250)
+	l := New(&buf, FormatJSON)
+	l.LogResponse("tiverton", "openai/gpt-4o", "gpt-4o", 200, 1250)
 
 	var entry map[string]any
 	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
@@ -51,8 +60,8 @@ func TestLogResponseIncludesLatency(t *testing.T) {
 
 func TestLogResponseIncludesCostFields(t *testing.T) {
 	var buf bytes.Buffer
-	l := New(&buf)
-	l.LogResponseWithCost("tiverton", "anthropic/claude-sonnet-4", 200, 1250,
+	l := New(&buf, FormatJSON)
+	l.LogResponseWithCost("tiverton", "anthropic/claude-sonnet-4", "claude-sonnet-4", 200, 1250,
 		&CostInfo{InputTokens: 100, OutputTokens: 50, CostUSD: 0.0105})
 
 	var entry map[string]interface{}
@@ -72,8 +81,8 @@ func TestLogResponseIncludesCostFields(t *testing.T) {
 
 func TestLogResponseWithoutCost(t *testing.T) {
 	var buf bytes.Buffer
-	l := New(&buf)
-	l.LogResponseWithCost("tiverton", "anthropic/claude-sonnet-4", 200, 500, nil)
+	l := New(&buf, FormatJSON)
+	l.LogResponseWithCost("tiverton", "anthropic/claude-sonnet-4", "claude-sonnet-4", 200, 500, nil)
 
 	var entry map[string]interface{}
 	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
@@ -83,3 +92,151 @@ func TestLogResponseWithoutCost(t *testing.T) {
 		t.Error("expected no tokens_in when CostInfo is nil")
 	}
 }
+
+func TestLogProviderChange(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatJSON)
+	l.LogProviderChange("upsert", "openai", "sk-e...1234")
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if entry["type"] != "provider_change" {
+		t.Errorf("expected type=provider_change, got %v", entry["type"])
+	}
+	if entry["action"] != "upsert" {
+		t.Errorf("expected action=upsert, got %v", entry["action"])
+	}
+	if entry["provider"] != "openai" {
+		t.Errorf("expected provider=openai, got %v", entry["provider"])
+	}
+	if entry["masked_key"] != "sk-e...1234" {
+		t.Errorf("expected masked_key, got %v", entry["masked_key"])
+	}
+	if _, ok := entry["claw_id"]; ok {
+		t.Error("expected no claw_id on provider_change entry")
+	}
+}
+
+func TestLogRetryRecordsEachAttempt(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatJSON)
+	l.LogRetry("tiverton", "openai/gpt-4o", "openai", 1, 503, 250*time.Millisecond, nil)
+	l.LogRetry("tiverton", "openai/gpt-4o", "openai", 2, 0, 0, errors.New("connection refused"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %s", len(lines), buf.String())
+	}
+	var first, second map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &second); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	if first["type"] != "retry" || first["provider"] != "openai" || first["attempt"] != float64(1) ||
+		first["status_code"] != float64(503) || first["delay_ms"] != float64(250) {
+		t.Errorf("unexpected retry entry: %v", first)
+	}
+	if second["type"] != "retry" || second["attempt"] != float64(2) || second["error"] != "connection refused" {
+		t.Errorf("unexpected retry entry: %v", second)
+	}
+	if _, ok := second["status_code"]; ok {
+		t.Error("expected no status_code when no response arrived")
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	for in, want := range map[string]Format{"": FormatJSON, "json": FormatJSON, " Text ": FormatText} {
+		if got, err := ParseFormat(in); err != nil || got != want {
+			t.Errorf("ParseFormat(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	if _, err := ParseFormat("logfmt"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatText)
+	l.LogResponseWithCost("tiverton", "openai/gpt-4o", "gpt-4o", 200, 42, &CostInfo{InputTokens: 120, OutputTokens: 30, CostUSD: 0.0015})
+	l.LogError("tiverton", "openai/gpt-4o", 502, 7, errors.New("upstream request failed"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per entry, got %q", buf.String())
+	}
+	ts, rest, _ := strings.Cut(lines[0], " ")
+	if _, err := time.Parse(time.RFC3339, ts); err != nil {
+		t.Errorf("expected the line to start with a timestamp, got %q", lines[0])
+	}
+	want := "response claw_id=tiverton model=openai/gpt-4o upstream_model=gpt-4o latency_ms=42 status_code=200 tokens_in=120 tokens_out=30 cost_usd=0.0015"
+	if rest != want {
+		t.Errorf("unexpected text entry:\n got %q\nwant %q", rest, want)
+	}
+	if !strings.Contains(lines[1], ` error="upstream request failed"`) {
+		t.Errorf("expected a quoted error value, got %q", lines[1])
+	}
+	if strings.Contains(buf.String(), "{") {
+		t.Errorf("expected no JSON in text output, got %q", buf.String())
+	}
+}
+
+func TestUnknownFormatFallsBackToJSON(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, Format("yaml")).LogRequest("tiverton", "openai/gpt-4o", "gpt-4o", "")
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected JSON, got %q", buf.String())
+	}
+}
+
+func TestSamplingKeepsOneInNRequestsAndResponses(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatJSON)
+	l.SetSampling(10)
+	for i := 0; i < 1000; i++ {
+		l.LogRequest("tiverton", "openai/gpt-4o", "gpt-4o", "")
+		if i%2 == 0 {
+			l.LogResponse("tiverton", "openai/gpt-4o", "gpt-4o", 200, 5)
+		} else {
+			l.LogResponseWithCost("tiverton", "openai/gpt-4o", "gpt-4o", 200, 5, &CostInfo{InputTokens: 1})
+		}
+		if i%100 == 0 {
+			l.LogError("tiverton", "openai/gpt-4o", 502, 5, errors.New("boom"))
+			l.LogIntervention("tiverton", "openai/gpt-4o", "prompt_limit")
+		}
+	}
+
+	counts := map[string]int{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e map[string]any
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		counts[e["type"].(string)]++
+	}
+	if counts["request"] != 100 || counts["response"] != 100 {
+		t.Errorf("expected 1 in 10 requests and responses kept, got %v", counts)
+	}
+	if counts["error"] != 10 || counts["intervention"] != 10 {
+		t.Errorf("expected every error and intervention kept, got %v", counts)
+	}
+}
+
+func TestSamplingKeepsErrorResponses(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatJSON)
+	l.SetSampling(10)
+	for i := 0; i < 20; i++ {
+		l.LogResponse("tiverton", "openai/gpt-4o", "gpt-4o", 429, 5)
+		l.LogResponseWithCost("tiverton", "openai/gpt-4o", "gpt-4o", 500, 5, &CostInfo{InputTokens: 1})
+	}
+	if n := strings.Count(buf.String(), `"type":"response"`); n != 40 {
+		t.Errorf("expected every 4xx/5xx response kept, got %d of 40", n)
+	}
+}
@@ -0,0 +1,326 @@
+// Package openai models the parts of the OpenAI chat completions API the
+// proxy inspects or rewrites. Every type keeps fields it does not model in
+// Extra, so decoding and re-encoding a body never drops provider-specific
+// parameters.
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ChatCompletionRequest is a /v1/chat/completions (or legacy /v1/completions)
+// request body. Optional fields are pointers so that absent and zero values
+// stay distinguishable on re-encode.
+type ChatCompletionRequest struct {
+	Model         string
+	Messages      []Message
+	Stream        *bool
+	MaxTokens     *int
+	StreamOptions *StreamOptions
+	Extra         map[string]json.RawMessage
+}
+
+// StreamOptions mirrors the stream_options request field.
+type StreamOptions struct {
+	IncludeUsage bool
+	Extra        map[string]json.RawMessage
+}
+
+// Message is one chat message. Content stays raw because it may be a string
+// or an array of content parts.
+type Message struct {
+	Role    string
+	Content json.RawMessage
+	Extra   map[string]json.RawMessage
+}
+
+// ChatCompletionResponse is a non-streaming chat completion.
+type ChatCompletionResponse struct {
+	ID      string
+	Object  string
+	Created int64
+	Model   string
+	Choices []Choice
+	Usage   *Usage
+	Extra   map[string]json.RawMessage
+}
+
+// Choice is one entry of ChatCompletionResponse.Choices.
+type Choice struct {
+	Index        int
+	Message      Message
+	FinishReason string
+	Extra        map[string]json.RawMessage
+}
+
+// Usage reports token counts for a completion.
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Extra            map[string]json.RawMessage
+}
+
+// IsStream reports whether the client asked for a streamed response.
+func (r *ChatCompletionRequest) IsStream() bool {
+	return r.Stream != nil && *r.Stream
+}
+
+// SessionID returns metadata.session_id, or "" when absent.
+func (r *ChatCompletionRequest) SessionID() string {
+	var meta struct {
+		SessionID string `json:"session_id"`
+	}
+	if raw, ok := r.Extra["metadata"]; ok {
+		_ = json.Unmarshal(raw, &meta)
+	}
+	return strings.TrimSpace(meta.SessionID)
+}
+
+// Roles lists the message roles Validate accepts.
+var Roles = []string{"system", "developer", "user", "assistant", "tool", "function"}
+
+// Validate checks the minimum a chat completions request needs: at least
+// one message, each with a known role. Everything else, including unknown
+// fields, is left for the provider to judge.
+func (r *ChatCompletionRequest) Validate() error {
+	if len(r.Messages) == 0 {
+		return errors.New("messages must be a non-empty array")
+	}
+	for i, m := range r.Messages {
+		if !slices.Contains(Roles, m.Role) {
+			return fmt.Errorf("messages[%d].role %q is not one of %s", i, m.Role, strings.Join(Roles, ", "))
+		}
+	}
+	return nil
+}
+
+func (r *ChatCompletionRequest) UnmarshalJSON(data []byte) error {
+	f, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	*r = ChatCompletionRequest{}
+	if err := f.take("model", &r.Model); err != nil {
+		return err
+	}
+	if err := f.take("messages", &r.Messages); err != nil {
+		return err
+	}
+	if err := f.take("stream", &r.Stream); err != nil {
+		return err
+	}
+	if err := f.take("max_tokens", &r.MaxTokens); err != nil {
+		return err
+	}
+	if err := f.take("stream_options", &r.StreamOptions); err != nil {
+		return err
+	}
+	r.Extra = f.rest()
+	return nil
+}
+
+func (r ChatCompletionRequest) MarshalJSON() ([]byte, error) {
+	f := withExtra(r.Extra)
+	f.put("model", r.Model, true)
+	f.put("messages", r.Messages, r.Messages != nil)
+	f.put("stream", r.Stream, r.Stream != nil)
+	f.put("max_tokens", r.MaxTokens, r.MaxTokens != nil)
+	f.put("stream_options", r.StreamOptions, r.StreamOptions != nil)
+	return f.encode()
+}
+
+func (o *StreamOptions) UnmarshalJSON(data []byte) error {
+	f, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	*o = StreamOptions{}
+	if err := f.take("include_usage", &o.IncludeUsage); err != nil {
+		return err
+	}
+	o.Extra = f.rest()
+	return nil
+}
+
+func (o StreamOptions) MarshalJSON() ([]byte, error) {
+	f := withExtra(o.Extra)
+	f.put("include_usage", o.IncludeUsage, true)
+	return f.encode()
+}
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	f, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	*m = Message{}
+	if err := f.take("role", &m.Role); err != nil {
+		return err
+	}
+	if raw, ok := f["content"]; ok {
+		m.Content = raw
+		delete(f, "content")
+	}
+	m.Extra = f.rest()
+	return nil
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	f := withExtra(m.Extra)
+	f.put("role", m.Role, true)
+	if m.Content != nil {
+		f.f["content"] = m.Content
+	}
+	return f.encode()
+}
+
+func (r *ChatCompletionResponse) UnmarshalJSON(data []byte) error {
+	f, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	*r = ChatCompletionResponse{}
+	for key, dst := range map[string]any{
+		"id": &r.ID, "object": &r.Object, "created": &r.Created, "model": &r.Model,
+		"choices": &r.Choices, "usage": &r.Usage,
+	} {
+		if err := f.take(key, dst); err != nil {
+			return err
+		}
+	}
+	r.Extra = f.rest()
+	return nil
+}
+
+func (r ChatCompletionResponse) MarshalJSON() ([]byte, error) {
+	f := withExtra(r.Extra)
+	f.put("id", r.ID, true)
+	f.put("object", r.Object, true)
+	f.put("created", r.Created, true)
+	f.put("model", r.Model, true)
+	f.put("choices", r.Choices, true)
+	f.put("usage", r.Usage, r.Usage != nil)
+	return f.encode()
+}
+
+func (c *Choice) UnmarshalJSON(data []byte) error {
+	f, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	*c = Choice{}
+	for key, dst := range map[string]any{
+		"index": &c.Index, "message": &c.Message, "finish_reason": &c.FinishReason,
+	} {
+		if err := f.take(key, dst); err != nil {
+			return err
+		}
+	}
+	c.Extra = f.rest()
+	return nil
+}
+
+func (c Choice) MarshalJSON() ([]byte, error) {
+	f := withExtra(c.Extra)
+	f.put("index", c.Index, true)
+	f.put("message", c.Message, true)
+	f.put("finish_reason", c.FinishReason, true)
+	return f.encode()
+}
+
+func (u *Usage) UnmarshalJSON(data []byte) error {
+	f, err := decodeFields(data)
+	if err != nil {
+		return err
+	}
+	*u = Usage{}
+	for key, dst := range map[string]any{
+		"prompt_tokens": &u.PromptTokens, "completion_tokens": &u.CompletionTokens, "total_tokens": &u.TotalTokens,
+	} {
+		if err := f.take(key, dst); err != nil {
+			return err
+		}
+	}
+	u.Extra = f.rest()
+	return nil
+}
+
+func (u Usage) MarshalJSON() ([]byte, error) {
+	f := withExtra(u.Extra)
+	f.put("prompt_tokens", u.PromptTokens, true)
+	f.put("completion_tokens", u.CompletionTokens, true)
+	f.put("total_tokens", u.TotalTokens, true)
+	return f.encode()
+}
+
+// fields is a JSON object split into its members, used to peel off the
+// modelled keys and keep the rest verbatim.
+type fields map[string]json.RawMessage
+
+func decodeFields(data []byte) (fields, error) {
+	var f fields
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	if f == nil {
+		f = fields{}
+	}
+	return f, nil
+}
+
+// take decodes key into dst, if present, and removes it. A JSON null leaves
+// dst at its zero value.
+func (f fields) take(key string, dst any) error {
+	raw, ok := f[key]
+	if !ok {
+		return nil
+	}
+	delete(f, key)
+	return json.Unmarshal(raw, dst)
+}
+
+func (f fields) rest() map[string]json.RawMessage {
+	if len(f) == 0 {
+		return nil
+	}
+	return f
+}
+
+// encoder rebuilds an object from its Extra members plus modelled fields.
+type encoder struct {
+	f   fields
+	err error
+}
+
+func withExtra(extra map[string]json.RawMessage) *encoder {
+	f := make(fields, len(extra)+6)
+	for k, v := range extra {
+		f[k] = v
+	}
+	return &encoder{f: f}
+}
+
+// put encodes v under key when include is true.
+func (e *encoder) put(key string, v any, include bool) {
+	if !include || e.err != nil {
+		return
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		e.err = err
+		return
+	}
+	e.f[key] = raw
+}
+
+func (e *encoder) encode() ([]byte, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return json.Marshal(map[string]json.RawMessage(e.f))
+}
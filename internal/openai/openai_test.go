@@ -0,0 +1,121 @@
+package openai
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestRoundTripPreservesUnknownFields(t *testing.T) {
+	in := `{
+		"model": "openai/gpt-4o",
+		"messages": [
+			{"role": "system", "content": "be brief"},
+			{"role": "user", "content": [{"type": "text", "text": "hi"}], "name": "ops"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function"}]}
+		],
+		"stream": false,
+		"max_tokens": 256,
+		"stream_options": {"include_usage": true, "x_vendor": 1},
+		"temperature": 0.2,
+		"seed": 12345678901234567,
+		"metadata": {"session_id": " conv-1 "},
+		"response_format": {"type": "json_object"}
+	}`
+
+	var req ChatCompletionRequest
+	if err := json.Unmarshal([]byte(in), &req); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if req.Model != "openai/gpt-4o" || len(req.Messages) != 3 || req.IsStream() || *req.MaxTokens != 256 {
+		t.Fatalf("unexpected typed fields: %+v", req)
+	}
+	if !req.StreamOptions.IncludeUsage {
+		t.Error("expected stream_options.include_usage")
+	}
+	if req.SessionID() != "conv-1" {
+		t.Errorf("expected session conv-1, got %q", req.SessionID())
+	}
+
+	out, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var want, got any
+	_ = json.Unmarshal([]byte(in), &want)
+	_ = json.Unmarshal(out, &got)
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("round trip changed body:\nwant %s\ngot  %s", in, out)
+	}
+	if string(req.Extra["seed"]) != "12345678901234567" {
+		t.Errorf("expected large integer kept verbatim, got %s", req.Extra["seed"])
+	}
+}
+
+func TestRequestOmitsAbsentOptionalFields(t *testing.T) {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal([]byte(`{"model":"m","prompt":"once upon"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	req.Model = "gpt-3.5-turbo-instruct"
+	out, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"model":"gpt-3.5-turbo-instruct","prompt":"once upon"}` {
+		t.Errorf("unexpected body: %s", out)
+	}
+}
+
+func TestResponseRoundTripPreservesUnknownFields(t *testing.T) {
+	in := `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"gpt-4o",
+		"system_fingerprint":"fp_1",
+		"choices":[{"index":0,"message":{"role":"assistant","content":"hi","refusal":null},"finish_reason":"stop","logprobs":null}],
+		"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15,"prompt_tokens_details":{"cached_tokens":8}}}`
+
+	var resp ChatCompletionResponse
+	if err := json.Unmarshal([]byte(in), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Usage == nil || resp.Usage.PromptTokens != 12 || resp.Choices[0].FinishReason != "stop" {
+		t.Fatalf("unexpected typed fields: %+v", resp)
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	var want, got any
+	_ = json.Unmarshal([]byte(in), &want)
+	_ = json.Unmarshal(out, &got)
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("round trip changed body:\nwant %s\ngot  %s", in, out)
+	}
+}
+
+func TestRequestValidate(t *testing.T) {
+	cases := []struct {
+		body    string
+		wantErr string
+	}{
+		{`{"model":"gpt-4o","messages":[{"role":"system","content":"s"},{"role":"user","content":"hi"}]}`, ""},
+		{`{"model":"gpt-4o"}`, "non-empty array"},
+		{`{"model":"gpt-4o","messages":[]}`, "non-empty array"},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"},{"content":"no role"}]}`, `messages[1].role ""`},
+		{`{"model":"gpt-4o","messages":[{"role":"robot","content":"hi"}]}`, `messages[0].role "robot"`},
+	}
+	for _, c := range cases {
+		var req ChatCompletionRequest
+		if err := json.Unmarshal([]byte(c.body), &req); err != nil {
+			t.Fatalf("%s: %v", c.body, err)
+		}
+		err := req.Validate()
+		switch {
+		case c.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", c.body, err)
+		case c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)):
+			t.Errorf("%s: expected error containing %q, got %v", c.body, c.wantErr, err)
+		}
+	}
+}
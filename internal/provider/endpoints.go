@@ -0,0 +1,120 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints returns the base URLs p can be reached at: BaseURL followed by
+// any regional BaseURLs, without blanks or duplicates.
+func (p *Provider) Endpoints() []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, u := range append([]string{p.BaseURL}, p.BaseURLs...) {
+		u = strings.TrimSpace(u)
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		out = append(out, u)
+	}
+	return out
+}
+
+// EndpointSelector picks which of a multi-endpoint provider's base URLs a
+// request goes to: the lowest-latency reachable one as of the last probe,
+// or, before any probe has answered or with probing off, each in turn.
+type EndpointSelector struct {
+	reg     *Registry
+	client  *http.Client
+	timeout time.Duration
+
+	mu      sync.Mutex
+	latency map[string]Health // by endpoint URL, from the last probe
+	next    map[string]int    // round-robin position by provider
+}
+
+// NewEndpointSelector returns a selector for reg's providers.
+func NewEndpointSelector(reg *Registry) *EndpointSelector {
+	return &EndpointSelector{
+		reg:     reg,
+		client:  &http.Client{},
+		timeout: 2 * time.Second,
+		latency: make(map[string]Health),
+		next:    make(map[string]int),
+	}
+}
+
+// Pick returns the base URL to use for p's next request.
+func (s *EndpointSelector) Pick(p *Provider) string {
+	endpoints := p.Endpoints()
+	if len(endpoints) < 2 {
+		return p.BaseURL
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	best := ""
+	var bestMS int64
+	for _, u := range endpoints {
+		h, ok := s.latency[u]
+		if !ok || !h.Reachable {
+			continue
+		}
+		if best == "" || h.LatencyMS < bestMS {
+			best, bestMS = u, h.LatencyMS
+		}
+	}
+	if best != "" {
+		return best
+	}
+	i := s.next[p.Name] % len(endpoints)
+	s.next[p.Name] = i + 1
+	return endpoints[i]
+}
+
+// Probe measures every endpoint of each multi-endpoint provider once, in
+// parallel. As with HealthChecker, any HTTP response counts as reachable.
+func (s *EndpointSelector) Probe(ctx context.Context) {
+	results := make(map[string]Health)
+	var rmu sync.Mutex
+	var wg sync.WaitGroup
+	for _, p := range s.reg.All() {
+		endpoints := p.Endpoints()
+		if len(endpoints) < 2 {
+			continue
+		}
+		for _, u := range endpoints {
+			wg.Add(1)
+			go func(u string) {
+				defer wg.Done()
+				h := probeURL(ctx, s.client, s.timeout, u)
+				rmu.Lock()
+				results[u] = h
+				rmu.Unlock()
+			}(u)
+		}
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	s.latency = results
+	s.mu.Unlock()
+}
+
+// Run probes immediately and then every interval until ctx is done.
+func (s *EndpointSelector) Run(ctx context.Context, interval time.Duration) {
+	s.Probe(ctx)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Probe(ctx)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health is the result of a reachability probe against one provider.
+type Health struct {
+	Reachable bool   `json:"reachable"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HealthChecker probes each registered provider's base URL and caches the
+// results for a short TTL so frequent health polls don't hit upstreams.
+type HealthChecker struct {
+	reg     *Registry
+	client  *http.Client
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu        sync.Mutex
+	cached    map[string]Health
+	checkedAt time.Time
+	now       func() time.Time
+}
+
+// NewHealthChecker returns a checker for reg that reuses results for ttl.
+func NewHealthChecker(reg *Registry, ttl time.Duration) *HealthChecker {
+	return &HealthChecker{
+		reg:     reg,
+		client:  &http.Client{},
+		ttl:     ttl,
+		timeout: 2 * time.Second,
+		now:     time.Now,
+	}
+}
+
+// Check returns the reachability of every provider, probing in parallel
+// when the cached results are older than the TTL. Any HTTP response counts
+// as reachable; only transport failures and timeouts do not.
+func (c *HealthChecker) Check(ctx context.Context) map[string]Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cached != nil && c.now().Sub(c.checkedAt) < c.ttl {
+		return copyHealth(c.cached)
+	}
+
+	providers := c.reg.All()
+	results := make(map[string]Health, len(providers))
+	var wg sync.WaitGroup
+	var rmu sync.Mutex
+	for name, p := range providers {
+		wg.Add(1)
+		go func(name, baseURL string) {
+			defer wg.Done()
+			h := probeURL(ctx, c.client, c.timeout, baseURL)
+			rmu.Lock()
+			results[name] = h
+			rmu.Unlock()
+		}(name, p.BaseURL)
+	}
+	wg.Wait()
+
+	c.cached = results
+	c.checkedAt = c.now()
+	return copyHealth(results)
+}
+
+func probeURL(ctx context.Context, client *http.Client, timeout time.Duration, baseURL string) Health {
+	if baseURL == "" {
+		return Health{Error: "no base_url configured"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+	if err != nil {
+		return Health{Error: err.Error()}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start).Milliseconds()
+	if err != nil {
+		return Health{LatencyMS: latency, Error: err.Error()}
+	}
+	resp.Body.Close()
+	return Health{Reachable: true, LatencyMS: latency}
+}
+
+func copyHealth(m map[string]Health) map[string]Health {
+	out := make(map[string]Health, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
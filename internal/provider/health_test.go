@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerReachability(t *testing.T) {
+	var hits atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusUnauthorized) // any response means reachable
+	}))
+	defer up.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downURL := "http://" + ln.Addr().String() + "/v1"
+	ln.Close()
+
+	r := NewRegistry("")
+	r.Set("openai", &Provider{BaseURL: up.URL + "/v1"})
+	r.Set("ollama", &Provider{BaseURL: downURL})
+
+	now := time.Unix(1_700_000_000, 0)
+	c := NewHealthChecker(r, 10*time.Second)
+	c.now = func() time.Time { return now }
+
+	got := c.Check(context.Background())
+	if !got["openai"].Reachable || got["openai"].Error != "" {
+		t.Errorf("expected openai reachable, got %+v", got["openai"])
+	}
+	if got["ollama"].Reachable || got["ollama"].Error == "" {
+		t.Errorf("expected ollama unreachable with error, got %+v", got["ollama"])
+	}
+
+	c.Check(context.Background())
+	if hits.Load() != 1 {
+		t.Fatalf("expected cached result within TTL, got %d probes", hits.Load())
+	}
+	now = now.Add(11 * time.Second)
+	c.Check(context.Background())
+	if hits.Load() != 2 {
+		t.Fatalf("expected re-probe after TTL, got %d probes", hits.Load())
+	}
+}
+
+func TestEndpointSelectorPrefersFasterEndpoint(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	r := NewRegistry("")
+	r.Set("gateway", &Provider{BaseURL: slow.URL + "/v1", BaseURLs: []string{fast.URL + "/v1"}})
+	p, _ := r.Get("gateway")
+	s := NewEndpointSelector(r)
+
+	// Before any probe, requests rotate.
+	if a, b := s.Pick(p), s.Pick(p); a == b {
+		t.Errorf("expected round-robin before probing, got %s twice", a)
+	}
+
+	s.Probe(context.Background())
+	for i := 0; i < 3; i++ {
+		if got := s.Pick(p); got != fast.URL+"/v1" {
+			t.Fatalf("expected the faster endpoint, got %s", got)
+		}
+	}
+
+	single := &Provider{Name: "openai", BaseURL: "https://api.openai.com/v1"}
+	if got := s.Pick(single); got != single.BaseURL {
+		t.Errorf("expected a single-endpoint provider untouched, got %s", got)
+	}
+}
+
+func TestEndpointSelectorSkipsUnreachableEndpoints(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer up.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downURL := "http://" + ln.Addr().String() + "/v1"
+	ln.Close()
+
+	r := NewRegistry("")
+	r.Set("gateway", &Provider{BaseURL: downURL, BaseURLs: []string{up.URL + "/v1", downURL}})
+	p, _ := r.Get("gateway")
+	if got := len(p.Endpoints()); got != 2 {
+		t.Fatalf("expected duplicate endpoints dropped, got %d", got)
+	}
+	s := NewEndpointSelector(r)
+	s.Probe(context.Background())
+	if got := s.Pick(p); got != up.URL+"/v1" {
+		t.Errorf("expected the reachable endpoint, got %s", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -15,8 +16,156 @@ type Provider struct {
 	Name      string `json:"name,omitempty"`
 	BaseURL   string `json:"base_url"`
 	APIKey    string `json:"api_key,omitempty"`
-	Auth      string `json:"auth,omitempty"`       // "bearer" (default), "none", "x-api-key"
+	Auth      string `json:"auth,omitempty"`       // "bearer" (default), "none", "x-api-key", "hmac"
 	APIFormat string `json:"api_format,omitempty"` // "openai" (default), "anthropic"
+
+	// DefaultModel is used when a request names the provider but no model
+	// (e.g. "ollama/").
+	DefaultModel string `json:"default_model,omitempty"`
+
+	// Pricing adds or overrides per-model rates for this provider, for
+	// self-hosted or custom models missing from the built-in table.
+	Pricing map[string]ModelPrice `json:"pricing,omitempty"`
+
+	// Free prices every model of this provider not listed in Pricing at
+	// zero, so a self-hosted backend's tokens are counted at $0.00 instead
+	// of as an unpriced model.
+	Free bool `json:"free,omitempty"`
+
+	// StatusMap rewrites upstream status codes before they reach the agent,
+	// for providers with non-standard codes (e.g. {"418": 429} so clients
+	// back off and retry). Unlisted codes pass through.
+	StatusMap map[int]int `json:"status_map,omitempty"`
+
+	// NormalizeModelCase lowercases the upstream model before it is
+	// forwarded and priced, for providers whose model IDs are all lowercase
+	// but whose agents send mixed case. Off by default: some providers'
+	// model IDs are case-sensitive.
+	NormalizeModelCase bool `json:"normalize_model_case,omitempty"`
+
+	// QueryParams are added to every upstream URL, for gateways that need a
+	// static parameter such as Azure's api-version. A parameter the client
+	// already sent wins unless OverrideQueryParams is set.
+	QueryParams         map[string]string `json:"query_params,omitempty"`
+	OverrideQueryParams bool              `json:"override_query_params,omitempty"`
+
+	// InsecureSkipVerify accepts any TLS certificate from this provider, for
+	// internal gateways with self-signed certs. It disables protection
+	// against interception of the API key, so it is off by default and
+	// warned about whenever providers.json is loaded.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// MaxResponseBytes caps a non-streaming response body; larger bodies
+	// are answered with a 502 instead of being relayed. Streams are exempt.
+	// Zero means no limit.
+	MaxResponseBytes int64 `json:"max_response_bytes,omitempty"`
+
+	// BlockedModels lists upstream models this provider must not be asked
+	// for, matched case-insensitively; "*" matches any run of characters,
+	// so "claude-opus-*" blocks every Opus release.
+	BlockedModels []string `json:"blocked_models,omitempty"`
+
+	// SigningSecret is the shared secret for auth "hmac": each request body
+	// is signed with HMAC-SHA256 and the hex digest sent in SigningHeader
+	// (X-Signature by default), for gateways that verify callers that way.
+	SigningSecret string `json:"signing_secret,omitempty"`
+	SigningHeader string `json:"signing_header,omitempty"`
+
+	// BaseURLs are further regional endpoints serving the same API as
+	// BaseURL; see Endpoints and EndpointSelector.
+	BaseURLs []string `json:"base_urls,omitempty"`
+}
+
+// SignatureHeader returns the header that carries p's request signature.
+func (p *Provider) SignatureHeader() string {
+	if h := strings.TrimSpace(p.SigningHeader); h != "" {
+		return h
+	}
+	return "X-Signature"
+}
+
+// UpstreamModel returns model as it should be sent to p.
+func (p *Provider) UpstreamModel(model string) string {
+	if p.NormalizeModelCase {
+		return strings.ToLower(model)
+	}
+	return model
+}
+
+// ModelBlocked reports whether model matches one of p's BlockedModels.
+func (p *Provider) ModelBlocked(model string) bool {
+	model = strings.ToLower(model)
+	for _, pattern := range p.BlockedModels {
+		if globMatch(strings.ToLower(strings.TrimSpace(pattern)), model) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches s against pattern, where "*" stands for any run of
+// characters, slashes included, and everything else is literal.
+func globMatch(pattern, s string) bool {
+	if pattern == "" {
+		return false
+	}
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return s == pattern
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, last)
+}
+
+// ModelPrice is a per-million-token rate in USD, as written in providers.json.
+type ModelPrice struct {
+	InputPerMTok  float64 `json:"input_per_mtok"`
+	OutputPerMTok float64 `json:"output_per_mtok"`
+}
+
+// AuthModes lists the accepted values of Provider.Auth.
+var AuthModes = []string{"bearer", "x-api-key", "none", "hmac"}
+
+// ValidateAuth checks an auth mode, after trimming and lowercasing, against
+// AuthModes. An empty mode is valid and means the provider default.
+func ValidateAuth(auth string) error {
+	auth = normalizeName(auth)
+	if auth == "" {
+		return nil
+	}
+	for _, m := range AuthModes {
+		if auth == m {
+			return nil
+		}
+	}
+	for _, m := range AuthModes {
+		if strings.ReplaceAll(auth, "_", "-") == m {
+			return fmt.Errorf("unsupported auth %q (did you mean %q?)", auth, m)
+		}
+	}
+	return fmt.Errorf("unsupported auth %q (want %s)", auth, strings.Join(AuthModes, ", "))
+}
+
+// ValidateStatusMap checks that every source and target in m is an HTTP
+// status code (100-599).
+func ValidateStatusMap(m map[int]int) error {
+	for from, to := range m {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			return fmt.Errorf("invalid status_map entry %d -> %d (codes must be 100-599)", from, to)
+		}
+	}
+	return nil
 }
 
 // Registry manages known providers; it is safe for concurrent use.
@@ -24,6 +173,28 @@ type Registry struct {
 	mu        sync.RWMutex
 	providers map[string]*Provider
 	authDir   string
+
+	warnf        func(format string, args ...any)
+	enforcePerms bool
+}
+
+// RegistryOption configures optional Registry behaviour.
+type RegistryOption func(*Registry)
+
+// WithWarnf routes non-fatal warnings, such as an over-permissive
+// providers.json, to fn.
+func WithWarnf(fn func(format string, args ...any)) RegistryOption {
+	return func(r *Registry) {
+		r.warnf = fn
+	}
+}
+
+// WithEnforcePerms makes SaveToFile reset providers.json to 0600 even when
+// the existing file was created with looser permissions.
+func WithEnforcePerms(enabled bool) RegistryOption {
+	return func(r *Registry) {
+		r.enforcePerms = enabled
+	}
 }
 
 var knownProviders = map[string]string{
@@ -46,41 +217,98 @@ var envBaseURLMap = map[string]string{
 	"OLLAMA_BASE_URL":     "ollama",
 }
 
-func NewRegistry(authDir string) *Registry {
-	return &Registry{
+// KnownBaseURL returns the default base URL for a well-known provider name,
+// or "" when the provider has no built-in default.
+func KnownBaseURL(name string) string {
+	return knownProviders[normalizeName(name)]
+}
+
+// Known returns the built-in providers, sorted by name, with the base URL,
+// auth scheme and API format a new entry for each would default to.
+func Known() []Provider {
+	out := make([]Provider, 0, len(knownProviders))
+	for name, baseURL := range knownProviders {
+		out = append(out, Provider{Name: name, BaseURL: baseURL, Auth: defaultAuth(name), APIFormat: defaultAPIFormat(name)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func NewRegistry(authDir string, opts ...RegistryOption) *Registry {
+	r := &Registry{
 		providers: make(map[string]*Provider),
 		authDir:   authDir,
 	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
-// LoadFromFile reads providers.json from the auth directory.
+// LoadFromFile reads providers.json from the auth directory and merges it
+// into the registry. Providers absent from the file are left in place; use
+// Reload to make the registry match the file exactly.
 func (r *Registry) LoadFromFile() error {
+	loaded, err := r.readFile()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n, p := range loaded {
+		r.providers[n] = p
+	}
+	return nil
+}
+
+// Reload rebuilds the registry from providers.json plus env overlays and
+// swaps it in atomically, so providers removed from the file disappear.
+// On error the current providers are kept.
+func (r *Registry) Reload() error {
+	loaded, err := r.readFile()
+	if err != nil {
+		return err
+	}
+	applyEnv(loaded)
+	r.mu.Lock()
+	r.providers = loaded
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Registry) readFile() (map[string]*Provider, error) {
+	out := make(map[string]*Provider)
 	if r.authDir == "" {
-		return nil
+		return out, nil
 	}
 	path := filepath.Join(r.authDir, "providers.json")
 	data, err := os.ReadFile(path)
 	if os.IsNotExist(err) {
-		return nil
+		return out, nil
 	}
 	if err != nil {
-		return fmt.Errorf("read providers.json: %w", err)
+		return nil, fmt.Errorf("read providers.json: %w", err)
 	}
+	r.checkPerms(path)
 
 	var cfg struct {
 		Providers map[string]Provider `json:"providers"`
 	}
 	if err := json.Unmarshal(data, &cfg); err != nil {
-		return fmt.Errorf("parse providers.json: %w", err)
+		return nil, fmt.Errorf("parse providers.json: %w", err)
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
 	for name, p := range cfg.Providers {
 		n := normalizeName(name)
 		if n == "" {
 			continue
 		}
+		if err := ValidateStatusMap(p.StatusMap); err != nil {
+			return nil, fmt.Errorf("parse providers.json: provider %q: %w", n, err)
+		}
+		if p.MaxResponseBytes < 0 {
+			return nil, fmt.Errorf("parse providers.json: provider %q: max_response_bytes must not be negative", n)
+		}
 		cp := p
 		cp.Name = n
 		if cp.BaseURL == "" {
@@ -92,10 +320,12 @@ func (r *Registry) LoadFromFile() error {
 		if cp.APIFormat == "" {
 			cp.APIFormat = defaultAPIFormat(n)
 		}
-		r.providers[n] = &cp
+		if cp.InsecureSkipVerify && r.warnf != nil {
+			r.warnf("provider %q has insecure_skip_verify set; TLS certificates from %s are NOT verified", n, cp.BaseURL)
+		}
+		out[n] = &cp
 	}
-
-	return nil
+	return out, nil
 }
 
 // LoadFromEnv overlays known provider keys/base URLs from env vars.
@@ -103,18 +333,21 @@ func (r *Registry) LoadFromFile() error {
 func (r *Registry) LoadFromEnv() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	applyEnv(r.providers)
+}
 
+func applyEnv(providers map[string]*Provider) {
 	for envKey, provName := range envBaseURLMap {
 		v := strings.TrimSpace(os.Getenv(envKey))
 		if v == "" {
 			continue
 		}
-		p, ok := r.providers[provName]
+		p, ok := providers[provName]
 		if !ok {
 			p = &Provider{Name: provName, Auth: defaultAuth(provName), APIFormat: defaultAPIFormat(provName)}
 		}
 		p.BaseURL = v
-		r.providers[provName] = p
+		providers[provName] = p
 	}
 
 	for envKey, provName := range envKeyMap {
@@ -122,7 +355,7 @@ func (r *Registry) LoadFromEnv() {
 		if v == "" {
 			continue
 		}
-		p, ok := r.providers[provName]
+		p, ok := providers[provName]
 		if !ok {
 			p = &Provider{Name: provName, BaseURL: knownProviders[provName], Auth: defaultAuth(provName), APIFormat: defaultAPIFormat(provName)}
 		}
@@ -136,7 +369,7 @@ func (r *Registry) LoadFromEnv() {
 			p.APIFormat = defaultAPIFormat(provName)
 		}
 		p.APIKey = v
-		r.providers[provName] = p
+		providers[provName] = p
 	}
 }
 
@@ -147,6 +380,7 @@ func (r *Registry) Set(name string, p *Provider) {
 	}
 	cp := *p
 	cp.Name = n
+	cp.Auth = normalizeName(cp.Auth)
 	if cp.BaseURL == "" {
 		cp.BaseURL = knownProviders[n]
 	}
@@ -222,11 +456,24 @@ func (r *Registry) SaveToFile() error {
 	providers := make(map[string]Provider, len(r.providers))
 	for name, p := range r.providers {
 		providers[name] = Provider{
-			Name:      "",
-			BaseURL:   p.BaseURL,
-			APIKey:    p.APIKey,
-			Auth:      p.Auth,
-			APIFormat: p.APIFormat,
+			Name:                "",
+			BaseURL:             p.BaseURL,
+			APIKey:              p.APIKey,
+			Auth:                p.Auth,
+			APIFormat:           p.APIFormat,
+			DefaultModel:        p.DefaultModel,
+			Pricing:             p.Pricing,
+			Free:                p.Free,
+			StatusMap:           p.StatusMap,
+			NormalizeModelCase:  p.NormalizeModelCase,
+			QueryParams:         p.QueryParams,
+			OverrideQueryParams: p.OverrideQueryParams,
+			InsecureSkipVerify:  p.InsecureSkipVerify,
+			MaxResponseBytes:    p.MaxResponseBytes,
+			BlockedModels:       p.BlockedModels,
+			SigningSecret:       p.SigningSecret,
+			SigningHeader:       p.SigningHeader,
+			BaseURLs:            p.BaseURLs,
 		}
 	}
 	r.mu.RUnlock()
@@ -239,12 +486,34 @@ func (r *Registry) SaveToFile() error {
 	if err != nil {
 		return fmt.Errorf("marshal providers.json: %w", err)
 	}
-	if err := os.WriteFile(filepath.Join(r.authDir, "providers.json"), data, 0o600); err != nil {
+	path := filepath.Join(r.authDir, "providers.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
 		return fmt.Errorf("write providers.json: %w", err)
 	}
+	if r.enforcePerms {
+		// WriteFile keeps the mode of an existing file.
+		if err := os.Chmod(path, 0o600); err != nil {
+			return fmt.Errorf("chmod providers.json: %w", err)
+		}
+	}
 	return nil
 }
 
+// checkPerms warns when providers.json, which holds plaintext API keys, is
+// readable by group or others.
+func (r *Registry) checkPerms(path string) {
+	if r.warnf == nil || runtime.GOOS == "windows" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if mode := info.Mode().Perm(); mode&0o077 != 0 {
+		r.warnf("%s has mode %04o; API keys are readable by other users (expected 0600)", path, mode)
+	}
+}
+
 func normalizeName(name string) string {
 	return strings.ToLower(strings.TrimSpace(name))
 }
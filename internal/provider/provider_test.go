@@ -1,8 +1,10 @@
 package provider
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -104,6 +106,53 @@ func TestRegistryEnvOverridesFile(t *testing.T) {
 	}
 }
 
+func TestRegistryReloadDropsRemovedProviders(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "providers.json")
+	write := func(body string) {
+		t.Helper()
+		if err := os.WriteFile(configPath, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"providers": {
+		"ollama": {"base_url": "http://ollama:11434/v1"},
+		"openrouter": {"api_key": "sk-or-test"}
+	}}`)
+	t.Setenv("OPENAI_API_KEY", "sk-from-env")
+
+	r := NewRegistry(dir)
+	if err := r.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	r.LoadFromEnv()
+
+	write(`{"providers": {"ollama": {"base_url": "http://gpu:11434/v1"}}}`)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if _, err := r.Get("openrouter"); err == nil {
+		t.Error("expected openrouter removed after reload")
+	}
+	p, err := r.Get("ollama")
+	if err != nil || p.BaseURL != "http://gpu:11434/v1" {
+		t.Errorf("expected updated ollama, got %+v (%v)", p, err)
+	}
+	p, err = r.Get("openai")
+	if err != nil || p.APIKey != "sk-from-env" {
+		t.Errorf("expected env overlay re-applied, got %+v (%v)", p, err)
+	}
+
+	write(`{not json`)
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected parse error")
+	}
+	if _, err := r.Get("ollama"); err != nil {
+		t.Error("failed reload should keep current providers")
+	}
+}
+
 func TestRegistryUnknownProvider(t *testing.T) {
 	r := NewRegistry("")
 	_, err := r.Get("nonexistent")
@@ -115,7 +164,7 @@ func TestRegistryUnknownProvider(t *testing.T) {
 func TestSaveToFileRoundTrip(t *testing.T) {
 	dir := t.TempDir()
 	r := NewRegistry(dir)
-	r.Set("openai", &Provider{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKey: "sk-x", Auth: "bearer"})
+	r.Set("openai", &Provider{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKey: "sk-x", Auth: "bearer", DefaultModel: "gpt-4o"})
 
 	if err := r.SaveToFile(); err != nil {
 		t.Fatalf("save: %v", err)
@@ -132,4 +181,150 @@ func TestSaveToFileRoundTrip(t *testing.T) {
 	if p.APIKey != "sk-x" {
 		t.Fatalf("unexpected key: %q", p.APIKey)
 	}
+	if p.DefaultModel != "gpt-4o" {
+		t.Fatalf("unexpected default model: %q", p.DefaultModel)
+	}
+}
+
+func TestLoadFromFileWarnsOnLoosePerms(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "providers.json")
+	if err := os.WriteFile(path, []byte(`{"providers": {"ollama": {}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	warnf := func(format string, args ...any) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+	r := NewRegistry(dir, WithWarnf(warnf), WithEnforcePerms(true))
+	if err := r.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "0644") {
+		t.Fatalf("expected one 0644 warning, got %q", warnings)
+	}
+
+	if err := r.SaveToFile(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("expected save to enforce 0600, got %04o", info.Mode().Perm())
+	}
+	warnings = nil
+	if err := r.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("expected no warning for 0600 file, got %q", warnings)
+	}
+}
+
+func TestLoadFromFileWarnsOnInsecureSkipVerify(t *testing.T) {
+	dir := t.TempDir()
+	data := `{"providers": {"gateway": {"base_url": "https://llm.internal/v1", "insecure_skip_verify": true}, "ollama": {}}}`
+	if err := os.WriteFile(filepath.Join(dir, "providers.json"), []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	warnf := func(format string, args ...any) { warnings = append(warnings, fmt.Sprintf(format, args...)) }
+	r := NewRegistry(dir, WithWarnf(warnf))
+	if err := r.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"gateway"`) || !strings.Contains(warnings[0], "NOT verified") {
+		t.Fatalf("expected one insecure_skip_verify warning for gateway, got %q", warnings)
+	}
+	if p, _ := r.Get("gateway"); !p.InsecureSkipVerify {
+		t.Error("expected insecure_skip_verify to load")
+	}
+	if p, _ := r.Get("ollama"); p.InsecureSkipVerify {
+		t.Error("expected insecure_skip_verify to default to false")
+	}
+}
+
+func TestKnown(t *testing.T) {
+	known := Known()
+	var names []string
+	for _, p := range known {
+		names = append(names, p.Name)
+	}
+	if strings.Join(names, ",") != "anthropic,ollama,openai,openrouter" {
+		t.Fatalf("unexpected known providers %v", names)
+	}
+	if a := known[0]; a.BaseURL != "https://api.anthropic.com/v1" || a.Auth != "x-api-key" || a.APIFormat != "anthropic" {
+		t.Errorf("unexpected anthropic defaults %+v", a)
+	}
+	if o := known[1]; o.Auth != "none" || o.APIFormat != "openai" {
+		t.Errorf("unexpected ollama defaults %+v", o)
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	for _, ok := range []string{"", "bearer", "x-api-key", "none", " Bearer "} {
+		if err := ValidateAuth(ok); err != nil {
+			t.Errorf("ValidateAuth(%q): unexpected error %v", ok, err)
+		}
+	}
+	for bad, hint := range map[string]string{
+		"x_api_key": `did you mean "x-api-key"`,
+		"basic":     "want bearer, x-api-key, none",
+	} {
+		err := ValidateAuth(bad)
+		if err == nil || !strings.Contains(err.Error(), hint) {
+			t.Errorf("ValidateAuth(%q): expected error containing %q, got %v", bad, hint, err)
+		}
+	}
+}
+
+func TestModelBlocked(t *testing.T) {
+	p := &Provider{BlockedModels: []string{"claude-opus-*", " GPT-4-32K ", "*/llama-*-405b"}}
+	for model, want := range map[string]bool{
+		"claude-opus-4":             true,
+		"Claude-Opus-4-20250514":    true,
+		"claude-sonnet-4":           false,
+		"gpt-4-32k":                 true,
+		"gpt-4-32k-0613":            false,
+		"meta-llama/llama-3.1-405b": true,
+		"meta-llama/llama-3.1-70b":  false,
+	} {
+		if got := p.ModelBlocked(model); got != want {
+			t.Errorf("ModelBlocked(%q) = %v, want %v", model, got, want)
+		}
+	}
+	if (&Provider{}).ModelBlocked("anything") {
+		t.Error("expected no blocklist to block nothing")
+	}
+}
+
+func TestLoadFromFileStatusMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "providers.json")
+	if err := os.WriteFile(path, []byte(`{"providers": {"quirky": {"base_url": "http://q:1/v1", "status_map": {"418": 429}}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry(dir)
+	if err := r.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := r.Get("quirky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.StatusMap[418] != 429 {
+		t.Errorf("expected 418 -> 429, got %v", p.StatusMap)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"providers": {"quirky": {"base_url": "http://q:1/v1", "status_map": {"418": 42}}}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewRegistry(dir).LoadFromFile(); err == nil || !strings.Contains(err.Error(), "418 -> 42") {
+		t.Errorf("expected invalid status_map to be rejected, got %v", err)
+	}
 }
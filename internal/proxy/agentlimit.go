@@ -0,0 +1,41 @@
+package proxy
+
+import "sync"
+
+// agentSlots counts each agent's in-flight requests, so an agent's
+// max_concurrent metadata can cap its own parallelism independently of the
+// proxy-wide in-flight limit. The zero value is ready to use.
+type agentSlots struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// acquire reserves one of agentID's limit slots without waiting. It reports
+// false when the agent already has limit requests in flight; limit of zero
+// or less means unlimited and always succeeds.
+func (s *agentSlots) acquire(agentID string, limit int) bool {
+	if limit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[agentID] >= limit {
+		return false
+	}
+	if s.active == nil {
+		s.active = make(map[string]int)
+	}
+	s.active[agentID]++
+	return true
+}
+
+// release frees a slot taken by a successful acquire with a positive limit.
+func (s *agentSlots) release(agentID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[agentID] <= 1 {
+		delete(s.active, agentID)
+		return
+	}
+	s.active[agentID]--
+}
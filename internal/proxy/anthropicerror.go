@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// maxErrorBody bounds how much of an upstream error body is read for
+// translation; error bodies are small, and anything larger is relayed as is.
+const maxErrorBody = 64 << 10
+
+// translateAnthropicError rewrites resp's body from Anthropic's error shape,
+// {"type":"error","error":{"type":...,"message":...}}, to OpenAI's,
+// {"error":{"message":...,"type":...,"param":null,"code":null}}, for agents
+// that reached an Anthropic-format provider through the OpenAI chat route.
+// Anthropic's error types (invalid_request_error, rate_limit_error, ...)
+// are kept as the OpenAI type. Bodies in any other shape are left alone.
+func translateAnthropicError(resp *http.Response) {
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+	rest := resp.Body
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(raw), rest), rest}
+	if err != nil || len(raw) > maxErrorBody {
+		return
+	}
+
+	var in struct {
+		Type  string `json:"type"`
+		Error *struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(raw, &in) != nil || in.Type != "error" || in.Error == nil {
+		return
+	}
+	out, err := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": in.Error.Message,
+			"type":    in.Error.Type,
+			"param":   nil,
+			"code":    nil,
+		},
+	})
+	if err != nil {
+		return
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(out), rest}
+	resp.ContentLength = int64(len(out))
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Del("Content-Length")
+}
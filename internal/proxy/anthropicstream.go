@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"time"
+)
+
+// anthropicStopReasons maps Anthropic stop_reason values to OpenAI
+// finish_reason values. Unknown reasons are relayed unchanged.
+var anthropicStopReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+}
+
+// anthropicStream rewrites an Anthropic Messages event stream as the
+// equivalent OpenAI chat.completion.chunk stream, for agents that reached an
+// Anthropic-format provider through the OpenAI chat route. The shape is
+// decided from the first data line: a stream that does not open with
+// message_start (for example one already served in OpenAI shape) is relayed
+// byte for byte.
+type anthropicStream struct {
+	src *bufio.Reader
+	out bytes.Buffer
+	err error
+
+	decided   bool
+	translate bool
+	pending   bytes.Buffer // raw lines seen before the shape was decided
+
+	id      string
+	model   string
+	created int64
+	input   int
+	output  int
+	tools   map[int]int // Anthropic content block index -> tool_calls index
+}
+
+// translateAnthropicStream wraps body so it reads as an OpenAI chunk stream.
+func translateAnthropicStream(body io.ReadCloser) io.ReadCloser {
+	s := &anthropicStream{
+		src:     bufio.NewReader(body),
+		created: time.Now().Unix(),
+		tools:   make(map[int]int),
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{s, body}
+}
+
+func (s *anthropicStream) Read(p []byte) (int, error) {
+	for s.out.Len() == 0 && s.err == nil {
+		if s.decided && !s.translate {
+			// Passthrough: no need to go line by line any more.
+			return s.src.Read(p)
+		}
+		line, err := s.src.ReadBytes('\n')
+		if len(line) > 0 {
+			s.line(line)
+		}
+		if err != nil {
+			s.err = err
+			if !s.decided {
+				s.out.Write(s.pending.Bytes())
+			}
+		}
+	}
+	if s.out.Len() > 0 {
+		return s.out.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *anthropicStream) line(raw []byte) {
+	if !s.decided {
+		data, ok := sseData(raw)
+		if !ok {
+			s.pending.Write(raw)
+			return
+		}
+		var head struct {
+			Type string `json:"type"`
+		}
+		s.decided = true
+		s.translate = json.Unmarshal([]byte(data), &head) == nil && head.Type == "message_start"
+		if !s.translate {
+			s.pending.Write(raw)
+			s.out.Write(s.pending.Bytes())
+			return
+		}
+	}
+	// Event names are repeated in each payload's type; blank lines and
+	// comments are replaced by the framing of the emitted chunks.
+	if data, ok := sseData(raw); ok {
+		s.event([]byte(data))
+	}
+}
+
+// sseData returns the payload of a "data:" line.
+func sseData(raw []byte) (string, bool) {
+	line := strings.TrimRight(string(raw), "\r\n")
+	if !strings.HasPrefix(line, "data:") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "data:")), true
+}
+
+func (s *anthropicStream) event(data []byte) {
+	var ev struct {
+		Type    string `json:"type"`
+		Index   int    `json:"index"`
+		Message struct {
+			ID    string `json:"id"`
+			Model string `json:"model"`
+			Usage struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		} `json:"message"`
+		ContentBlock struct {
+			Type string `json:"type"`
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"content_block"`
+		Delta struct {
+			Type        string  `json:"type"`
+			Text        string  `json:"text"`
+			PartialJSON string  `json:"partial_json"`
+			StopReason  *string `json:"stop_reason"`
+		} `json:"delta"`
+		Usage *struct {
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return
+	}
+
+	switch ev.Type {
+	case "message_start":
+		s.id = ev.Message.ID
+		s.model = ev.Message.Model
+		s.input = ev.Message.Usage.InputTokens
+		s.output = ev.Message.Usage.OutputTokens
+		s.chunk(map[string]any{"role": "assistant", "content": ""}, nil)
+	case "content_block_start":
+		if ev.ContentBlock.Type == "tool_use" {
+			i := len(s.tools)
+			s.tools[ev.Index] = i
+			s.chunk(map[string]any{"tool_calls": []any{map[string]any{
+				"index":    i,
+				"id":       ev.ContentBlock.ID,
+				"type":     "function",
+				"function": map[string]any{"name": ev.ContentBlock.Name, "arguments": ""},
+			}}}, nil)
+		}
+	case "content_block_delta":
+		switch ev.Delta.Type {
+		case "text_delta":
+			s.chunk(map[string]any{"content": ev.Delta.Text}, nil)
+		case "input_json_delta":
+			if i, ok := s.tools[ev.Index]; ok {
+				s.chunk(map[string]any{"tool_calls": []any{map[string]any{
+					"index":    i,
+					"function": map[string]any{"arguments": ev.Delta.PartialJSON},
+				}}}, nil)
+			}
+		}
+	case "message_delta":
+		if ev.Usage != nil {
+			s.output = ev.Usage.OutputTokens
+		}
+		if ev.Delta.StopReason != nil {
+			reason := *ev.Delta.StopReason
+			if mapped, ok := anthropicStopReasons[reason]; ok {
+				reason = mapped
+			}
+			s.chunk(map[string]any{}, reason)
+		}
+	case "message_stop":
+		s.emit(map[string]any{
+			"id":      s.id,
+			"object":  "chat.completion.chunk",
+			"created": s.created,
+			"model":   s.model,
+			"choices": []any{},
+			"usage": map[string]int{
+				"prompt_tokens":     s.input,
+				"completion_tokens": s.output,
+				"total_tokens":      s.input + s.output,
+			},
+		})
+		s.out.WriteString("data: [DONE]\n\n")
+	case "error":
+		if len(ev.Error) > 0 {
+			s.emit(map[string]json.RawMessage{"error": ev.Error})
+		}
+	}
+}
+
+// chunk emits a single-choice chunk; finish is nil until the closing chunk.
+func (s *anthropicStream) chunk(delta map[string]any, finish any) {
+	s.emit(map[string]any{
+		"id":      s.id,
+		"object":  "chat.completion.chunk",
+		"created": s.created,
+		"model":   s.model,
+		"choices": []any{map[string]any{
+			"index":         0,
+			"delta":         delta,
+			"finish_reason": finish,
+		}},
+	})
+}
+
+func (s *anthropicStream) emit(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	s.out.WriteString("data: ")
+	s.out.Write(data)
+	s.out.WriteString("\n\n")
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// authThrottle counts failed secret validations per client IP and agent ID
+// and blocks that pair once it reaches max failures within window. Keying
+// by client as well means someone guessing an agent's secret locks out only
+// themselves, not the agent. Only agents with a loadable context are
+// tracked, and expired records are swept once the table grows past
+// authThrottleSweepAt.
+type authThrottle struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string]*authFailures
+	now      func() time.Time
+}
+
+type authFailures struct {
+	count int
+	first time.Time
+}
+
+const authThrottleSweepAt = 4096
+
+// authThrottleKey identifies the client/agent pair a failure counts against.
+func authThrottleKey(clientIP, agentID string) string {
+	return clientIP + "|" + agentID
+}
+
+func newAuthThrottle(max int, window time.Duration) *authThrottle {
+	if max <= 0 || window <= 0 {
+		return nil
+	}
+	return &authThrottle{
+		max:      max,
+		window:   window,
+		failures: make(map[string]*authFailures),
+		now:      time.Now,
+	}
+}
+
+// blocked reports whether key is currently throttled and, if so, how long
+// until the window expires.
+func (t *authThrottle) blocked(key string) (bool, time.Duration) {
+	if t == nil {
+		return false, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.current(key)
+	if f == nil || f.count < t.max {
+		return false, 0
+	}
+	return true, f.first.Add(t.window).Sub(t.now())
+}
+
+// fail records a failed attempt and reports whether it crossed the limit.
+func (t *authThrottle) fail(key string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.current(key)
+	if f == nil {
+		if len(t.failures) >= authThrottleSweepAt {
+			for k := range t.failures {
+				t.current(k)
+			}
+		}
+		f = &authFailures{first: t.now()}
+		t.failures[key] = f
+	}
+	f.count++
+	return f.count == t.max
+}
+
+func (t *authThrottle) reset(key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	delete(t.failures, key)
+	t.mu.Unlock()
+}
+
+// current returns the live failure record for key, dropping it once its
+// window has elapsed. Callers must hold t.mu.
+func (t *authThrottle) current(key string) *authFailures {
+	f, ok := t.failures[key]
+	if !ok {
+		return nil
+	}
+	if t.now().Sub(f.first) >= t.window {
+		delete(t.failures, key)
+		return nil
+	}
+	return f
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBudgetThresholds are the percentages of an agent's budget that
+// trigger a webhook alert when no thresholds are configured.
+var DefaultBudgetThresholds = []float64{50, 80, 100}
+
+// ParseBudgetThresholds reads percentages such as "50", "80%" or "100";
+// none means DefaultBudgetThresholds.
+func ParseBudgetThresholds(values []string) ([]float64, error) {
+	if len(values) == 0 {
+		return DefaultBudgetThresholds, nil
+	}
+	out := make([]float64, 0, len(values))
+	for _, v := range values {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+		if err != nil || pct <= 0 {
+			return nil, fmt.Errorf("invalid threshold %q (want a positive percentage)", v)
+		}
+		out = append(out, pct)
+	}
+	sort.Float64s(out)
+	return out, nil
+}
+
+// WithBudgetWebhook POSTs a JSON alert to url the first time, each UTC
+// month, an agent's month-to-date spend reaches each of thresholds percent
+// of budgetUSD. Alerts are only notifications; nothing is refused. It needs
+// WithCostTracking; an empty url or zero budget disables it.
+func WithBudgetWebhook(url string, budgetUSD float64, thresholds []float64) HandlerOption {
+	return func(h *Handler) {
+		h.budgetAlerts = newBudgetAlerter(url, budgetUSD, thresholds)
+	}
+}
+
+// BudgetAlert is the body of a budget webhook POST.
+type BudgetAlert struct {
+	AgentID          string    `json:"agent_id"`
+	ThresholdPercent float64   `json:"threshold_percent"`
+	BudgetUSD        float64   `json:"budget_usd"`
+	SpentUSD         float64   `json:"spent_usd"`
+	Window           string    `json:"window"` // billing month, e.g. "2026-03"
+	Timestamp        time.Time `json:"ts"`
+}
+
+// budgetAlerter remembers which thresholds have fired for each agent in the
+// current billing month, so each fires once per window.
+type budgetAlerter struct {
+	mu         sync.Mutex
+	url        string
+	budgetUSD  float64
+	thresholds []float64
+	fired      map[budgetAlertKey]bool
+	client     *http.Client
+	now        func() time.Time
+}
+
+type budgetAlertKey struct {
+	agentID   string
+	window    string
+	threshold float64
+}
+
+func newBudgetAlerter(url string, budgetUSD float64, thresholds []float64) *budgetAlerter {
+	if url == "" || budgetUSD <= 0 || len(thresholds) == 0 {
+		return nil
+	}
+	return &budgetAlerter{
+		url:        url,
+		budgetUSD:  budgetUSD,
+		thresholds: thresholds,
+		fired:      make(map[budgetAlertKey]bool),
+		client:     &http.Client{Timeout: 10 * time.Second},
+		now:        time.Now,
+	}
+}
+
+// observe records agentID's month-to-date spend and returns an alert for
+// every threshold it has newly reached, lowest first.
+func (b *budgetAlerter) observe(agentID string, spentUSD float64) []BudgetAlert {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now().UTC()
+	window := now.Format("2006-01")
+	var alerts []BudgetAlert
+	for _, pct := range b.thresholds {
+		if spentUSD < b.budgetUSD*pct/100 {
+			break
+		}
+		key := budgetAlertKey{agentID: agentID, window: window, threshold: pct}
+		if b.fired[key] {
+			continue
+		}
+		b.fired[key] = true
+		alerts = append(alerts, BudgetAlert{
+			AgentID:          agentID,
+			ThresholdPercent: pct,
+			BudgetUSD:        b.budgetUSD,
+			SpentUSD:         spentUSD,
+			Window:           window,
+			Timestamp:        now,
+		})
+	}
+	for k := range b.fired {
+		if k.window != window {
+			delete(b.fired, k)
+		}
+	}
+	return alerts
+}
+
+// send POSTs alert to the webhook.
+func (b *budgetAlerter) send(alert BudgetAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := b.client.Post(b.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("budget webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// checkBudget fires any budget alerts agentID's latest spend has crossed.
+// Webhooks are sent in order in the background, so the agent's response is
+// not held up; failures are logged.
+func (h *Handler) checkBudget(agentID string) {
+	if h.budgetAlerts == nil || h.accumulator == nil {
+		return
+	}
+	alerts := h.budgetAlerts.observe(agentID, h.accumulator.AgentMonthToDate(agentID))
+	if len(alerts) == 0 {
+		return
+	}
+	go func() {
+		for _, alert := range alerts {
+			if err := h.budgetAlerts.send(alert); err != nil {
+				h.logger.LogError(agentID, "", 0, 0, fmt.Errorf("budget webhook: %w", err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies is the set of peers whose X-Forwarded-For / X-Real-IP
+// headers are believed. A nil set trusts nobody.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies accepts CIDRs and bare IPs; invalid entries are skipped.
+func parseTrustedProxies(entries []string) trustedProxies {
+	var out trustedProxies
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, n, err := net.ParseCIDR(e); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range t {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the caller. Forwarding headers are only
+// consulted when the immediate peer is trusted; X-Forwarded-For is walked
+// right to left, skipping further trusted hops.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !t.contains(net.ParseIP(peer)) {
+		return peer
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				break
+			}
+			if !t.contains(ip) || i == 0 {
+				return hop
+			}
+		}
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return peer
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mostlydev/cllama/internal/openai"
+	"github.com/mostlydev/cllama/internal/provider"
+)
+
+// echoProviderName is the built-in provider WithEchoProvider adds.
+const echoProviderName = "echo"
+
+// echoHost is the upstream host of the echo provider; requests to it are
+// answered in-process and never reach the network.
+const echoHost = "echo.cllama.invalid"
+
+var echoProvider = &provider.Provider{
+	Name:    echoProviderName,
+	BaseURL: "http://" + echoHost + "/v1",
+	Auth:    "none",
+}
+
+// WithEchoProvider adds a built-in "echo" provider that, instead of calling
+// a backend, answers every request with a chat completion whose message is
+// the request body the proxy would have sent. Usage is derived from the text
+// lengths, so auth, routing and cost accounting can be exercised offline.
+// It shadows any registry provider named "echo".
+func WithEchoProvider(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.echo = enabled
+	}
+}
+
+// provider resolves name against the registry, or the echo provider.
+func (h *Handler) provider(name string) (*provider.Provider, error) {
+	if h.echo && name == echoProviderName {
+		return echoProvider, nil
+	}
+	return h.registry.Get(name)
+}
+
+// echoTransport answers requests for echoHost and sends the rest on to next.
+type echoTransport struct {
+	next http.RoundTripper
+}
+
+func (t echoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != echoHost {
+		next := t.next
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		return next.RoundTrip(req)
+	}
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var in openai.ChatCompletionRequest
+	_ = json.Unmarshal(body, &in)
+	contents := make([]any, len(in.Messages))
+	for i, m := range in.Messages {
+		contents[i] = m.Content
+	}
+
+	reply, _ := json.Marshal(string(body))
+	completionTokens := estimatePromptTokens([]any{string(body)})
+	promptTokens := estimatePromptTokens(contents)
+	out, err := json.Marshal(openai.ChatCompletionResponse{
+		ID:      "chatcmpl-echo",
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   in.Model,
+		Choices: []openai.Choice{{
+			Message:      openai.Message{Role: "assistant", Content: reply},
+			FinishReason: "stop",
+		}},
+		Usage: &openai.Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := "application/json"
+	if in.IsStream() {
+		if frames, ok := completionToSSE(out); ok {
+			out, contentType = frames, "text/event-stream"
+		}
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {contentType}},
+		Body:          io.NopCloser(bytes.NewReader(out)),
+		ContentLength: int64(len(out)),
+		Request:       req,
+	}, nil
+}
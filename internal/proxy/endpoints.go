@@ -0,0 +1,26 @@
+package proxy
+
+import "github.com/mostlydev/cllama/internal/provider"
+
+// WithEndpointSelector spreads requests to providers with regional
+// base_urls across their endpoints as sel picks them. Without it every
+// request goes to the provider's base_url.
+func WithEndpointSelector(sel *provider.EndpointSelector) HandlerOption {
+	return func(h *Handler) {
+		h.endpoints = sel
+	}
+}
+
+// endpoint returns prov addressed at the endpoint chosen for this request.
+func (h *Handler) endpoint(prov *provider.Provider) *provider.Provider {
+	if h.endpoints == nil {
+		return prov
+	}
+	base := h.endpoints.Pick(prov)
+	if base == prov.BaseURL {
+		return prov
+	}
+	cp := *prov
+	cp.BaseURL = base
+	return &cp
+}
@@ -2,19 +2,30 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mostlydev/cllama/internal/agentctx"
 	"github.com/mostlydev/cllama/internal/cost"
 	"github.com/mostlydev/cllama/internal/identity"
 	"github.com/mostlydev/cllama/internal/logging"
+	"github.com/mostlydev/cllama/internal/openai"
 	"github.com/mostlydev/cllama/internal/provider"
 )
 
@@ -29,6 +40,61 @@ type Handler struct {
 	logger      *logging.Logger
 	accumulator *cost.Accumulator
 	pricing     *cost.Pricing
+
+	inflight     chan struct{}
+	inflightWait time.Duration
+
+	responseHeaders *headerFilter
+	authThrottle    *authThrottle
+
+	upstreamTimeout    time.Duration
+	maxUpstreamTimeout time.Duration
+
+	reframeSSE bool
+
+	trustedProxies trustedProxies
+
+	globalBudgetUSD float64
+
+	maxPromptMessages int
+	maxPromptTokens   int
+
+	validateRequests bool
+
+	idempotency *idempotencyCache
+
+	liveCostInterval time.Duration
+
+	insecureOnce   sync.Once
+	insecureClient *http.Client
+
+	breaker *providerBreaker
+
+	echo bool
+
+	streamBufferSize    int
+	streamFlushInterval time.Duration
+
+	reconcile            UsageReconciliation
+	priceByResponseModel bool
+
+	budgetAlerts *budgetAlerter
+
+	agentSlots agentSlots
+
+	shadows map[string]ShadowTarget
+
+	routes []RouteRule
+
+	endpoints *provider.EndpointSelector
+
+	tokenGrace time.Duration
+
+	agentBudgetUSD float64
+
+	retries     int
+	retryDelay  time.Duration
+	retryBudget *retryBudget
 }
 
 // HandlerOption configures optional Handler behaviour.
@@ -42,6 +108,140 @@ func WithCostTracking(acc *cost.Accumulator, pricing *cost.Pricing) HandlerOptio
 	}
 }
 
+// WithMaxInflight bounds the number of requests the handler serves at once.
+// When all slots are taken, a request waits up to wait for one to free up
+// before being rejected with 503. A limit of zero or less disables the bound.
+func WithMaxInflight(limit int, wait time.Duration) HandlerOption {
+	return func(h *Handler) {
+		if limit <= 0 {
+			h.inflight = nil
+			return
+		}
+		h.inflight = make(chan struct{}, limit)
+		h.inflightWait = wait
+	}
+}
+
+// WithResponseHeaderFilter restricts which upstream response headers reach
+// the agent. Names are case-insensitive; a trailing "*" matches any suffix
+// (e.g. "x-*"). When allow is non-empty only matching headers are returned;
+// deny is applied afterwards. Content-Type is always returned.
+func WithResponseHeaderFilter(allow, deny []string) HandlerOption {
+	return func(h *Handler) {
+		h.responseHeaders = newHeaderFilter(allow, deny)
+	}
+}
+
+// WithAuthThrottle rejects an agent with 429 once it accumulates maxFailures
+// invalid secrets within window. A successful authentication resets the
+// count. Zero values disable throttling.
+func WithAuthThrottle(maxFailures int, window time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.authThrottle = newAuthThrottle(maxFailures, window)
+	}
+}
+
+// WithIdempotency replays the stored response when an agent repeats a
+// non-streaming request with the same Idempotency-Key within ttl, instead of
+// calling the provider again. Each agent may hold maxKeys keys at once, and
+// responses over maxBodyBytes are relayed but not stored; zero leaves either
+// unbounded. A ttl of zero disables it.
+func WithIdempotency(ttl time.Duration, maxKeys, maxBodyBytes int) HandlerOption {
+	return func(h *Handler) {
+		h.idempotency = newIdempotencyCache(ttl, maxKeys, maxBodyBytes)
+	}
+}
+
+// WithProviderCooldown stops sending to a provider for cooldown once it has
+// failed threshold times in a row (transport errors and 5xx responses);
+// requests for it get 503 meanwhile. Zero values disable it.
+func WithProviderCooldown(threshold int, cooldown time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.breaker = newProviderBreaker(threshold, cooldown)
+	}
+}
+
+// ProviderHealth reports passive health for every registered provider.
+func (h *Handler) ProviderHealth() map[string]ProviderHealth {
+	return h.breaker.health(h.registry.Names())
+}
+
+// WithUpstreamTimeout bounds how long a request may take end to end.
+// def applies when the agent sends no X-Cllama-Timeout-Seconds header;
+// max caps what the header may ask for. Zero means no limit.
+func WithUpstreamTimeout(def, max time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.upstreamTimeout = def
+		h.maxUpstreamTimeout = max
+	}
+}
+
+// WithSSEReframe converts a non-streaming chat completion into an SSE stream
+// when the agent asked for "stream": true but the upstream ignored it, so
+// clients that only parse SSE still work against buffered backends.
+func WithSSEReframe(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.reframeSSE = enabled
+	}
+}
+
+// WithTrustedProxies lists the CIDRs (or bare IPs) of load balancers whose
+// X-Forwarded-For and X-Real-IP headers identify the real client. Requests
+// from any other peer are logged with the peer address.
+func WithTrustedProxies(cidrs []string) HandlerOption {
+	return func(h *Handler) {
+		h.trustedProxies = parseTrustedProxies(cidrs)
+	}
+}
+
+// WithGlobalBudget refuses every request with 402 once total recorded spend
+// across all agents reaches usd. It needs WithCostTracking; zero disables it.
+func WithGlobalBudget(usd float64) HandlerOption {
+	return func(h *Handler) {
+		h.globalBudgetUSD = usd
+	}
+}
+
+// WithAgentBudget refuses an agent's requests with 402 once its spend in the
+// current UTC month reaches usd, the same month-to-date figure budget alerts
+// are measured against. It needs WithCostTracking; zero disables it.
+func WithAgentBudget(usd float64) HandlerOption {
+	return func(h *Handler) {
+		h.agentBudgetUSD = usd
+	}
+}
+
+// WithPromptLimits rejects prompts with more than maxMessages messages, or
+// an estimated maxTokens prompt tokens, with 413. Agent metadata can replace
+// either limit; zero disables it.
+func WithPromptLimits(maxMessages, maxTokens int) HandlerOption {
+	return func(h *Handler) {
+		h.maxPromptMessages = maxMessages
+		h.maxPromptTokens = maxTokens
+	}
+}
+
+// WithRequestValidation rejects chat completion requests with no messages,
+// or with a message whose role is not a standard one, with 400 before they
+// reach the provider. It is off by default so that providers with their own
+// roles or extensions still work.
+func WithRequestValidation(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.validateRequests = enabled
+	}
+}
+
+// WithStreamFlush sets the read size used to relay response bodies (default
+// 32KB) and, when flushEvery is positive, coalesces flushes to the agent to
+// at most one per flushEvery. A zero flushEvery flushes every read at once,
+// for the lowest latency.
+func WithStreamFlush(bufSize int, flushEvery time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.streamBufferSize = bufSize
+		h.streamFlushInterval = flushEvery
+	}
+}
+
 func NewHandler(registry *provider.Registry, contextLoader ContextLoader, logger *logging.Logger, opts ...HandlerOption) *Handler {
 	if registry == nil {
 		registry = provider.NewRegistry("")
@@ -52,29 +252,68 @@ func NewHandler(registry *provider.Registry, contextLoader ContextLoader, logger
 		}
 	}
 	if logger == nil {
-		logger = logging.New(io.Discard)
+		logger = logging.New(io.Discard, logging.FormatJSON)
 	}
 	h := &Handler{
 		registry:    registry,
 		loadContext: contextLoader,
 		client:      &http.Client{},
 		logger:      logger,
+
+		liveCostInterval: liveCostInterval,
 	}
 	for _, opt := range opts {
 		opt(h)
 	}
+	if h.echo {
+		h.client.Transport = echoTransport{next: h.client.Transport}
+	}
 	return h
 }
 
+// skipVerifyClient returns the client for providers with
+// insecure_skip_verify, built on first use.
+func (h *Handler) skipVerifyClient() *http.Client {
+	h.insecureOnce.Do(func() {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		h.insecureClient = &http.Client{Transport: tr}
+	})
+	return h.insecureClient
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tw := &headerTracker{ResponseWriter: w}
+	defer h.recoverPanic(tw, r)
+	h.serve(tw, r)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	if r.Method != http.MethodPost {
+	passthrough := isPassthroughPath(r.URL.Path)
+	if r.Method != http.MethodPost && !(passthrough && r.Method == http.MethodGet) {
+		allow := http.MethodPost
+		if passthrough {
+			allow = "GET, POST"
+		}
+		w.Header().Set("Allow", allow)
 		h.fail(w, http.StatusMethodNotAllowed, "method not allowed", "", "", start, nil)
 		return
 	}
 
+	if !h.acquireSlot(r) {
+		h.logger.LogIntervention("", "", "proxy_capacity")
+		h.fail(w, http.StatusServiceUnavailable, "proxy at capacity", "", "", start, fmt.Errorf("no in-flight slot within %s", h.inflightWait))
+		return
+	}
+	defer h.releaseSlot()
+
 	agentID, secret, err := identity.ParseBearer(r.Header.Get("Authorization"))
+	if errors.Is(err, identity.ErrInvalidAgentID) {
+		h.fail(w, http.StatusBadRequest, "invalid agent id", "", "", start, err)
+		return
+	}
 	if err != nil {
 		h.fail(w, http.StatusUnauthorized, "invalid bearer token", "", "", start, err)
 		return
@@ -85,21 +324,191 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.fail(w, http.StatusForbidden, "agent context not found", agentID, "", start, err)
 		return
 	}
+	throttleKey := authThrottleKey(h.trustedProxies.clientIP(r), agentID)
+	if blocked, retryIn := h.authThrottle.blocked(throttleKey); blocked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryIn.Seconds())+1))
+		h.logger.LogIntervention(agentID, "", "auth_throttled")
+		h.fail(w, http.StatusTooManyRequests, "too many failed authentication attempts", agentID, "", start, fmt.Errorf("auth throttled"))
+		return
+	}
 	if err := validateSecret(ctx, agentID, secret); err != nil {
+		if h.authThrottle.fail(throttleKey) {
+			h.logger.LogIntervention(agentID, "", "auth_bruteforce")
+		}
 		h.fail(w, http.StatusForbidden, "invalid agent secret", agentID, "", start, err)
 		return
 	}
+	h.authThrottle.reset(throttleKey)
+	graced, err := tokenExpiry(ctx, time.Now(), h.tokenGrace)
+	if err != nil {
+		h.fail(w, http.StatusUnauthorized, "agent token expired", agentID, "", start, err)
+		return
+	}
+	if graced {
+		h.logger.LogIntervention(agentID, "", "token_grace")
+	}
+
+	pol := h.policyFor(ctx)
+	if !h.agentSlots.acquire(agentID, pol.maxConcurrent) {
+		h.logger.LogIntervention(agentID, "", "agent_concurrency")
+		h.fail(w, http.StatusTooManyRequests, fmt.Sprintf("agent has %d requests in flight, its max_concurrent limit", pol.maxConcurrent), agentID, "", start,
+			fmt.Errorf("agent concurrency limit %d reached", pol.maxConcurrent))
+		return
+	}
+	if pol.maxConcurrent > 0 {
+		defer h.agentSlots.release(agentID)
+	}
+
+	if key := strings.TrimSpace(r.Header.Get(idempotencyHeader)); key != "" && h.idempotency != nil && r.Method == http.MethodPost {
+		rec, proceed := h.beginIdempotent(w, r, agentID, key, start)
+		if !proceed {
+			return
+		}
+		if rec != nil {
+			defer h.idempotency.finish(agentID, key, rec)
+			w = rec
+		}
+	}
+
+	if h.globalBudgetUSD > 0 && h.accumulator != nil {
+		if spent := h.accumulator.TotalCost(); spent >= h.globalBudgetUSD {
+			h.logger.LogIntervention(agentID, "", "global_budget")
+			h.fail(w, http.StatusPaymentRequired, fmt.Sprintf("global budget of $%.2f exhausted", h.globalBudgetUSD), agentID, "", start,
+				fmt.Errorf("total spend $%.4f reached global budget", spent))
+			return
+		}
+	}
+	if h.agentBudgetUSD > 0 && h.accumulator != nil {
+		if spent := h.accumulator.AgentMonthToDate(agentID); spent >= h.agentBudgetUSD {
+			h.logger.LogIntervention(agentID, "", "agent_budget")
+			h.fail(w, http.StatusPaymentRequired, fmt.Sprintf("monthly agent budget of $%.2f exhausted", h.agentBudgetUSD), agentID, "", start,
+				fmt.Errorf("month-to-date $%.4f reached agent budget", spent))
+			return
+		}
+	}
 
-	// Route based on path: /v1/messages → Anthropic flow, everything else → OpenAI flow
-	if strings.HasPrefix(r.URL.Path, "/v1/messages") {
-		h.handleAnthropicMessages(w, r, agentID, start)
+	timeout, err := h.requestTimeout(r)
+	if err != nil {
+		h.fail(w, http.StatusBadRequest, err.Error(), agentID, "", start, err)
+		return
+	}
+	tags, err := requestTags(r.Header.Get(tagsHeader))
+	if err != nil {
+		h.fail(w, http.StatusBadRequest, err.Error(), agentID, "", start, err)
 		return
 	}
+	r = r.WithContext(withTags(r.Context(), tags))
+	if timeout > 0 {
+		reqCtx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if h.upstreamTimeout <= 0 || timeout < h.upstreamTimeout {
+			reqCtx = context.WithValue(reqCtx, agentDeadlineKey{}, true)
+		}
+		r = r.WithContext(reqCtx)
+	}
+
+	// Route based on path: /v1/messages → Anthropic flow, chat and legacy
+	// completions → OpenAI flow, anything else → raw passthrough.
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/messages"):
+		h.handleAnthropicMessages(w, r, agentID, pol, start)
+	case passthrough:
+		h.handlePassthrough(w, r, agentID, pol, start)
+	default:
+		h.handleOpenAI(w, r, agentID, pol, start)
+	}
+}
+
+// isPassthroughPath reports whether path has no dedicated flow and is
+// forwarded verbatim to the provider.
+func isPassthroughPath(path string) bool {
+	switch path {
+	case "/v1/chat/completions", "/v1/completions":
+		return false
+	}
+	return !strings.HasPrefix(path, "/v1/messages")
+}
+
+// beginIdempotent checks r against the idempotency cache. It reports false
+// once it has answered the request itself (a replay or a conflict). When the
+// request should go upstream and be remembered, it returns the recorder to
+// write the response through; streaming requests are never cached.
+func (h *Handler) beginIdempotent(w http.ResponseWriter, r *http.Request, agentID, key string, start time.Time) (*responseRecorder, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.fail(w, http.StatusBadRequest, "failed to read request body", agentID, "", start, err)
+		return nil, false
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var peek struct {
+		Model  string `json:"model"`
+		Stream bool   `json:"stream"`
+	}
+	_ = json.Unmarshal(body, &peek)
+	if peek.Stream {
+		return nil, true
+	}
+
+	stored, reserved, err := h.idempotency.begin(agentID, key, sha256.Sum256(body))
+	switch {
+	case errors.Is(err, errIdempotencyMismatch):
+		h.fail(w, http.StatusUnprocessableEntity, err.Error(), agentID, peek.Model, start, err)
+		return nil, false
+	case errors.Is(err, errIdempotencyFull):
+		h.fail(w, http.StatusTooManyRequests, err.Error(), agentID, peek.Model, start, err)
+		return nil, false
+	case err != nil:
+		h.fail(w, http.StatusConflict, err.Error(), agentID, peek.Model, start, err)
+		return nil, false
+	case reserved:
+		return &responseRecorder{ResponseWriter: w, limit: h.idempotency.maxBody}, true
+	}
+
+	for k, vals := range stored.header {
+		w.Header()[k] = append([]string(nil), vals...)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.status)
+	_, _ = w.Write(stored.body)
+	h.logger.LogResponse(agentID, peek.Model, "", stored.status, time.Since(start).Milliseconds())
+	return nil, false
+}
+
+// acquireSlot reserves an in-flight slot, waiting up to inflightWait.
+// It reports false when no slot became available in time.
+func (h *Handler) acquireSlot(r *http.Request) bool {
+	if h.inflight == nil {
+		return true
+	}
+	select {
+	case h.inflight <- struct{}{}:
+		return true
+	default:
+	}
+	if h.inflightWait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(h.inflightWait)
+	defer timer.Stop()
+	select {
+	case h.inflight <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
 
-	h.handleOpenAI(w, r, agentID, start)
+func (h *Handler) releaseSlot() {
+	if h.inflight != nil {
+		<-h.inflight
+	}
 }
 
-func (h *Handler) handleOpenAI(w http.ResponseWriter, r *http.Request, agentID string, start time.Time) {
+func (h *Handler) handleOpenAI(w http.ResponseWriter, r *http.Request, agentID string, pol agentPolicy, start time.Time) {
 	inBody, err := io.ReadAll(r.Body)
 	if err != nil {
 		h.fail(w, http.StatusBadRequest, "failed to read request body", agentID, "", start, err)
@@ -107,39 +516,75 @@ func (h *Handler) handleOpenAI(w http.ResponseWriter, r *http.Request, agentID s
 	}
 	defer r.Body.Close()
 
-	var payload map[string]any
+	var payload openai.ChatCompletionRequest
 	if err := json.Unmarshal(inBody, &payload); err != nil {
 		h.fail(w, http.StatusBadRequest, "invalid JSON body", agentID, "", start, err)
 		return
 	}
 
-	requestedModel, _ := payload["model"].(string)
-	requestedModel = strings.TrimSpace(requestedModel)
+	requestedModel := strings.TrimSpace(payload.Model)
 	if requestedModel == "" {
 		h.fail(w, http.StatusBadRequest, "missing model field", agentID, "", start, fmt.Errorf("missing model"))
 		return
 	}
+	// Legacy /v1/completions takes a prompt rather than messages.
+	if h.validateRequests && r.URL.Path == "/v1/chat/completions" {
+		if err := payload.Validate(); err != nil {
+			h.fail(w, http.StatusBadRequest, "invalid request: "+err.Error(), agentID, requestedModel, start, err)
+			return
+		}
+	}
 
-	providerName, upstreamModel, err := splitModel(requestedModel)
-	if err != nil {
-		h.fail(w, http.StatusBadRequest, err.Error(), agentID, requestedModel, start, err)
+	contents := make([]any, len(payload.Messages))
+	for i, m := range payload.Messages {
+		contents[i] = m.Content
+	}
+	if !h.promptWithinLimits(w, pol, agentID, requestedModel, len(payload.Messages), contents, start) {
 		return
 	}
 
-	prov, err := h.registry.Get(providerName)
-	if err != nil {
-		h.fail(w, http.StatusBadGateway, "unknown provider", agentID, requestedModel, start, err)
+	// X-Cllama-Provider picks the provider out of band; the model field is
+	// then the upstream model as given, slashes and all.
+	providerName, upstreamModel := providerOverride(r), requestedModel
+	if providerName == "" {
+		providerName, upstreamModel, err = h.routeModel(requestedModel)
+		if err != nil {
+			h.fail(w, http.StatusBadRequest, err.Error(), agentID, requestedModel, start, err)
+			return
+		}
+	}
+
+	if !h.providerAllowed(w, pol.allowedProviders, agentID, providerName, requestedModel, start) {
+		return
+	}
+	prov, ok := h.resolveProvider(w, r, agentID, providerName, requestedModel, start)
+	if !ok {
+		return
+	}
+	if upstreamModel == "" {
+		upstreamModel = strings.TrimSpace(prov.DefaultModel)
+		if upstreamModel == "" {
+			err := fmt.Errorf("no model given and provider %q has no default_model", providerName)
+			h.fail(w, http.StatusBadRequest, err.Error(), agentID, requestedModel, start, err)
+			return
+		}
+	}
+	upstreamModel = prov.UpstreamModel(upstreamModel)
+	if !h.modelAllowed(w, prov, agentID, requestedModel, upstreamModel, start) {
+		return
+	}
+	if h.modelBudgetExhausted(w, agentID, providerName, requestedModel, upstreamModel, start) {
 		return
 	}
 
-	payload["model"] = upstreamModel
+	payload.Model = upstreamModel
 	outBody, err := json.Marshal(payload)
 	if err != nil {
 		h.fail(w, http.StatusInternalServerError, "failed to encode upstream body", agentID, requestedModel, start, err)
 		return
 	}
 
-	targetURL, err := buildUpstreamURL(prov.BaseURL, r.URL.Path, r.URL.RawQuery)
+	targetURL, err := buildUpstreamURL(h.endpoint(prov), r.URL.Path, r.URL.RawQuery)
 	if err != nil {
 		h.fail(w, http.StatusBadGateway, "invalid provider URL", agentID, requestedModel, start, err)
 		return
@@ -152,15 +597,146 @@ func (h *Handler) handleOpenAI(w http.ResponseWriter, r *http.Request, agentID s
 	}
 	copyRequestHeaders(outReq.Header, r.Header)
 	outReq.Header.Set("Content-Type", "application/json")
+	outReq.Header.Del(sessionHeader)
+	outReq.Header.Del(tagsHeader)
+	outReq.Header.Del(timeoutHeader)
+	outReq.Header.Del(providerHeader)
+
+	if err := h.setProviderAuth(outReq, prov, agentID, requestedModel, start, w); err != nil {
+		return // error already written
+	}
+
+	if target, ok := h.shadows[providerName+"/"+upstreamModel]; ok {
+		h.shadow(target, r, agentID, requestedModel, payload)
+	}
+	h.proxyAndLog(w, outReq, agentID, sessionID(r, payload.SessionID()), h.trustedProxies.clientIP(r), providerName, requestedModel, upstreamModel, true, payload.IsStream(), start)
+}
+
+// providerHeader names the provider out of band: for chat requests whose
+// model should be sent as is, and for passthrough requests whose body
+// carries no provider-prefixed model, such as GET /v1/models.
+const providerHeader = "X-Cllama-Provider"
+
+// providerOverride returns the provider named by X-Cllama-Provider, if any.
+func providerOverride(r *http.Request) string {
+	return strings.ToLower(strings.TrimSpace(r.Header.Get(providerHeader)))
+}
+
+// resolveProvider looks up providerName, failing the request when it is not
+// configured: with 400 when the agent named it in X-Cllama-Provider, since
+// the agent asked for something that does not exist, otherwise with 502.
+func (h *Handler) resolveProvider(w http.ResponseWriter, r *http.Request, agentID, providerName, requestedModel string, start time.Time) (*provider.Provider, bool) {
+	prov, err := h.provider(providerName)
+	if err == nil {
+		return prov, true
+	}
+	if providerOverride(r) != "" {
+		h.fail(w, http.StatusBadRequest, fmt.Sprintf("unknown provider %q in %s", providerName, providerHeader), agentID, requestedModel, start, err)
+	} else {
+		h.fail(w, http.StatusBadGateway, "unknown provider", agentID, requestedModel, start, err)
+	}
+	return nil, false
+}
+
+// handlePassthrough forwards any other /v1 path to the same sub-path on the
+// provider. The provider comes from X-Cllama-Provider when set, in which case
+// a "model" field, if any, already names the upstream model; otherwise from
+// a provider-prefixed "model" field, which is rewritten to the upstream model
+// as on the chat route. Either way a named model goes through the same
+// blocklist, caps and cost recording as chat; only bodies without one (e.g.
+// GET /v1/models) are forwarded untouched and unrecorded.
+func (h *Handler) handlePassthrough(w http.ResponseWriter, r *http.Request, agentID string, pol agentPolicy, start time.Time) {
+	inBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.fail(w, http.StatusBadRequest, "failed to read request body", agentID, "", start, err)
+		return
+	}
+	defer r.Body.Close()
+
+	providerName := providerOverride(r)
+	var requestedModel, upstreamModel string
+	var payload *openai.ChatCompletionRequest
+	outBody := inBody
+	if providerName != "" {
+		var p openai.ChatCompletionRequest
+		if len(inBody) > 0 && json.Unmarshal(inBody, &p) == nil && strings.TrimSpace(p.Model) != "" {
+			payload = &p
+			requestedModel = strings.TrimSpace(p.Model)
+			upstreamModel = requestedModel
+		}
+	} else {
+		payload = &openai.ChatCompletionRequest{}
+		if len(inBody) == 0 || json.Unmarshal(inBody, payload) != nil || strings.TrimSpace(payload.Model) == "" {
+			err := fmt.Errorf("set %s or a provider-prefixed model field", providerHeader)
+			h.fail(w, http.StatusBadRequest, "cannot resolve provider: "+err.Error(), agentID, "", start, err)
+			return
+		}
+		requestedModel = strings.TrimSpace(payload.Model)
+		providerName, upstreamModel, err = h.routeModel(requestedModel)
+		if err != nil {
+			h.fail(w, http.StatusBadRequest, err.Error(), agentID, requestedModel, start, err)
+			return
+		}
+		if upstreamModel == "" {
+			err := fmt.Errorf("model %q names no upstream model", requestedModel)
+			h.fail(w, http.StatusBadRequest, err.Error(), agentID, requestedModel, start, err)
+			return
+		}
+	}
+
+	if !h.providerAllowed(w, pol.allowedProviders, agentID, providerName, requestedModel, start) {
+		return
+	}
+	prov, ok := h.resolveProvider(w, r, agentID, providerName, requestedModel, start)
+	if !ok {
+		return
+	}
+	if payload != nil {
+		upstreamModel = prov.UpstreamModel(upstreamModel)
+		if !h.modelAllowed(w, prov, agentID, requestedModel, upstreamModel, start) {
+			return
+		}
+		if h.modelBudgetExhausted(w, agentID, providerName, requestedModel, upstreamModel, start) {
+			return
+		}
+		if payload.Model != upstreamModel {
+			payload.Model = upstreamModel
+			if outBody, err = json.Marshal(payload); err != nil {
+				h.fail(w, http.StatusInternalServerError, "failed to encode upstream body", agentID, requestedModel, start, err)
+				return
+			}
+		}
+	}
+
+	targetURL, err := buildUpstreamURL(h.endpoint(prov), r.URL.Path, r.URL.RawQuery)
+	if err != nil {
+		h.fail(w, http.StatusBadGateway, "invalid provider URL", agentID, requestedModel, start, err)
+		return
+	}
+
+	var body io.Reader
+	if r.Method != http.MethodGet {
+		body = bytes.NewReader(outBody)
+	}
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, targetURL, body)
+	if err != nil {
+		h.fail(w, http.StatusBadGateway, "failed to create upstream request", agentID, requestedModel, start, err)
+		return
+	}
+	copyRequestHeaders(outReq.Header, r.Header)
+	outReq.Header.Del(sessionHeader)
+	outReq.Header.Del(tagsHeader)
+	outReq.Header.Del(timeoutHeader)
+	outReq.Header.Del(providerHeader)
 
 	if err := h.setProviderAuth(outReq, prov, agentID, requestedModel, start, w); err != nil {
 		return // error already written
 	}
 
-	h.proxyAndLog(w, outReq, agentID, providerName, requestedModel, upstreamModel, start)
+	h.proxyAndLog(w, outReq, agentID, sessionID(r, ""), h.trustedProxies.clientIP(r), providerName, requestedModel, upstreamModel, false, false, start)
 }
 
-func (h *Handler) handleAnthropicMessages(w http.ResponseWriter, r *http.Request, agentID string, start time.Time) {
+func (h *Handler) handleAnthropicMessages(w http.ResponseWriter, r *http.Request, agentID string, pol agentPolicy, start time.Time) {
 	inBody, err := io.ReadAll(r.Body)
 	if err != nil {
 		h.fail(w, http.StatusBadRequest, "failed to read request body", agentID, "", start, err)
@@ -181,12 +757,33 @@ func (h *Handler) handleAnthropicMessages(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	messages, _ := payload["messages"].([]any)
+	contents := []any{payload["system"]}
+	for _, m := range messages {
+		msg, _ := m.(map[string]any)
+		contents = append(contents, msg["content"])
+	}
+	if !h.promptWithinLimits(w, pol, agentID, requestedModel, len(messages), contents, start) {
+		return
+	}
+
 	// Anthropic models don't use provider prefix — route directly to "anthropic" provider
-	prov, err := h.registry.Get("anthropic")
+	if !h.providerAllowed(w, pol.allowedProviders, agentID, "anthropic", requestedModel, start) {
+		return
+	}
+	prov, err := h.provider("anthropic")
 	if err != nil {
 		h.fail(w, http.StatusBadGateway, "anthropic provider not configured", agentID, requestedModel, start, err)
 		return
 	}
+	upstreamModel := prov.UpstreamModel(requestedModel)
+	if !h.modelAllowed(w, prov, agentID, requestedModel, upstreamModel, start) {
+		return
+	}
+	if h.modelBudgetExhausted(w, agentID, "anthropic", requestedModel, upstreamModel, start) {
+		return
+	}
+	payload["model"] = upstreamModel
 
 	outBody, err := json.Marshal(payload)
 	if err != nil {
@@ -194,7 +791,7 @@ func (h *Handler) handleAnthropicMessages(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	targetURL, err := buildUpstreamURL(prov.BaseURL, r.URL.Path, r.URL.RawQuery)
+	targetURL, err := buildUpstreamURL(h.endpoint(prov), r.URL.Path, r.URL.RawQuery)
 	if err != nil {
 		h.fail(w, http.StatusBadGateway, "invalid provider URL", agentID, requestedModel, start, err)
 		return
@@ -207,6 +804,9 @@ func (h *Handler) handleAnthropicMessages(w http.ResponseWriter, r *http.Request
 	}
 	copyRequestHeaders(outReq.Header, r.Header)
 	outReq.Header.Set("Content-Type", "application/json")
+	outReq.Header.Del(sessionHeader)
+	outReq.Header.Del(tagsHeader)
+	outReq.Header.Del(timeoutHeader)
 
 	// Forward Anthropic-specific headers
 	for _, hdr := range []string{"Anthropic-Version", "Anthropic-Beta"} {
@@ -219,86 +819,386 @@ func (h *Handler) handleAnthropicMessages(w http.ResponseWriter, r *http.Request
 		return // error already written
 	}
 
-	h.proxyAndLog(w, outReq, agentID, "anthropic", requestedModel, requestedModel, start)
+	meta, _ := payload["metadata"].(map[string]any)
+	bodySession, _ := meta["session_id"].(string)
+	h.proxyAndLog(w, outReq, agentID, sessionID(r, bodySession), h.trustedProxies.clientIP(r), "anthropic", requestedModel, upstreamModel, false, false, start)
+}
+
+// providerAllowed enforces the agent's allowed_providers metadata, writing
+// a 403 when providerName is not on it. An empty list allows every provider.
+func (h *Handler) providerAllowed(w http.ResponseWriter, allowed []string, agentID, providerName, requestedModel string, start time.Time) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, p := range allowed {
+		if strings.EqualFold(strings.TrimSpace(p), providerName) {
+			return true
+		}
+	}
+	h.logger.LogIntervention(agentID, requestedModel, "provider_not_allowed")
+	h.fail(w, http.StatusForbidden, fmt.Sprintf("provider %q is not allowed for this agent", providerName), agentID, requestedModel, start,
+		fmt.Errorf("provider %s not in allowed_providers %v", providerName, allowed))
+	return false
+}
+
+// modelAllowed enforces the provider's blocked_models, writing a 403 when
+// upstreamModel is on it.
+func (h *Handler) modelAllowed(w http.ResponseWriter, prov *provider.Provider, agentID, requestedModel, upstreamModel string, start time.Time) bool {
+	if !prov.ModelBlocked(upstreamModel) {
+		return true
+	}
+	h.logger.LogIntervention(agentID, requestedModel, "model_blocked")
+	h.fail(w, http.StatusForbidden, fmt.Sprintf("model %q is blocked on provider %q", upstreamModel, prov.Name), agentID, requestedModel, start,
+		fmt.Errorf("model %s matches blocked_models of %s", upstreamModel, prov.Name))
+	return false
 }
 
 // setProviderAuth applies the provider's auth method to the upstream request.
 // Returns an error (and writes the HTTP response) if auth cannot be applied.
 func (h *Handler) setProviderAuth(outReq *http.Request, prov *provider.Provider, agentID, requestedModel string, start time.Time, w http.ResponseWriter) error {
+	err := applyProviderAuth(outReq, prov)
+	switch {
+	case errors.Is(err, errMissingAPIKey):
+		h.fail(w, http.StatusBadGateway, "provider API key not configured", agentID, requestedModel, start, err)
+	case errors.Is(err, errMissingSigningSecret):
+		h.fail(w, http.StatusBadGateway, "provider signing secret not configured", agentID, requestedModel, start, err)
+	case err != nil:
+		h.fail(w, http.StatusBadGateway, "unsupported provider auth", agentID, requestedModel, start, err)
+	}
+	return err
+}
+
+var (
+	errMissingAPIKey        = errors.New("missing API key")
+	errMissingSigningSecret = errors.New("missing signing secret")
+	errUnsupportedAuth      = errors.New("unsupported auth mode")
+)
+
+// applyProviderAuth replaces the agent's credentials on outReq with the
+// provider's, in the provider's auth style.
+func applyProviderAuth(outReq *http.Request, prov *provider.Provider) error {
 	switch strings.ToLower(strings.TrimSpace(prov.Auth)) {
 	case "", "bearer":
 		if strings.TrimSpace(prov.APIKey) == "" {
-			h.fail(w, http.StatusBadGateway, "provider API key not configured", agentID, requestedModel, start, fmt.Errorf("missing API key for %s", prov.Name))
-			return fmt.Errorf("missing API key")
+			return fmt.Errorf("%w for %s", errMissingAPIKey, prov.Name)
 		}
 		outReq.Header.Set("Authorization", "Bearer "+prov.APIKey)
 	case "x-api-key":
 		if strings.TrimSpace(prov.APIKey) == "" {
-			h.fail(w, http.StatusBadGateway, "provider API key not configured", agentID, requestedModel, start, fmt.Errorf("missing API key for %s", prov.Name))
-			return fmt.Errorf("missing API key")
+			return fmt.Errorf("%w for %s", errMissingAPIKey, prov.Name)
 		}
 		outReq.Header.Del("Authorization")
 		outReq.Header.Set("X-Api-Key", prov.APIKey)
 	case "none":
 		outReq.Header.Del("Authorization")
+	case "hmac":
+		if prov.SigningSecret == "" {
+			return fmt.Errorf("%w for %s", errMissingSigningSecret, prov.Name)
+		}
+		sig, err := signBody(outReq, prov.SigningSecret)
+		if err != nil {
+			return err
+		}
+		outReq.Header.Del("Authorization")
+		outReq.Header.Set(prov.SignatureHeader(), sig)
 	default:
-		h.fail(w, http.StatusBadGateway, "unsupported provider auth", agentID, requestedModel, start, fmt.Errorf("unsupported auth mode: %s", prov.Auth))
-		return fmt.Errorf("unsupported auth mode")
+		return fmt.Errorf("%w: %s", errUnsupportedAuth, prov.Auth)
 	}
 	return nil
 }
 
+// signBody returns the hex HMAC-SHA256 of outReq's body under secret. The
+// body is read through GetBody, so the request can still be sent.
+func signBody(outReq *http.Request, secret string) (string, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if outReq.GetBody != nil {
+		body, err := outReq.GetBody()
+		if err != nil {
+			return "", fmt.Errorf("read body to sign: %w", err)
+		}
+		defer body.Close()
+		if _, err := io.Copy(mac, body); err != nil {
+			return "", fmt.Errorf("read body to sign: %w", err)
+		}
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// modelBudgetExhausted rejects the request with 402 when the model's
+// month-to-date spend has reached its configured cap.
+func (h *Handler) modelBudgetExhausted(w http.ResponseWriter, agentID, providerName, requestedModel, upstreamModel string, start time.Time) bool {
+	if h.accumulator == nil || h.pricing == nil {
+		return false
+	}
+	key, capUSD, ok := h.pricing.MonthlyCap(providerName, upstreamModel)
+	if !ok {
+		return false
+	}
+	spent := h.accumulator.MonthToDate(providerName, key)
+	if spent < capUSD {
+		return false
+	}
+	h.logger.LogIntervention(agentID, requestedModel, "model_budget")
+	h.fail(w, http.StatusPaymentRequired, fmt.Sprintf("monthly budget for %s/%s exhausted", providerName, key), agentID, requestedModel, start,
+		fmt.Errorf("month-to-date $%.2f reached cap $%.2f", spent, capUSD))
+	return true
+}
+
+// observeUpstream reports one upstream attempt to providerName's breaker.
+func (h *Handler) observeUpstream(outReq *http.Request, resp *http.Response, err error, agentID, requestedModel, providerName string) {
+	switch {
+	case err == nil && resp.StatusCode < 500:
+		h.breaker.succeed(providerName)
+	case errors.Is(err, context.Canceled):
+		// The agent went away; that says nothing about the provider.
+	case errors.Is(err, context.DeadlineExceeded) && agentDeadline(outReq.Context()):
+		// The agent's own X-Cllama-Timeout-Seconds ran out first; only the
+		// proxy's upstream timeout counts against the provider.
+	default:
+		if h.breaker.fail(providerName) {
+			h.logger.LogIntervention(agentID, requestedModel, "provider_cooldown")
+		}
+	}
+}
+
 // proxyAndLog forwards the request upstream, streams the response, and logs.
-func (h *Handler) proxyAndLog(w http.ResponseWriter, outReq *http.Request, agentID, providerName, requestedModel, upstreamModel string, start time.Time) {
-	h.logger.LogRequest(agentID, requestedModel)
-	resp, err := h.client.Do(outReq)
+// openAIClient marks a request on the OpenAI chat route, whose agent expects
+// OpenAI-shaped errors. reframe asks for a buffered chat completion to be
+// re-emitted as SSE when WithSSEReframe is enabled.
+func (h *Handler) proxyAndLog(w http.ResponseWriter, outReq *http.Request, agentID, session, clientIP, providerName, requestedModel, upstreamModel string, openAIClient, reframe bool, start time.Time) {
+	if cooling, left := h.breaker.cooling(providerName); cooling {
+		w.Header().Set("Retry-After", strconv.Itoa(int(left.Seconds())+1))
+		h.fail(w, http.StatusServiceUnavailable, fmt.Sprintf("provider %s is cooling down after repeated failures", providerName), agentID, requestedModel, start,
+			fmt.Errorf("provider %s unhealthy", providerName))
+		return
+	}
+	prov, _ := h.provider(providerName)
+	client := h.client
+	if prov != nil && prov.InsecureSkipVerify {
+		client = h.skipVerifyClient()
+	}
+	h.logger.LogRequest(agentID, requestedModel, upstreamModel, clientIP)
+	resp, err := h.sendUpstream(client, outReq, agentID, requestedModel, providerName)
 	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			h.fail(w, http.StatusGatewayTimeout, "upstream request timed out", agentID, requestedModel, start, err)
+			return
+		}
 		h.fail(w, http.StatusBadGateway, "upstream request failed", agentID, requestedModel, start, err)
 		return
 	}
 	defer resp.Body.Close()
+	if prov != nil {
+		if openAIClient && prov.APIFormat == "anthropic" && resp.StatusCode >= 300 {
+			translateAnthropicError(resp)
+		}
+		if openAIClient && prov.APIFormat == "anthropic" && resp.StatusCode == http.StatusOK && isSSE(resp.Header) {
+			resp.Body = translateAnthropicStream(resp.Body)
+			resp.Header.Del("Content-Length")
+		}
+		if to, ok := prov.StatusMap[resp.StatusCode]; ok {
+			resp.StatusCode = to
+		}
+	}
 
-	copyResponseHeaders(w.Header(), resp.Header)
+	tracking := h.accumulator != nil && h.pricing != nil && upstreamModel != ""
+	sse := isSSE(resp.Header)
+	// Streams are costed incrementally as they pass through; other bodies
+	// are buffered and parsed once complete.
+	var live *streamCost
+	var sink *cost.UsageSink
+	var tools cost.ToolCallCounter
+	var responseBuf bytes.Buffer
+	var body io.Reader = resp.Body
+	apiFormat := ""
+	if prov != nil && !(openAIClient && sse) {
+		// Streams for OpenAI clients were translated to OpenAI chunks above.
+		apiFormat = prov.APIFormat
+	}
+	if tracking && sse {
+		live = newStreamCost(h.accumulator, h.pricing, h.liveCostInterval, apiFormat, agentID, session, providerName, upstreamModel)
+		live.tags = tagsFrom(outReq.Context())
+		live.byResponseModel = h.priceByResponseModel
+		if h.reconcile == ReconcileEstimate {
+			// Keep the stream text in case it reports no usage.
+			body = io.TeeReader(resp.Body, io.MultiWriter(live, &tools, &responseBuf))
+		} else {
+			body = io.TeeReader(resp.Body, io.MultiWriter(live, &tools))
+		}
+	} else if tracking {
+		sink = cost.NewUsageSink(apiFormat)
+		if h.reconcile == ReconcileEstimate {
+			body = io.TeeReader(resp.Body, io.MultiWriter(sink, &tools, &responseBuf))
+		} else {
+			body = io.TeeReader(resp.Body, io.MultiWriter(sink, &tools))
+		}
+	}
+	if prov != nil && prov.MaxResponseBytes > 0 && !sse {
+		// Streams are parsed incrementally and never held whole, so only
+		// buffered bodies are bounded. Checked before any header is sent so
+		// the agent gets a clean error rather than a truncated body.
+		raw, err := io.ReadAll(io.LimitReader(body, prov.MaxResponseBytes+1))
+		if err != nil {
+			h.fail(w, http.StatusBadGateway, "failed to read upstream response", agentID, requestedModel, start, err)
+			return
+		}
+		if int64(len(raw)) > prov.MaxResponseBytes {
+			if tracking {
+				// The provider has billed for it all the same. Usage usually
+				// comes last and was cut off, so count the request with
+				// whatever reconciliation makes of it, and flag the miss.
+				h.logger.LogUsageMiss(agentID, requestedModel, upstreamModel, "response exceeded max_response_bytes")
+				h.recordBuffered(sink, outReq, responseBuf.Bytes(), agentID, session, requestedModel, providerName, upstreamModel)
+				h.checkBudget(agentID)
+			}
+			msg := fmt.Sprintf("upstream response exceeds max_response_bytes (%d) for provider %s", prov.MaxResponseBytes, providerName)
+			h.fail(w, http.StatusBadGateway, msg, agentID, requestedModel, start, errors.New(msg))
+			return
+		}
+		body = bytes.NewReader(raw)
+	}
+	if h.reframeSSE && reframe && !sse && resp.StatusCode == http.StatusOK {
+		raw, err := io.ReadAll(body)
+		if err != nil {
+			h.fail(w, http.StatusBadGateway, "failed to read upstream response", agentID, requestedModel, start, err)
+			return
+		}
+		body = bytes.NewReader(raw)
+		if frames, ok := completionToSSE(raw); ok {
+			resp.Header.Set("Content-Type", "text/event-stream")
+			resp.Header.Del("Content-Length")
+			body = bytes.NewReader(frames)
+		}
+	}
+
+	copyResponseHeaders(w.Header(), resp.Header, h.responseHeaders)
+	setRateLimitHeaders(w.Header(), resp.Header, time.Now())
 	w.WriteHeader(resp.StatusCode)
 
-	var responseBuf bytes.Buffer
-	tee := io.TeeReader(resp.Body, &responseBuf)
-	if err := streamBody(w, tee); err != nil {
+	relayed := &countingReader{r: body}
+	err = streamBody(w, relayed, h.streamBufferSize, h.streamFlushInterval)
+	if h.accumulator != nil && upstreamModel != "" {
+		h.accumulator.RecordBytes(agentID, providerName, upstreamModel, max(outReq.ContentLength, 0), relayed.n)
+	}
+	if err != nil {
+		if live != nil {
+			// Spend already pushed for a broken stream is real; close it out
+			// so the request is counted alongside it.
+			live.finish()
+		}
 		h.logger.LogError(agentID, requestedModel, resp.StatusCode, time.Since(start).Milliseconds(), err)
 		return
 	}
 
 	var costInfo *logging.CostInfo
-	if h.accumulator != nil && h.pricing != nil {
-		captured := responseBuf.Bytes()
+	if tracking {
+		// Every completed request is counted, even when the upstream reports
+		// no usage, so request counts stay accurate; what is billed for it
+		// then depends on the reconciliation strategy.
 		var usage cost.Usage
-		if isSSE(resp.Header) {
-			usage, _ = cost.ExtractUsageFromSSE(captured)
+		var costUSD float64
+		if live != nil {
+			usage = h.reconcileUsage(live.reported(), outReq, responseBuf.Bytes(), agentID, requestedModel, providerName, upstreamModel)
+			costUSD = live.settle(usage)
 		} else {
-			usage, _ = cost.ExtractUsage(captured)
+			usage, costUSD = h.recordBuffered(sink, outReq, responseBuf.Bytes(), agentID, session, requestedModel, providerName, upstreamModel)
+		}
+		calls, callTokens := tools.ToolCalls()
+		if defTokens := toolDefinitionTokens(outReq); calls > 0 || defTokens > 0 {
+			h.accumulator.RecordTools(agentID, providerName, upstreamModel, calls, defTokens+callTokens)
 		}
 		if usage.PromptTokens > 0 || usage.CompletionTokens > 0 {
-			rate, ok := h.pricing.Lookup(providerName, upstreamModel)
-			costUSD := 0.0
-			if ok {
-				costUSD = rate.Compute(usage.PromptTokens, usage.CompletionTokens)
-			}
-			h.accumulator.Record(agentID, providerName, upstreamModel,
-				usage.PromptTokens, usage.CompletionTokens, costUSD)
 			costInfo = &logging.CostInfo{
 				InputTokens:  usage.PromptTokens,
 				OutputTokens: usage.CompletionTokens,
 				CostUSD:      costUSD,
 			}
 		}
+		h.checkBudget(agentID)
 	}
 
 	latency := time.Since(start).Milliseconds()
 	if costInfo != nil {
-		h.logger.LogResponseWithCost(agentID, requestedModel, resp.StatusCode, latency, costInfo)
+		h.logger.LogResponseWithCost(agentID, requestedModel, upstreamModel, resp.StatusCode, latency, costInfo)
 	} else {
-		h.logger.LogResponse(agentID, requestedModel, resp.StatusCode, latency)
+		h.logger.LogResponse(agentID, requestedModel, upstreamModel, resp.StatusCode, latency)
+	}
+}
+
+// recordBuffered prices and records a buffered response from what sink
+// parsed of it, reconciled against respBody when usage is missing.
+func (h *Handler) recordBuffered(sink *cost.UsageSink, outReq *http.Request, respBody []byte, agentID, session, requestedModel, providerName, upstreamModel string) (cost.Usage, float64) {
+	usage, _ := sink.Usage()
+	usage = h.reconcileUsage(usage, outReq, respBody, agentID, requestedModel, providerName, upstreamModel)
+	reported := ""
+	if h.priceByResponseModel {
+		reported = sink.Model()
+	}
+	var costUSD float64
+	if rate, ok := lookupRate(h.pricing, providerName, reported, upstreamModel); ok {
+		costUSD = h.pricing.Charge(rate.Compute(usage.PromptTokens, usage.CompletionTokens))
+	}
+	h.accumulator.RecordTagged(agentID, session, tagsFrom(outReq.Context()), providerName, upstreamModel,
+		usage.PromptTokens, usage.CompletionTokens, costUSD)
+	return usage, costUSD
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// timeoutHeader lets an agent ask for a longer (or shorter) deadline than
+// the proxy default, in whole seconds.
+const timeoutHeader = "X-Cllama-Timeout-Seconds"
+
+// requestTimeout resolves the deadline for r: the X-Cllama-Timeout-Seconds
+// header capped at maxUpstreamTimeout, or upstreamTimeout when absent.
+func (h *Handler) requestTimeout(r *http.Request) (time.Duration, error) {
+	v := strings.TrimSpace(r.Header.Get(timeoutHeader))
+	if v == "" {
+		return h.upstreamTimeout, nil
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs <= 0 || secs > maxTimeoutSeconds {
+		return 0, fmt.Errorf("invalid %s: %q", timeoutHeader, v)
+	}
+	d := time.Duration(secs) * time.Second
+	if h.maxUpstreamTimeout > 0 && d > h.maxUpstreamTimeout {
+		d = h.maxUpstreamTimeout
+	}
+	return d, nil
+}
+
+type agentDeadlineKey struct{}
+
+// agentDeadline reports whether ctx's deadline was set, shorter than the
+// proxy's own upstream timeout, by the agent's X-Cllama-Timeout-Seconds.
+func agentDeadline(ctx context.Context) bool {
+	set, _ := ctx.Value(agentDeadlineKey{}).(bool)
+	return set
+}
+
+// maxTimeoutSeconds rejects header values no agent loop plausibly needs.
+const maxTimeoutSeconds = 24 * 60 * 60
+
+// sessionHeader lets agents attribute spend to a conversation.
+const sessionHeader = "X-Cllama-Session"
+
+// sessionID returns the conversation ID from the X-Cllama-Session header,
+// falling back to metadata.session_id from the request body.
+func sessionID(r *http.Request, bodySession string) string {
+	if v := strings.TrimSpace(r.Header.Get(sessionHeader)); v != "" {
+		return v
 	}
+	return strings.TrimSpace(bodySession)
 }
 
 func (h *Handler) fail(w http.ResponseWriter, status int, msg, clawID, model string, start time.Time, err error) {
@@ -333,22 +1233,42 @@ func validateSecret(ctx *agentctx.AgentContext, agentID, presentedSecret string)
 	return nil
 }
 
-func splitModel(model string) (providerName, upstreamModel string, err error) {
-	providerName, upstreamModel, ok := strings.Cut(strings.TrimSpace(model), "/")
-	if !ok || providerName == "" || upstreamModel == "" {
-		return "", "", fmt.Errorf("model must be provider-prefixed: <provider>/<model>")
+// splitModel splits "<provider>/<model>". The model part may be empty
+// ("ollama/"), in which case the caller falls back to the provider default.
+// A bare model that pricing knows gets a "did you mean" hint; a nil pricing
+// falls back to the built-in table.
+func splitModel(model string, pricing *cost.Pricing) (providerName, upstreamModel string, err error) {
+	model = strings.TrimSpace(model)
+	providerName, upstreamModel, ok := strings.Cut(model, "/")
+	if !ok || providerName == "" {
+		msg := "model must be provider-prefixed: <provider>/<model>"
+		if !ok {
+			if pricing == nil {
+				pricing = cost.DefaultPricing()
+			}
+			if providers := pricing.ProvidersFor(model); len(providers) > 0 {
+				for i, p := range providers {
+					providers[i] = p + "/" + model
+				}
+				msg += fmt.Sprintf(" (did you mean %s?)", strings.Join(providers, " or "))
+			}
+		}
+		return "", "", errors.New(msg)
 	}
 	return strings.ToLower(providerName), upstreamModel, nil
 }
 
-func buildUpstreamURL(baseURL, incomingPath, rawQuery string) (string, error) {
-	u, err := url.Parse(strings.TrimSpace(baseURL))
+func buildUpstreamURL(prov *provider.Provider, incomingPath, rawQuery string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(prov.BaseURL))
 	if err != nil {
 		return "", err
 	}
 	if u.Scheme == "" || u.Host == "" {
-		return "", fmt.Errorf("invalid base URL: %q", baseURL)
+		return "", fmt.Errorf("invalid base URL: %q", prov.BaseURL)
 	}
+	// Credentials pasted into a base URL would be sent as Basic auth and
+	// logged with the URL; auth comes only from the provider's auth mode.
+	u.User = nil
 
 	suffix := incomingPath
 	if !strings.HasPrefix(suffix, "/") {
@@ -361,61 +1281,231 @@ func buildUpstreamURL(baseURL, incomingPath, rawQuery string) (string, error) {
 	}
 
 	u.Path = strings.TrimRight(u.Path, "/") + suffix
-	u.RawQuery = rawQuery
+	u.RawQuery = mergeQueryParams(rawQuery, prov.QueryParams, prov.OverrideQueryParams)
 	return u.String(), nil
 }
 
+// mergeQueryParams appends params to the client's rawQuery. A param the
+// client already sent is left alone unless override is set, in which case
+// the client's values for it are dropped. The client's own parameters keep
+// their original order and encoding.
+func mergeQueryParams(rawQuery string, params map[string]string, override bool) string {
+	if len(params) == 0 {
+		return rawQuery
+	}
+	var parts []string
+	sent := make(map[string]bool)
+	for _, part := range strings.Split(rawQuery, "&") {
+		if part == "" {
+			continue
+		}
+		key, _, _ := strings.Cut(part, "=")
+		if k, err := url.QueryUnescape(key); err == nil {
+			key = k
+		}
+		if _, ours := params[key]; ours && override {
+			continue
+		}
+		sent[key] = true
+		parts = append(parts, part)
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !sent[k] {
+			parts = append(parts, url.QueryEscape(k)+"="+url.QueryEscape(params[k]))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// copyRequestHeaders copies src to dst, dropping hop-by-hop headers and the
+// agent's Authorization (the provider key is set separately).
 func copyRequestHeaders(dst, src http.Header) {
 	for k, vals := range src {
-		if isHopByHopHeader(k) || strings.EqualFold(k, "Authorization") {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if _, skip := hopByHopHeaders[k]; skip || k == "Authorization" || len(vals) == 0 {
 			continue
 		}
-		for _, v := range vals {
-			dst.Add(k, v)
-		}
+		dst[k] = append(dst[k], vals...)
 	}
 }
 
-func copyResponseHeaders(dst, src http.Header) {
+// copyResponseHeaders replaces dst's values with src's for every header the
+// filter allows, dropping hop-by-hop headers.
+func copyResponseHeaders(dst, src http.Header, filter *headerFilter) {
 	for k, vals := range src {
-		if isHopByHopHeader(k) {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if _, skip := hopByHopHeaders[k]; skip || !filter.allows(k) {
 			continue
 		}
-		dst.Del(k)
-		for _, v := range vals {
-			dst.Add(k, v)
+		if len(vals) == 0 {
+			delete(dst, k)
+			continue
 		}
+		dst[k] = append([]string(nil), vals...)
+	}
+}
+
+// hopByHopHeaders holds the canonical names of headers that apply to a single
+// connection and must not be forwarded. Header keys are canonicalized before
+// lookup, which for the usual already-canonical key costs no allocation.
+var hopByHopHeaders = map[string]struct{}{
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+}
+
+// headerFilter is an operator-configured allow/deny list for response headers.
+// A nil filter allows everything.
+type headerFilter struct {
+	allow []string
+	deny  []string
+}
+
+func newHeaderFilter(allow, deny []string) *headerFilter {
+	f := &headerFilter{
+		allow: normalizeHeaderPatterns(allow),
+		deny:  normalizeHeaderPatterns(deny),
 	}
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil
+	}
+	return f
 }
 
-func isHopByHopHeader(name string) bool {
-	switch strings.ToLower(name) {
-	case "connection", "keep-alive", "proxy-authenticate", "proxy-authorization", "te", "trailer", "transfer-encoding", "upgrade":
+func (f *headerFilter) allows(name string) bool {
+	if f == nil {
 		return true
-	default:
+	}
+	name = strings.ToLower(name)
+	if name == "content-type" {
+		return true
+	}
+	if len(f.allow) > 0 && !matchHeaderPattern(f.allow, name) {
 		return false
 	}
+	return !matchHeaderPattern(f.deny, name)
+}
+
+func normalizeHeaderPatterns(patterns []string) []string {
+	var out []string
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func matchHeaderPattern(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+			continue
+		}
+		if p == name {
+			return true
+		}
+	}
+	return false
 }
 
 func isSSE(h http.Header) bool {
 	return strings.Contains(h.Get("Content-Type"), "text/event-stream")
 }
 
-func streamBody(w http.ResponseWriter, body io.Reader) error {
+// defaultStreamBufferSize is the read size used to relay response bodies
+// when WithStreamFlush sets none.
+const defaultStreamBufferSize = 32 * 1024
+
+// streamBody relays body to w in reads of up to bufSize bytes. With a zero
+// flushEvery each read is flushed at once; otherwise flushes are coalesced to
+// at most one per flushEvery, with anything still pending flushed on return.
+func streamBody(w http.ResponseWriter, body io.Reader, bufSize int, flushEvery time.Duration) error {
 	flusher, _ := w.(http.Flusher)
 	if flusher == nil {
 		_, err := io.Copy(w, body)
 		return err
 	}
+	if bufSize <= 0 {
+		bufSize = defaultStreamBufferSize
+	}
+	buf := make([]byte, bufSize)
+
+	if flushEvery <= 0 {
+		for {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return werr
+				}
+				flusher.Flush()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
 
-	buf := make([]byte, 32*1024)
+	// A timer flushes what is pending, so a quiet upstream never holds back
+	// data already written. mu serializes it with the writes below.
+	var (
+		mu      sync.Mutex
+		pending bool
+		done    bool
+		timer   *time.Timer
+	)
+	flushPending := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done && pending {
+			flusher.Flush()
+			pending = false
+		}
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		if timer != nil {
+			timer.Stop()
+		}
+		if pending {
+			flusher.Flush()
+		}
+	}()
 	for {
 		n, err := body.Read(buf)
 		if n > 0 {
-			if _, werr := w.Write(buf[:n]); werr != nil {
+			mu.Lock()
+			_, werr := w.Write(buf[:n])
+			if werr == nil && !pending {
+				pending = true
+				if timer == nil {
+					timer = time.AfterFunc(flushEvery, flushPending)
+				} else {
+					timer.Reset(flushEvery)
+				}
+			}
+			mu.Unlock()
+			if werr != nil {
 				return werr
 			}
-			flusher.Flush()
 		}
 		if err == io.EOF {
 			return nil
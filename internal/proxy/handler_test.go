@@ -2,11 +2,23 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/mostlydev/cllama/internal/agentctx"
 	"github.com/mostlydev/cllama/internal/cost"
@@ -116,7 +128,7 @@ func TestHandlerRecordsCost(t *testing.T) {
 
 	acc := cost.NewAccumulator()
 	pricing := cost.DefaultPricing()
-	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard),
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
 		WithCostTracking(acc, pricing))
 
 	body := `{"model":"anthropic/claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`
@@ -160,7 +172,7 @@ func TestHandlerRecordsCostFromSSE(t *testing.T) {
 
 	acc := cost.NewAccumulator()
 	pricing := cost.DefaultPricing()
-	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard),
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
 		WithCostTracking(acc, pricing))
 
 	body := `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`
@@ -185,6 +197,82 @@ func TestHandlerRecordsCostFromSSE(t *testing.T) {
 	}
 }
 
+func TestHandlerRecordsCostFromAnthropicStream(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"model\":\"claude-sonnet-4-20250514\",\"usage\":{\"input_tokens\":200,\"output_tokens\":1}}}\n\n"))
+		w.Write([]byte("event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"index\":0,\"delta\":{\"type\":\"text_delta\",\"text\":\"hi\"}}\n\n"))
+		w.Write([]byte("event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":80}}\n\n"))
+		w.Write([]byte("event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n"))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("anthropic", &provider.Provider{
+		Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-ant-real", Auth: "x-api-key", APIFormat: "anthropic",
+	})
+
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	body := `{"model":"claude-sonnet-4-20250514","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 {
+		t.Fatalf("expected one cost entry, got %d", len(entries))
+	}
+	if entries[0].TotalInputTokens != 200 || entries[0].TotalOutputTokens != 80 {
+		t.Errorf("expected 200 in / 80 out, got %d / %d", entries[0].TotalInputTokens, entries[0].TotalOutputTokens)
+	}
+	if entries[0].TotalCostUSD <= 0 {
+		t.Error("expected positive cost")
+	}
+}
+
+func TestHandlerRecordsRequestWithoutUsage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[{"message":{"content":"hello"}}]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL, APIKey: "sk-real", Auth: "bearer"})
+
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), nil,
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	}
+
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	if entries[0].RequestCount != 2 {
+		t.Errorf("expected 2 requests counted, got %d", entries[0].RequestCount)
+	}
+	if entries[0].TotalCostUSD != 0 || entries[0].TotalInputTokens != 0 {
+		t.Errorf("expected zero tokens and cost, got %+v", entries[0])
+	}
+}
+
 func TestHandlerForwardsAnthropicMessages(t *testing.T) {
 	var gotAPIKey string
 	var gotVersion string
@@ -266,6 +354,3127 @@ func TestHandlerAnthropicRejectsUnknownAgent(t *testing.T) {
 	}
 }
 
+func TestHandlerMaxInflightQueuesThenRejects(t *testing.T) {
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	newReq := func() *http.Request {
+		body := `{"model":"openai/gpt-4o","messages":[]}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		return req
+	}
+
+	t.Run("rejects when wait expires", func(t *testing.T) {
+		var logs bytes.Buffer
+		h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+			WithMaxInflight(1, 20*time.Millisecond))
+
+		done := make(chan int)
+		go func() {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newReq())
+			done <- w.Code
+		}()
+		<-entered
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newReq())
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 while saturated, got %d", w.Code)
+		}
+		if !strings.Contains(logs.String(), `"intervention":"proxy_capacity"`) {
+			t.Errorf("expected proxy_capacity intervention logged, got %s", logs.String())
+		}
+
+		release <- struct{}{}
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("expected first request 200, got %d", code)
+		}
+	})
+
+	t.Run("queues until a slot frees", func(t *testing.T) {
+		h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), nil,
+			WithMaxInflight(1, 5*time.Second))
+
+		codes := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, newReq())
+				codes <- w.Code
+			}()
+		}
+		<-entered
+		select {
+		case <-entered:
+			t.Fatal("second request reached upstream while first was in flight")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		release <- struct{}{}
+		<-entered
+		release <- struct{}{}
+		for i := 0; i < 2; i++ {
+			if code := <-codes; code != http.StatusOK {
+				t.Errorf("expected queued request to succeed, got %d", code)
+			}
+		}
+	})
+}
+
+func TestHandlerResponseHeaderFilter(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Openai-Organization", "org-secret")
+		w.Header().Set("X-Request-Id", "req-1")
+		w.Header().Set("X-Ratelimit-Remaining-Requests", "99")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	serve := func(opts ...HandlerOption) http.Header {
+		h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), nil, opts...)
+		body := `{"model":"openai/gpt-4o","messages":[]}`
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Header()
+	}
+
+	got := serve(WithResponseHeaderFilter(nil, []string{"openai-organization"}))
+	if got.Get("Openai-Organization") != "" {
+		t.Error("expected denied header to be stripped")
+	}
+	if got.Get("X-Request-Id") != "req-1" {
+		t.Error("expected non-denied header to pass through")
+	}
+
+	got = serve(WithResponseHeaderFilter([]string{"x-ratelimit-*"}, nil))
+	if got.Get("X-Ratelimit-Remaining-Requests") != "99" {
+		t.Error("expected allowlisted header to pass through")
+	}
+	if got.Get("X-Request-Id") != "" || got.Get("Openai-Organization") != "" {
+		t.Error("expected headers outside the allowlist to be stripped")
+	}
+	if got.Get("Content-Type") != "application/json" {
+		t.Error("expected Content-Type to always pass through")
+	}
+}
+
+func TestHandlerRecordsCostPerSession(t *testing.T) {
+	var gotSessionHeader string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSessionHeader = r.Header.Get("X-Cllama-Session")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":100,"completion_tokens":50,"total_tokens":150}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL, APIKey: "sk-real", Auth: "bearer"})
+
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), nil,
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	send := func(body, session string) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		if session != "" {
+			req.Header.Set("X-Cllama-Session", session)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+	send(`{"model":"openai/gpt-4o","messages":[]}`, "conv-a")
+	send(`{"model":"openai/gpt-4o","messages":[],"metadata":{"session_id":"conv-b"}}`, "")
+	send(`{"model":"openai/gpt-4o","messages":[],"metadata":{"session_id":"conv-b"}}`, "")
+	send(`{"model":"openai/gpt-4o","messages":[]}`, "")
+
+	if gotSessionHeader != "" {
+		t.Errorf("expected session header stripped before upstream, got %q", gotSessionHeader)
+	}
+	if entries := acc.ByAgent("tiverton"); len(entries) != 1 || entries[0].RequestCount != 4 {
+		t.Fatalf("expected 4 requests in the agent bucket, got %+v", entries)
+	}
+	sessions := acc.Sessions()["tiverton"]
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	if sessions[0].Session != "conv-a" || sessions[0].RequestCount != 1 {
+		t.Errorf("unexpected conv-a entry: %+v", sessions[0])
+	}
+	if sessions[1].Session != "conv-b" || sessions[1].RequestCount != 2 {
+		t.Errorf("unexpected conv-b entry: %+v", sessions[1])
+	}
+}
+
+func TestHandlerAppliesBillingPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5,"total_tokens":15}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL, APIKey: "sk-real", Auth: "bearer"})
+
+	acc := cost.NewAccumulator()
+	pricing := cost.DefaultPricing()
+	pricing.MinChargeUSD = 0.001
+	pricing.RoundToCents = true
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), nil,
+		WithCostTracking(acc, pricing))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if got := acc.TotalCost(); got != 0.01 {
+		t.Errorf("expected tiny request billed at one cent, got %f", got)
+	}
+}
+
+func TestHandlerWithMemoryStore(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	store := agentctx.NewMemoryStore()
+	if err := store.Add(&agentctx.AgentContext{AgentID: "embedded", Metadata: map[string]any{"token": "embedded:s3cret"}}); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(reg, store.Load, nil)
+
+	send := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := send("Bearer embedded:s3cret"); code != http.StatusOK {
+		t.Errorf("expected 200 for registered agent, got %d", code)
+	}
+	if code := send("Bearer stranger:s3cret"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for unregistered agent, got %d", code)
+	}
+}
+
+func TestHandlerUsesProviderDefaultModel(t *testing.T) {
+	var gotModel string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		gotModel, _ = payload["model"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("ollama", &provider.Provider{Name: "ollama", BaseURL: backend.URL + "/v1", Auth: "none", DefaultModel: "llama3.1:8b"})
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), nil)
+
+	send := func(model string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send("ollama/"); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if gotModel != "llama3.1:8b" {
+		t.Errorf("expected provider default model forwarded, got %q", gotModel)
+	}
+	if code := send("ollama/qwen2.5"); code != http.StatusOK || gotModel != "qwen2.5" {
+		t.Errorf("expected explicit model to win, got code=%d model=%q", code, gotModel)
+	}
+	if code := send("openai/"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for provider without default_model, got %d", code)
+	}
+	if code := send("gpt-4o"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unprefixed model, got %d", code)
+	}
+}
+
+func TestHandlerThrottlesRepeatedBadSecrets(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:correct"), logging.New(&logs, logging.FormatJSON),
+		WithAuthThrottle(3, time.Minute))
+	clock := time.Now()
+	h.authThrottle.now = func() time.Time { return clock }
+
+	send := func(secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:"+secret)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// A success before the limit clears earlier failures.
+	send("wrong")
+	send("wrong")
+	if w := send("correct"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 before limit, got %d", w.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := send("wrong"); w.Code != http.StatusForbidden {
+			t.Fatalf("attempt %d: expected 403, got %d", i, w.Code)
+		}
+	}
+	w := send("correct")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 once throttled, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header on throttled response")
+	}
+	if !strings.Contains(logs.String(), `"intervention":"auth_bruteforce"`) {
+		t.Errorf("expected auth_bruteforce intervention logged, got %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"intervention":"auth_throttled"`) {
+		t.Errorf("expected auth_throttled intervention logged, got %s", logs.String())
+	}
+
+	// The throttle is per client: the agent itself, elsewhere, still gets in.
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:correct")
+	req.RemoteAddr = "198.51.100.7:4321"
+	other := httptest.NewRecorder()
+	h.ServeHTTP(other, req)
+	if other.Code != http.StatusOK {
+		t.Errorf("expected another client with the right secret to pass, got %d: %s", other.Code, other.Body.String())
+	}
+
+	clock = clock.Add(time.Minute)
+	if w := send("correct"); w.Code != http.StatusOK {
+		t.Errorf("expected throttle to lift after window, got %d", w.Code)
+	}
+}
+
+func TestHandlerTimeoutHeaderOverridesDefault(t *testing.T) {
+	var forwarded atomic.Value
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Store(r.Header.Get("X-Cllama-Timeout-Seconds"))
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	send := func(h *Handler, timeout string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		if timeout != "" {
+			req.Header.Set("X-Cllama-Timeout-Seconds", timeout)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON), WithUpstreamTimeout(50*time.Millisecond, time.Minute))
+	if w := send(h, ""); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected default timeout to yield 504, got %d", w.Code)
+	}
+	if w := send(h, "5"); w.Code != http.StatusOK {
+		t.Fatalf("expected header to extend the deadline, got %d: %s", w.Code, w.Body.String())
+	}
+	if got, _ := forwarded.Load().(string); got != "" {
+		t.Errorf("timeout header leaked upstream: %q", got)
+	}
+
+	capped := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON), WithUpstreamTimeout(0, 100*time.Millisecond))
+	if w := send(capped, "5"); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected header capped at max, got %d", w.Code)
+	}
+
+	for _, bad := range []string{"0", "-3", "abc", "9999999"} {
+		if w := send(h, bad); w.Code != http.StatusBadRequest {
+			t.Errorf("timeout %q: expected 400, got %d", bad, w.Code)
+		}
+	}
+}
+
+func TestHandlerLogsUpstreamModelSeparately(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openrouter", &provider.Provider{Name: "openrouter", BaseURL: backend.URL + "/v1", APIKey: "sk-or", Auth: "bearer"})
+
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openrouter/anthropic/claude-sonnet-4","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	dec := json.NewDecoder(&logs)
+	var seen int
+	for dec.More() {
+		var e map[string]any
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("invalid log line: %v", err)
+		}
+		if e["type"] != "request" && e["type"] != "response" {
+			continue
+		}
+		seen++
+		if e["model"] != "openrouter/anthropic/claude-sonnet-4" || e["upstream_model"] != "anthropic/claude-sonnet-4" {
+			t.Errorf("expected requested and upstream models logged distinctly, got %v", e)
+		}
+	}
+	if seen != 2 {
+		t.Fatalf("expected request and response entries, got %d", seen)
+	}
+}
+
+func TestHandlerReframesBufferedCompletionAsSSE(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-9","object":"chat.completion","created":1700000000,"model":"gpt-4o",` +
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"hello there"},"finish_reason":"stop"}],` +
+			`"usage":{"prompt_tokens":12,"completion_tokens":3}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+
+	send := func(h *Handler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithSSEReframe(true))
+	w := send(h, `{"model":"openai/gpt-4o","stream":true,"messages":[]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected SSE content type, got %q", ct)
+	}
+	frames := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(frames) != 3 || frames[2] != "data: [DONE]" {
+		t.Fatalf("expected delta, finish, and [DONE] frames, got %q", w.Body.String())
+	}
+	var first struct {
+		Object  string `json:"object"`
+		Choices []struct {
+			Delta map[string]any `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frames[0], "data: ")), &first); err != nil {
+		t.Fatalf("invalid chunk: %v", err)
+	}
+	if first.Object != "chat.completion.chunk" || first.Choices[0].Delta["content"] != "hello there" {
+		t.Errorf("unexpected first chunk: %s", frames[0])
+	}
+	if !strings.Contains(frames[1], `"finish_reason":"stop"`) || !strings.Contains(frames[1], `"usage"`) {
+		t.Errorf("expected finish chunk with usage, got %s", frames[1])
+	}
+	if entries := acc.ByAgent("tiverton"); len(entries) != 1 || entries[0].TotalInputTokens != 12 {
+		t.Errorf("expected usage recorded from buffered body, got %+v", entries)
+	}
+
+	// Non-streaming requests and a disabled option pass JSON through.
+	if w := send(h, `{"model":"openai/gpt-4o","messages":[]}`); !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected JSON for non-stream request, got %q", w.Header().Get("Content-Type"))
+	}
+	off := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	if w := send(off, `{"model":"openai/gpt-4o","stream":true,"messages":[]}`); !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		t.Errorf("expected passthrough when reframing disabled, got %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestHandlerLogsClientIPFromTrustedProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	cases := []struct {
+		name    string
+		trusted []string
+		peer    string
+		xff     string
+		realIP  string
+		want    string
+	}{
+		{name: "no trust config ignores headers", peer: "10.0.0.5:4000", xff: "203.0.113.9", want: "10.0.0.5"},
+		{name: "untrusted peer ignores headers", trusted: []string{"10.1.0.0/16"}, peer: "10.0.0.5:4000", xff: "203.0.113.9", want: "10.0.0.5"},
+		{name: "trusted peer uses forwarded-for", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.5:4000", xff: "198.51.100.1, 203.0.113.9", want: "203.0.113.9"},
+		{name: "skips trusted hops", trusted: []string{"10.0.0.0/8"}, peer: "10.0.0.5:4000", xff: "203.0.113.9, 10.2.3.4", want: "203.0.113.9"},
+		{name: "falls back to real-ip", trusted: []string{"10.0.0.5"}, peer: "10.0.0.5:4000", realIP: "203.0.113.7", want: "203.0.113.7"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON), WithTrustedProxies(tc.trusted))
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+			req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+			req.RemoteAddr = tc.peer
+			if tc.xff != "" {
+				req.Header.Set("X-Forwarded-For", tc.xff)
+			}
+			if tc.realIP != "" {
+				req.Header.Set("X-Real-IP", tc.realIP)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !strings.Contains(logs.String(), `"client_ip":"`+tc.want+`"`) {
+				t.Errorf("expected client_ip %s, got %s", tc.want, logs.String())
+			}
+		})
+	}
+}
+
+func TestHandlerEnforcesModelMonthlyCap(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		// 100k in + 10k out on claude-opus-4 = $1.50 + $0.75 = $2.25
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":100000,"completion_tokens":10000}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-ant", Auth: "x-api-key"})
+	acc := cost.NewAccumulator()
+	pricing := cost.DefaultPricing()
+	pricing.SetMonthlyCap("anthropic", "claude-opus-4", 4.00)
+
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON), WithCostTracking(acc, pricing))
+	send := func(model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ { // $2.25, then $4.50 — the second crosses the cap
+		if w := send("anthropic/claude-opus-4-20250514"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200 under cap, got %d", i, w.Code)
+		}
+	}
+	w := send("anthropic/claude-opus-4")
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected 402 once cap is exceeded, got %d", w.Code)
+	}
+	if upstreamCalls != 2 {
+		t.Errorf("blocked request must not reach upstream, got %d calls", upstreamCalls)
+	}
+	if !strings.Contains(logs.String(), `"intervention":"model_budget"`) {
+		t.Errorf("expected model_budget intervention logged, got %s", logs.String())
+	}
+	if w := send("anthropic/claude-sonnet-4"); w.Code != http.StatusOK {
+		t.Errorf("uncapped model should still pass, got %d", w.Code)
+	}
+}
+
+func TestHandlerGlobalBudgetCutoff(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		// 1M in on gpt-4o = $2.50
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":1000000,"completion_tokens":0}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	acc.Record("westin", "anthropic", "claude-opus-4", 0, 0, 2.50)
+
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithGlobalBudget(5.00))
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 below the ceiling, got %d", w.Code)
+	}
+	w := send() // total is now exactly $5.00
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected 402 at the ceiling, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "global budget") {
+		t.Errorf("expected clear budget message, got %s", w.Body.String())
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("blocked request must not reach upstream, got %d calls", upstreamCalls)
+	}
+	if !strings.Contains(logs.String(), `"intervention":"global_budget"`) {
+		t.Errorf("expected global_budget intervention logged, got %s", logs.String())
+	}
+}
+
+func TestHandlerAgentBudgetCutoff(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":0}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-opus-4", 0, 0, 5.00)
+	acc.Record("westin", "anthropic", "claude-opus-4", 0, 0, 4.00)
+
+	var logs bytes.Buffer
+	loader := func(agentID string) (*agentctx.AgentContext, error) {
+		return &agentctx.AgentContext{AgentID: agentID, Metadata: map[string]any{"token": agentID + ":dummy123"}}, nil
+	}
+	h := NewHandler(reg, loader, logging.New(&logs, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithAgentBudget(5.00))
+	send := func(agentID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer "+agentID+":dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("tiverton")
+	if w.Code != http.StatusPaymentRequired {
+		t.Fatalf("expected 402 at the agent ceiling, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "agent budget") {
+		t.Errorf("expected clear budget message, got %s", w.Body.String())
+	}
+	if w := send("westin"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for an agent below the ceiling, got %d", w.Code)
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("blocked request must not reach upstream, got %d calls", upstreamCalls)
+	}
+	if !strings.Contains(logs.String(), `"intervention":"agent_budget"`) {
+		t.Errorf("expected agent_budget intervention logged, got %s", logs.String())
+	}
+}
+
+func TestHandlerPassthroughForwardsOtherPaths(t *testing.T) {
+	var gotPath, gotMethod, gotAuth string
+	var gotBody map[string]any
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotMethod, gotAuth = r.URL.Path, r.Method, r.Header.Get("Authorization")
+		gotBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/embeddings" {
+			_, _ = w.Write([]byte(`{"object":"list","data":[],"usage":{"prompt_tokens":8,"total_tokens":8}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"object":"list","data":[{"id":"gpt-4o"}]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", bytes.NewBufferString(`{"model":"openai/text-embedding-3-small","input":"hi"}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotPath != "/v1/embeddings" || gotMethod != http.MethodPost || gotAuth != "Bearer sk-real" {
+		t.Errorf("unexpected upstream request: %s %s auth=%q", gotMethod, gotPath, gotAuth)
+	}
+	if gotBody["model"] != "text-embedding-3-small" || gotBody["input"] != "hi" {
+		t.Errorf("expected model rewritten and other fields kept, got %v", gotBody)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	req.Header.Set("X-Cllama-Provider", "openai")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "gpt-4o") {
+		t.Fatalf("expected model list passed through, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotPath != "/v1/models" || gotMethod != http.MethodGet {
+		t.Errorf("unexpected upstream request: %s %s", gotMethod, gotPath)
+	}
+
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 || entries[0].Model != "text-embedding-3-small" || entries[0].TotalInputTokens != 8 {
+		t.Errorf("expected only the embeddings call accounted, got %+v", entries)
+	}
+}
+
+func TestHandlerPassthroughProviderHeaderEnforcesModelPolicy(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"object":"list","data":[],"usage":{"prompt_tokens":8,"total_tokens":8}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer",
+		BlockedModels: []string{"gpt-4o*"}})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/embeddings", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		req.Header.Set("X-Cllama-Provider", "openai")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(`{"model":"gpt-4o-mini","input":"hi"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a blocked model behind the provider header, got %d: %s", w.Code, w.Body.String())
+	}
+	if upstreamCalls != 0 {
+		t.Errorf("blocked request must not reach upstream, got %d calls", upstreamCalls)
+	}
+
+	if w := send(`{"model":"text-embedding-3-small","input":"hi"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 || entries[0].Model != "text-embedding-3-small" || entries[0].TotalInputTokens != 8 {
+		t.Errorf("expected the call accounted under its model, got %+v", entries)
+	}
+}
+
+func TestHandlerPassthroughRequiresProvider(t *testing.T) {
+	h := NewHandler(provider.NewRegistry(""), stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "X-Cllama-Provider") {
+		t.Fatalf("expected 400 naming the provider header, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerSuggestsPrefixForKnownBareModel(t *testing.T) {
+	h := NewHandler(provider.NewRegistry(""), stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	send := func(model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("gpt-4o")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "did you mean openai/gpt-4o?") {
+		t.Errorf("expected prefix suggestion, got %s", w.Body.String())
+	}
+
+	w = send("my-local-model")
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "did you mean") {
+		t.Errorf("expected plain prefix error for unknown model, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerIdempotencyKeyReplaysResponse(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id":"chatcmpl-%d","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5}}`, upstreamCalls)
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithIdempotency(time.Minute, 0, 0))
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		req.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	body := `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`
+
+	first := send("k-1", body)
+	if first.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", first.Code, first.Body.String())
+	}
+	retry := send("k-1", body)
+	if retry.Code != http.StatusOK || retry.Body.String() != first.Body.String() {
+		t.Fatalf("expected stored response replayed, got %d: %s", retry.Code, retry.Body.String())
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || retry.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected replay headers: %v", retry.Header())
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("expected one upstream call, got %d", upstreamCalls)
+	}
+	if entries := acc.ByAgent("tiverton"); len(entries) != 1 || entries[0].RequestCount != 1 {
+		t.Errorf("replay must not be charged again, got %+v", entries)
+	}
+
+	conflict := send("k-1", `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"bye"}]}`)
+	if conflict.Code != http.StatusUnprocessableEntity || !strings.Contains(conflict.Body.String(), "different request body") {
+		t.Errorf("expected 422 for reused key, got %d: %s", conflict.Code, conflict.Body.String())
+	}
+
+	if w := send("k-2", body); w.Code != http.StatusOK || upstreamCalls != 2 {
+		t.Errorf("expected a new key to reach upstream, got %d with %d calls", w.Code, upstreamCalls)
+	}
+}
+
+func TestIdempotencyCacheReleasesFailuresAndExpires(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 0, 0)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	sum := sha256.Sum256([]byte("body"))
+
+	if _, reserved, err := c.begin("tiverton", "k", sum); !reserved || err != nil {
+		t.Fatalf("expected reservation, got %v %v", reserved, err)
+	}
+	if _, _, err := c.begin("tiverton", "k", sum); !errors.Is(err, errIdempotencyInFlight) {
+		t.Fatalf("expected in-flight conflict, got %v", err)
+	}
+	if _, reserved, _ := c.begin("westin", "k", sum); !reserved {
+		t.Fatal("expected keys to be scoped per agent")
+	}
+
+	c.finish("tiverton", "k", &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusBadGateway})
+	if _, reserved, _ := c.begin("tiverton", "k", sum); !reserved {
+		t.Fatal("expected failed request to release its key")
+	}
+
+	c.finish("tiverton", "k", &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK})
+	if stored, _, _ := c.begin("tiverton", "k", sum); stored == nil || stored.status != http.StatusOK {
+		t.Fatalf("expected stored response, got %+v", stored)
+	}
+	now = now.Add(time.Minute)
+	if _, reserved, _ := c.begin("tiverton", "k", sum); !reserved {
+		t.Error("expected stored response to expire after ttl")
+	}
+}
+
+func TestIdempotencyCacheBoundsKeysAndBodies(t *testing.T) {
+	c := newIdempotencyCache(time.Minute, 2, 8)
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	sum := sha256.Sum256([]byte("body"))
+	stored := func(key, body string) {
+		rec := &responseRecorder{ResponseWriter: httptest.NewRecorder(), limit: c.maxBody}
+		_, _ = rec.Write([]byte(body))
+		c.finish("tiverton", key, rec)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if _, reserved, err := c.begin("tiverton", key, sum); !reserved || err != nil {
+			t.Fatalf("expected key %s reserved, got %v %v", key, reserved, err)
+		}
+	}
+	if _, _, err := c.begin("tiverton", "c", sum); !errors.Is(err, errIdempotencyFull) {
+		t.Fatalf("expected a third key refused, got %v", err)
+	}
+	if _, reserved, _ := c.begin("westin", "c", sum); !reserved {
+		t.Fatal("expected the key limit to be per agent")
+	}
+
+	stored("a", "small")
+	stored("b", "much too large")
+	if _, reserved, _ := c.begin("tiverton", "b", sum); !reserved {
+		t.Fatal("expected an oversized response not to be stored")
+	}
+	if got, _, _ := c.begin("tiverton", "a", sum); got == nil || string(got.body) != "small" {
+		t.Fatalf("expected the small response stored, got %+v", got)
+	}
+
+	now = now.Add(time.Minute)
+	if _, reserved, err := c.begin("tiverton", "c", sum); !reserved || err != nil {
+		t.Fatalf("expected an expired key to free a slot, got %v %v", reserved, err)
+	}
+	if len(c.entries) != 3 || len(c.expiry) != 0 {
+		t.Errorf("expected the expired entry dropped, got %d entries and %d queued", len(c.entries), len(c.expiry))
+	}
+}
+
+func TestHandlerRemapsProviderStatus(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte(`{"error":"slow down"}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("quirky", &provider.Provider{Name: "quirky", BaseURL: backend.URL + "/v1", Auth: "none",
+		StatusMap: map[int]int{http.StatusTeapot: http.StatusTooManyRequests}})
+	reg.Set("plain", &provider.Provider{Name: "plain", BaseURL: backend.URL + "/v1", Auth: "none"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	send := func(model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("quirky/m")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 418 remapped to 429, got %d", w.Code)
+	}
+	if w.Body.String() != `{"error":"slow down"}` {
+		t.Errorf("expected body passed through, got %s", w.Body.String())
+	}
+	if w := send("plain/m"); w.Code != http.StatusTeapot {
+		t.Errorf("expected unmapped provider to keep 418, got %d", w.Code)
+	}
+}
+
+func TestHandlerRecordsStreamCostIncrementally(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"a\"}}],\"usage\":{\"prompt_tokens\":1000,\"completion_tokens\":100}}\n\n"))
+		flusher.Flush()
+		<-release
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"b\"}}],\"usage\":{\"prompt_tokens\":1000,\"completion_tokens\":600}}\n\n"))
+		_, _ = w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":1000,\"completion_tokens\":1000}}\n\ndata: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	pricing := cost.DefaultPricing()
+	pricing.RoundToCents = true
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, pricing))
+	h.liveCostInterval = 0
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","stream":true,"messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, req)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		spent, requests, _ := acc.AgentTotal("tiverton")
+		if spent > 0 {
+			if requests != 0 {
+				t.Errorf("in-progress stream must not count as a request yet, got %d", requests)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected spend recorded before the stream finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	<-done
+
+	// 1000 in + 1000 out on gpt-4o = $0.0125, rounded up to $0.02.
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %+v", entries)
+	}
+	e := entries[0]
+	if e.RequestCount != 1 || e.TotalInputTokens != 1000 || e.TotalOutputTokens != 1000 {
+		t.Errorf("expected final usage counted once, got %+v", e)
+	}
+	if e.TotalCostUSD < 0.0199 || e.TotalCostUSD > 0.0201 {
+		t.Errorf("expected final cost $0.02, got %f", e.TotalCostUSD)
+	}
+}
+
+func TestHandlerProviderCooldown(t *testing.T) {
+	var upstreamCalls atomic.Int32
+	var failing atomic.Bool
+	failing.Store(true)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithProviderCooldown(2, time.Minute))
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	h.breaker.now = func() time.Time { return clock }
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	send()
+	if !h.ProviderHealth()["openai"].Healthy {
+		t.Fatal("one failure must not trip the breaker")
+	}
+	send()
+	health := h.ProviderHealth()["openai"]
+	if health.Healthy || health.ConsecutiveFailures != 2 || health.CooldownUntil == nil {
+		t.Fatalf("expected openai in cooldown, got %+v", health)
+	}
+	if !strings.Contains(logs.String(), `"intervention":"provider_cooldown"`) {
+		t.Errorf("expected provider_cooldown intervention logged, got %s", logs.String())
+	}
+
+	w := send()
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "61" {
+		t.Fatalf("expected 503 with Retry-After during cooldown, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := upstreamCalls.Load(); got != 2 {
+		t.Errorf("cooling provider must not be called, got %d calls", got)
+	}
+
+	clock = clock.Add(time.Minute)
+	failing.Store(false)
+	if w := send(); w.Code != http.StatusOK {
+		t.Fatalf("expected request through after cooldown, got %d", w.Code)
+	}
+	if health := h.ProviderHealth()["openai"]; !health.Healthy || health.ConsecutiveFailures != 0 {
+		t.Errorf("expected success to reset health, got %+v", health)
+	}
+}
+
+func TestHandlerCooldownIgnoresAgentDeadlines(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	send := func(h *Handler, timeoutHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		if timeoutHeader != "" {
+			req.Header.Set("X-Cllama-Timeout-Seconds", timeoutHeader)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// An agent that shortens its own deadline does not put the provider
+	// into cooldown for everyone else.
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithProviderCooldown(1, time.Minute), WithUpstreamTimeout(time.Minute, time.Hour))
+	if w := send(h, "1"); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d: %s", w.Code, w.Body.String())
+	}
+	if !h.ProviderHealth()["openai"].Healthy {
+		t.Errorf("an agent-shortened deadline must not trip the breaker, got %+v", h.ProviderHealth()["openai"])
+	}
+
+	// The proxy's own upstream timeout does count.
+	h = NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithProviderCooldown(1, time.Minute), WithUpstreamTimeout(50*time.Millisecond, time.Hour))
+	if w := send(h, ""); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504, got %d: %s", w.Code, w.Body.String())
+	}
+	if h.ProviderHealth()["openai"].Healthy {
+		t.Error("expected the proxy's upstream timeout to trip the breaker")
+	}
+}
+
+func TestHandlerAccountsUsageWithLargeLogprobs(t *testing.T) {
+	// ~4MB of logprobs ahead of the usage object.
+	var lp strings.Builder
+	lp.WriteString(`{"content":[`)
+	for i := 0; i < 20000; i++ {
+		if i > 0 {
+			lp.WriteByte(',')
+		}
+		lp.WriteString(`{"token":"tok","logprob":-0.01,"bytes":[116,111,107],"top_logprobs":[`)
+		for j := 0; j < 5; j++ {
+			if j > 0 {
+				lp.WriteByte(',')
+			}
+			fmt.Fprintf(&lp, `{"token":"alt%d","logprob":-%d.5,"bytes":[97]}`, j, j+1)
+		}
+		lp.WriteString(`]}`)
+	}
+	lp.WriteString(`]}`)
+	logprobs := lp.String()
+
+	var gotBody map[string]any
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotBody = nil
+		_ = json.NewDecoder(r.Body).Decode(&gotBody)
+		if gotBody["stream"] == true && r.Header.Get("X-Test-Native-Stream") != "" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = fmt.Fprintf(w, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"tok\"},\"logprobs\":%s}]}\n\n", logprobs)
+			_, _ = w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":7,\"completion_tokens\":20000}}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"id":"chatcmpl-1","object":"chat.completion","created":1700000000,"model":"gpt-4o",`+
+			`"choices":[{"index":0,"message":{"role":"assistant","content":"tok"},"logprobs":%s,"finish_reason":"length"}],`+
+			`"usage":{"prompt_tokens":7,"completion_tokens":20000}}`, logprobs)
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithSSEReframe(true))
+	send := func(body string, native bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		if native {
+			req.Header.Set("X-Test-Native-Stream", "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(`{"model":"openai/gpt-4o","messages":[],"logprobs":true,"top_logprobs":5}`, false)
+	if w.Code != http.StatusOK || w.Body.Len() < len(logprobs) {
+		t.Fatalf("expected full body passed through, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+	if gotBody["logprobs"] != true || gotBody["top_logprobs"] != float64(5) {
+		t.Errorf("expected logprobs parameters forwarded, got %v", gotBody)
+	}
+	send(`{"model":"openai/gpt-4o","stream":true,"messages":[],"logprobs":true,"top_logprobs":5}`, true)
+
+	// A buffered completion reframed as SSE keeps its logprobs.
+	w = send(`{"model":"openai/gpt-4o","stream":true,"messages":[],"logprobs":true,"top_logprobs":5}`, false)
+	if first := strings.SplitN(w.Body.String(), "\n\n", 2)[0]; !strings.Contains(first, `"top_logprobs"`) {
+		t.Error("expected logprobs carried into the reframed delta chunk")
+	}
+
+	e := acc.ByAgent("tiverton")
+	if len(e) != 1 || e[0].RequestCount != 3 || e[0].TotalInputTokens != 21 || e[0].TotalOutputTokens != 60000 {
+		t.Errorf("expected usage from all three responses accounted, got %+v", e)
+	}
+}
+
+func TestHandlerEnforcesAllowedProviders(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("ollama", &provider.Provider{Name: "ollama", BaseURL: backend.URL + "/v1", Auth: "none"})
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-ant", Auth: "x-api-key"})
+	loader := func(id string) (*agentctx.AgentContext, error) {
+		return &agentctx.AgentContext{AgentID: id, Metadata: map[string]any{
+			"token":             "local-bot:dummy123",
+			"allowed_providers": []any{"ollama"},
+		}}, nil
+	}
+	var logs bytes.Buffer
+	h := NewHandler(reg, loader, logging.New(&logs, logging.FormatJSON))
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer local-bot:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("/v1/chat/completions", `{"model":"ollama/llama3","messages":[]}`); w.Code != http.StatusOK {
+		t.Fatalf("expected permitted provider to pass, got %d: %s", w.Code, w.Body.String())
+	}
+	for path, body := range map[string]string{
+		"/v1/chat/completions": `{"model":"openai/gpt-4o","messages":[]}`,
+		"/v1/embeddings":       `{"model":"openai/text-embedding-3-small","input":"hi"}`,
+		"/v1/messages":         `{"model":"claude-sonnet-4","messages":[]}`,
+	} {
+		w := send(path, body)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "not allowed") {
+			t.Errorf("%s: expected 403 for forbidden provider, got %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("forbidden requests must not reach upstream, got %d calls", upstreamCalls)
+	}
+	if n := strings.Count(logs.String(), `"intervention":"provider_not_allowed"`); n != 3 {
+		t.Errorf("expected 3 provider_not_allowed interventions, got %d: %s", n, logs.String())
+	}
+}
+
+func TestHandlerLogsCostOnResponseEntry(t *testing.T) {
+	for name, tc := range map[string]struct {
+		contentType, body string
+	}{
+		"buffered": {"application/json", `{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":30}}`},
+		"streamed": {"text/event-stream", "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n" +
+			"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":120,\"completion_tokens\":30}}\n\ndata: [DONE]\n\n"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tc.contentType)
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer backend.Close()
+
+			reg := provider.NewRegistry("")
+			reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+			var logs bytes.Buffer
+			h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+				WithCostTracking(cost.NewAccumulator(), cost.DefaultPricing()))
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+			req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			var response map[string]any
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var e map[string]any
+				if err := json.Unmarshal([]byte(line), &e); err == nil && e["type"] == "response" {
+					response = e
+				}
+			}
+			if response == nil {
+				t.Fatalf("no response entry logged: %s", logs.String())
+			}
+			if response["tokens_in"] != float64(120) || response["tokens_out"] != float64(30) {
+				t.Errorf("expected tokens_in=120 tokens_out=30, got %v", response)
+			}
+			if c, _ := response["cost_usd"].(float64); c <= 0 {
+				t.Errorf("expected positive cost_usd, got %v", response["cost_usd"])
+			}
+		})
+	}
+}
+
+func TestHandlerNormalizesModelCase(t *testing.T) {
+	var gotModels []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		gotModels = append(gotModels, payload.Model)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":1000,"completion_tokens":0}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer", NormalizeModelCase: true})
+	reg.Set("vllm", &provider.Provider{Name: "vllm", BaseURL: backend.URL + "/v1", Auth: "none"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	for _, model := range []string{"openai/GPT-4o", "vllm/Qwen/Qwen2-7B"} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", model, w.Code, w.Body.String())
+		}
+	}
+
+	if strings.Join(gotModels, ",") != "gpt-4o,Qwen/Qwen2-7B" {
+		t.Errorf("expected only the normalizing provider's model lowercased, got %q", gotModels)
+	}
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 2 || entries[0].Model != "gpt-4o" || entries[0].TotalCostUSD <= 0 {
+		t.Errorf("expected the lowercased model to be priced, got %+v", entries)
+	}
+}
+
+func TestHandlerNormalizesRateLimitHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Ratelimit-Limit-Requests", "500")
+		w.Header().Set("X-Ratelimit-Remaining-Requests", "499")
+		w.Header().Set("X-Ratelimit-Reset-Requests", "120ms")
+		w.Header().Set("X-Ratelimit-Limit-Tokens", "30000")
+		w.Header().Set("X-Ratelimit-Remaining-Tokens", "29000")
+		w.Header().Set("X-Ratelimit-Reset-Tokens", "6m0s")
+		w.Header().Set("Retry-After", "7")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	for name, want := range map[string]string{
+		"X-Cllama-RateLimit-Limit-Requests":     "500",
+		"X-Cllama-RateLimit-Remaining-Requests": "499",
+		"X-Cllama-RateLimit-Reset-Requests":     "1",
+		"X-Cllama-RateLimit-Limit-Tokens":       "30000",
+		"X-Cllama-RateLimit-Remaining-Tokens":   "29000",
+		"X-Cllama-RateLimit-Reset-Tokens":       "360",
+		"X-Cllama-RateLimit-Retry-After":        "7",
+		"X-Ratelimit-Remaining-Requests":        "499", // originals still pass through
+	} {
+		if got := w.Header().Get(name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestSetRateLimitHeadersAnthropic(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	src := http.Header{}
+	src.Set("Anthropic-Ratelimit-Tokens-Remaining", "800")
+	src.Set("Anthropic-Ratelimit-Tokens-Reset", "2026-01-01T12:00:30Z")
+	src.Set("Anthropic-Ratelimit-Requests-Reset", "not-a-time")
+	dst := http.Header{}
+	setRateLimitHeaders(dst, src, now)
+
+	if got := dst.Get("X-Cllama-RateLimit-Remaining-Tokens"); got != "800" {
+		t.Errorf("expected remaining tokens 800, got %q", got)
+	}
+	if got := dst.Get("X-Cllama-RateLimit-Reset-Tokens"); got != "30" {
+		t.Errorf("expected reset in 30s, got %q", got)
+	}
+	if _, ok := dst["X-Cllama-Ratelimit-Reset-Requests"]; ok {
+		t.Error("unparseable reset should be left out")
+	}
+}
+
+// The reference copies below are the original per-header implementations,
+// kept to pin the faster versions to identical filtering and to benchmark
+// against.
+
+func referenceCopyRequestHeaders(dst, src http.Header) {
+	for k, vals := range src {
+		if referenceIsHopByHop(k) || strings.EqualFold(k, "Authorization") {
+			continue
+		}
+		for _, v := range vals {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func referenceCopyResponseHeaders(dst, src http.Header, filter *headerFilter) {
+	for k, vals := range src {
+		if referenceIsHopByHop(k) || !filter.allows(k) {
+			continue
+		}
+		dst.Del(k)
+		for _, v := range vals {
+			dst.Add(k, v)
+		}
+	}
+}
+
+func referenceIsHopByHop(name string) bool {
+	switch strings.ToLower(name) {
+	case "connection", "keep-alive", "proxy-authenticate", "proxy-authorization", "te", "trailer", "transfer-encoding", "upgrade":
+		return true
+	default:
+		return false
+	}
+}
+
+func sampleHeaders() http.Header {
+	return http.Header{
+		"Content-Type":                   {"application/json"},
+		"Authorization":                  {"Bearer tiverton:dummy123"},
+		"Connection":                     {"keep-alive"},
+		"keep-alive":                     {"timeout=5"},
+		"Transfer-Encoding":              {"chunked"},
+		"TE":                             {"trailers"},
+		"Upgrade":                        {"h2c"},
+		"Proxy-Authorization":            {"Basic x"},
+		"X-Request-Id":                   {"req-1"},
+		"x-custom-lower":                 {"a", "b"},
+		"X-Ratelimit-Remaining-Requests": {"499"},
+		"Openai-Organization":            {"org-1"},
+		"Set-Cookie":                     {"a=1", "b=2"},
+		"X-Empty":                        {},
+	}
+}
+
+func TestCopyHeadersMatchesReference(t *testing.T) {
+	filters := map[string]*headerFilter{
+		"none":  nil,
+		"allow": newHeaderFilter([]string{"x-ratelimit-*", "x-request-id"}, nil),
+		"deny":  newHeaderFilter(nil, []string{"openai-*", "set-cookie"}),
+	}
+	for name, filter := range filters {
+		// dst starts with stale values so replacement is exercised too.
+		want := http.Header{"X-Request-Id": {"stale"}, "X-Empty": {"stale"}, "Server": {"cllama"}}
+		got := want.Clone()
+		referenceCopyResponseHeaders(want, sampleHeaders(), filter)
+		copyResponseHeaders(got, sampleHeaders(), filter)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("response filter %s:\n got  %v\n want %v", name, got, want)
+		}
+	}
+
+	want, got := http.Header{}, http.Header{}
+	referenceCopyRequestHeaders(want, sampleHeaders())
+	copyRequestHeaders(got, sampleHeaders())
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("request headers:\n got  %v\n want %v", got, want)
+	}
+}
+
+func BenchmarkCopyRequestHeaders(b *testing.B) {
+	src := sampleHeaders()
+	b.Run("reference", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			referenceCopyRequestHeaders(make(http.Header, len(src)), src)
+		}
+	})
+	b.Run("current", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			copyRequestHeaders(make(http.Header, len(src)), src)
+		}
+	})
+}
+
+func BenchmarkCopyResponseHeaders(b *testing.B) {
+	src := sampleHeaders()
+	b.Run("reference", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			referenceCopyResponseHeaders(make(http.Header, len(src)), src, nil)
+		}
+	})
+	b.Run("current", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			copyResponseHeaders(make(http.Header, len(src)), src, nil)
+		}
+	})
+}
+
+func TestHandlerPromptLimits(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"msg-1","content":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-ant", Auth: "x-api-key"})
+	meta := map[string]any{"token": "tiverton:dummy123"}
+	loader := func(id string) (*agentctx.AgentContext, error) {
+		return &agentctx.AgentContext{AgentID: id, Metadata: meta}, nil
+	}
+	var logs bytes.Buffer
+	h := NewHandler(reg, loader, logging.New(&logs, logging.FormatJSON), WithPromptLimits(2, 10))
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	long := strings.Repeat("x", 60) // ~15 tokens
+
+	// An image part is not counted toward the estimate.
+	compliant := `{"model":"openai/gpt-4o","messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"data:image/png;base64,` + long + `"}}]}]}`
+	if w := send("/v1/chat/completions", compliant); w.Code != http.StatusOK {
+		t.Fatalf("expected compliant request to pass, got %d: %s", w.Code, w.Body.String())
+	}
+	for name, tc := range map[string]struct{ path, body, want string }{
+		"messages": {"/v1/chat/completions", `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"a"},{"role":"assistant","content":"b"},{"role":"user","content":"c"}]}`, "3 messages"},
+		"tokens":   {"/v1/chat/completions", `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"` + long + `"}]}`, "about 15 tokens"},
+		"system":   {"/v1/messages", `{"model":"claude-sonnet-4","system":"` + long + `","messages":[{"role":"user","content":"hi"}]}`, "about 16 tokens"},
+	} {
+		w := send(tc.path, tc.body)
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), tc.want) {
+			t.Errorf("%s: expected 413 mentioning %q, got %d: %s", name, tc.want, w.Code, w.Body.String())
+		}
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("over-limit requests must not reach upstream, got %d calls", upstreamCalls)
+	}
+	if !strings.Contains(logs.String(), `"intervention":"prompt_limit"`) {
+		t.Errorf("expected prompt_limit intervention logged, got %s", logs.String())
+	}
+
+	// Agent metadata replaces the proxy-wide limits.
+	meta["max_prompt_tokens"] = float64(100)
+	meta["max_prompt_messages"] = "0"
+	if w := send("/v1/chat/completions", `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"a"},{"role":"assistant","content":"b"},{"role":"user","content":"`+long+`"}]}`); w.Code != http.StatusOK {
+		t.Errorf("expected metadata limits to admit request, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerRejectsTraversalAgentID(t *testing.T) {
+	var loaded bool
+	loader := func(id string) (*agentctx.AgentContext, error) {
+		loaded = true
+		return nil, errors.New("unexpected load")
+	}
+	h := NewHandler(provider.NewRegistry(""), loader, logging.New(io.Discard, logging.FormatJSON))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer ../../etc:secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unsafe agent id, got %d: %s", w.Code, w.Body.String())
+	}
+	if loaded {
+		t.Error("unsafe agent id must not reach the context loader")
+	}
+}
+
+func TestHandlerAppendsProviderQueryParams(t *testing.T) {
+	var gotQuery string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("azure", &provider.Provider{Name: "azure", BaseURL: backend.URL + "/v1", APIKey: "sk-az", Auth: "bearer",
+		QueryParams: map[string]string{"api-version": "2024-06-01"}})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions?trace=on", bytes.NewBufferString(`{"model":"azure/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotQuery != "trace=on&api-version=2024-06-01" {
+		t.Errorf("expected provider param appended to client query, got %q", gotQuery)
+	}
+}
+
+func TestMergeQueryParams(t *testing.T) {
+	params := map[string]string{"api-version": "2024-06-01", "route": "a b"}
+	for _, tc := range []struct {
+		raw      string
+		override bool
+		want     string
+	}{
+		{"", false, "api-version=2024-06-01&route=a+b"},
+		{"x=%2F&api-version=2023", false, "x=%2F&api-version=2023&route=a+b"},
+		{"x=%2F&api-version=2023", true, "x=%2F&api-version=2024-06-01&route=a+b"},
+	} {
+		if got := mergeQueryParams(tc.raw, params, tc.override); got != tc.want {
+			t.Errorf("mergeQueryParams(%q, override=%v) = %q, want %q", tc.raw, tc.override, got, tc.want)
+		}
+	}
+	if got := mergeQueryParams("a=1&&b", nil, true); got != "a=1&&b" {
+		t.Errorf("expected query untouched without params, got %q", got)
+	}
+}
+
+func TestHandlerEchoProvider(t *testing.T) {
+	acc := cost.NewAccumulator()
+	h := NewHandler(provider.NewRegistry(""), stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithEchoProvider(true))
+
+	body := `{"model":"echo/test-model","messages":[{"role":"user","content":"hello there, echo"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Object  string `json:"object"`
+		Model   string `json:"model"`
+		Choices []struct {
+			Message struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid completion: %v: %s", err, w.Body.String())
+	}
+	if resp.Object != "chat.completion" || resp.Model != "test-model" || len(resp.Choices) != 1 || resp.Choices[0].FinishReason != "stop" {
+		t.Fatalf("malformed completion: %s", w.Body.String())
+	}
+	echoed := resp.Choices[0].Message.Content
+	if resp.Choices[0].Message.Role != "assistant" || !strings.Contains(echoed, `"model":"test-model"`) || !strings.Contains(echoed, "hello there, echo") {
+		t.Errorf("expected the upstream request echoed back, got %q", echoed)
+	}
+	if resp.Usage.PromptTokens != 5 || resp.Usage.CompletionTokens != (len(echoed)+3)/4 ||
+		resp.Usage.TotalTokens != resp.Usage.PromptTokens+resp.Usage.CompletionTokens {
+		t.Errorf("unexpected usage: %+v", resp.Usage)
+	}
+
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 || entries[0].Provider != "echo" || entries[0].RequestCount != 1 || entries[0].TotalInputTokens != 5 {
+		t.Errorf("expected echo request accounted, got %+v", entries)
+	}
+
+	off := NewHandler(provider.NewRegistry(""), stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	req = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w = httptest.NewRecorder()
+	off.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("expected echo to be unknown without the flag, got %d", w.Code)
+	}
+}
+
+// flushRecorder records each write's size and counts flushes.
+type flushRecorder struct {
+	mu      sync.Mutex
+	header  http.Header
+	body    bytes.Buffer
+	writes  []int
+	flushes int
+}
+
+func (f *flushRecorder) Header() http.Header {
+	if f.header == nil {
+		f.header = http.Header{}
+	}
+	return f.header
+}
+
+func (f *flushRecorder) WriteHeader(int) {}
+
+func (f *flushRecorder) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.writes = append(f.writes, len(p))
+	return f.body.Write(p)
+}
+
+func (f *flushRecorder) Flush() {
+	f.mu.Lock()
+	f.flushes++
+	f.mu.Unlock()
+}
+
+func (f *flushRecorder) flushCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flushes
+}
+
+func TestStreamBodyHonorsBufferSizeAndFlushInterval(t *testing.T) {
+	data := bytes.Repeat([]byte("data: {\"choices\":[]}\n\n"), 50)
+
+	immediate := &flushRecorder{}
+	if err := streamBody(immediate, bytes.NewReader(data), 100, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(immediate.body.Bytes(), data) {
+		t.Fatal("relayed body differs from upstream body")
+	}
+	for _, n := range immediate.writes {
+		if n > 100 {
+			t.Fatalf("write of %d bytes exceeds the 100-byte buffer", n)
+		}
+	}
+	if want := (len(data) + 99) / 100; len(immediate.writes) != want || immediate.flushes != want {
+		t.Errorf("expected %d writes each flushed, got %d writes and %d flushes", want, len(immediate.writes), immediate.flushes)
+	}
+
+	coalesced := &flushRecorder{}
+	if err := streamBody(coalesced, bytes.NewReader(data), 100, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(coalesced.body.Bytes(), data) {
+		t.Fatal("relayed body differs from upstream body when coalescing")
+	}
+	if coalesced.flushes != 1 {
+		t.Errorf("expected flushes coalesced into the final one, got %d", coalesced.flushes)
+	}
+
+	// A quiet upstream must not hold back what was already written.
+	quiet := &flushRecorder{}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- streamBody(quiet, pr, 0, 10*time.Millisecond) }()
+	_, _ = pw.Write([]byte("data: first\n\n"))
+	deadline := time.Now().Add(2 * time.Second)
+	for quiet.flushCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if quiet.flushCount() == 0 {
+		t.Error("expected pending data flushed by the interval while upstream was idle")
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlerUsageReconciliation(t *testing.T) {
+	// A stream without a usage chunk, as sent when the agent does not ask
+	// for stream_options.include_usage.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"" + strings.Repeat("y", 400) + "\"}}]}\n\n"))
+		_, _ = w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer backend.Close()
+
+	prompt := strings.Repeat("x", 800)
+	for _, tc := range []struct {
+		mode            UsageReconciliation
+		wantIn, wantOut int
+		wantMiss        bool
+	}{
+		{ReconcileReportedOnly, 0, 0, false},
+		{ReconcileEstimate, 200, 100, false},
+		{ReconcileStrict, 0, 0, true},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			reg := provider.NewRegistry("")
+			reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+			acc := cost.NewAccumulator()
+			var logs bytes.Buffer
+			h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+				WithCostTracking(acc, cost.DefaultPricing()), WithUsageReconciliation(tc.mode))
+
+			body := `{"model":"openai/gpt-4o","stream":true,"messages":[{"role":"user","content":"` + prompt + `"}]}`
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+
+			entries := acc.ByAgent("tiverton")
+			if len(entries) != 1 || entries[0].RequestCount != 1 {
+				t.Fatalf("expected one counted request, got %+v", entries)
+			}
+			e := entries[0]
+			if e.TotalInputTokens != tc.wantIn || e.TotalOutputTokens != tc.wantOut {
+				t.Errorf("expected %d/%d tokens billed, got %d/%d", tc.wantIn, tc.wantOut, e.TotalInputTokens, e.TotalOutputTokens)
+			}
+			if (e.TotalCostUSD > 0) != (tc.wantIn > 0) {
+				t.Errorf("unexpected cost %f", e.TotalCostUSD)
+			}
+			miss := strings.Contains(logs.String(), `"type":"usage_miss"`) && strings.Contains(logs.String(), "no usage reported")
+			if miss != tc.wantMiss {
+				t.Errorf("expected usage_miss logged=%v, logs: %s", tc.wantMiss, logs.String())
+			}
+		})
+	}
+}
+
+func TestHandlerStripsBaseURLUserinfo(t *testing.T) {
+	var gotAuth string
+	var sawBasic bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		_, _, sawBasic = r.BasicAuth()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	withCreds := strings.Replace(backend.URL, "http://", "http://user:hunter2@", 1) + "/v1"
+	prov := &provider.Provider{Name: "ollama", BaseURL: withCreds, Auth: "none"}
+	target, err := buildUpstreamURL(prov, "/v1/chat/completions", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(target, "hunter2") || strings.Contains(target, "user@") {
+		t.Errorf("expected userinfo stripped from %q", target)
+	}
+
+	reg := provider.NewRegistry("")
+	reg.Set("ollama", prov)
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"ollama/llama3","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotAuth != "" || sawBasic {
+		t.Errorf("expected no credentials upstream for auth none, got Authorization %q", gotAuth)
+	}
+}
+
+func TestHandlerBudgetWebhook(t *testing.T) {
+	alerts := make(chan BudgetAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a BudgetAlert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("decode alert: %v", err)
+		}
+		alerts <- a
+	}))
+	defer webhook.Close()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":3,"completion_tokens":0}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	pricing := cost.DefaultPricing()
+	pricing.SetRate("openai", "gpt-4o", cost.Rate{InputPerMTok: 1_000_000}) // $3 per request
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(cost.NewAccumulator(), pricing),
+		WithBudgetWebhook(webhook.URL, 10, DefaultBudgetThresholds))
+
+	// Spend after each request: $3, $6, $9, $12, $15.
+	want := [][]float64{nil, {50}, {80}, {100}, nil}
+	for i, thresholds := range want {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+		for _, pct := range thresholds {
+			select {
+			case a := <-alerts:
+				if a.AgentID != "tiverton" || a.ThresholdPercent != pct || a.BudgetUSD != 10 || a.SpentUSD != float64(3*(i+1)) {
+					t.Errorf("request %d: unexpected alert %+v", i+1, a)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("request %d: no alert for %g%%", i+1, pct)
+			}
+		}
+		select {
+		case a := <-alerts:
+			t.Errorf("request %d: unexpected extra alert %+v", i+1, a)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestBudgetAlerterFiresOncePerWindow(t *testing.T) {
+	b := newBudgetAlerter("http://hooks.invalid", 10, []float64{50, 80, 100})
+	clock := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return clock }
+
+	thresholds := func(alerts []BudgetAlert) []float64 {
+		var out []float64
+		for _, a := range alerts {
+			out = append(out, a.ThresholdPercent)
+		}
+		return out
+	}
+	// A jump past several thresholds fires each of them.
+	if got := thresholds(b.observe("tiverton", 8.5)); !reflect.DeepEqual(got, []float64{50, 80}) {
+		t.Fatalf("expected 50 and 80 to fire, got %v", got)
+	}
+	if got := b.observe("tiverton", 9); len(got) != 0 {
+		t.Fatalf("expected no repeat alerts, got %v", thresholds(got))
+	}
+	if got := thresholds(b.observe("westin", 5)); !reflect.DeepEqual(got, []float64{50}) {
+		t.Fatalf("expected thresholds tracked per agent, got %v", got)
+	}
+
+	clock = clock.Add(2 * time.Hour) // April
+	got := b.observe("tiverton", 6)
+	if !reflect.DeepEqual(thresholds(got), []float64{50}) || got[0].Window != "2026-04" {
+		t.Fatalf("expected 50 to fire again in the new window, got %+v", got)
+	}
+}
+
+func TestHandlerProviderHeaderOverride(t *testing.T) {
+	var gotModel, gotHeader string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+		gotModel, gotHeader = payload.Model, r.Header.Get(providerHeader)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("together", &provider.Provider{Name: "together", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+	send := func(providerName string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			bytes.NewBufferString(`{"model":"meta-llama/Llama-3-70b","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		req.Header.Set(providerHeader, providerName)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("Together"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotModel != "meta-llama/Llama-3-70b" {
+		t.Errorf("expected the full model upstream, got %q", gotModel)
+	}
+	if gotHeader != "" {
+		t.Errorf("expected %s stripped upstream, got %q", providerHeader, gotHeader)
+	}
+
+	w := send("nope")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown override, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), `unknown provider \"nope\"`) {
+		t.Errorf("expected the unknown provider named, got %s", w.Body.String())
+	}
+}
+
+func TestHandlerTranslatesAnthropicErrors(t *testing.T) {
+	const anthropicErr = `{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens: Field required"}}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(anthropicErr))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "x-api-key", APIFormat: "anthropic"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("/v1/chat/completions", `{"model":"anthropic/claude-sonnet-4","messages":[]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected upstream 400 relayed, got %d", w.Code)
+	}
+	var got struct {
+		Type  string `json:"type"`
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Param   any    `json:"param"`
+			Code    any    `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON error body: %v: %s", err, w.Body.String())
+	}
+	if got.Type != "" || got.Error.Message != "max_tokens: Field required" || got.Error.Type != "invalid_request_error" {
+		t.Errorf("expected an OpenAI-shaped error, got %s", w.Body.String())
+	}
+
+	// Agents speaking the Anthropic API keep Anthropic's shape.
+	w = send("/v1/messages", `{"model":"claude-sonnet-4","max_tokens":1,"messages":[]}`)
+	if strings.TrimSpace(w.Body.String()) != anthropicErr {
+		t.Errorf("expected the native error on /v1/messages, got %s", w.Body.String())
+	}
+}
+
+func TestHandlerTranslatesAnthropicStream(t *testing.T) {
+	const anthropicStream = "event: message_start\n" +
+		`data: {"type":"message_start","message":{"id":"msg_1","model":"claude-sonnet-4","usage":{"input_tokens":12,"output_tokens":1}}}` + "\n\n" +
+		"event: content_block_start\n" +
+		`data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}` + "\n\n" +
+		"event: ping\n" +
+		`data: {"type":"ping"}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}` + "\n\n" +
+		"event: content_block_delta\n" +
+		`data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}` + "\n\n" +
+		"event: content_block_stop\n" +
+		`data: {"type":"content_block_stop","index":0}` + "\n\n" +
+		"event: message_delta\n" +
+		`data: {"type":"message_delta","delta":{"stop_reason":"max_tokens"},"usage":{"output_tokens":5}}` + "\n\n" +
+		"event: message_stop\n" +
+		`data: {"type":"message_stop"}` + "\n\n"
+	const openAIStream = `data: {"object":"chat.completion.chunk","choices":[{"index":0,"delta":{"content":"hi"}}]}` + "\n\ndata: [DONE]\n\n"
+
+	upstream := anthropicStream
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte(upstream))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "x-api-key", APIFormat: "anthropic"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+	send := func() string {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"anthropic/claude-sonnet-4","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	body := send()
+	if strings.Contains(body, "event:") || strings.Contains(body, "content_block_delta") {
+		t.Fatalf("expected no Anthropic events to reach the agent, got %s", body)
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("expected the stream to end with [DONE], got %s", body)
+	}
+
+	var content, finish string
+	var usage map[string]int
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			ID      string `json:"id"`
+			Object  string `json:"object"`
+			Model   string `json:"model"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+			Usage map[string]int `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || chunk.ID != "msg_1" || chunk.Model != "claude-sonnet-4" {
+			t.Errorf("unexpected chunk envelope: %s", data)
+		}
+		for _, c := range chunk.Choices {
+			content += c.Delta.Content
+			if c.FinishReason != nil {
+				finish = *c.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+	if content != "Hello, world" {
+		t.Errorf("expected deltas to carry the text, got %q", content)
+	}
+	if finish != "length" {
+		t.Errorf("expected max_tokens to map to length, got %q", finish)
+	}
+	if usage["prompt_tokens"] != 12 || usage["completion_tokens"] != 5 || usage["total_tokens"] != 17 {
+		t.Errorf("unexpected usage chunk: %v", usage)
+	}
+
+	// A provider already answering in OpenAI's shape is relayed as is.
+	upstream = openAIStream
+	if body := send(); body != openAIStream {
+		t.Errorf("expected an OpenAI stream to pass through, got %s", body)
+	}
+}
+
+func TestHandlerMaxResponseBytes(t *testing.T) {
+	big := `{"choices":[{"message":{"role":"assistant","content":"` + strings.Repeat("x", 2048) + `"}}]}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.RawQuery, "stream") {
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = w.Write([]byte("data: " + big + "\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(big))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer", MaxResponseBytes: 1024})
+	acc := cost.NewAccumulator()
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	send := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("/v1/chat/completions")
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502 for an oversized response, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "max_response_bytes") || strings.Contains(w.Body.String(), "xxxx") {
+		t.Errorf("expected a clear error and no partial body, got %s", w.Body.String())
+	}
+	// The provider billed for it, so it still counts.
+	if entries := acc.ByAgent("tiverton"); len(entries) != 1 || entries[0].RequestCount != 1 {
+		t.Errorf("expected the oversized request counted, got %+v", entries)
+	}
+	if !strings.Contains(logs.String(), `"type":"usage_miss"`) {
+		t.Errorf("expected a usage_miss entry, got %s", logs.String())
+	}
+
+	// Streams are exempt.
+	w = send("/v1/chat/completions?stream=1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "[DONE]") {
+		t.Errorf("expected the stream relayed in full, got %d: %.80s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerBlockedModels(t *testing.T) {
+	var hits int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "x-api-key", BlockedModels: []string{"claude-opus-*"}})
+	var logs syncBuffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON))
+
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("/v1/chat/completions", `{"model":"anthropic/claude-opus-4","messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "blocked") {
+		t.Fatalf("expected 403 for a blocked model, got %d: %s", w.Code, w.Body.String())
+	}
+	w = send("/v1/messages", `{"model":"claude-opus-4-20250514","max_tokens":1,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 on the Anthropic route too, got %d", w.Code)
+	}
+	if hits != 0 {
+		t.Fatalf("expected blocked requests never to reach the provider, got %d", hits)
+	}
+	if !strings.Contains(logs.String(), `"intervention":"model_blocked"`) {
+		t.Errorf("expected a model_blocked intervention, got %s", logs.String())
+	}
+
+	w = send("/v1/chat/completions", `{"model":"anthropic/claude-sonnet-4","messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK || hits != 1 {
+		t.Errorf("expected an allowed model to be proxied, got %d (%d upstream hits)", w.Code, hits)
+	}
+}
+
+func TestSignBodyKnownVector(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://gateway/v1/chat/completions", strings.NewReader("The quick brown fox jumps over the lazy dog"))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader("The quick brown fox jumps over the lazy dog")), nil
+	}
+	sig, err := signBody(req, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8"; sig != want {
+		t.Errorf("expected %s, got %s", want, sig)
+	}
+}
+
+func TestHandlerSignsRequestsForHMACProviders(t *testing.T) {
+	var gotSig, gotAuth string
+	var gotBody []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSig = r.Header.Get("X-Gateway-Signature")
+		gotAuth = r.Header.Get("Authorization")
+		gotBody, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("gateway", &provider.Provider{Name: "gateway", BaseURL: backend.URL + "/v1", Auth: "hmac", SigningSecret: "s3cret", SigningHeader: "X-Gateway-Signature"})
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"gateway/llama-3","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(gotBody)
+	if want := hex.EncodeToString(mac.Sum(nil)); gotSig != want {
+		t.Errorf("expected signature %s over the forwarded body, got %q", want, gotSig)
+	}
+	if gotAuth != "" {
+		t.Errorf("expected the agent's credentials stripped, got %q", gotAuth)
+	}
+
+	reg.Set("gateway", &provider.Provider{Name: "gateway", BaseURL: backend.URL + "/v1", Auth: "hmac"})
+	req = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"gateway/llama-3","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "signing secret") {
+		t.Errorf("expected 502 without a signing secret, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerRecordsBodyBytes(t *testing.T) {
+	const reply = `{"choices":[{"message":{"role":"assistant","content":"ok"}}],"usage":{"prompt_tokens":3,"completion_tokens":1}}`
+	var sent int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sent += len(body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(reply))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %+v", entries)
+	}
+	e := entries[0]
+	if e.RequestBytes != int64(sent) || e.ResponseBytes != int64(2*len(reply)) || e.RequestCount != 2 {
+		t.Errorf("expected %d request and %d response bytes over 2 requests, got %d/%d over %d",
+			sent, 2*len(reply), e.RequestBytes, e.ResponseBytes, e.RequestCount)
+	}
+}
+
+func TestHandlerPrefersFasterRegionalEndpoint(t *testing.T) {
+	var slowHits, fastHits atomic.Int32
+	reply := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"ok"}}]}`))
+		}
+	}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			time.Sleep(100 * time.Millisecond) // probes see the latency
+		} else {
+			slowHits.Add(1)
+		}
+		reply(w, r)
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			fastHits.Add(1)
+		}
+		reply(w, r)
+	}))
+	defer fast.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("gateway", &provider.Provider{BaseURL: slow.URL + "/v1", BaseURLs: []string{fast.URL + "/v1"}, APIKey: "sk-real"})
+	sel := provider.NewEndpointSelector(reg)
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithEndpointSelector(sel))
+
+	send := func() {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"gateway/llama-3","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Unprobed, the endpoints take turns.
+	send()
+	send()
+	if slowHits.Load() != 1 || fastHits.Load() != 1 {
+		t.Fatalf("expected round-robin before probing, got slow=%d fast=%d", slowHits.Load(), fastHits.Load())
+	}
+
+	sel.Probe(context.Background())
+	for i := 0; i < 4; i++ {
+		send()
+	}
+	if slowHits.Load() != 1 || fastHits.Load() != 5 {
+		t.Errorf("expected probed requests to prefer the faster endpoint, got slow=%d fast=%d", slowHits.Load(), fastHits.Load())
+	}
+}
+
+func TestHandlerRecordsToolCalls(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"choices":[{"message":{"role":"assistant","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]}}],"usage":{"prompt_tokens":40,"completion_tokens":12}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	body := `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"weather?"}],"tools":[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}}}}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %+v", entries)
+	}
+	e := entries[0]
+	// One call of ~7 tokens plus a tool definition of ~25.
+	if e.ToolCallCount != 1 || e.ToolTokens < 20 {
+		t.Errorf("expected 1 tool call with definition tokens included, got %d calls, %d tokens", e.ToolCallCount, e.ToolTokens)
+	}
+}
+
+func TestHandlerTokenGrace(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	expiry := map[string]time.Duration{
+		"fresh":   time.Hour,
+		"grace":   -10 * time.Second,
+		"expired": -5 * time.Minute,
+	}
+	loader := func(id string) (*agentctx.AgentContext, error) {
+		return &agentctx.AgentContext{AgentID: id, Metadata: map[string]any{
+			"token":            id + ":dummy123",
+			"token_expires_at": time.Now().Add(expiry[id]).UTC().Format(time.RFC3339),
+		}}, nil
+	}
+	var logs bytes.Buffer
+	h := NewHandler(reg, loader, logging.New(&logs, logging.FormatJSON), WithTokenGrace(time.Minute))
+
+	send := func(agentID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Authorization", "Bearer "+agentID+":dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("fresh"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 before expiry, got %d: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(logs.String(), "token_grace") {
+		t.Errorf("expected no token_grace before expiry, got %s", logs.String())
+	}
+
+	if w := send("grace"); w.Code != http.StatusOK {
+		t.Errorf("expected 200 within the grace window, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), `"intervention":"token_grace"`) {
+		t.Errorf("expected a token_grace intervention, got %s", logs.String())
+	}
+
+	if w := send("expired"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "expired") {
+		t.Errorf("expected 401 beyond the grace window, got %d: %s", w.Code, w.Body.String())
+	}
+
+	h = NewHandler(reg, loader, logging.New(io.Discard, logging.FormatJSON))
+	if w := send("grace"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an expired token without grace, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerRetriesFailedUpstreamAttempts(t *testing.T) {
+	var calls atomic.Int32
+	var bodies []string
+	var mu sync.Mutex
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithUpstreamRetries(2, time.Millisecond, 0, 0))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 after two retries, got %d: %s", w.Code, w.Body.String())
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 upstream attempts, got %d", calls.Load())
+	}
+	for i, body := range bodies {
+		if !strings.Contains(body, `"model":"gpt-4o"`) {
+			t.Errorf("attempt %d sent body %q", i+1, body)
+		}
+	}
+	for _, want := range []string{`"type":"retry"`, `"attempt":1`, `"attempt":2`, `"status_code":503`} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("expected %s logged, got %s", want, logs.String())
+		}
+	}
+}
+
+func TestHandlerRetryBudgetReturnsFailureOnceSpent(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithUpstreamRetries(3, time.Millisecond, 0.001, 1))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected the upstream 502 returned, got %d", w.Code)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected one retry from a budget of one, got %d attempts", calls.Load())
+	}
+	if !strings.Contains(logs.String(), `"intervention":"retry_budget"`) {
+		t.Errorf("expected a retry_budget intervention, got %s", logs.String())
+	}
+}
+
+func TestRetryBudgetStopsRetriesOnceDepleted(t *testing.T) {
+	b := newRetryBudget(0.5, 2) // one retry every two seconds, two saved
+	clock := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return clock }
+
+	if !b.allow("openai") || !b.allow("openai") {
+		t.Fatal("expected the saved burst to be spent first")
+	}
+	if b.allow("openai") {
+		t.Fatal("expected retries to stop once the budget is depleted")
+	}
+	if !b.allow("anthropic") {
+		t.Error("expected each provider to have its own budget")
+	}
+
+	clock = clock.Add(time.Second)
+	if b.allow("openai") {
+		t.Error("expected half a retry earned after one second not to be enough")
+	}
+	clock = clock.Add(time.Second)
+	if !b.allow("openai") {
+		t.Error("expected a retry earned after two seconds")
+	}
+
+	clock = clock.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if !b.allow("openai") {
+			t.Fatalf("expected retry %d of a refilled burst", i+1)
+		}
+	}
+	if b.allow("openai") {
+		t.Error("expected the refill to be capped at the burst")
+	}
+
+	var unlimited *retryBudget
+	if !unlimited.allow("openai") {
+		t.Error("expected a nil budget to allow every retry")
+	}
+}
+
+func TestHandlerInsecureSkipVerify(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	for _, skip := range []bool{false, true} {
+		reg := provider.NewRegistry("")
+		reg.Set("gateway", &provider.Provider{Name: "gateway", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer", InsecureSkipVerify: skip})
+		h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"gateway/llama3","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		want := http.StatusBadGateway
+		if skip {
+			want = http.StatusOK
+		}
+		if w.Code != want {
+			t.Errorf("insecure_skip_verify=%v: expected %d against a self-signed backend, got %d: %s", skip, want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHandlerAgentConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "hold") {
+			entered <- struct{}{}
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	loader := func(id string) (*agentctx.AgentContext, error) {
+		meta := map[string]any{"token": id + ":dummy123"}
+		if id == "tiverton" {
+			meta["max_concurrent"] = float64(1)
+		}
+		return &agentctx.AgentContext{AgentID: id, Metadata: meta}, nil
+	}
+	var logs bytes.Buffer
+	h := NewHandler(reg, loader, logging.New(&logs, logging.FormatJSON))
+
+	send := func(agentID, content string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"`+content+`"}]}`))
+		req.Header.Set("Authorization", "Bearer "+agentID+":dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	held := make(chan *httptest.ResponseRecorder)
+	go func() { held <- send("tiverton", "hold") }()
+	<-entered
+
+	if w := send("tiverton", "hi"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 over the agent's limit, got %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(logs.String(), `"intervention":"agent_concurrency"`) {
+		t.Errorf("expected agent_concurrency intervention logged, got %s", logs.String())
+	}
+	for i := 0; i < 3; i++ {
+		if w := send("westin", "hi"); w.Code != http.StatusOK {
+			t.Errorf("expected other agent unaffected, got %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	close(release)
+	if w := <-held; w.Code != http.StatusOK {
+		t.Fatalf("expected held request to complete, got %d", w.Code)
+	}
+	if w := send("tiverton", "hi"); w.Code != http.StatusOK {
+		t.Errorf("expected slot freed after completion, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerShadowsRequestToSecondProvider(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"primary","choices":[],"usage":{"prompt_tokens":10,"completion_tokens":5}}`))
+	}))
+	defer primary.Close()
+	shadowModels := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if got := r.Header.Get("Authorization"); got != "Bearer sk-shadow" {
+			t.Errorf("expected shadow provider's key, got %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"shadow","choices":[],"usage":{"prompt_tokens":1000,"completion_tokens":2000}}`))
+		shadowModels <- body.Model
+	}))
+	defer shadow.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: primary.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	reg.Set("anthropic", &provider.Provider{Name: "anthropic", BaseURL: shadow.URL + "/v1", APIKey: "sk-shadow", Auth: "bearer"})
+
+	rules, err := ParseShadowRules([]string{"openai/gpt-4o=anthropic/claude-sonnet-4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := cost.NewAccumulator()
+	var logs syncBuffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithShadow(rules))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"id":"primary"`) {
+		t.Fatalf("expected the primary response, got %d: %s", w.Code, w.Body.String())
+	}
+	select {
+	case model := <-shadowModels:
+		if model != "claude-sonnet-4" {
+			t.Errorf("expected shadow model claude-sonnet-4, got %q", model)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shadow request never arrived")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(acc.ByAgent(ShadowAgentID("tiverton"))) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	shadowed := acc.ByAgent(ShadowAgentID("tiverton"))
+	if len(shadowed) != 1 || shadowed[0].Provider != "anthropic" || shadowed[0].TotalInputTokens != 1000 || shadowed[0].TotalCostUSD <= 0 {
+		t.Fatalf("expected shadow spend recorded separately, got %+v", shadowed)
+	}
+	own := acc.ByAgent("tiverton")
+	if len(own) != 1 || own[0].Provider != "openai" || own[0].TotalInputTokens != 10 {
+		t.Errorf("expected only the primary on the agent, got %+v", own)
+	}
+	for !strings.Contains(logs.String(), `"type":"shadow"`) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), `"type":"shadow"`) {
+		t.Errorf("expected a shadow log entry, got %s", logs.String())
+	}
+}
+
+func TestHandlerShadowFailureDoesNotAffectPrimary(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"primary","choices":[]}`))
+	}))
+	defer primary.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: primary.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	// The shadow provider is not configured at all.
+	rules := map[string]ShadowTarget{"openai/gpt-4o": {Provider: "missing", Model: "x"}}
+	var logs syncBuffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON), WithShadow(rules))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected primary 200 despite shadow failure, got %d: %s", w.Code, w.Body.String())
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(logs.String(), `"type":"shadow"`) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), `"type":"shadow"`) || !strings.Contains(logs.String(), `"provider":"missing"`) {
+		t.Errorf("expected failed shadow logged, got %s", logs.String())
+	}
+}
+
+func TestParseShadowRulesLowercasesProviders(t *testing.T) {
+	rules, err := ParseShadowRules([]string{"OpenAI/gpt-4o=Anthropic/claude-sonnet-4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, ok := rules["openai/gpt-4o"]
+	if !ok {
+		t.Fatalf("expected the rule keyed by the lowercased provider, got %v", rules)
+	}
+	if target.Provider != "anthropic" || target.Model != "claude-sonnet-4" {
+		t.Errorf("expected target anthropic/claude-sonnet-4, got %+v", target)
+	}
+}
+
+func TestParseShadowRulesRejectsMalformed(t *testing.T) {
+	for _, e := range []string{"gpt-4o=anthropic/claude", "openai/gpt-4o", "openai/gpt-4o=claude", "=anthropic/x"} {
+		if _, err := ParseShadowRules([]string{e}); err == nil {
+			t.Errorf("expected error for %q", e)
+		}
+	}
+}
+
+func TestHandlerPricesByResponseModel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Asked for gpt-4o, served by gpt-4o-mini.
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","model":"gpt-4o-mini-2024-07-18","choices":[],"usage":{"prompt_tokens":1000000,"completion_tokens":0}}`))
+	}))
+	defer backend.Close()
+
+	for _, tc := range []struct {
+		enabled bool
+		want    float64
+	}{
+		{false, 2.50}, // the requested gpt-4o rate
+		{true, 0.15},  // the reported gpt-4o-mini rate
+	} {
+		reg := provider.NewRegistry("")
+		reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+		acc := cost.NewAccumulator()
+		h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+			WithCostTracking(acc, cost.DefaultPricing()), WithResponseModelPricing(tc.enabled))
+
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		entries := acc.ByAgent("tiverton")
+		if len(entries) != 1 || entries[0].Model != "gpt-4o" {
+			t.Fatalf("expected spend recorded under the requested model, got %+v", entries)
+		}
+		if got := entries[0].TotalCostUSD; math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("enabled=%v: expected cost %.2f, got %f", tc.enabled, tc.want, got)
+		}
+	}
+}
+
+func TestHandlerRequestValidation(t *testing.T) {
+	var upstreamCalls int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[]}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	send := func(h *Handler, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	missingMessages := `{"model":"openai/gpt-4o"}`
+	badRole := `{"model":"openai/gpt-4o","messages":[{"role":"wizard","content":"hi"}]}`
+
+	// Off by default: odd payloads are the provider's to judge.
+	lenient := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON))
+	if w := send(lenient, badRole); w.Code != http.StatusOK {
+		t.Fatalf("expected unvalidated request forwarded, got %d", w.Code)
+	}
+
+	strict := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON), WithRequestValidation(true))
+	upstreamCalls = 0
+	for body, want := range map[string]string{missingMessages: "messages must be a non-empty array", badRole: `messages[0].role \"wizard\"`} {
+		w := send(strict, body)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: expected error mentioning %q, got %s", body, want, w.Body.String())
+		}
+	}
+	if upstreamCalls != 0 {
+		t.Errorf("invalid requests must not reach the provider, got %d calls", upstreamCalls)
+	}
+	if w := send(strict, `{"model":"openai/gpt-4o","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+		t.Errorf("expected valid request forwarded, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandlerRecordsFreeProviderTokensAtZeroCost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":120,"completion_tokens":80}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("ollama", &provider.Provider{Name: "ollama", BaseURL: backend.URL + "/v1", Auth: "none"})
+	acc := cost.NewAccumulator()
+	var logs bytes.Buffer
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()), WithUsageReconciliation(ReconcileStrict))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"ollama/llama3.1:8b","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	entries := acc.ByAgent("tiverton")
+	if len(entries) != 1 {
+		t.Fatalf("expected one cost entry, got %+v", entries)
+	}
+	e := entries[0]
+	if e.TotalInputTokens != 120 || e.TotalOutputTokens != 80 || e.TotalCostUSD != 0 || e.RequestCount != 1 {
+		t.Errorf("expected 120/80 tokens at $0, got %+v", e)
+	}
+	if strings.Contains(logs.String(), "usage_miss") {
+		t.Errorf("a free model must not be logged as unpriced, got %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"tokens_in":120`) || !strings.Contains(logs.String(), `"cost_usd":0`) {
+		t.Errorf("expected tokens and zero cost in the response log, got %s", logs.String())
+	}
+}
+
+func TestHandlerRecordsTagsFromHeader(t *testing.T) {
+	var gotTags string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTags = r.Header.Get("X-Cllama-Tags")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"chatcmpl-1","choices":[],"usage":{"prompt_tokens":100,"completion_tokens":50}}`))
+	}))
+	defer backend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: backend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	acc := cost.NewAccumulator()
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON),
+		WithCostTracking(acc, cost.DefaultPricing()))
+
+	send := func(tags string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		if tags != "" {
+			req.Header.Set("X-Cllama-Tags", tags)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("Feature=search, experiment=b"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if gotTags != "" {
+		t.Errorf("expected tags header stripped before forwarding, got %q", gotTags)
+	}
+	send("feature=triage")
+	send("")
+
+	features := acc.ByTag("feature")
+	if len(features["search"]) != 1 || features["search"][0].TotalInputTokens != 100 || len(features["triage"]) != 1 {
+		t.Errorf("expected spend grouped by feature, got %+v", features)
+	}
+	if got := acc.ByTag("experiment")["b"]; len(got) != 1 || got[0].RequestCount != 1 {
+		t.Errorf("expected the experiment tag recorded, got %+v", got)
+	}
+	if entries := acc.ByAgent("tiverton"); len(entries) != 1 || entries[0].RequestCount != 3 {
+		t.Errorf("expected all three requests on the agent, got %+v", entries)
+	}
+
+	if w := send("feature"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a malformed tag, got %d", w.Code)
+	}
+}
+
+func TestHandlerRouteRules(t *testing.T) {
+	var cheapModel, openaiModel string
+	cheap := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		cheapModel = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"cheap","choices":[]}`))
+	}))
+	defer cheap.Close()
+	openaiBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		openaiModel = body.Model
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":"openai","choices":[]}`))
+	}))
+	defer openaiBackend.Close()
+
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: openaiBackend.URL + "/v1", APIKey: "sk-real", Auth: "bearer"})
+	reg.Set("cheap", &provider.Provider{Name: "cheap", BaseURL: cheap.URL + "/v1", Auth: "none"})
+
+	rules, err := ParseRouteRules([]byte(`[
+		{"match": "^(?:openai/)?(?P<base>.+)-mini$", "provider": "Cheap", "rewrite": "${base}-small"},
+		{"match": "^local-", "provider": "cheap"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(io.Discard, logging.FormatJSON), WithRouteRules(rules))
+
+	send := func(model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"`+model+`","messages":[]}`))
+		req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("openai/gpt-4o-mini"); !strings.Contains(w.Body.String(), `"id":"cheap"`) || cheapModel != "gpt-4o-small" {
+		t.Errorf("expected *-mini routed to cheap as gpt-4o-small, got %d %s (model %q)", w.Code, w.Body.String(), cheapModel)
+	}
+	if w := send("local-llama"); !strings.Contains(w.Body.String(), `"id":"cheap"`) || cheapModel != "local-llama" {
+		t.Errorf("expected a rule without rewrite to send the model as requested, got %s (model %q)", w.Body.String(), cheapModel)
+	}
+	// No rule matches: prefix routing as before.
+	if w := send("openai/gpt-4o"); !strings.Contains(w.Body.String(), `"id":"openai"`) || openaiModel != "gpt-4o" {
+		t.Errorf("expected fallthrough to prefix routing, got %s (model %q)", w.Body.String(), openaiModel)
+	}
+	if w := send("gpt-4o"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unmatched bare model to still need a prefix, got %d", w.Code)
+	}
+
+	for _, bad := range []string{`[{"match": "(", "provider": "cheap"}]`, `[{"match": "x"}]`, `{"match": "x"}`} {
+		if _, err := ParseRouteRules([]byte(bad)); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while a background goroutine
+// logs to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+type panicTransport struct{}
+
+func (panicTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	panic("boom")
+}
+
+func TestHandlerRecoversFromPanic(t *testing.T) {
+	reg := provider.NewRegistry("")
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: "http://upstream.invalid/v1", APIKey: "sk-real", Auth: "bearer"})
+
+	var logs bytes.Buffer
+	forcePanic := func(h *Handler) { h.client = &http.Client{Transport: panicTransport{}} }
+	h := NewHandler(reg, stubContextLoaderWithToken("tiverton", "tiverton:dummy123"), logging.New(&logs, logging.FormatJSON), forcePanic)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBufferString(`{"model":"openai/gpt-4o","messages":[]}`))
+	req.Header.Set("Authorization", "Bearer tiverton:dummy123")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", w.Code)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error.Message == "" {
+		t.Fatalf("expected OpenAI-shaped error body, got %q", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), `"type":"panic"`) || !strings.Contains(logs.String(), `"error":"boom"`) {
+		t.Errorf("expected panic entry logged, got %s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"claw_id":"tiverton"`) {
+		t.Errorf("expected panic entry attributed to agent, got %s", logs.String())
+	}
+}
+
 func stubContextLoaderWithToken(agentID, token string) ContextLoader {
 	return func(id string) (*agentctx.AgentContext, error) {
 		if id != agentID {
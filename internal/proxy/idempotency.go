@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyHeader lets an agent retry a non-streaming request without it
+// reaching the provider twice.
+const idempotencyHeader = "Idempotency-Key"
+
+// idempotencyCache remembers the first successful response per agent and
+// Idempotency-Key for ttl. A key is reserved while its first request is in
+// flight so concurrent retries cannot both go upstream. Each agent may hold
+// at most maxKeys keys, and responses larger than maxBody bytes are not
+// stored, so no agent can pin unbounded memory.
+type idempotencyCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxKeys  int
+	maxBody  int
+	entries  map[string]*idempotentResponse
+	perAgent map[string]int
+	expiry   []idempotentExpiry
+	now      func() time.Time
+}
+
+var (
+	errIdempotencyMismatch = errors.New("Idempotency-Key was already used with a different request body")
+	errIdempotencyInFlight = errors.New("a request with this Idempotency-Key is still in progress")
+	errIdempotencyFull     = errors.New("too many Idempotency-Keys held for this agent; retry once older keys expire")
+)
+
+type idempotentResponse struct {
+	agentID  string
+	bodyHash [sha256.Size]byte
+	done     bool
+	expires  time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotentExpiry queues a stored response for removal at.
+type idempotentExpiry struct {
+	id string
+	at time.Time
+}
+
+func newIdempotencyCache(ttl time.Duration, maxKeys, maxBody int) *idempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &idempotencyCache{
+		ttl:      ttl,
+		maxKeys:  maxKeys,
+		maxBody:  maxBody,
+		entries:  make(map[string]*idempotentResponse),
+		perAgent: make(map[string]int),
+		now:      time.Now,
+	}
+}
+
+// begin looks up agentID/key for a request whose body hashes to sum. It
+// returns the stored response for a completed match; otherwise, if the key is
+// free, it reserves it and returns reserved=true. A key held by a different
+// body, or still in flight, is an error, as is a new key from an agent
+// already holding maxKeys.
+func (c *idempotencyCache) begin(agentID, key string, sum [sha256.Size]byte) (stored *idempotentResponse, reserved bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(c.now())
+
+	id := agentID + "\x00" + key
+	e, ok := c.entries[id]
+	if !ok {
+		if c.maxKeys > 0 && c.perAgent[agentID] >= c.maxKeys {
+			return nil, false, errIdempotencyFull
+		}
+		c.entries[id] = &idempotentResponse{agentID: agentID, bodyHash: sum}
+		c.perAgent[agentID]++
+		return nil, true, nil
+	}
+	if e.bodyHash != sum {
+		return nil, false, errIdempotencyMismatch
+	}
+	if !e.done {
+		return nil, false, errIdempotencyInFlight
+	}
+	return e, false, nil
+}
+
+// finish stores rec against a reserved key when the upstream succeeded, and
+// otherwise releases the key so the agent can retry. A response too large
+// to keep also releases its key.
+func (c *idempotencyCache) finish(agentID, key string, rec *responseRecorder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := agentID + "\x00" + key
+	e, ok := c.entries[id]
+	if !ok {
+		return
+	}
+	if rec.status < 200 || rec.status >= 300 || rec.overflow {
+		c.remove(id, e)
+		return
+	}
+	e.done = true
+	e.expires = c.now().Add(c.ttl)
+	e.status = rec.status
+	e.header = rec.Header().Clone()
+	e.body = rec.body.Bytes()
+	c.expiry = append(c.expiry, idempotentExpiry{id: id, at: e.expires})
+}
+
+// expire drops stored responses whose ttl has passed. Every response is kept
+// for the same ttl, so the queue is in expiry order and only its head needs
+// checking. A key stored again since it was queued has a later expiry and
+// is left alone.
+func (c *idempotencyCache) expire(now time.Time) {
+	for len(c.expiry) > 0 && !now.Before(c.expiry[0].at) {
+		id := c.expiry[0].id
+		c.expiry = c.expiry[1:]
+		if e, ok := c.entries[id]; ok && e.done && !now.Before(e.expires) {
+			c.remove(id, e)
+		}
+	}
+}
+
+func (c *idempotencyCache) remove(id string, e *idempotentResponse) {
+	delete(c.entries, id)
+	if c.perAgent[e.agentID]--; c.perAgent[e.agentID] <= 0 {
+		delete(c.perAgent, e.agentID)
+	}
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy for the idempotency cache, up to limit bytes (zero for no limit).
+// Past the limit the copy is dropped and overflow set.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	switch {
+	case r.overflow:
+	case r.limit > 0 && r.body.Len()+len(p) > r.limit:
+		r.overflow = true
+		r.body = bytes.Buffer{}
+	default:
+		r.body.Write(p)
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
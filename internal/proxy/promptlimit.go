@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mostlydev/cllama/internal/agentctx"
+)
+
+// agentPolicy is what the handlers enforce for one agent, resolved from
+// handler defaults and the agent's metadata.
+type agentPolicy struct {
+	allowedProviders []string
+	maxMessages      int
+	maxPromptTokens  int
+	maxConcurrent    int
+}
+
+// policyFor resolves the policy for ctx. The max_prompt_messages and
+// max_prompt_tokens metadata fields replace the handler-wide limits for that
+// agent; zero turns a limit off. max_concurrent caps the agent's requests in
+// flight, with no handler-wide default.
+func (h *Handler) policyFor(ctx *agentctx.AgentContext) agentPolicy {
+	p := agentPolicy{
+		allowedProviders: ctx.MetadataStrings("allowed_providers"),
+		maxMessages:      h.maxPromptMessages,
+		maxPromptTokens:  h.maxPromptTokens,
+	}
+	if n, ok := ctx.MetadataInt("max_prompt_messages"); ok {
+		p.maxMessages = n
+	}
+	if n, ok := ctx.MetadataInt("max_prompt_tokens"); ok {
+		p.maxPromptTokens = n
+	}
+	if n, ok := ctx.MetadataInt("max_concurrent"); ok {
+		p.maxConcurrent = n
+	}
+	return p
+}
+
+// promptWithinLimits rejects a prompt over the agent's message count or
+// estimated token limit with 413, before anything is sent upstream. contents
+// holds each message's content, plus any top-level system prompt.
+func (h *Handler) promptWithinLimits(w http.ResponseWriter, pol agentPolicy, agentID, requestedModel string, messages int, contents []any, start time.Time) bool {
+	var msg string
+	if pol.maxMessages > 0 && messages > pol.maxMessages {
+		msg = fmt.Sprintf("request has %d messages, over this agent's limit of %d", messages, pol.maxMessages)
+	} else if pol.maxPromptTokens > 0 {
+		if est := estimatePromptTokens(contents); est > pol.maxPromptTokens {
+			msg = fmt.Sprintf("prompt is about %d tokens, over this agent's limit of %d", est, pol.maxPromptTokens)
+		}
+	}
+	if msg == "" {
+		return true
+	}
+	h.logger.LogIntervention(agentID, requestedModel, "prompt_limit")
+	h.fail(w, http.StatusRequestEntityTooLarge, msg, agentID, requestedModel, start, errors.New(msg))
+	return false
+}
+
+// estimatePromptTokens approximates the prompt's token count at four
+// characters of text per token. Only text counts: image and other non-text
+// parts, which would dwarf the text when base64-encoded, are skipped.
+func estimatePromptTokens(contents []any) int {
+	var chars int
+	for _, c := range contents {
+		chars += textLen(c)
+	}
+	return (chars + 3) / 4
+}
+
+// textLen measures the text in a message content: a string, or a list of
+// parts whose "text" fields are counted.
+func textLen(v any) int {
+	switch c := v.(type) {
+	case string:
+		return len(c)
+	case json.RawMessage:
+		var decoded any
+		if json.Unmarshal(c, &decoded) != nil {
+			return len(c)
+		}
+		return textLen(decoded)
+	case []any:
+		n := 0
+		for _, part := range c {
+			n += textLen(part)
+		}
+		return n
+	case map[string]any:
+		text, _ := c["text"].(string)
+		return len(text)
+	}
+	return 0
+}
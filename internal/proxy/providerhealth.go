@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// providerBreaker tracks consecutive upstream failures per provider. After
+// threshold failures in a row a provider cools down: requests to it are
+// refused without being sent until cooldown has passed. After that, requests
+// flow again: one more failure restarts the cooldown, a success resets it.
+type providerBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     map[string]*breakerState
+	now       func() time.Time
+}
+
+type breakerState struct {
+	failures int
+	until    time.Time
+}
+
+// ProviderHealth is the passive health of one provider as seen by live
+// traffic.
+type ProviderHealth struct {
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CooldownUntil       *time.Time `json:"cooldown_until,omitempty"`
+}
+
+func newProviderBreaker(threshold int, cooldown time.Duration) *providerBreaker {
+	if threshold <= 0 || cooldown <= 0 {
+		return nil
+	}
+	return &providerBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     make(map[string]*breakerState),
+		now:       time.Now,
+	}
+}
+
+// cooling reports whether provider is in its cooldown window and, if so,
+// how long remains.
+func (b *providerBreaker) cooling(provider string) (bool, time.Duration) {
+	if b == nil {
+		return false, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.state[provider]
+	if !ok {
+		return false, 0
+	}
+	if left := s.until.Sub(b.now()); left > 0 {
+		return true, left
+	}
+	return false, 0
+}
+
+// fail records a failed upstream call and reports whether it started a
+// cooldown.
+func (b *providerBreaker) fail(provider string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.state[provider]
+	if !ok {
+		s = &breakerState{}
+		b.state[provider] = s
+	}
+	s.failures++
+	if s.failures >= b.threshold {
+		s.until = b.now().Add(b.cooldown)
+		return true
+	}
+	return false
+}
+
+func (b *providerBreaker) succeed(provider string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	delete(b.state, provider)
+	b.mu.Unlock()
+}
+
+// health reports the state of each named provider; untracked ones are
+// healthy.
+func (b *providerBreaker) health(names []string) map[string]ProviderHealth {
+	out := make(map[string]ProviderHealth, len(names))
+	for _, n := range names {
+		out[n] = ProviderHealth{Healthy: true}
+	}
+	if b == nil {
+		return out
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for n, s := range b.state {
+		h := ProviderHealth{Healthy: true, ConsecutiveFailures: s.failures}
+		if s.until.After(now) {
+			until := s.until
+			h.Healthy = false
+			h.CooldownUntil = &until
+		}
+		out[n] = h
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitPrefix starts the provider-neutral rate-limit headers added to
+// responses, so agents can back off without parsing each provider's own.
+const rateLimitPrefix = "X-Cllama-Ratelimit-"
+
+// rateLimitSources lists, per normalized header suffix, the provider
+// headers it is read from: OpenAI-style first, then Anthropic.
+var rateLimitSources = []struct {
+	suffix  string
+	sources []string
+	reset   bool
+}{
+	{"Limit-Requests", []string{"X-Ratelimit-Limit-Requests", "Anthropic-Ratelimit-Requests-Limit"}, false},
+	{"Remaining-Requests", []string{"X-Ratelimit-Remaining-Requests", "Anthropic-Ratelimit-Requests-Remaining"}, false},
+	{"Reset-Requests", []string{"X-Ratelimit-Reset-Requests", "Anthropic-Ratelimit-Requests-Reset"}, true},
+	{"Limit-Tokens", []string{"X-Ratelimit-Limit-Tokens", "Anthropic-Ratelimit-Tokens-Limit"}, false},
+	{"Remaining-Tokens", []string{"X-Ratelimit-Remaining-Tokens", "Anthropic-Ratelimit-Tokens-Remaining"}, false},
+	{"Reset-Tokens", []string{"X-Ratelimit-Reset-Tokens", "Anthropic-Ratelimit-Tokens-Reset"}, true},
+	{"Retry-After", []string{"Retry-After"}, true},
+}
+
+// setRateLimitHeaders copies the upstream rate-limit headers in src onto dst
+// under rateLimitPrefix. Limits and remaining counts are whole numbers;
+// resets and Retry-After are whole seconds from now, rounded up, whether the
+// provider sent a duration ("6m0s"), seconds, or a timestamp. Values that
+// don't parse are left out.
+func setRateLimitHeaders(dst, src http.Header, now time.Time) {
+	for _, rl := range rateLimitSources {
+		for _, name := range rl.sources {
+			v := strings.TrimSpace(src.Get(name))
+			if v == "" {
+				continue
+			}
+			var norm string
+			var ok bool
+			if rl.reset {
+				norm, ok = resetSeconds(v, now)
+			} else {
+				_, err := strconv.ParseInt(v, 10, 64)
+				norm, ok = v, err == nil
+			}
+			if ok {
+				dst.Set(rateLimitPrefix+rl.suffix, norm)
+			}
+			break
+		}
+	}
+}
+
+// resetSeconds converts a reset or Retry-After value to seconds from now.
+func resetSeconds(v string, now time.Time) (string, bool) {
+	var d time.Duration
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if math.IsNaN(secs) || math.IsInf(secs, 0) {
+			return "", false
+		}
+		d = time.Duration(secs * float64(time.Second))
+	} else if parsed, err := time.ParseDuration(v); err == nil {
+		d = parsed
+	} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+		d = t.Sub(now)
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = t.Sub(now)
+	} else {
+		return "", false
+	}
+	if d < 0 {
+		d = 0
+	}
+	return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10), true
+}
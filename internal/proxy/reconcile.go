@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mostlydev/cllama/internal/cost"
+)
+
+// UsageReconciliation decides what is billed when a response reports no
+// usage, as streams without stream_options.include_usage do.
+type UsageReconciliation string
+
+const (
+	// ReconcileReportedOnly bills exactly what the provider reported; a
+	// response without usage is counted as a request at zero cost.
+	ReconcileReportedOnly UsageReconciliation = "reported-only"
+	// ReconcileEstimate bills an estimate from the request and response
+	// text, at four characters per token, when no usage was reported.
+	ReconcileEstimate UsageReconciliation = "estimate-if-missing"
+	// ReconcileStrict bills what was reported, like ReconcileReportedOnly,
+	// but logs a usage_miss entry for responses without usage and for
+	// models with no price.
+	ReconcileStrict UsageReconciliation = "strict"
+)
+
+// ParseUsageReconciliation checks s against the known strategies; empty
+// means ReconcileReportedOnly.
+func ParseUsageReconciliation(s string) (UsageReconciliation, error) {
+	switch m := UsageReconciliation(strings.ToLower(strings.TrimSpace(s))); m {
+	case "":
+		return ReconcileReportedOnly, nil
+	case ReconcileReportedOnly, ReconcileEstimate, ReconcileStrict:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown usage reconciliation %q (want %s, %s or %s)", s, ReconcileReportedOnly, ReconcileEstimate, ReconcileStrict)
+}
+
+// WithUsageReconciliation selects how responses without usage are billed.
+// Unknown values fall back to ReconcileReportedOnly.
+func WithUsageReconciliation(mode UsageReconciliation) HandlerOption {
+	return func(h *Handler) {
+		if m, err := ParseUsageReconciliation(string(mode)); err == nil {
+			h.reconcile = m
+		}
+	}
+}
+
+// WithResponseModelPricing prices each response by the model it reports
+// serving, when it names one with a known price, instead of the model that
+// was requested. It catches a provider silently downgrading (or upgrading)
+// a request. Spend is still recorded under the requested model.
+func WithResponseModelPricing(enabled bool) HandlerOption {
+	return func(h *Handler) {
+		h.priceByResponseModel = enabled
+	}
+}
+
+// lookupRate finds the rate for reported, the model a response named, and
+// falls back to requested when reported is empty or unpriced.
+func lookupRate(pricing *cost.Pricing, providerName, reported, requested string) (cost.Rate, bool) {
+	if reported != "" && reported != requested {
+		if rate, ok := pricing.Lookup(providerName, reported); ok {
+			return rate, true
+		}
+	}
+	return pricing.Lookup(providerName, requested)
+}
+
+// reconcileUsage applies the reconciliation strategy to the usage a response
+// reported and returns the usage to bill. respBody is the response as
+// relayed; it is only kept, and only read, under ReconcileEstimate.
+func (h *Handler) reconcileUsage(reported cost.Usage, outReq *http.Request, respBody []byte, agentID, requestedModel, providerName, upstreamModel string) cost.Usage {
+	missing := reported.PromptTokens == 0 && reported.CompletionTokens == 0
+	switch h.reconcile {
+	case ReconcileEstimate:
+		if !missing {
+			return reported
+		}
+		var reqBody []byte
+		if outReq.GetBody != nil {
+			if rc, err := outReq.GetBody(); err == nil {
+				reqBody, _ = io.ReadAll(rc)
+				rc.Close()
+			}
+		}
+		est := cost.Usage{
+			PromptTokens:     estimateTextTokens(reqBody),
+			CompletionTokens: estimateTextTokens(respBody),
+		}
+		est.TotalTokens = est.PromptTokens + est.CompletionTokens
+		return est
+	case ReconcileStrict:
+		if missing {
+			h.logger.LogUsageMiss(agentID, requestedModel, upstreamModel, "no usage reported")
+		}
+		if _, ok := h.pricing.Lookup(providerName, upstreamModel); !ok {
+			h.logger.LogUsageMiss(agentID, requestedModel, upstreamModel, fmt.Sprintf("no price for %s/%s", providerName, upstreamModel))
+		}
+	}
+	return reported
+}
+
+// estimateTextTokens estimates the tokens of text in a JSON body, or in
+// each data line of an SSE body, at four characters per token. Text is
+// taken from "content", "text" and "system" string fields at any depth,
+// which covers chat requests, completions and stream deltas for both the
+// OpenAI and Anthropic formats.
+func estimateTextTokens(body []byte) int {
+	var chars int
+	count := func(payload []byte) {
+		var v any
+		if json.Unmarshal(payload, &v) == nil {
+			chars += textFields(v)
+		}
+	}
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		count(trimmed)
+	} else {
+		for _, line := range bytes.Split(body, []byte("\n")) {
+			if payload, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:")); ok {
+				count(bytes.TrimSpace(payload))
+			}
+		}
+	}
+	return (chars + 3) / 4
+}
+
+func textFields(v any) int {
+	n := 0
+	switch c := v.(type) {
+	case []any:
+		for _, item := range c {
+			n += textFields(item)
+		}
+	case map[string]any:
+		for k, item := range c {
+			if s, ok := item.(string); ok {
+				if k == "content" || k == "text" || k == "system" {
+					n += len(s)
+				}
+				continue
+			}
+			n += textFields(item)
+		}
+	}
+	return n
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/mostlydev/cllama/internal/identity"
+)
+
+// recoverPanic turns a panic while serving r into a logged "panic" entry and
+// a 500 for the agent, instead of a dropped connection with no trace. If the
+// response had already started there is no way to signal the error in it, so
+// the connection is aborted instead.
+func (h *Handler) recoverPanic(w *headerTracker, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	agentID, _, _ := identity.ParseBearer(r.Header.Get("Authorization"))
+	h.logger.LogPanic(agentID, v, debug.Stack())
+	if w.wroteHeader {
+		panic(http.ErrAbortHandler)
+	}
+	writeJSONError(w, http.StatusInternalServerError, "internal proxy error")
+}
+
+// headerTracker notes whether a response has started, so recoverPanic knows
+// whether it can still send an error status.
+type headerTracker struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (t *headerTracker) WriteHeader(status int) {
+	t.wroteHeader = true
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *headerTracker) Write(p []byte) (int, error) {
+	t.wroteHeader = true
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *headerTracker) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// completionToSSE rewrites a buffered chat.completion JSON body as the
+// equivalent chat.completion.chunk SSE stream: one delta chunk per choice
+// carrying the whole message, a closing chunk with finish_reason (and usage,
+// if present), then [DONE]. It reports false for anything that is not a
+// chat completion, leaving the body untouched.
+func completionToSSE(body []byte) ([]byte, bool) {
+	var c struct {
+		ID      string          `json:"id"`
+		Object  string          `json:"object"`
+		Created int64           `json:"created"`
+		Model   string          `json:"model"`
+		Usage   json.RawMessage `json:"usage,omitempty"`
+		Choices []struct {
+			Index        int             `json:"index"`
+			Message      map[string]any  `json:"message"`
+			FinishReason any             `json:"finish_reason"`
+			Logprobs     json.RawMessage `json:"logprobs,omitempty"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(body, &c); err != nil || c.Object != "chat.completion" || len(c.Choices) == 0 {
+		return nil, false
+	}
+
+	type chunkChoice struct {
+		Index        int             `json:"index"`
+		Delta        map[string]any  `json:"delta"`
+		Logprobs     json.RawMessage `json:"logprobs,omitempty"`
+		FinishReason any             `json:"finish_reason"`
+	}
+	type chunk struct {
+		ID      string          `json:"id"`
+		Object  string          `json:"object"`
+		Created int64           `json:"created"`
+		Model   string          `json:"model"`
+		Choices []chunkChoice   `json:"choices"`
+		Usage   json.RawMessage `json:"usage,omitempty"`
+	}
+
+	var out bytes.Buffer
+	emit := func(v any) bool {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return false
+		}
+		out.WriteString("data: ")
+		out.Write(data)
+		out.WriteString("\n\n")
+		return true
+	}
+
+	first := chunk{ID: c.ID, Object: "chat.completion.chunk", Created: c.Created, Model: c.Model}
+	last := first
+	for _, ch := range c.Choices {
+		delta := ch.Message
+		if delta == nil {
+			delta = map[string]any{}
+		}
+		// Streamed tool calls are addressed by position.
+		if calls, ok := delta["tool_calls"].([]any); ok {
+			for i, call := range calls {
+				if m, ok := call.(map[string]any); ok {
+					m["index"] = i
+				}
+			}
+		}
+		// Logprobs travel with the content they describe.
+		first.Choices = append(first.Choices, chunkChoice{Index: ch.Index, Delta: delta, Logprobs: ch.Logprobs})
+		last.Choices = append(last.Choices, chunkChoice{Index: ch.Index, Delta: map[string]any{}, FinishReason: ch.FinishReason})
+	}
+	last.Usage = c.Usage
+
+	if !emit(first) || !emit(last) {
+		return nil, false
+	}
+	out.WriteString("data: [DONE]\n\n")
+	return out.Bytes(), true
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WithUpstreamRetries sends a request again, up to max more times and delay
+// apart, when its upstream attempt fails with a transport error or a 502,
+// 503 or 504. Retries are drawn from a per-provider budget that earns
+// perSecond retries a second, up to burst saved; once a provider's budget is
+// spent its failures are returned at once. A perSecond or burst of zero
+// leaves retries unbudgeted; a max of zero disables them.
+func WithUpstreamRetries(max int, delay time.Duration, perSecond float64, burst int) HandlerOption {
+	return func(h *Handler) {
+		h.retries = max
+		h.retryDelay = delay
+		h.retryBudget = newRetryBudget(perSecond, burst)
+	}
+}
+
+// retryBudget is a token bucket of retries per provider: each provider earns
+// perSecond retries a second, up to burst saved, and a retry is only allowed
+// while it has one to spend. During an outage the budget drains and further
+// failures are returned (or failed over) at once, instead of every request
+// multiplying the load on a provider that is already struggling.
+type retryBudget struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	buckets   map[string]*retryBucket
+	now       func() time.Time
+}
+
+type retryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRetryBudget(perSecond float64, burst int) *retryBudget {
+	if perSecond <= 0 || burst <= 0 {
+		return nil
+	}
+	return &retryBudget{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		buckets:   make(map[string]*retryBucket),
+		now:       time.Now,
+	}
+}
+
+// allow spends one retry from provider's budget and reports whether there
+// was one to spend. A nil budget allows every retry.
+func (b *retryBudget) allow(provider string) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	bk, ok := b.buckets[provider]
+	if !ok {
+		bk = &retryBucket{tokens: b.burst, last: now}
+		b.buckets[provider] = bk
+	}
+	if elapsed := now.Sub(bk.last).Seconds(); elapsed > 0 {
+		bk.tokens = min(b.burst, bk.tokens+elapsed*b.perSecond)
+	}
+	bk.last = now
+	if bk.tokens < 1 {
+		return false
+	}
+	bk.tokens--
+	return true
+}
+
+// sendUpstream sends outReq, retrying as configured by WithUpstreamRetries.
+// Every attempt is reported to the provider's breaker; retries stop early
+// once the provider cools down or the agent's context ends.
+func (h *Handler) sendUpstream(client *http.Client, outReq *http.Request, agentID, requestedModel, providerName string) (*http.Response, error) {
+	resp, err := client.Do(outReq)
+	h.observeUpstream(outReq, resp, err, agentID, requestedModel, providerName)
+	for attempt := 1; attempt <= h.retries && retryable(outReq, resp, err); attempt++ {
+		if cooling, _ := h.breaker.cooling(providerName); cooling {
+			break
+		}
+		if !h.retryBudget.allow(providerName) {
+			h.logger.LogIntervention(agentID, requestedModel, "retry_budget")
+			break
+		}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		h.logger.LogRetry(agentID, requestedModel, providerName, attempt, status, h.retryDelay, err)
+		if !wait(outReq.Context(), h.retryDelay) {
+			break
+		}
+		if outReq.GetBody != nil {
+			body, gerr := outReq.GetBody()
+			if gerr != nil {
+				break
+			}
+			outReq.Body = body
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		resp, err = client.Do(outReq)
+		h.observeUpstream(outReq, resp, err, agentID, requestedModel, providerName)
+	}
+	return resp, err
+}
+
+// retryable reports whether an upstream attempt failed in a way worth
+// retrying, with a body that can be sent again.
+func retryable(outReq *http.Request, resp *http.Response, err error) bool {
+	if outReq.Body != nil && outReq.Body != http.NoBody && outReq.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// wait sleeps for d and reports whether ctx is still live afterwards.
+func wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
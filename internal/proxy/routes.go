@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RouteRule sends requests whose model matches Match, a regular expression
+// tested against the model exactly as the agent sent it, to Provider.
+// Rewrite, if set, is the upstream model, with $1 or ${name} standing for
+// the match's groups; otherwise the model is sent as requested.
+type RouteRule struct {
+	Match    string `json:"match"`
+	Provider string `json:"provider"`
+	Rewrite  string `json:"rewrite,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// ParseRouteRules reads a JSON array of rules and compiles their patterns.
+func ParseRouteRules(data []byte) ([]RouteRule, error) {
+	var rules []RouteRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parse route rules: %w", err)
+	}
+	for i := range rules {
+		rule := &rules[i]
+		rule.Provider = strings.ToLower(strings.TrimSpace(rule.Provider))
+		if rule.Match == "" || rule.Provider == "" {
+			return nil, fmt.Errorf("route rule %d: match and provider are required", i)
+		}
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("route rule %d: %w", i, err)
+		}
+		rule.re = re
+	}
+	return rules, nil
+}
+
+// LoadRouteRules reads rules from the JSON file at path; an empty path means
+// no rules.
+func LoadRouteRules(path string) ([]RouteRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRouteRules(data)
+}
+
+// WithRouteRules routes chat and passthrough requests by the first rule, in
+// order, whose pattern matches the requested model. Requests no rule matches,
+// and those naming a provider in X-Cllama-Provider, are routed by the
+// "<provider>/<model>" prefix as usual.
+func WithRouteRules(rules []RouteRule) HandlerOption {
+	return func(h *Handler) {
+		h.routes = rules
+	}
+}
+
+// routeModel resolves the provider and upstream model for a requested model.
+func (h *Handler) routeModel(model string) (providerName, upstreamModel string, err error) {
+	model = strings.TrimSpace(model)
+	for _, rule := range h.routes {
+		m := rule.re.FindStringSubmatchIndex(model)
+		if m == nil {
+			continue
+		}
+		if rule.Rewrite == "" {
+			return rule.Provider, model, nil
+		}
+		return rule.Provider, string(rule.re.ExpandString(nil, rule.Rewrite, model, m)), nil
+	}
+	return splitModel(model, h.pricing)
+}
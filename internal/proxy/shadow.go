@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/mostlydev/cllama/internal/cost"
+	"github.com/mostlydev/cllama/internal/logging"
+	"github.com/mostlydev/cllama/internal/openai"
+)
+
+// shadowTimeout bounds a shadow request when no upstream timeout is set,
+// so a hung shadow provider cannot pile up goroutines.
+const shadowTimeout = 2 * time.Minute
+
+// ShadowTarget is the provider and model a shadowed model's requests are
+// copied to.
+type ShadowTarget struct {
+	Provider string
+	Model    string
+}
+
+// ShadowAgentID returns the accumulator key a shadow request's spend is
+// recorded under for agentID. The colon can never appear in a real agent
+// ID, so shadow spend never mixes with the agent's own.
+func ShadowAgentID(agentID string) string {
+	return "shadow:" + agentID
+}
+
+// ParseShadowRules reads "provider/model=provider/model" entries: chat
+// requests for the model on the left are also sent to the one on the right.
+func ParseShadowRules(entries []string) (map[string]ShadowTarget, error) {
+	rules := make(map[string]ShadowTarget, len(entries))
+	for _, e := range entries {
+		from, to, ok := strings.Cut(e, "=")
+		from = strings.TrimSpace(from)
+		toProvider, toModel, hasSlash := strings.Cut(strings.TrimSpace(to), "/")
+		fromProvider, fromModel, fromSlash := strings.Cut(from, "/")
+		if !ok || !hasSlash || !fromSlash || fromProvider == "" || fromModel == "" || toProvider == "" || toModel == "" {
+			return nil, fmt.Errorf("invalid shadow entry %q (want provider/model=provider/model)", e)
+		}
+		// Provider names are matched lowercased, as requests are routed.
+		rules[strings.ToLower(fromProvider)+"/"+fromModel] = ShadowTarget{Provider: strings.ToLower(toProvider), Model: toModel}
+	}
+	return rules, nil
+}
+
+// WithShadow copies chat requests for each model in rules, keyed
+// "provider/model" as from ParseShadowRules, to a second provider for
+// comparison. The copy is sent in the background and its body discarded;
+// its cost is recorded under ShadowAgentID and it is logged as a "shadow"
+// entry. Nothing about it reaches the agent. It needs WithCostTracking for
+// the cost to be recorded.
+func WithShadow(rules map[string]ShadowTarget) HandlerOption {
+	return func(h *Handler) {
+		h.shadows = rules
+	}
+}
+
+// shadow sends payload to target in the background. It reads nothing from
+// r after returning, and no failure of its own reaches the caller.
+func (h *Handler) shadow(target ShadowTarget, r *http.Request, agentID, requestedModel string, payload openai.ChatCompletionRequest) {
+	payload.Model = target.Model
+	body, err := json.Marshal(payload)
+	if err != nil {
+		h.logger.LogShadow(agentID, requestedModel, target.Provider, target.Model, 0, 0, nil, err)
+		return
+	}
+	header := make(http.Header)
+	copyRequestHeaders(header, r.Header)
+	for _, k := range []string{sessionHeader, tagsHeader, timeoutHeader, providerHeader, idempotencyHeader} {
+		header.Del(k)
+	}
+	path, rawQuery := r.URL.Path, r.URL.RawQuery
+	session := sessionID(r, payload.SessionID())
+
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				h.logger.LogPanic(agentID, v, debug.Stack())
+			}
+		}()
+		start := time.Now()
+		status, usage, err := h.sendShadow(target, path, rawQuery, header, body)
+		latency := time.Since(start).Milliseconds()
+		if err != nil {
+			h.logger.LogShadow(agentID, requestedModel, target.Provider, target.Model, status, latency, nil, err)
+			return
+		}
+		var ci *logging.CostInfo
+		if h.accumulator != nil && h.pricing != nil {
+			var costUSD float64
+			if rate, ok := h.pricing.Lookup(target.Provider, target.Model); ok {
+				costUSD = h.pricing.Charge(rate.Compute(usage.PromptTokens, usage.CompletionTokens))
+			}
+			h.accumulator.RecordSession(ShadowAgentID(agentID), session, target.Provider, target.Model,
+				usage.PromptTokens, usage.CompletionTokens, costUSD)
+			ci = &logging.CostInfo{InputTokens: usage.PromptTokens, OutputTokens: usage.CompletionTokens, CostUSD: costUSD}
+		}
+		h.logger.LogShadow(agentID, requestedModel, target.Provider, target.Model, status, latency, ci, nil)
+	}()
+}
+
+// sendShadow performs the shadow request and reads its usage, discarding
+// the body. A non-2xx status is returned as an error.
+func (h *Handler) sendShadow(target ShadowTarget, path, rawQuery string, header http.Header, body []byte) (int, cost.Usage, error) {
+	prov, err := h.provider(target.Provider)
+	if err != nil {
+		return 0, cost.Usage{}, err
+	}
+	targetURL, err := buildUpstreamURL(h.endpoint(prov), path, rawQuery)
+	if err != nil {
+		return 0, cost.Usage{}, err
+	}
+	timeout := h.upstreamTimeout
+	if timeout <= 0 {
+		timeout = shadowTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, cost.Usage{}, err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	if err := applyProviderAuth(req, prov); err != nil {
+		return 0, cost.Usage{}, err
+	}
+	client := h.client
+	if prov.InsecureSkipVerify {
+		client = h.skipVerifyClient()
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, cost.Usage{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, cost.Usage{}, fmt.Errorf("shadow provider returned %s", resp.Status)
+	}
+	sink := cost.NewUsageSink(prov.APIFormat)
+	if _, err := io.Copy(sink, resp.Body); err != nil {
+		return resp.StatusCode, cost.Usage{}, err
+	}
+	usage, _ := sink.Usage()
+	return resp.StatusCode, usage, nil
+}
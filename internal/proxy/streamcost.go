@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/mostlydev/cllama/internal/cost"
+)
+
+// liveCostInterval is how often a running stream's spend is pushed to the
+// accumulator, so the dashboard shows long streams before they finish.
+const liveCostInterval = 5 * time.Second
+
+// streamCost costs a streamed response as it is written through it, in
+// either the OpenAI or the Anthropic event format. Usage reports are
+// cumulative, so each update records only the growth since the
+// last one (without counting a request); finish records the remainder at
+// the billed price, leaving the totals equal to a single final record.
+type streamCost struct {
+	acc      *cost.Accumulator
+	pricing  *cost.Pricing
+	interval time.Duration
+	now      func() time.Time
+
+	agentID, session, provider, model string
+	tags                              map[string]string
+
+	// byResponseModel prices by the model the stream names, when it names
+	// one with a price; see WithResponseModelPricing.
+	byResponseModel bool
+
+	sink         *cost.UsageSink
+	lastUpdate   time.Time
+	recorded     cost.Usage
+	recordedCost float64
+}
+
+// newStreamCost returns a streamCost for a stream in apiFormat, as in
+// cost.NewUsageSink.
+func newStreamCost(acc *cost.Accumulator, pricing *cost.Pricing, interval time.Duration, apiFormat, agentID, session, provider, model string) *streamCost {
+	s := &streamCost{
+		acc:      acc,
+		pricing:  pricing,
+		interval: interval,
+		now:      time.Now,
+		agentID:  agentID,
+		session:  session,
+		provider: provider,
+		model:    model,
+		sink:     cost.NewUsageSink(apiFormat),
+	}
+	s.lastUpdate = s.now()
+	s.sink.OnUsage = s.observe
+	return s
+}
+
+func (s *streamCost) Write(p []byte) (int, error) {
+	return s.sink.Write(p)
+}
+
+func (s *streamCost) observe(u cost.Usage) {
+	if now := s.now(); now.Sub(s.lastUpdate) >= s.interval {
+		s.lastUpdate = now
+		s.record(u, s.rawCost(u), false)
+	}
+}
+
+// finish records what is left of the final usage, with the billing policy
+// applied, and returns the final usage and cost.
+func (s *streamCost) finish() (cost.Usage, float64) {
+	u := s.reported()
+	return u, s.settle(u)
+}
+
+// reported returns the last usage the stream reported, or zero usage.
+func (s *streamCost) reported() cost.Usage {
+	u, _ := s.sink.Usage()
+	return u
+}
+
+// settle closes the stream out at final usage u, which may differ from what
+// was reported (an estimate, say), and returns its billed cost.
+func (s *streamCost) settle(u cost.Usage) float64 {
+	total := s.pricing.Charge(s.rawCost(u))
+	s.record(u, total, true)
+	return total
+}
+
+func (s *streamCost) rawCost(u cost.Usage) float64 {
+	reported := ""
+	if s.byResponseModel {
+		reported = s.sink.Model()
+	}
+	if rate, ok := lookupRate(s.pricing, s.provider, reported, s.model); ok {
+		return rate.Compute(u.PromptTokens, u.CompletionTokens)
+	}
+	return 0
+}
+
+func (s *streamCost) record(u cost.Usage, costUSD float64, final bool) {
+	dIn := u.PromptTokens - s.recorded.PromptTokens
+	dOut := u.CompletionTokens - s.recorded.CompletionTokens
+	dCost := costUSD - s.recordedCost
+	if final {
+		s.acc.RecordTagged(s.agentID, s.session, s.tags, s.provider, s.model, dIn, dOut, dCost)
+	} else {
+		if dIn <= 0 && dOut <= 0 {
+			return
+		}
+		s.acc.RecordPartialTagged(s.agentID, s.session, s.tags, s.provider, s.model, dIn, dOut, dCost)
+	}
+	s.recorded = u
+	s.recordedCost = costUSD
+}
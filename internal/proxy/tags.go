@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// tagsHeader lets agents tag spend with their own dimensions, such as
+// "feature=search, experiment=b".
+const tagsHeader = "X-Cllama-Tags"
+
+// Tags per header are capped here; the accumulator caps the distinct keys
+// and values across requests (cost.MaxTagKeys, cost.MaxTagValues).
+const (
+	maxTags      = 8
+	maxTagLength = 64
+)
+
+// requestTags parses the comma-separated key=value pairs in value. Keys are
+// lowercased; an empty value yields no tags.
+func requestTags(value string) (map[string]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		if !ok || k == "" || v == "" || len(k) > maxTagLength || len(v) > maxTagLength {
+			return nil, fmt.Errorf("invalid %s entry %q (want key=value, at most %d characters each)", tagsHeader, strings.TrimSpace(pair), maxTagLength)
+		}
+		tags[k] = v
+	}
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("too many %s entries (at most %d)", tagsHeader, maxTags)
+	}
+	return tags, nil
+}
+
+type tagsKey struct{}
+
+// withTags carries a request's tags to where its cost is recorded.
+func withTags(ctx context.Context, tags map[string]string) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+func tagsFrom(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
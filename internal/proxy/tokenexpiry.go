@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mostlydev/cllama/internal/agentctx"
+)
+
+// WithTokenGrace keeps accepting an agent token for grace after its
+// metadata token_expires_at passes, so clock skew during credential
+// rotation doesn't turn into 401s. Zero rejects expired tokens at once.
+func WithTokenGrace(grace time.Duration) HandlerOption {
+	return func(h *Handler) {
+		if grace > 0 {
+			h.tokenGrace = grace
+		}
+	}
+}
+
+// tokenExpiry checks metadata token_expires_at (RFC 3339) against now.
+// graced reports a token past its expiry but still within grace; an
+// expired token, or an expiry that doesn't parse, is an error. Agents
+// without token_expires_at never expire.
+func tokenExpiry(ctx *agentctx.AgentContext, now time.Time, grace time.Duration) (graced bool, err error) {
+	raw := strings.TrimSpace(ctx.MetadataString("token_expires_at"))
+	if raw == "" {
+		return false, nil
+	}
+	expires, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return false, fmt.Errorf("bad token_expires_at: %w", err)
+	}
+	if now.Before(expires) {
+		return false, nil
+	}
+	if now.Before(expires.Add(grace)) {
+		return true, nil
+	}
+	return false, fmt.Errorf("token expired at %s", expires.Format(time.RFC3339))
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// toolDefinitionTokens estimates the prompt tokens spent on the tool
+// definitions in outReq's body: the "tools" (OpenAI and Anthropic) and
+// legacy "functions" fields, at four characters per token of their JSON.
+func toolDefinitionTokens(outReq *http.Request) int {
+	if outReq.GetBody == nil {
+		return 0
+	}
+	body, err := outReq.GetBody()
+	if err != nil {
+		return 0
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return 0
+	}
+	var req struct {
+		Tools     json.RawMessage `json:"tools"`
+		Functions json.RawMessage `json:"functions"`
+	}
+	if json.Unmarshal(raw, &req) != nil {
+		return 0
+	}
+	var chars int
+	for _, defs := range []json.RawMessage{req.Tools, req.Functions} {
+		if string(defs) != "null" {
+			chars += len(defs)
+		}
+	}
+	return (chars + 3) / 4
+}
@@ -1,16 +1,26 @@
 package ui
 
 import (
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mostlydev/cllama/internal/agentctx"
 	"github.com/mostlydev/cllama/internal/cost"
+	"github.com/mostlydev/cllama/internal/identity"
+	"github.com/mostlydev/cllama/internal/logging"
 	"github.com/mostlydev/cllama/internal/provider"
 )
 
@@ -35,11 +45,50 @@ func WithContextRoot(root string) UIOption {
 	}
 }
 
+// WithTokenUnit sets the token count the costs page quotes effective prices
+// per, such as cost.PerThousand; the default is cost.PerMillion.
+func WithTokenUnit(unit int) UIOption {
+	return func(h *Handler) {
+		if unit > 0 {
+			h.tokenUnit = unit
+		}
+	}
+}
+
+// WithAdminToken enables the operator endpoints for requests bearing token:
+// GET /providers/{name}/reveal, which returns a provider's full API key, and
+// POST /agents and DELETE /agents/{id}, which provision agents under the
+// context root. Without a token they are disabled, and keys are only ever
+// shown masked.
+func WithAdminToken(token string) UIOption {
+	return func(h *Handler) {
+		h.adminToken = strings.TrimSpace(token)
+	}
+}
+
+// WithPricing attaches the pricing table in effect, enabling /pricing/api.
+func WithPricing(p *cost.Pricing) UIOption {
+	return func(h *Handler) {
+		h.pricing = p
+	}
+}
+
+// WithLogger sets the structured logger used to audit provider changes.
+func WithLogger(logger *logging.Logger) UIOption {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
 type Handler struct {
 	registry    *provider.Registry
 	accumulator *cost.Accumulator
 	contextRoot string
+	logger      *logging.Logger
 	tpl         *template.Template
+	tokenUnit   int
+	adminToken  string
+	pricing     *cost.Pricing
 }
 
 type providerRow struct {
@@ -60,63 +109,141 @@ type costsPageData struct {
 	TotalCostUSD  float64
 	TotalRequests int
 	TotalTokens   int
+	UnitLabel     string // token unit the CostPerUnit columns are quoted per, e.g. "1K"
+	Providers     []providerCostRow
 	Agents        []agentCostRow
 }
 
+type providerCostRow struct {
+	Provider    string
+	Requests    int
+	TokensIn    int
+	TokensOut   int
+	CostUSD     float64
+	CostPerUnit float64
+}
+
 type agentCostRow struct {
 	AgentID        string
 	TotalRequests  int
 	TotalTokensIn  int
 	TotalTokensOut int
 	TotalCostUSD   float64
+	CostPerUnit    float64
+	LastSeen       time.Time
 	Models         []modelCostRow
 }
 
 type modelCostRow struct {
-	Provider  string
-	Model     string
-	Requests  int
-	TokensIn  int
-	TokensOut int
-	CostUSD   float64
+	Provider    string
+	Model       string
+	Requests    int
+	TokensIn    int
+	TokensOut   int
+	CostUSD     float64
+	CostPerUnit float64
+	LastSeen    time.Time
 }
 
 // -- pod page types --
 
 type podPageData struct {
-	PodName string
-	Members []podMemberRow
+	PodName    string
+	Members    []podMemberRow
+	LoadErrors []string
 }
 
 type podMemberRow struct {
-	AgentID       string
-	Service       string
-	Type          string
-	TotalRequests int
-	TotalCostUSD  float64
-	Models        []string // models seen in live traffic
+	AgentID        string
+	Service        string
+	Type           string
+	TotalRequests  int
+	TotalTokensIn  int
+	TotalTokensOut int
+	TotalCostUSD   float64
+	Models         []string // models seen in live traffic
+}
+
+// -- pricing API types --
+
+type pricingAPIResponse struct {
+	MinChargeUSD float64                            `json:"min_charge_usd"`
+	RoundToCents bool                               `json:"round_to_cents"`
+	Providers    map[string]pricingProviderResponse `json:"providers"`
+}
+
+type pricingProviderResponse struct {
+	Free        bool                    `json:"free,omitempty"`
+	Models      map[string]pricingModel `json:"models"`
+	MonthlyCaps map[string]float64      `json:"monthly_caps_usd,omitempty"`
+}
+
+type pricingModel struct {
+	InputPerMTok  float64 `json:"input_per_mtok"`
+	OutputPerMTok float64 `json:"output_per_mtok"`
+}
+
+// -- agents API types --
+
+type agentsAPIResponse struct {
+	Pod        string             `json:"pod,omitempty"`
+	Agents     []agentAPIListItem `json:"agents"`
+	LoadErrors []string           `json:"load_errors,omitempty"`
+}
+
+type agentAPIListItem struct {
+	AgentID       string   `json:"agent_id"`
+	Service       string   `json:"service,omitempty"`
+	Type          string   `json:"type,omitempty"`
+	TotalRequests int      `json:"total_requests"`
+	TotalCostUSD  float64  `json:"total_cost_usd"`
+	Models        []string `json:"models"`
 }
 
 // -- costs API types --
 
 type costsAPIResponse struct {
-	TotalCostUSD float64                     `json:"total_cost_usd"`
-	Agents       map[string]agentAPIResponse `json:"agents"`
+	Since        string                         `json:"since,omitempty"`
+	Until        string                         `json:"until,omitempty"`
+	TotalCostUSD float64                        `json:"total_cost_usd"`
+	Providers    map[string]providerAPIResponse `json:"providers"`
+	Agents       map[string]agentAPIResponse    `json:"agents"`
+	Tag          string                         `json:"tag,omitempty"`
+	Tags         map[string]agentAPIResponse    `json:"tags,omitempty"`
+}
+
+type providerAPIResponse struct {
+	TotalCostUSD  float64 `json:"total_cost_usd"`
+	TotalRequests int     `json:"total_requests"`
+	InputTokens   int     `json:"input_tokens"`
+	OutputTokens  int     `json:"output_tokens"`
 }
 
 type agentAPIResponse struct {
-	TotalCostUSD  float64            `json:"total_cost_usd"`
-	TotalRequests int                `json:"total_requests"`
-	Models        []modelAPIResponse `json:"models"`
+	TotalCostUSD  float64                     `json:"total_cost_usd"`
+	TotalRequests int                         `json:"total_requests"`
+	LastSeen      string                      `json:"last_seen,omitempty"`
+	Models        []modelAPIResponse          `json:"models"`
+	Sessions      map[string]agentAPIResponse `json:"sessions,omitempty"`
 }
 
 type modelAPIResponse struct {
-	Provider    string  `json:"provider"`
-	Model       string  `json:"model"`
-	InputTokens int     `json:"input_tokens"`
-	OutputTokens int    `json:"output_tokens"`
-	CostUSD     float64 `json:"cost_usd"`
-	Requests    int     `json:"requests"`
+	Provider     string  `json:"provider"`
+	Model        string  `json:"model"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd"`
+	Requests     int     `json:"requests"`
+	// Body bytes sent upstream and relayed back; only on the per-agent
+	// views, as sessions and tags are not tracked by size.
+	RequestBytes  int64 `json:"request_bytes,omitempty"`
+	ResponseBytes int64 `json:"response_bytes,omitempty"`
+	// Tool calls answered and the estimated tokens of tool definitions and
+	// calls, a breakdown of the token counts above; per-agent views only.
+	ToolCalls  int    `json:"tool_calls,omitempty"`
+	ToolTokens int    `json:"tool_tokens,omitempty"`
+	FirstSeen  string `json:"first_seen,omitempty"`
+	LastSeen   string `json:"last_seen,omitempty"`
 }
 
 func NewHandler(reg *provider.Registry, opts ...UIOption) http.Handler {
@@ -124,10 +251,13 @@ func NewHandler(reg *provider.Registry, opts ...UIOption) http.Handler {
 		reg = provider.NewRegistry("")
 	}
 	tpl := template.Must(template.ParseFS(templateFS, "templates/*.html"))
-	h := &Handler{registry: reg, tpl: tpl}
+	h := &Handler{registry: reg, tpl: tpl, tokenUnit: cost.PerMillion}
 	for _, o := range opts {
 		o(h)
 	}
+	if h.logger == nil {
+		h.logger = logging.New(io.Discard, logging.FormatJSON)
+	}
 	return h
 }
 
@@ -139,14 +269,41 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case r.Method == http.MethodPost && r.URL.Path == "/providers":
 		h.handleProviderUpdate(w, r)
 		return
+	case r.Method == http.MethodGet && r.URL.Path == "/providers/known":
+		h.handleKnownProviders(w)
+		return
+	case r.Method == http.MethodGet && r.URL.Path == "/providers/export":
+		h.handleProviderExport(w)
+		return
+	case r.Method == http.MethodPost && r.URL.Path == "/providers/import":
+		h.handleProviderImport(w, r)
+		return
 	case r.Method == http.MethodGet && r.URL.Path == "/pod":
 		h.renderPod(w)
 		return
+	case r.Method == http.MethodPost && r.URL.Path == "/pod/reload":
+		h.handlePodReload(w)
+		return
+	case r.Method == http.MethodGet && r.URL.Path == "/agents/api":
+		h.handleAgentsAPI(w, r)
+		return
 	case r.Method == http.MethodGet && r.URL.Path == "/costs":
 		h.renderCosts(w)
 		return
 	case r.Method == http.MethodGet && r.URL.Path == "/costs/api":
-		h.handleCostsAPI(w)
+		h.handleCostsAPI(w, r)
+		return
+	case r.Method == http.MethodGet && r.URL.Path == "/pricing/api":
+		h.handlePricingAPI(w, r)
+		return
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/providers/") && strings.HasSuffix(r.URL.Path, "/reveal"):
+		h.handleProviderReveal(w, r)
+		return
+	case r.Method == http.MethodPost && r.URL.Path == "/agents":
+		h.handleAgentCreate(w, r)
+		return
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/agents/"):
+		h.handleAgentDelete(w, r)
 		return
 	default:
 		http.NotFound(w, r)
@@ -154,6 +311,40 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// adminAuthorized gates the operator endpoints: they do not exist without
+// an admin token, and answer 401 to requests that do not bear it.
+func (h *Handler) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if h.adminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(presented)), []byte(h.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="cllama"`)
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleProviderReveal returns one provider's unmasked API key to an
+// operator presenting the admin token. Every reveal is logged, with the
+// key masked.
+func (h *Handler) handleProviderReveal(w http.ResponseWriter, r *http.Request) {
+	if !h.adminAuthorized(w, r) {
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/providers/"), "/reveal")
+	p, err := h.registry.Get(strings.ToLower(name))
+	if err != nil {
+		http.Error(w, "unknown provider", http.StatusNotFound)
+		return
+	}
+	h.logger.LogProviderChange("reveal", p.Name, maskKey(p.APIKey))
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]string{"name": p.Name, "api_key": p.APIKey})
+}
+
 func (h *Handler) handleProviderUpdate(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		h.renderIndex(w, "invalid form body", http.StatusBadRequest)
@@ -169,19 +360,35 @@ func (h *Handler) handleProviderUpdate(w http.ResponseWriter, r *http.Request) {
 	action := strings.ToLower(strings.TrimSpace(r.FormValue("action")))
 	switch action {
 	case "delete":
-		h.registry.Delete(name)
+		var maskedKey string
+		if p, err := h.registry.Get(name); err == nil {
+			maskedKey = maskKey(p.APIKey)
+		}
+		if h.registry.Delete(name) {
+			h.logger.LogProviderChange("delete", name, maskedKey)
+		}
 	default:
 		baseURL := strings.TrimSpace(r.FormValue("base_url"))
 		auth := strings.ToLower(strings.TrimSpace(r.FormValue("auth")))
+		if err := provider.ValidateAuth(auth); err != nil {
+			h.renderIndex(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if auth == "" {
 			auth = "bearer"
 		}
-		h.registry.Set(name, &provider.Provider{
-			Name:    name,
-			BaseURL: baseURL,
-			APIKey:  strings.TrimSpace(r.FormValue("api_key")),
-			Auth:    auth,
-		})
+		// The form only carries these fields; keep everything else an
+		// existing provider has (blocked_models, signing_secret, pricing...).
+		p := &provider.Provider{}
+		if existing, err := h.registry.Get(name); err == nil {
+			p = existing
+		}
+		p.Name = name
+		p.BaseURL = baseURL
+		p.APIKey = strings.TrimSpace(r.FormValue("api_key"))
+		p.Auth = auth
+		h.registry.Set(name, p)
+		h.logger.LogProviderChange("upsert", name, maskKey(r.FormValue("api_key")))
 	}
 
 	if err := h.registry.SaveToFile(); err != nil {
@@ -192,6 +399,166 @@ func (h *Handler) handleProviderUpdate(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// handleKnownProviders lists the built-in providers and their default base
+// URL, auth and API format, for prefilling the add-provider form.
+func (h *Handler) handleKnownProviders(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, struct {
+		Providers []provider.Provider `json:"providers"`
+	}{Providers: provider.Known()})
+}
+
+// handleProviderExport returns the registry in providers.json shape so it can
+// be copied to another instance. API keys are always masked.
+func (h *Handler) handleProviderExport(w http.ResponseWriter) {
+	all := h.registry.All()
+	providers := make(map[string]provider.Provider, len(all))
+	for name, p := range all {
+		providers[name] = provider.Provider{
+			BaseURL:             p.BaseURL,
+			APIKey:              maskKey(p.APIKey),
+			Auth:                p.Auth,
+			APIFormat:           p.APIFormat,
+			DefaultModel:        p.DefaultModel,
+			Pricing:             p.Pricing,
+			Free:                p.Free,
+			StatusMap:           p.StatusMap,
+			NormalizeModelCase:  p.NormalizeModelCase,
+			QueryParams:         p.QueryParams,
+			OverrideQueryParams: p.OverrideQueryParams,
+			InsecureSkipVerify:  p.InsecureSkipVerify,
+			MaxResponseBytes:    p.MaxResponseBytes,
+			BlockedModels:       p.BlockedModels,
+			SigningSecret:       maskKey(p.SigningSecret),
+			SigningHeader:       p.SigningHeader,
+			BaseURLs:            p.BaseURLs,
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Providers map[string]provider.Provider `json:"providers"`
+	}{Providers: providers})
+}
+
+type importResponse struct {
+	Imported []string          `json:"imported"`
+	Errors   map[string]string `json:"errors,omitempty"`
+}
+
+// handleProviderImport merges a providers.json body into the registry.
+// Each entry is validated independently; invalid entries are reported
+// without blocking the valid ones. A masked key matching the existing
+// provider's key (as produced by /providers/export) keeps the stored key.
+func (h *Handler) handleProviderImport(w http.ResponseWriter, r *http.Request) {
+	var cfg struct {
+		Providers map[string]provider.Provider `json:"providers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&cfg); err != nil {
+		writeJSON(w, http.StatusBadRequest, importResponse{Errors: map[string]string{"": "invalid JSON: " + err.Error()}})
+		return
+	}
+
+	names := make([]string, 0, len(cfg.Providers))
+	for name := range cfg.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp := importResponse{Imported: []string{}, Errors: map[string]string{}}
+	for _, rawName := range names {
+		name := strings.ToLower(strings.TrimSpace(rawName))
+		p := cfg.Providers[rawName]
+		if err := validateImportedProvider(name, &p); err != nil {
+			resp.Errors[rawName] = err.Error()
+			continue
+		}
+		if existing, err := h.registry.Get(name); err == nil {
+			if p.APIKey != "" && p.APIKey == maskKey(existing.APIKey) {
+				p.APIKey = existing.APIKey
+			}
+			if p.SigningSecret != "" && p.SigningSecret == maskKey(existing.SigningSecret) {
+				p.SigningSecret = existing.SigningSecret
+			}
+		}
+		// A masked value that matched no stored key came from another
+		// instance's export; saving it would replace a key with its mask.
+		if looksMasked(p.APIKey) {
+			resp.Errors[rawName] = "api_key is a masked export value with no matching stored key; supply the real key"
+			continue
+		}
+		if looksMasked(p.SigningSecret) {
+			resp.Errors[rawName] = "signing_secret is a masked export value with no matching stored secret; supply the real secret"
+			continue
+		}
+		h.registry.Set(name, &p)
+		h.logger.LogProviderChange("import", name, maskKey(p.APIKey))
+		resp.Imported = append(resp.Imported, name)
+	}
+
+	if len(resp.Imported) > 0 {
+		if err := h.registry.SaveToFile(); err != nil {
+			resp.Errors[""] = "failed to persist providers.json: " + err.Error()
+			writeJSON(w, http.StatusInternalServerError, resp)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if len(resp.Imported) == 0 && len(resp.Errors) > 0 {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, resp)
+}
+
+func validateImportedProvider(name string, p *provider.Provider) error {
+	if name == "" {
+		return fmt.Errorf("provider name is required")
+	}
+	p.Name = name
+	p.BaseURL = strings.TrimSpace(p.BaseURL)
+	p.APIKey = strings.TrimSpace(p.APIKey)
+	p.Auth = strings.ToLower(strings.TrimSpace(p.Auth))
+	p.APIFormat = strings.ToLower(strings.TrimSpace(p.APIFormat))
+
+	if p.BaseURL == "" && provider.KnownBaseURL(name) == "" {
+		return fmt.Errorf("base_url is required for unknown provider %q", name)
+	}
+	if p.BaseURL != "" {
+		u, err := url.Parse(p.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("base_url must be an absolute http(s) URL")
+		}
+	}
+	for _, raw := range p.BaseURLs {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("base_urls entries must be absolute http(s) URLs")
+		}
+	}
+	if err := provider.ValidateAuth(p.Auth); err != nil {
+		return err
+	}
+	if err := provider.ValidateStatusMap(p.StatusMap); err != nil {
+		return err
+	}
+	if p.MaxResponseBytes < 0 {
+		return fmt.Errorf("max_response_bytes must not be negative")
+	}
+	switch p.APIFormat {
+	case "", "openai", "anthropic":
+	default:
+		return fmt.Errorf("unsupported api_format %q (want openai or anthropic)", p.APIFormat)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
 func (h *Handler) renderIndex(w http.ResponseWriter, errText string, status int) {
 	all := h.registry.All()
 	names := make([]string, 0, len(all))
@@ -222,14 +589,142 @@ func (h *Handler) renderCosts(w http.ResponseWriter) {
 	_ = h.tpl.ExecuteTemplate(w, "costs.html", data)
 }
 
-func (h *Handler) handleCostsAPI(w http.ResponseWriter) {
-	resp := h.buildCostsAPIResponse()
+func (h *Handler) handleCostsAPI(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupBy := q.Get("group_by")
+	tagKey, byTag := strings.CutPrefix(groupBy, "tag:")
+	tagKey = strings.ToLower(strings.TrimSpace(tagKey))
+	if groupBy != "" && groupBy != "session" && (!byTag || tagKey == "") {
+		http.Error(w, "unsupported group_by (want: session or tag:<key>)", http.StatusBadRequest)
+		return
+	}
+
+	if wantsPrometheus(r) {
+		if groupBy != "" || q.Get("since") != "" {
+			http.Error(w, "the prometheus format has lifetime totals only; drop group_by and since", http.StatusBadRequest)
+			return
+		}
+		if h.notModified(w, r, "prom") {
+			return
+		}
+		w.Header().Set("Content-Type", cost.PrometheusContentType)
+		if h.accumulator != nil {
+			cost.WritePrometheus(w, h.accumulator.All())
+		}
+		return
+	}
+
+	var resp costsAPIResponse
+	if raw := q.Get("since"); raw != "" {
+		if groupBy != "" {
+			http.Error(w, "since cannot be combined with group_by", http.StatusBadRequest)
+			return
+		}
+		since, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		resp, err = h.buildCostsAPIDelta(since)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		resp = h.buildCostsAPIResponse()
+	}
+	if groupBy == "session" {
+		h.addSessionBreakdown(&resp)
+	}
+	if byTag {
+		h.addTagBreakdown(&resp, tagKey)
+	}
+
+	if h.notModified(w, r, "json") {
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	enc := json.NewEncoder(w)
 	enc.SetIndent("", "  ")
 	_ = enc.Encode(resp)
 }
 
+// notModified sets ETag and Last-Modified from the accumulator's version and
+// answers 304 when the poller's If-None-Match (or, without one,
+// If-Modified-Since) shows it already has this state. kind tells apart the
+// formats served from the same URL. The response may be cached but must be
+// revalidated, so browsers can send the conditional requests too.
+func (h *Handler) notModified(w http.ResponseWriter, r *http.Request, kind string) bool {
+	if h.accumulator == nil {
+		return false
+	}
+	version, modified := h.accumulator.Version()
+	etag := fmt.Sprintf(`"%d-%s"`, version, kind)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == etag || tag == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// wantsPrometheus reports whether a /costs/api request asked for the
+// Prometheus exposition format, by ?format=prometheus or an Accept header
+// ranking text/plain or application/openmetrics-text above JSON, as
+// Prometheus scrapers send. Clients that accept both equally, like the
+// "application/json, text/plain, */*" of common HTTP libraries, get JSON.
+func wantsPrometheus(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "prometheus"
+	}
+	q := acceptQualities(r.Header.Get("Accept"))
+	text := max(q["text/plain"], q["application/openmetrics-text"])
+	jsonQ, ok := q["application/json"]
+	if !ok {
+		jsonQ = max(q["application/*"], q["*/*"])
+	}
+	return text > jsonQ
+}
+
+// acceptQualities maps each media range in an Accept header to its q value,
+// 1 when absent.
+func acceptQualities(accept string) map[string]float64 {
+	q := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		media, params, _ := strings.Cut(part, ";")
+		media = strings.ToLower(strings.TrimSpace(media))
+		if media == "" {
+			continue
+		}
+		quality := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.TrimSpace(k) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					quality = f
+				}
+			}
+		}
+		q[media] = max(q[media], quality)
+	}
+	return q
+}
+
 func (h *Handler) buildCostsPageData() costsPageData {
 	if h.accumulator == nil {
 		return costsPageData{}
@@ -251,15 +746,21 @@ func (h *Handler) buildCostsPageData() costsPageData {
 			row.TotalTokensIn += e.TotalInputTokens
 			row.TotalTokensOut += e.TotalOutputTokens
 			row.TotalCostUSD += e.TotalCostUSD
+			if e.LastSeen.After(row.LastSeen) {
+				row.LastSeen = e.LastSeen
+			}
 			row.Models = append(row.Models, modelCostRow{
-				Provider:  e.Provider,
-				Model:     e.Model,
-				Requests:  e.RequestCount,
-				TokensIn:  e.TotalInputTokens,
-				TokensOut: e.TotalOutputTokens,
-				CostUSD:   e.TotalCostUSD,
+				Provider:    e.Provider,
+				Model:       e.Model,
+				Requests:    e.RequestCount,
+				TokensIn:    e.TotalInputTokens,
+				TokensOut:   e.TotalOutputTokens,
+				CostUSD:     e.TotalCostUSD,
+				CostPerUnit: cost.CostPer(e.TotalCostUSD, e.TotalInputTokens+e.TotalOutputTokens, h.tokenUnit),
+				LastSeen:    e.LastSeen,
 			})
 		}
+		row.CostPerUnit = cost.CostPer(row.TotalCostUSD, row.TotalTokensIn+row.TotalTokensOut, h.tokenUnit)
 		agents = append(agents, row)
 	}
 
@@ -269,30 +770,159 @@ func (h *Handler) buildCostsPageData() costsPageData {
 		totalToks += a.TotalTokensIn + a.TotalTokensOut
 	}
 
+	providers := providerTotals(grouped)
+	for i := range providers {
+		p := &providers[i]
+		p.CostPerUnit = cost.CostPer(p.CostUSD, p.TokensIn+p.TokensOut, h.tokenUnit)
+	}
+
 	return costsPageData{
 		TotalCostUSD:  h.accumulator.TotalCost(),
 		TotalRequests: totalReqs,
 		TotalTokens:   totalToks,
+		UnitLabel:     tokenUnitLabel(h.tokenUnit),
+		Providers:     providers,
 		Agents:        agents,
 	}
 }
 
+// tokenUnitLabel names a token unit for column headings: "1K", "1M", or the
+// plain count for anything else.
+func tokenUnitLabel(unit int) string {
+	switch unit {
+	case cost.PerThousand:
+		return "1K"
+	case cost.PerMillion:
+		return "1M"
+	}
+	return fmt.Sprint(unit)
+}
+
+// providerTotals sums spend per provider across all agents, largest first.
+func providerTotals(grouped map[string][]cost.CostEntry) []providerCostRow {
+	byName := make(map[string]*providerCostRow)
+	for _, entries := range grouped {
+		for _, e := range entries {
+			row, ok := byName[e.Provider]
+			if !ok {
+				row = &providerCostRow{Provider: e.Provider}
+				byName[e.Provider] = row
+			}
+			row.Requests += e.RequestCount
+			row.TokensIn += e.TotalInputTokens
+			row.TokensOut += e.TotalOutputTokens
+			row.CostUSD += e.TotalCostUSD
+		}
+	}
+	out := make([]providerCostRow, 0, len(byName))
+	for _, row := range byName {
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].CostUSD != out[j].CostUSD {
+			return out[i].CostUSD > out[j].CostUSD
+		}
+		return out[i].Provider < out[j].Provider
+	})
+	return out
+}
+
 func (h *Handler) buildCostsAPIResponse() costsAPIResponse {
 	resp := costsAPIResponse{
-		Agents: make(map[string]agentAPIResponse),
+		Providers: make(map[string]providerAPIResponse),
+		Agents:    make(map[string]agentAPIResponse),
 	}
 	if h.accumulator == nil {
 		return resp
 	}
 
 	resp.TotalCostUSD = h.accumulator.TotalCost()
-	grouped := h.accumulator.All()
+	addAgentCosts(&resp, h.accumulator.All())
+	return resp
+}
+
+// buildCostsAPIDelta reports only cost recorded in the whole windows between
+// since and the one still open, whose start is returned as until for the
+// poller's next since.
+func (h *Handler) buildCostsAPIDelta(since time.Time) (costsAPIResponse, error) {
+	resp := costsAPIResponse{
+		Since:     since.UTC().Format(time.RFC3339),
+		Providers: make(map[string]providerAPIResponse),
+		Agents:    make(map[string]agentAPIResponse),
+	}
+	if h.accumulator == nil {
+		return resp, nil
+	}
+	grouped, until, err := h.accumulator.Since(since)
+	if err != nil {
+		return resp, err
+	}
+	resp.Until = until.UTC().Format(time.RFC3339)
+	addAgentCosts(&resp, grouped)
+	for _, agent := range resp.Agents {
+		resp.TotalCostUSD += agent.TotalCostUSD
+	}
+	return resp, nil
+}
+
+func addAgentCosts(resp *costsAPIResponse, grouped map[string][]cost.CostEntry) {
 	for id, entries := range grouped {
 		agent := agentAPIResponse{}
+		var lastSeen time.Time
 		for _, e := range entries {
 			agent.TotalRequests += e.RequestCount
 			agent.TotalCostUSD += e.TotalCostUSD
+			if e.LastSeen.After(lastSeen) {
+				lastSeen = e.LastSeen
+			}
 			agent.Models = append(agent.Models, modelAPIResponse{
+				Provider:      e.Provider,
+				Model:         e.Model,
+				InputTokens:   e.TotalInputTokens,
+				OutputTokens:  e.TotalOutputTokens,
+				CostUSD:       e.TotalCostUSD,
+				Requests:      e.RequestCount,
+				RequestBytes:  e.RequestBytes,
+				ResponseBytes: e.ResponseBytes,
+				ToolCalls:     e.ToolCallCount,
+				ToolTokens:    e.ToolTokens,
+				FirstSeen:     formatSeen(e.FirstSeen),
+				LastSeen:      formatSeen(e.LastSeen),
+			})
+		}
+		agent.LastSeen = formatSeen(lastSeen)
+		resp.Agents[id] = agent
+	}
+	for _, p := range providerTotals(grouped) {
+		resp.Providers[p.Provider] = providerAPIResponse{
+			TotalCostUSD:  p.CostUSD,
+			TotalRequests: p.Requests,
+			InputTokens:   p.TokensIn,
+			OutputTokens:  p.TokensOut,
+		}
+	}
+}
+
+func formatSeen(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// addSessionBreakdown nests per-session totals under each agent.
+func (h *Handler) addSessionBreakdown(resp *costsAPIResponse) {
+	if h.accumulator == nil {
+		return
+	}
+	for id, entries := range h.accumulator.Sessions() {
+		agent := resp.Agents[id]
+		agent.Sessions = make(map[string]agentAPIResponse)
+		for _, e := range entries {
+			sess := agent.Sessions[e.Session]
+			sess.TotalRequests += e.RequestCount
+			sess.TotalCostUSD += e.TotalCostUSD
+			sess.Models = append(sess.Models, modelAPIResponse{
 				Provider:     e.Provider,
 				Model:        e.Model,
 				InputTokens:  e.TotalInputTokens,
@@ -300,10 +930,76 @@ func (h *Handler) buildCostsAPIResponse() costsAPIResponse {
 				CostUSD:      e.TotalCostUSD,
 				Requests:     e.RequestCount,
 			})
+			agent.Sessions[e.Session] = sess
 		}
 		resp.Agents[id] = agent
 	}
-	return resp
+}
+
+// addTagBreakdown adds the spend of requests tagged with key, across
+// agents, keyed by the tag's value.
+func (h *Handler) addTagBreakdown(resp *costsAPIResponse, key string) {
+	resp.Tag = key
+	resp.Tags = make(map[string]agentAPIResponse)
+	if h.accumulator == nil {
+		return
+	}
+	for value, entries := range h.accumulator.ByTag(key) {
+		var group agentAPIResponse
+		for _, e := range entries {
+			group.TotalRequests += e.RequestCount
+			group.TotalCostUSD += e.TotalCostUSD
+			group.Models = append(group.Models, modelAPIResponse{
+				Provider:     e.Provider,
+				Model:        e.Model,
+				InputTokens:  e.TotalInputTokens,
+				OutputTokens: e.TotalOutputTokens,
+				CostUSD:      e.TotalCostUSD,
+				Requests:     e.RequestCount,
+			})
+		}
+		resp.Tags[value] = group
+	}
+}
+
+// handlePricingAPI returns the rates the proxy is charging with: the
+// built-in table after providers.json pricing, free providers and monthly
+// caps have been applied. It holds no keys.
+func (h *Handler) handlePricingAPI(w http.ResponseWriter, r *http.Request) {
+	if h.pricing == nil {
+		http.NotFound(w, r)
+		return
+	}
+	resp := pricingAPIResponse{
+		MinChargeUSD: h.pricing.MinChargeUSD,
+		RoundToCents: h.pricing.RoundToCents,
+		Providers:    make(map[string]pricingProviderResponse),
+	}
+	entry := func(name string) pricingProviderResponse {
+		p, ok := resp.Providers[name]
+		if !ok {
+			p.Models = make(map[string]pricingModel)
+		}
+		return p
+	}
+	for name, models := range h.pricing.Rates() {
+		p := entry(name)
+		for model, rate := range models {
+			p.Models[model] = pricingModel{InputPerMTok: rate.InputPerMTok, OutputPerMTok: rate.OutputPerMTok}
+		}
+		resp.Providers[name] = p
+	}
+	for _, name := range h.pricing.FreeProviders() {
+		p := entry(name)
+		p.Free = true
+		resp.Providers[name] = p
+	}
+	for name, caps := range h.pricing.MonthlyCaps() {
+		p := entry(name)
+		p.MonthlyCaps = caps
+		resp.Providers[name] = p
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 func (h *Handler) renderPod(w http.ResponseWriter) {
@@ -312,21 +1008,143 @@ func (h *Handler) renderPod(w http.ResponseWriter) {
 	_ = h.tpl.ExecuteTemplate(w, "pod.html", data)
 }
 
+// handlePodReload re-scans the context root and reports how many agents it
+// now holds, for deployments that add agents at runtime. Nothing is cached
+// between renders today, so this is the same scan the pod views do; it gives
+// automation one place to ask for a fresh view, and any cache added later
+// must be cleared here.
+func (h *Handler) handlePodReload(w http.ResponseWriter) {
+	data := h.buildPodPageData()
+	loadErrors := data.LoadErrors
+	if loadErrors == nil {
+		loadErrors = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"members":     len(data.Members),
+		"load_errors": loadErrors,
+	})
+}
+
+// agentCreateRequest is the body of POST /agents.
+type agentCreateRequest struct {
+	AgentID     string         `json:"agent_id"`
+	AgentsMD    string         `json:"agents_md"`
+	ClawdapusMD string         `json:"clawdapus_md"`
+	Metadata    map[string]any `json:"metadata"`
+}
+
+// handleAgentCreate provisions an agent under the context root, for
+// operators without filesystem access to it. IDs must pass the same check
+// bearer tokens do, so the new agent can authenticate.
+func (h *Handler) handleAgentCreate(w http.ResponseWriter, r *http.Request) {
+	if !h.adminAuthorized(w, r) {
+		return
+	}
+	if h.contextRoot == "" {
+		http.Error(w, "no context root configured", http.StatusServiceUnavailable)
+		return
+	}
+	var req agentCreateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := identity.ValidateAgentID(req.AgentID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := agentctx.Create(h.contextRoot, &agentctx.AgentContext{
+		AgentID:     req.AgentID,
+		AgentsMD:    []byte(req.AgentsMD),
+		ClawdapusMD: []byte(req.ClawdapusMD),
+		Metadata:    req.Metadata,
+	})
+	switch {
+	case errors.Is(err, agentctx.ErrAgentExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"agent_id": req.AgentID})
+}
+
+// handleAgentDelete removes an agent's context directory. Its recorded
+// spend is kept.
+func (h *Handler) handleAgentDelete(w http.ResponseWriter, r *http.Request) {
+	if !h.adminAuthorized(w, r) {
+		return
+	}
+	if h.contextRoot == "" {
+		http.Error(w, "no context root configured", http.StatusServiceUnavailable)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/agents/")
+	if err := identity.ValidateAgentID(id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := agentctx.Remove(h.contextRoot, id)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "unknown agent", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAgentsAPI is the JSON form of the pod page for automation. When an
+// admin token is configured it must be presented.
+func (h *Handler) handleAgentsAPI(w http.ResponseWriter, r *http.Request) {
+	if h.adminToken != "" && !h.adminAuthorized(w, r) {
+		return
+	}
+	data := h.buildPodPageData()
+	resp := agentsAPIResponse{
+		Pod:        data.PodName,
+		Agents:     make([]agentAPIListItem, 0, len(data.Members)),
+		LoadErrors: data.LoadErrors,
+	}
+	for _, m := range data.Members {
+		models := m.Models
+		if models == nil {
+			models = []string{}
+		}
+		resp.Agents = append(resp.Agents, agentAPIListItem{
+			AgentID:       m.AgentID,
+			Service:       m.Service,
+			Type:          m.Type,
+			TotalRequests: m.TotalRequests,
+			TotalCostUSD:  m.TotalCostUSD,
+			Models:        models,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 func (h *Handler) buildPodPageData() podPageData {
 	var members []podMemberRow
 	var podName string
+	var loadErrors []string
 
 	if h.contextRoot != "" {
-		agents, err := agentctx.ListAgents(h.contextRoot)
+		agents, loadErrs, err := agentctx.ListAgentsWithErrors(h.contextRoot)
+		for _, le := range loadErrs {
+			loadErrors = append(loadErrors, redactTokens(le.Error()))
+		}
 		if err == nil {
 			for _, a := range agents {
 				if podName == "" && a.Pod != "" {
-					podName = a.Pod
+					podName = redactTokens(a.Pod)
 				}
 				m := podMemberRow{
 					AgentID: a.AgentID,
-					Service: a.Service,
-					Type:    a.Type,
+					Service: redactTokens(a.Service),
+					Type:    redactTokens(a.Type),
 				}
 
 				// merge live cost data if accumulator available
@@ -335,6 +1153,8 @@ func (h *Handler) buildPodPageData() podPageData {
 					seen := make(map[string]bool)
 					for _, e := range entries {
 						m.TotalRequests += e.RequestCount
+						m.TotalTokensIn += e.TotalInputTokens
+						m.TotalTokensOut += e.TotalOutputTokens
 						m.TotalCostUSD += e.TotalCostUSD
 						modelKey := fmt.Sprintf("%s/%s", e.Provider, e.Model)
 						if !seen[modelKey] {
@@ -353,7 +1173,38 @@ func (h *Handler) buildPodPageData() podPageData {
 		return members[i].AgentID < members[j].AgentID
 	})
 
-	return podPageData{PodName: podName, Members: members}
+	return podPageData{PodName: podName, Members: members, LoadErrors: loadErrors}
+}
+
+// maskToken hides the secret half of an agent bearer token ("agent:secret"
+// becomes "agent:****"); a token without an agent prefix is masked entirely.
+func maskToken(token string) string {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return ""
+	}
+	if agent, _, ok := strings.Cut(token, ":"); ok && agent != "" {
+		return agent + ":****"
+	}
+	return "****"
+}
+
+// tokenField matches a metadata "token" key and its value as it may appear
+// in raw JSON or YAML quoted back by an error message.
+var tokenField = regexp.MustCompile(`(?i)(\btoken["']?\s*[:=]\s*["']?)([^"'\s,}]+)`)
+
+// redactTokens masks any agent token value embedded in s. Everything the
+// pod views show that originates from agent metadata passes through here.
+func redactTokens(s string) string {
+	return tokenField.ReplaceAllStringFunc(s, func(m string) string {
+		parts := tokenField.FindStringSubmatch(m)
+		return parts[1] + maskToken(parts[2])
+	})
+}
+
+// looksMasked reports whether s has the shape maskKey produces.
+func looksMasked(s string) bool {
+	return s == "****" || len(s) == 11 && s[4:7] == "..."
 }
 
 func maskKey(key string) string {
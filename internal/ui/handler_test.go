@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -8,10 +9,14 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/mostlydev/cllama/internal/agentctx"
 	"github.com/mostlydev/cllama/internal/cost"
+	"github.com/mostlydev/cllama/internal/logging"
 	"github.com/mostlydev/cllama/internal/provider"
 )
 
@@ -69,6 +74,72 @@ func TestUIUpsertProvider(t *testing.T) {
 	}
 }
 
+func TestUIUpsertProviderKeepsOtherFields(t *testing.T) {
+	authDir := t.TempDir()
+	reg := provider.NewRegistry(authDir)
+	reg.Set("gateway", &provider.Provider{
+		Name: "gateway", BaseURL: "https://gw.example/v1", Auth: "hmac", SigningSecret: "s3cret",
+		BlockedModels: []string{"opus-*"}, BaseURLs: []string{"https://gw-eu.example/v1"}, MaxResponseBytes: 1 << 20,
+	})
+	h := NewHandler(reg)
+
+	form := url.Values{}
+	form.Set("name", "gateway")
+	form.Set("base_url", "https://gw2.example/v1")
+	form.Set("api_key", "sk-gw")
+	form.Set("auth", "hmac")
+	req := httptest.NewRequest(http.MethodPost, "/providers", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d body=%s", w.Code, w.Body.String())
+	}
+
+	// Reload from disk so fields SaveToFile drops would show up missing.
+	reloaded := provider.NewRegistry(authDir)
+	if err := reloaded.LoadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	p, err := reloaded.Get("gateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.BaseURL != "https://gw2.example/v1" || p.APIKey != "sk-gw" {
+		t.Errorf("expected form fields applied, got %+v", p)
+	}
+	if p.SigningSecret != "s3cret" || !reflect.DeepEqual(p.BlockedModels, []string{"opus-*"}) ||
+		!reflect.DeepEqual(p.BaseURLs, []string{"https://gw-eu.example/v1"}) || p.MaxResponseBytes != 1<<20 {
+		t.Errorf("expected fields outside the form kept, got %+v", p)
+	}
+}
+
+func TestUIUpsertProviderRejectsUnknownAuth(t *testing.T) {
+	authDir := t.TempDir()
+	reg := provider.NewRegistry(authDir)
+	h := NewHandler(reg)
+
+	form := url.Values{}
+	form.Set("name", "anthropic")
+	form.Set("api_key", "sk-ant-test")
+	form.Set("auth", "x_api_key")
+
+	req := httptest.NewRequest(http.MethodPost, "/providers", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "did you mean") {
+		t.Errorf("expected helpful error, got %s", w.Body.String())
+	}
+	if _, err := reg.Get("anthropic"); err == nil {
+		t.Error("invalid provider must not be saved")
+	}
+}
+
 func TestUIDeleteProvider(t *testing.T) {
 	reg := provider.NewRegistry(t.TempDir())
 	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKey: "sk-test", Auth: "bearer"})
@@ -93,6 +164,273 @@ func TestUIDeleteProvider(t *testing.T) {
 	}
 }
 
+func TestUIProviderExportMasksKeys(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKey: "sk-example-1234", Auth: "bearer"})
+	reg.Set("ollama", &provider.Provider{Name: "ollama", BaseURL: "http://ollama:11434/v1", Auth: "none"})
+	h := NewHandler(reg)
+
+	req := httptest.NewRequest(http.MethodGet, "/providers/export", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "sk-example-1234") {
+		t.Fatal("raw API key leaked in export")
+	}
+
+	var result struct {
+		Providers map[string]provider.Provider `json:"providers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if got := result.Providers["openai"]; got.APIKey != "sk-e...1234" || got.BaseURL != "https://api.openai.com/v1" || got.Auth != "bearer" {
+		t.Errorf("unexpected openai export: %+v", got)
+	}
+	if got := result.Providers["ollama"]; got.APIKey != "" || got.Auth != "none" {
+		t.Errorf("unexpected ollama export: %+v", got)
+	}
+}
+
+func TestUIProviderImport(t *testing.T) {
+	authDir := t.TempDir()
+	reg := provider.NewRegistry(authDir)
+	reg.Set("openai", &provider.Provider{Name: "openai", APIKey: "sk-example-1234", Auth: "bearer"})
+	h := NewHandler(reg)
+
+	body := `{"providers": {
+		"openai": {"api_key": "sk-e...1234"},
+		"ollama": {"base_url": "http://ollama:11434/v1", "auth": "none"}
+	}}`
+	req := httptest.NewRequest(http.MethodPost, "/providers/import", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d body=%s", w.Code, w.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(resp.Imported) != 2 || len(resp.Errors) != 0 {
+		t.Fatalf("unexpected import result: %+v", resp)
+	}
+
+	p, err := reg.Get("openai")
+	if err != nil || p.APIKey != "sk-example-1234" {
+		t.Errorf("expected masked key to keep the stored key, got %+v err=%v", p, err)
+	}
+	if p, err := reg.Get("ollama"); err != nil || p.Auth != "none" {
+		t.Errorf("expected ollama imported, got %+v err=%v", p, err)
+	}
+	data, err := os.ReadFile(filepath.Join(authDir, "providers.json"))
+	if err != nil || !strings.Contains(string(data), "ollama") {
+		t.Fatalf("expected import persisted, err=%v data=%s", err, data)
+	}
+}
+
+func TestUIProviderImportPartiallyInvalid(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	h := NewHandler(reg)
+
+	body := `{"providers": {
+		"good": {"base_url": "https://gateway.example/v1", "api_key": "sk-good"},
+		"typo": {"base_url": "https://gateway.example/v1", "auth": "x_api_key"},
+		"nourl": {"api_key": "sk-x"},
+		"relative": {"base_url": "/v1"},
+		"masked": {"base_url": "https://gateway.example/v1", "api_key": "sk-o...9876"},
+		"masked-secret": {"base_url": "https://gateway.example/v1", "auth": "hmac", "signing_secret": "****"}
+	}}`
+	req := httptest.NewRequest(http.MethodPost, "/providers/import", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 when some entries import, got %d body=%s", w.Code, w.Body.String())
+	}
+	var resp importResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(resp.Imported) != 1 || resp.Imported[0] != "good" {
+		t.Errorf("expected only 'good' imported, got %v", resp.Imported)
+	}
+	for _, name := range []string{"typo", "nourl", "relative", "masked", "masked-secret"} {
+		if resp.Errors[name] == "" {
+			t.Errorf("expected error reported for %q, got %v", name, resp.Errors)
+		}
+		if _, err := reg.Get(name); err == nil {
+			t.Errorf("expected invalid provider %q not to be registered", name)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/providers/import", strings.NewReader(`{"providers": {"typo": {"auth": "bogus"}}}`))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 when nothing imports, got %d", w.Code)
+	}
+}
+
+func TestUIProviderReveal(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	reg.Set("openai", &provider.Provider{Name: "openai", BaseURL: "https://api.openai.com/v1", APIKey: "sk-emergency-1234", Auth: "bearer"})
+
+	get := func(h http.Handler, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/providers/openai/reveal", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// Masked by default: without an admin token the endpoint does not exist.
+	if w := get(NewHandler(reg), "Bearer anything"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 with reveal disabled, got %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	NewHandler(reg, WithAdminToken("op-secret")).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if strings.Contains(w.Body.String(), "sk-emergency-1234") {
+		t.Fatal("expected the index page to keep keys masked")
+	}
+
+	var logs bytes.Buffer
+	h := NewHandler(reg, WithAdminToken("op-secret"), WithLogger(logging.New(&logs, logging.FormatJSON)))
+	for _, auth := range []string{"", "Bearer wrong"} {
+		if w := get(h, auth); w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "sk-emergency-1234") {
+			t.Fatalf("expected 401 without the admin token (auth %q), got %d: %s", auth, w.Code, w.Body.String())
+		}
+	}
+
+	w = get(h, "Bearer op-secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the admin token, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		APIKey string `json:"api_key"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.APIKey != "sk-emergency-1234" {
+		t.Fatalf("expected the full key, got %s", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), `"action":"reveal"`) || strings.Contains(logs.String(), "sk-emergency-1234") {
+		t.Errorf("expected a masked reveal audit entry, got %s", logs.String())
+	}
+
+	if w := get(h, "Bearer op-secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected repeat reveal to work, got %d", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/providers/nope/reveal", nil)
+	req.Header.Set("Authorization", "Bearer op-secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown provider, got %d", w.Code)
+	}
+}
+
+func TestUIAgentProvisioning(t *testing.T) {
+	root := t.TempDir()
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(root), WithAdminToken("op-secret"))
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	listed := func() []string {
+		agents, err := agentctx.ListAgents(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, a := range agents {
+			ids = append(ids, a.AgentID)
+		}
+		return ids
+	}
+
+	body := `{"agent_id":"tiverton","agents_md":"# Tiverton","clawdapus_md":"# Contract","metadata":{"token":"tiverton:secret","pod":"ops"}}`
+	if w := do(http.MethodPost, "/agents", body, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", w.Code)
+	}
+	if w := do(http.MethodPost, "/agents", body, "op-secret"); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if ids := listed(); !reflect.DeepEqual(ids, []string{"tiverton"}) {
+		t.Fatalf("expected ListAgents to show tiverton, got %v", ids)
+	}
+	if ctx, err := agentctx.Load(root, "tiverton"); err != nil || ctx.MetadataToken() != "tiverton:secret" {
+		t.Fatalf("expected the agent to load with its token, got %v %v", ctx, err)
+	}
+	if w := do(http.MethodPost, "/agents", body, "op-secret"); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for an existing agent, got %d", w.Code)
+	}
+	for _, id := range []string{"../etc", "Tiverton", ""} {
+		bad := `{"agent_id":"` + id + `"}`
+		if w := do(http.MethodPost, "/agents", bad, "op-secret"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for agent id %q, got %d", id, w.Code)
+		}
+	}
+
+	if w := do(http.MethodDelete, "/agents/tiverton", "", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a wrong token, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/agents/tiverton", "", "op-secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if ids := listed(); len(ids) != 0 {
+		t.Fatalf("expected no agents after delete, got %v", ids)
+	}
+	if w := do(http.MethodDelete, "/agents/tiverton", "", "op-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 deleting a missing agent, got %d", w.Code)
+	}
+	if w := do(http.MethodDelete, "/agents/..", "", "op-secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a traversal id, got %d", w.Code)
+	}
+}
+
+func TestUIKnownProviders(t *testing.T) {
+	h := NewHandler(provider.NewRegistry(t.TempDir()))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/providers/known", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Providers []struct {
+			Name      string `json:"name"`
+			BaseURL   string `json:"base_url"`
+			Auth      string `json:"auth"`
+			APIFormat string `json:"api_format"`
+		} `json:"providers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]string{}
+	for _, p := range resp.Providers {
+		byName[p.Name] = p.BaseURL + " " + p.Auth + " " + p.APIFormat
+	}
+	want := map[string]string{
+		"anthropic":  "https://api.anthropic.com/v1 x-api-key anthropic",
+		"ollama":     "http://ollama:11434/v1 none openai",
+		"openai":     "https://api.openai.com/v1 bearer openai",
+		"openrouter": "https://openrouter.ai/api/v1 bearer openai",
+	}
+	if !reflect.DeepEqual(byName, want) {
+		t.Errorf("unexpected known providers:\n got %v\nwant %v", byName, want)
+	}
+}
+
 func TestMaskKey(t *testing.T) {
 	if got := maskKey(""); got != "" {
 		t.Fatalf("expected empty mask, got %q", got)
@@ -145,6 +483,25 @@ func TestUICostsPageRenders(t *testing.T) {
 	}
 }
 
+func TestUICostsPageQuotesCostPerTokenUnit(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+
+	h := NewHandler(reg, WithAccumulator(acc), WithTokenUnit(cost.PerThousand))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/costs", nil))
+
+	body := w.Body.String()
+	if !strings.Contains(body, "$ / 1K tok") {
+		t.Error("expected per-1K column heading in response")
+	}
+	// 0.0105 USD over 1500 tokens is 0.007 USD per 1K.
+	if !strings.Contains(body, "$0.0070") {
+		t.Error("expected cost per 1K tokens 0.0070 in response")
+	}
+}
+
 func TestUICostsPageRendersEmpty(t *testing.T) {
 	reg := provider.NewRegistry(t.TempDir())
 	h := NewHandler(reg) // no accumulator
@@ -208,6 +565,191 @@ func TestUICostsAPIReturnsJSON(t *testing.T) {
 	}
 }
 
+func TestUICostsAPIReportsBodyBytes(t *testing.T) {
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "openai", "gpt-4o", 10, 5, 0.01)
+	acc.RecordBytes("tiverton", "openai", "gpt-4o", 150, 900)
+
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithAccumulator(acc))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/costs/api", nil))
+
+	var result struct {
+		Agents map[string]struct {
+			Models []struct {
+				RequestBytes  int64 `json:"request_bytes"`
+				ResponseBytes int64 `json:"response_bytes"`
+			} `json:"models"`
+		} `json:"agents"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	models := result.Agents["tiverton"].Models
+	if len(models) != 1 || models[0].RequestBytes != 150 || models[0].ResponseBytes != 900 {
+		t.Errorf("expected byte counts on the model entry, got %+v", models)
+	}
+}
+
+func TestUIPricingAPI(t *testing.T) {
+	pricing := cost.DefaultPricing()
+	pricing.SetRate("anthropic", "claude-sonnet-4", cost.Rate{InputPerMTok: 2.5, OutputPerMTok: 12})
+	pricing.SetRate("vllm", "llama-3-70b", cost.Rate{InputPerMTok: 0.1, OutputPerMTok: 0.2})
+	pricing.SetMonthlyCap("anthropic", "claude-opus-4", 500)
+	pricing.MinChargeUSD = 0.001
+
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithPricing(pricing))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/pricing/api", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var result struct {
+		MinChargeUSD float64 `json:"min_charge_usd"`
+		Providers    map[string]struct {
+			Free   bool `json:"free"`
+			Models map[string]struct {
+				InputPerMTok  float64 `json:"input_per_mtok"`
+				OutputPerMTok float64 `json:"output_per_mtok"`
+			} `json:"models"`
+			MonthlyCaps map[string]float64 `json:"monthly_caps_usd"`
+		} `json:"providers"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if got := result.Providers["openai"].Models["gpt-4o"]; got.InputPerMTok != 2.50 || got.OutputPerMTok != 10.0 {
+		t.Errorf("expected the default gpt-4o rate, got %+v", got)
+	}
+	if got := result.Providers["anthropic"].Models["claude-sonnet-4"]; got.InputPerMTok != 2.5 || got.OutputPerMTok != 12 {
+		t.Errorf("expected the overridden claude-sonnet-4 rate, got %+v", got)
+	}
+	if _, ok := result.Providers["vllm"].Models["llama-3-70b"]; !ok {
+		t.Error("expected a provider-configured model")
+	}
+	if !result.Providers["ollama"].Free {
+		t.Error("expected ollama marked free")
+	}
+	if result.Providers["anthropic"].MonthlyCaps["claude-opus-4"] != 500 || result.MinChargeUSD != 0.001 {
+		t.Errorf("expected caps and billing settings, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	NewHandler(provider.NewRegistry(t.TempDir())).ServeHTTP(w, httptest.NewRequest("GET", "/pricing/api", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a pricing table, got %d", w.Code)
+	}
+}
+
+func TestUICostsAPIPrometheusFormat(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	h := NewHandler(reg, WithAccumulator(acc))
+
+	for name, req := range map[string]*http.Request{
+		"query":  httptest.NewRequest("GET", "/costs/api?format=prometheus", nil),
+		"accept": httptest.NewRequest("GET", "/costs/api", nil),
+	} {
+		if name == "accept" {
+			req.Header.Set("Accept", "text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s: expected 200, got %d: %s", name, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Errorf("%s: expected text/plain content type, got %q", name, ct)
+		}
+		body := w.Body.String()
+		for _, line := range []string{
+			"# TYPE cllama_cost_usd_total counter",
+			`cllama_requests_total{agent_id="tiverton",provider="anthropic",model="claude-sonnet-4"} 1`,
+			`cllama_input_tokens_total{agent_id="tiverton",provider="anthropic",model="claude-sonnet-4"} 1000`,
+			`cllama_output_tokens_total{agent_id="tiverton",provider="anthropic",model="claude-sonnet-4"} 500`,
+			`cllama_cost_usd_total{agent_id="tiverton",provider="anthropic",model="claude-sonnet-4"} 0.0105`,
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("%s: missing %q in:\n%s", name, line, body)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/costs/api?format=prometheus&group_by=session", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for prometheus with group_by, got %d", w.Code)
+	}
+}
+
+func TestWantsPrometheus(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                  false,
+		"application/json, text/plain, */*": false,
+		"text/html,application/xhtml+xml,*/*;q=0.8":                   false,
+		"text/plain;version=0.0.4;q=0.5,*/*;q=0.1":                    true,
+		"application/openmetrics-text;version=1.0.0,text/plain;q=0.5": true,
+		"text/plain":                            true,
+		"application/json;q=0.5, text/plain":    true,
+		"text/plain;q=0.5, application/*;q=0.9": false,
+	} {
+		req := httptest.NewRequest("GET", "/costs/api", nil)
+		req.Header.Set("Accept", accept)
+		if got := wantsPrometheus(req); got != want {
+			t.Errorf("Accept %q: expected %v, got %v", accept, want, got)
+		}
+	}
+}
+
+func TestUICostsAPIConditionalGet(t *testing.T) {
+	reg := provider.NewRegistry(t.TempDir())
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	h := NewHandler(reg, WithAccumulator(acc))
+
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/costs/api", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != 200 || etag == "" || first.Header().Get("Last-Modified") == "" {
+		t.Fatalf("expected 200 with ETag and Last-Modified, got %d %v", first.Code, first.Header())
+	}
+
+	if w := get("If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected empty 304 for unchanged state, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := get("If-Modified-Since", first.Header().Get("Last-Modified")); w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for If-Modified-Since, got %d", w.Code)
+	}
+
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 10, 5, 0.0001)
+	w := get("If-None-Match", etag)
+	if w.Code != 200 {
+		t.Fatalf("expected 200 after a new record, got %d", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("expected ETag to change after a new record")
+	}
+
+	promReq := httptest.NewRequest("GET", "/costs/api?format=prometheus", nil)
+	promReq.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	prom := httptest.NewRecorder()
+	h.ServeHTTP(prom, promReq)
+	if prom.Code != 200 {
+		t.Errorf("expected the JSON ETag not to match the prometheus format, got %d", prom.Code)
+	}
+}
+
 func TestUICostsAPIEmptyAccumulator(t *testing.T) {
 	reg := provider.NewRegistry(t.TempDir())
 	h := NewHandler(reg) // no accumulator
@@ -231,3 +773,478 @@ func TestUICostsAPIEmptyAccumulator(t *testing.T) {
 		t.Errorf("expected empty agents map, got %d entries", len(result.Agents))
 	}
 }
+
+func TestUIProviderChangesAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	reg := provider.NewRegistry(t.TempDir())
+	h := NewHandler(reg, WithLogger(logging.New(&buf, logging.FormatJSON)))
+
+	post := func(form url.Values) {
+		req := httptest.NewRequest(http.MethodPost, "/providers", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected 303, got %d body=%s", w.Code, w.Body.String())
+		}
+	}
+	post(url.Values{"name": {"openai"}, "base_url": {"https://api.openai.com/v1"}, "api_key": {"sk-example-1234"}})
+	post(url.Values{"name": {"openai"}, "action": {"delete"}})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %s", len(lines), buf.String())
+	}
+	for i, want := range []string{"upsert", "delete"} {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("invalid JSON: %v", err)
+		}
+		if entry["type"] != "provider_change" {
+			t.Errorf("line %d: expected type=provider_change, got %v", i, entry["type"])
+		}
+		if entry["action"] != want {
+			t.Errorf("line %d: expected action=%s, got %v", i, want, entry["action"])
+		}
+		if entry["provider"] != "openai" {
+			t.Errorf("line %d: expected provider=openai, got %v", i, entry["provider"])
+		}
+		if entry["masked_key"] != "sk-e...1234" {
+			t.Errorf("line %d: expected masked key, got %v", i, entry["masked_key"])
+		}
+	}
+	if strings.Contains(buf.String(), "sk-example-1234") {
+		t.Fatal("raw API key leaked into audit log")
+	}
+}
+
+func TestUICostsAPIGroupBySession(t *testing.T) {
+	acc := cost.NewAccumulator()
+	acc.RecordSession("tiverton", "conv-a", "anthropic", "claude-sonnet-4", 1000, 500, 0.01)
+	acc.RecordSession("tiverton", "conv-b", "anthropic", "claude-sonnet-4", 2000, 1000, 0.02)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithAccumulator(acc))
+
+	req := httptest.NewRequest("GET", "/costs/api?group_by=session", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var result costsAPIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	sessions := result.Agents["tiverton"].Sessions
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v", sessions)
+	}
+	if sessions["conv-a"].TotalCostUSD != 0.01 || sessions["conv-b"].TotalCostUSD != 0.02 {
+		t.Errorf("unexpected session totals: %+v", sessions)
+	}
+	if result.Agents["tiverton"].TotalRequests != 2 {
+		t.Errorf("expected agent total to include both sessions, got %d", result.Agents["tiverton"].TotalRequests)
+	}
+
+	req = httptest.NewRequest("GET", "/costs/api", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "sessions") {
+		t.Error("expected no session breakdown without group_by")
+	}
+
+	req = httptest.NewRequest("GET", "/costs/api?group_by=weather", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for unsupported group_by, got %d", w.Code)
+	}
+}
+
+func TestUICostsAPIGroupByTag(t *testing.T) {
+	acc := cost.NewAccumulator()
+	acc.RecordTagged("tiverton", "", map[string]string{"feature": "search"}, "openai", "gpt-4o", 1000, 500, 0.01)
+	acc.RecordTagged("westin", "", map[string]string{"feature": "search"}, "openai", "gpt-4o", 1000, 500, 0.01)
+	acc.RecordTagged("westin", "", map[string]string{"feature": "triage"}, "openai", "gpt-4o", 1000, 500, 0.04)
+	acc.Record("westin", "openai", "gpt-4o", 1000, 500, 0.5)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithAccumulator(acc))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/costs/api?group_by=tag:feature", nil))
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result costsAPIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if result.Tag != "feature" || len(result.Tags) != 2 {
+		t.Fatalf("expected two feature groups, got %q %+v", result.Tag, result.Tags)
+	}
+	if g := result.Tags["search"]; g.TotalRequests != 2 || g.TotalCostUSD != 0.02 || len(g.Models) != 1 {
+		t.Errorf("unexpected search group: %+v", g)
+	}
+	if g := result.Tags["triage"]; g.TotalRequests != 1 || g.TotalCostUSD != 0.04 {
+		t.Errorf("unexpected triage group: %+v", g)
+	}
+	if result.Agents["westin"].TotalRequests != 3 {
+		t.Errorf("expected agent totals unchanged by grouping, got %+v", result.Agents["westin"])
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/costs/api?group_by=tag:", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a tag group without a key, got %d", w.Code)
+	}
+}
+
+func TestUIPodPageReportsAgentLoadErrors(t *testing.T) {
+	root := t.TempDir()
+	for agent, meta := range map[string]string{
+		"tiverton": `{"pod":"ops","type":"openclaw"}`,
+		"west":     `{"pod":`,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, agent), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, agent, "metadata.json"), []byte(meta), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(root))
+
+	req := httptest.NewRequest(http.MethodGet, "/pod", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "1 agents, 1 failed to load") {
+		t.Error("expected load error summary on pod page")
+	}
+	if !strings.Contains(body, "bad JSON in west/metadata.json") {
+		t.Error("expected per-agent load error detail on pod page")
+	}
+}
+
+func TestUIPodReloadPicksUpNewAgents(t *testing.T) {
+	root := t.TempDir()
+	addAgent := func(agent string) {
+		if err := os.MkdirAll(filepath.Join(root, agent), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, agent, "metadata.json"), []byte(`{"pod":"ops"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func(h http.Handler) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/pod/reload", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Members int `json:"members"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Members
+	}
+
+	addAgent("tiverton")
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(root))
+	if n := reload(h); n != 1 {
+		t.Fatalf("expected 1 member, got %d", n)
+	}
+
+	addAgent("westin")
+	if n := reload(h); n != 2 {
+		t.Fatalf("expected 2 members after reload, got %d", n)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pod", nil))
+	if !strings.Contains(w.Body.String(), "westin") {
+		t.Error("expected the new agent on the pod page")
+	}
+}
+
+func TestUIPodPageShowsTokenTotalsPerMember(t *testing.T) {
+	root := t.TempDir()
+	for _, agent := range []string{"tiverton", "westin"} {
+		if err := os.MkdirAll(filepath.Join(root, agent), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, agent, "metadata.json"), []byte(`{"pod":"ops"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "openai", "gpt-4o", 1200, 300, 0.01)
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 34, 5, 0.01)
+	acc.Record("westin", "openai", "gpt-4o", 777, 88, 0.01)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(root), WithAccumulator(acc))
+
+	data := h.(*Handler).buildPodPageData()
+	got := map[string][2]int{}
+	for _, m := range data.Members {
+		got[m.AgentID] = [2]int{m.TotalTokensIn, m.TotalTokensOut}
+	}
+	if got["tiverton"] != [2]int{1234, 305} || got["westin"] != [2]int{777, 88} {
+		t.Errorf("unexpected per-member token totals: %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pod", nil))
+	body := w.Body.String()
+	for _, want := range []string{">1234<", ">305<", ">777<", ">88<", "Tokens In", "Tokens Out"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q on pod page", want)
+		}
+	}
+}
+
+func TestUIPodViewsNeverLeakAgentTokens(t *testing.T) {
+	root := t.TempDir()
+	for file, meta := range map[string]string{
+		"tiverton/metadata.json": `{"pod":"ops","type":"openclaw","token":"tiverton:s3cret-tiv"}`,
+		"westin/metadata.yaml":   "pod: ops\ntoken: \"westin:s3cret-wes\n",
+		"allen/metadata.json":    `{"pod":"ops","service":"debug token=allen:s3cret-all"}`,
+	} {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(meta), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(root), WithAccumulator(cost.NewAccumulator()))
+
+	for _, path := range []string{"/pod", "/agents/api"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, w.Code)
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "s3cret") {
+			t.Errorf("%s leaked an agent token: %s", path, body)
+		}
+		if !strings.Contains(body, "westin") {
+			t.Errorf("%s: expected westin load error reported, got %s", path, body)
+		}
+	}
+}
+
+func TestMaskToken(t *testing.T) {
+	for in, want := range map[string]string{
+		"":                   "",
+		"tiverton:s3cret":    "tiverton:****",
+		"s3cret":             "****",
+		":s3cret":            "****",
+		" westin:abc:def   ": "westin:****",
+	} {
+		if got := maskToken(in); got != want {
+			t.Errorf("maskToken(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := redactTokens(`line 2: token: "westin:abc`); got != `line 2: token: "westin:****` {
+		t.Errorf("unexpected redaction: %q", got)
+	}
+}
+
+func TestUICostsAPISince(t *testing.T) {
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithAccumulator(acc))
+
+	get := func(since string) (int, costsAPIResponse) {
+		req := httptest.NewRequest("GET", "/costs/api?since="+url.QueryEscape(since), nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var result costsAPIResponse
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+		}
+		return w.Code, result
+	}
+
+	// Spend in the still-open minute is left for the poll that passes the
+	// returned until back as since; cost tests cover closed windows.
+	code, result := get(time.Now().Add(-time.Hour).Format(time.RFC3339))
+	until, err := time.Parse(time.RFC3339, result.Until)
+	if code != 200 || err != nil || until.After(time.Now()) || time.Since(until) > 2*time.Minute {
+		t.Errorf("expected until at the open minute's start, got code=%d until=%q", code, result.Until)
+	}
+	if len(result.Agents) != 0 {
+		t.Errorf("expected the open minute's spend held back, got %+v", result)
+	}
+
+	code, result = get(time.Now().Add(time.Hour).Format(time.RFC3339))
+	if code != 200 || len(result.Agents) != 0 || result.TotalCostUSD != 0 {
+		t.Errorf("expected entries before since excluded, got code=%d %+v", code, result)
+	}
+
+	if code, _ := get("yesterday"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for malformed since, got %d", code)
+	}
+	if code, _ := get(time.Now().Add(-48 * time.Hour).Format(time.RFC3339)); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for since beyond retention, got %d", code)
+	}
+}
+
+func TestUICostsShowLastSeen(t *testing.T) {
+	acc := cost.NewAccumulator()
+	before := time.Now().UTC().Add(-time.Second)
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithAccumulator(acc))
+
+	req := httptest.NewRequest("GET", "/costs/api", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var result costsAPIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	agent := result.Agents["tiverton"]
+	seen, err := time.Parse(time.RFC3339, agent.LastSeen)
+	if err != nil {
+		t.Fatalf("expected RFC 3339 last_seen, got %q", agent.LastSeen)
+	}
+	if seen.Before(before.Truncate(time.Second)) {
+		t.Errorf("last_seen %s predates the request", seen)
+	}
+	if agent.Models[0].LastSeen != agent.LastSeen || agent.Models[0].FirstSeen == "" {
+		t.Errorf("expected model timestamps populated, got %+v", agent.Models[0])
+	}
+
+	req = httptest.NewRequest("GET", "/costs", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "Last Seen") || !strings.Contains(w.Body.String(), seen.Format("Jan 2 15:04")) {
+		t.Error("expected last seen column on costs page")
+	}
+}
+
+func TestUICostsProviderTotals(t *testing.T) {
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	acc.Record("westin", "anthropic", "claude-haiku-3.5", 200, 100, 0.0006)
+	acc.Record("westin", "openai", "gpt-4o", 100, 50, 0.0008)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithAccumulator(acc))
+
+	req := httptest.NewRequest("GET", "/costs/api", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	var result costsAPIResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	anth := result.Providers["anthropic"]
+	if anth.TotalRequests != 2 || anth.InputTokens != 1200 || anth.OutputTokens != 600 {
+		t.Errorf("unexpected anthropic totals: %+v", anth)
+	}
+	if diff := anth.TotalCostUSD - 0.0111; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("expected anthropic cost 0.0111, got %f", anth.TotalCostUSD)
+	}
+	var sum float64
+	for _, p := range result.Providers {
+		sum += p.TotalCostUSD
+	}
+	if diff := sum - result.TotalCostUSD; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("provider totals %f do not sum to total %f", sum, result.TotalCostUSD)
+	}
+
+	rows := providerTotals(acc.All())
+	if len(rows) != 2 || rows[0].Provider != "anthropic" {
+		t.Fatalf("expected providers ordered by spend, got %+v", rows)
+	}
+
+	req = httptest.NewRequest("GET", "/costs", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), "By Provider") {
+		t.Error("expected provider summary on costs page")
+	}
+}
+
+func TestUIAgentsAPI(t *testing.T) {
+	root := t.TempDir()
+	for agent, meta := range map[string]string{
+		"tiverton": `{"pod":"ops","type":"openclaw","service":"tiverton-svc"}`,
+		"westin":   `{"pod":"ops","type":"nanoclaw"}`,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, agent), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, agent, "metadata.json"), []byte(meta), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	acc := cost.NewAccumulator()
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	acc.Record("tiverton", "anthropic", "claude-sonnet-4", 1000, 500, 0.0105)
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(root), WithAccumulator(acc))
+
+	req := httptest.NewRequest(http.MethodGet, "/agents/api", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("expected JSON content type, got %q", ct)
+	}
+	var result struct {
+		Pod    string `json:"pod"`
+		Agents []struct {
+			AgentID       string   `json:"agent_id"`
+			Service       string   `json:"service"`
+			Type          string   `json:"type"`
+			TotalRequests int      `json:"total_requests"`
+			TotalCostUSD  float64  `json:"total_cost_usd"`
+			Models        []string `json:"models"`
+		} `json:"agents"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if result.Pod != "ops" || len(result.Agents) != 2 {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+	tiv, west := result.Agents[0], result.Agents[1]
+	if tiv.AgentID != "tiverton" || tiv.Service != "tiverton-svc" || tiv.Type != "openclaw" {
+		t.Errorf("unexpected agent config: %+v", tiv)
+	}
+	if tiv.TotalRequests != 2 || tiv.TotalCostUSD < 0.0209 || len(tiv.Models) != 1 || tiv.Models[0] != "anthropic/claude-sonnet-4" {
+		t.Errorf("expected live cost merged, got %+v", tiv)
+	}
+	if west.TotalRequests != 0 || west.Models == nil {
+		t.Errorf("expected idle agent with empty models list, got %+v", west)
+	}
+}
+
+func TestUIAgentsAPIRequiresAdminToken(t *testing.T) {
+	h := NewHandler(provider.NewRegistry(t.TempDir()), WithContextRoot(t.TempDir()), WithAccumulator(cost.NewAccumulator()),
+		WithAdminToken("admin-secret"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/agents/api", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin token, got %d", w.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/agents/api", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the admin token, got %d: %s", w.Code, w.Body.String())
+	}
+}